@@ -13,12 +13,15 @@ type AgentConfiguration struct {
 	GitMirrorsPath        string
 	GitMirrorsLockTimeout int
 	GitMirrorsSkipUpdate  bool
+	GitMirrorsWorktrees   bool
 	PluginsPath           string
 	GitCheckoutFlags      string
 	GitCloneFlags         string
 	GitCloneMirrorFlags   string
 	GitCleanFlags         string
 	GitFetchFlags         string
+	GitPartialCloneFilter string
+	GitLFS                bool
 	GitSubmodules         bool
 	SSHKeyscan            bool
 	CommandEval           bool
@@ -30,6 +33,8 @@ type AgentConfiguration struct {
 
 	JobSigningKeyPath                       string
 	JobVerificationKeyPath                  string
+	JobVerificationHelper                   string
+	JobVerificationHelperAlgorithm          string
 	JobVerificationNoSignatureBehavior      string
 	JobVerificationInvalidSignatureBehavior string
 
@@ -1,8 +1,15 @@
 package integration
 
 import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
 	"fmt"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
@@ -242,3 +249,421 @@ func TestWhenTheJobHasASignature_ButTheJobRunnerCantVerify_ItRefusesTheJob(t *te
 		t.Errorf("job.SignalReason = %q, want %q", got, want)
 	}
 }
+
+func TestJobVerification_Ed25519(t *testing.T) {
+	t.Parallel()
+
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey(rand.Reader) error = %v", err)
+	}
+
+	signer, err := pipeline.NewSigner(pipeline.AlgorithmEd25519, priv)
+	if err != nil {
+		t.Fatalf("pipeline.NewSigner(ed25519, priv) error = %v", err)
+	}
+
+	step := pipeline.CommandStep{Command: "echo hello world"}
+	step.Signature, err = pipeline.Sign(&step, signer)
+	if err != nil {
+		t.Fatalf("pipeline.Sign(step, signer) error = %v", err)
+	}
+
+	job := &api.Job{
+		ID:                 defaultJobID,
+		ChunksMaxSizeBytes: 1024,
+		Step:               step,
+		Env:                map[string]string{"BUILDKITE_COMMAND": "echo hello world"},
+	}
+
+	// Only the public half is needed for verification.
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		t.Fatalf("x509.MarshalPKIXPublicKey(pub) error = %v", err)
+	}
+	keyPath := filepath.Join(t.TempDir(), "verification-key.pem")
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0o600); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", keyPath, err)
+	}
+
+	e := createTestAgentEndpoint()
+	server := e.server(job.ID)
+	defer server.Close()
+
+	mb := mockBootstrap(t)
+	mb.Expect().Once().AndExitWith(0)
+	defer mb.CheckAndClose(t)
+
+	runJob(t, job, server, agent.AgentConfiguration{
+		JobVerificationKeyPath:                  keyPath,
+		JobVerificationInvalidSignatureBehavior: agent.VerificationBehaviourBlock,
+		JobVerificationNoSignatureBehavior:      agent.VerificationBehaviourBlock,
+	}, mb)
+
+	finish := e.finishesFor(t, job.ID)[0]
+	if got, want := finish.ExitStatus, "0"; got != want {
+		t.Errorf("job.ExitStatus = %q, want %q", got, want)
+	}
+	if got, want := finish.SignalReason, ""; got != want {
+		t.Errorf("job.SignalReason = %q, want %q", got, want)
+	}
+}
+
+func TestJobVerification_KeySet(t *testing.T) {
+	t.Parallel()
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	cases := []struct {
+		name                 string
+		revoked              bool
+		expectedExitStatus   string
+		expectedSignalReason string
+		expectLogsContain    []string
+	}{
+		{
+			name:               "when the signing key is trusted, it runs the job and reports the key",
+			expectedExitStatus: "0",
+			expectLogsContain:  []string{`✅ Verified job with signature`, `using key "current"`},
+		},
+		{
+			name:                 "when the signing key is revoked, it refuses the job",
+			revoked:              true,
+			expectedExitStatus:   "-1",
+			expectedSignalReason: agent.SignalReasonSignatureRejected,
+			expectLogsContain:    []string{"⚠️ ERROR", `key "current" has been revoked`},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			pub, priv, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				t.Fatalf("ed25519.GenerateKey(rand.Reader) error = %v", err)
+			}
+			oldPub, _, err := ed25519.GenerateKey(rand.Reader)
+			if err != nil {
+				t.Fatalf("ed25519.GenerateKey(rand.Reader) error = %v", err)
+			}
+
+			signingKey := &pipeline.Key{ID: "current", Algorithm: pipeline.AlgorithmEd25519, Key: priv}
+			signer, err := signingKey.Signer()
+			if err != nil {
+				t.Fatalf("signingKey.Signer() error = %v", err)
+			}
+
+			step := pipeline.CommandStep{Command: "echo hello world"}
+			step.Signature, err = pipeline.Sign(&step, signer)
+			if err != nil {
+				t.Fatalf("pipeline.Sign(step, signer) error = %v", err)
+			}
+
+			job := &api.Job{
+				ID:                 defaultJobID,
+				ChunksMaxSizeBytes: 1024,
+				Step:               step,
+				Env:                map[string]string{"BUILDKITE_COMMAND": "echo hello world"},
+			}
+
+			jwks, err := json.Marshal(map[string]any{
+				"keys": []map[string]any{
+					{"kty": "OKP", "crv": "Ed25519", "kid": "previous", "x": b64(oldPub)},
+					{"kty": "OKP", "crv": "Ed25519", "kid": "current", "x": b64(pub), "revoked": tc.revoked},
+				},
+			})
+			if err != nil {
+				t.Fatalf("json.Marshal(jwks) error = %v", err)
+			}
+			keyPath := filepath.Join(t.TempDir(), "verification-keys.json")
+			if err := os.WriteFile(keyPath, jwks, 0o600); err != nil {
+				t.Fatalf("os.WriteFile(%q) error = %v", keyPath, err)
+			}
+
+			e := createTestAgentEndpoint()
+			server := e.server(job.ID)
+			defer server.Close()
+
+			mb := mockBootstrap(t)
+			if tc.expectedExitStatus == "0" {
+				mb.Expect().Once().AndExitWith(0)
+			} else {
+				mb.Expect().NotCalled()
+			}
+			defer mb.CheckAndClose(t)
+
+			runJob(t, job, server, agent.AgentConfiguration{
+				JobVerificationKeyPath:                  keyPath,
+				JobVerificationInvalidSignatureBehavior: agent.VerificationBehaviourBlock,
+				JobVerificationNoSignatureBehavior:      agent.VerificationBehaviourBlock,
+			}, mb)
+
+			finish := e.finishesFor(t, job.ID)[0]
+			if got, want := finish.ExitStatus, tc.expectedExitStatus; got != want {
+				t.Errorf("job.ExitStatus = %q, want %q", got, want)
+			}
+			if got, want := finish.SignalReason, tc.expectedSignalReason; got != want {
+				t.Errorf("job.SignalReason = %q, want %q", got, want)
+			}
+
+			logs := e.logsFor(t, job.ID)
+			for _, want := range tc.expectLogsContain {
+				if !strings.Contains(logs, want) {
+					t.Errorf("logs = %q, want to contain %q", logs, want)
+				}
+			}
+		})
+	}
+}
+
+func TestJobVerification_Matrix(t *testing.T) {
+	t.Parallel()
+
+	const pipelineYAML = `steps:
+  - command: "echo {{matrix.greeting}} {{matrix.name}}"
+    matrix:
+      setup:
+        greeting: [hello, goodbye]
+        name: [world, llamas]
+      adjustments:
+        - with: { greeting: goodbye, name: world }
+          skip: true
+`
+
+	p, err := pipeline.Parse(strings.NewReader(pipelineYAML))
+	if err != nil {
+		t.Fatalf("pipeline.Parse() error = %v", err)
+	}
+	signer, err := pipeline.NewSigner("hmac-sha256", signingKey)
+	if err != nil {
+		t.Fatalf("pipeline.NewSigner(hmac-sha256, signingKey) error = %v", err)
+	}
+	if err := p.Sign(signer); err != nil {
+		t.Fatalf("p.Sign(signer) error = %v", err)
+	}
+	step := *p.Steps[0].(*pipeline.CommandStep)
+
+	cases := []struct {
+		name                 string
+		permutation          pipeline.MatrixPermutation
+		command              string
+		expectedExitStatus   string
+		expectedSignalReason string
+		expectLogsContain    []string
+	}{
+		{
+			name:               "when the permutation is in the signed matrix, it runs the job",
+			permutation:        pipeline.MatrixPermutation{"greeting": "hello", "name": "llamas"},
+			command:            "echo hello llamas",
+			expectedExitStatus: "0",
+		},
+		{
+			name:                 "when the permutation is skipped by the signed matrix, it refuses the job",
+			permutation:          pipeline.MatrixPermutation{"greeting": "goodbye", "name": "world"},
+			command:              "echo goodbye world",
+			expectedExitStatus:   "-1",
+			expectedSignalReason: agent.SignalReasonSignatureRejected,
+			expectLogsContain:    []string{"⚠️ ERROR", "is skipped by an adjustment"},
+		},
+		{
+			name:                 "when the permutation is not in the signed matrix, it refuses the job",
+			permutation:          pipeline.MatrixPermutation{"greeting": "hello", "name": "crimes"},
+			command:              "echo hello crimes",
+			expectedExitStatus:   "-1",
+			expectedSignalReason: agent.SignalReasonSignatureRejected,
+			expectLogsContain:    []string{"⚠️ ERROR", `value "crimes" for dimension "name"`},
+		},
+		{
+			name:                 "when the command doesn't match the permutation, it refuses the job",
+			permutation:          pipeline.MatrixPermutation{"greeting": "hello", "name": "world"},
+			command:              "echo hello crimes",
+			expectedExitStatus:   "-1",
+			expectedSignalReason: agent.SignalReasonSignatureRejected,
+			expectLogsContain:    []string{"⚠️ ERROR", `the value of field "command" on the job ("echo hello crimes") does not match`},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			job := &api.Job{
+				ID:                 defaultJobID,
+				ChunksMaxSizeBytes: 1024,
+				Step:               step,
+				MatrixPermutation:  tc.permutation,
+				Env:                map[string]string{"BUILDKITE_COMMAND": tc.command},
+			}
+
+			keyPath := filepath.Join(t.TempDir(), "keyfile")
+			if err := os.WriteFile(keyPath, []byte(signingKey), 0o600); err != nil {
+				t.Fatalf("os.WriteFile(%q) error = %v", keyPath, err)
+			}
+
+			e := createTestAgentEndpoint()
+			server := e.server(job.ID)
+			defer server.Close()
+
+			mb := mockBootstrap(t)
+			if tc.expectedExitStatus == "0" {
+				mb.Expect().Once().AndExitWith(0)
+			} else {
+				mb.Expect().NotCalled()
+			}
+			defer mb.CheckAndClose(t)
+
+			runJob(t, job, server, agent.AgentConfiguration{
+				JobVerificationKeyPath:                  keyPath,
+				JobVerificationInvalidSignatureBehavior: agent.VerificationBehaviourBlock,
+				JobVerificationNoSignatureBehavior:      agent.VerificationBehaviourBlock,
+			}, mb)
+
+			finish := e.finishesFor(t, job.ID)[0]
+			if got, want := finish.ExitStatus, tc.expectedExitStatus; got != want {
+				t.Errorf("job.ExitStatus = %q, want %q", got, want)
+			}
+			if got, want := finish.SignalReason, tc.expectedSignalReason; got != want {
+				t.Errorf("job.SignalReason = %q, want %q", got, want)
+			}
+
+			logs := e.logsFor(t, job.ID)
+			for _, want := range tc.expectLogsContain {
+				if !strings.Contains(logs, want) {
+					t.Errorf("logs = %q, want to contain %q", logs, want)
+				}
+			}
+		})
+	}
+}
+
+func TestJobVerification_PluginsAndEnv(t *testing.T) {
+	t.Parallel()
+
+	const pipelineYAML = `steps:
+  - command: echo hello world
+    env:
+      GREETING: hello
+    plugins:
+      - docker#v5.8.0:
+          image: golang:1.21
+          environment: [GREETING]
+`
+
+	p, err := pipeline.Parse(strings.NewReader(pipelineYAML))
+	if err != nil {
+		t.Fatalf("pipeline.Parse() error = %v", err)
+	}
+	signer, err := pipeline.NewSigner("hmac-sha256", signingKey)
+	if err != nil {
+		t.Fatalf("pipeline.NewSigner(hmac-sha256, signingKey) error = %v", err)
+	}
+	if err := p.Sign(signer); err != nil {
+		t.Fatalf("p.Sign(signer) error = %v", err)
+	}
+	step := *p.Steps[0].(*pipeline.CommandStep)
+
+	// The backend expands the plugin shorthand, and doesn't preserve the order
+	// of config keys.
+	const signedPlugins = `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v5.8.0":{"environment":["GREETING"],"image":"golang:1.21"}}]`
+
+	cases := []struct {
+		name                 string
+		step                 pipeline.CommandStep
+		env                  map[string]string
+		expectedExitStatus   string
+		expectedSignalReason string
+		expectLogsContain    []string
+	}{
+		{
+			name:               "when the job's plugins and env match the signed step, it runs the job",
+			step:               step,
+			env:                map[string]string{"BUILDKITE_PLUGINS": signedPlugins, "GREETING": "hello"},
+			expectedExitStatus: "0",
+		},
+		{
+			name: "when the job's plugin config doesn't match the signed step, it refuses the job",
+			step: step,
+			env: map[string]string{
+				"BUILDKITE_PLUGINS": `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v5.8.0":{"environment":["GREETING"],"image":"crimes:latest"}}]`,
+				"GREETING":          "hello",
+			},
+			expectedExitStatus:   "-1",
+			expectedSignalReason: agent.SignalReasonSignatureRejected,
+			expectLogsContain:    []string{"⚠️ ERROR", `the value of field "plugins" on the job`},
+		},
+		{
+			name:                 "when the job's env doesn't match the signed step, it refuses the job",
+			step:                 step,
+			env:                  map[string]string{"BUILDKITE_PLUGINS": signedPlugins, "GREETING": "crimes"},
+			expectedExitStatus:   "-1",
+			expectedSignalReason: agent.SignalReasonSignatureRejected,
+			expectLogsContain:    []string{"⚠️ ERROR", `the value of field "env::GREETING" on the job ("crimes")`},
+		},
+		{
+			name:                 "when the signature doesn't cover plugins, but the job has plugins, it refuses the job",
+			step:                 jobWithValidSignature.Step,
+			env:                  map[string]string{"BUILDKITE_PLUGINS": signedPlugins},
+			expectedExitStatus:   "-1",
+			expectedSignalReason: agent.SignalReasonSignatureRejected,
+			expectLogsContain:    []string{"⚠️ ERROR", "but the signature does not cover plugins"},
+		},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			env := map[string]string{"BUILDKITE_COMMAND": "echo hello world"}
+			for k, v := range tc.env {
+				env[k] = v
+			}
+			job := &api.Job{
+				ID:                 defaultJobID,
+				ChunksMaxSizeBytes: 1024,
+				Step:               tc.step,
+				Env:                env,
+			}
+
+			keyPath := filepath.Join(t.TempDir(), "keyfile")
+			if err := os.WriteFile(keyPath, []byte(signingKey), 0o600); err != nil {
+				t.Fatalf("os.WriteFile(%q) error = %v", keyPath, err)
+			}
+
+			e := createTestAgentEndpoint()
+			server := e.server(job.ID)
+			defer server.Close()
+
+			mb := mockBootstrap(t)
+			if tc.expectedExitStatus == "0" {
+				mb.Expect().Once().AndExitWith(0)
+			} else {
+				mb.Expect().NotCalled()
+			}
+			defer mb.CheckAndClose(t)
+
+			runJob(t, job, server, agent.AgentConfiguration{
+				JobVerificationKeyPath:                  keyPath,
+				JobVerificationInvalidSignatureBehavior: agent.VerificationBehaviourBlock,
+				JobVerificationNoSignatureBehavior:      agent.VerificationBehaviourBlock,
+			}, mb)
+
+			finish := e.finishesFor(t, job.ID)[0]
+			if got, want := finish.ExitStatus, tc.expectedExitStatus; got != want {
+				t.Errorf("job.ExitStatus = %q, want %q", got, want)
+			}
+			if got, want := finish.SignalReason, tc.expectedSignalReason; got != want {
+				t.Errorf("job.SignalReason = %q, want %q", got, want)
+			}
+
+			logs := e.logsFor(t, job.ID)
+			for _, want := range tc.expectLogsContain {
+				if !strings.Contains(logs, want) {
+					t.Errorf("logs = %q, want to contain %q", logs, want)
+				}
+			}
+		})
+	}
+}
@@ -58,6 +58,7 @@ var ProtectedEnv = map[string]struct{}{
 	"BUILDKITE_BUILD_PATH":               {},
 	"BUILDKITE_GIT_MIRRORS_PATH":         {},
 	"BUILDKITE_GIT_MIRRORS_SKIP_UPDATE":  {},
+	"BUILDKITE_GIT_MIRRORS_WORKTREES":    {},
 	"BUILDKITE_HOOKS_PATH":               {},
 	"BUILDKITE_PLUGINS_PATH":             {},
 	"BUILDKITE_SSH_KEYSCAN":              {},
@@ -70,6 +71,8 @@ var ProtectedEnv = map[string]struct{}{
 	"BUILDKITE_GIT_CLONE_MIRROR_FLAGS":   {},
 	"BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT": {},
 	"BUILDKITE_GIT_CLEAN_FLAGS":          {},
+	"BUILDKITE_GIT_PARTIAL_CLONE_FILTER": {},
+	"BUILDKITE_GIT_LFS":                  {},
 	"BUILDKITE_SHELL":                    {},
 }
 
@@ -377,7 +380,7 @@ func NewJobRunner(l logger.Logger, apiClient APIClient, conf JobRunnerConfig) (j
 }
 
 func (r *JobRunner) normalizeVerificationBehavior(behavior string) (string, error) {
-	if r.conf.AgentConfiguration.JobVerificationKeyPath == "" {
+	if !r.verificationEnabled() {
 		// We won't be verifying jobs, so it doesn't matter
 		return "if you're seeing this string, there's a problem with the job verification code in the agent. contact support@buildkite.com", nil
 	}
@@ -463,6 +466,7 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	env["BUILDKITE_SOCKETS_PATH"] = r.conf.AgentConfiguration.SocketsPath
 	env["BUILDKITE_GIT_MIRRORS_PATH"] = r.conf.AgentConfiguration.GitMirrorsPath
 	env["BUILDKITE_GIT_MIRRORS_SKIP_UPDATE"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.GitMirrorsSkipUpdate)
+	env["BUILDKITE_GIT_MIRRORS_WORKTREES"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.GitMirrorsWorktrees)
 	env["BUILDKITE_HOOKS_PATH"] = r.conf.AgentConfiguration.HooksPath
 	env["BUILDKITE_PLUGINS_PATH"] = r.conf.AgentConfiguration.PluginsPath
 	env["BUILDKITE_SSH_KEYSCAN"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.SSHKeyscan)
@@ -475,6 +479,8 @@ func (r *JobRunner) createEnvironment() ([]string, error) {
 	env["BUILDKITE_GIT_FETCH_FLAGS"] = r.conf.AgentConfiguration.GitFetchFlags
 	env["BUILDKITE_GIT_CLONE_MIRROR_FLAGS"] = r.conf.AgentConfiguration.GitCloneMirrorFlags
 	env["BUILDKITE_GIT_CLEAN_FLAGS"] = r.conf.AgentConfiguration.GitCleanFlags
+	env["BUILDKITE_GIT_PARTIAL_CLONE_FILTER"] = r.conf.AgentConfiguration.GitPartialCloneFilter
+	env["BUILDKITE_GIT_LFS"] = fmt.Sprintf("%t", r.conf.AgentConfiguration.GitLFS)
 	env["BUILDKITE_GIT_MIRRORS_LOCK_TIMEOUT"] = fmt.Sprintf("%d", r.conf.AgentConfiguration.GitMirrorsLockTimeout)
 	env["BUILDKITE_SHELL"] = r.conf.AgentConfiguration.Shell
 	env["BUILDKITE_AGENT_EXPERIMENT"] = strings.Join(experiments.Enabled(), ",")
@@ -10,7 +10,6 @@ import (
 	"time"
 
 	"github.com/buildkite/agent/v3/hook"
-	"github.com/buildkite/agent/v3/internal/pipeline"
 	"github.com/buildkite/agent/v3/kubernetes"
 	"github.com/buildkite/agent/v3/metrics"
 	"github.com/buildkite/agent/v3/process"
@@ -35,17 +34,9 @@ func (r *JobRunner) Run(ctx context.Context) error {
 
 	r.startedAt = time.Now()
 
-	var verifier pipeline.Verifier
-	if r.conf.AgentConfiguration.JobVerificationKeyPath != "" {
-		verificationKey, err := os.ReadFile(r.conf.AgentConfiguration.JobVerificationKeyPath)
-		if err != nil {
-			return fmt.Errorf("failed to read job verification key: %w", err)
-		}
-
-		verifier, err = pipeline.NewVerifier("hmac-sha256", verificationKey)
-		if err != nil {
-			return fmt.Errorf("failed to create job verifier: %w", err)
-		}
+	verificationKeys, err := r.verificationKeys()
+	if err != nil {
+		return err
 	}
 
 	// Start the build in the Buildkite Agent API. This is the first thing
@@ -89,7 +80,7 @@ func (r *JobRunner) Run(ctx context.Context) error {
 
 	job := r.conf.Job
 
-	if verifier == nil && job.Step.Signature != nil {
+	if verificationKeys == nil && job.Step.Signature != nil {
 		r.verificationFailureLogs(
 			fmt.Errorf("job %q was signed with signature %q, but no verification key was provided, so the job can't be verified", job.ID, job.Step.Signature.Value),
 			VerificationBehaviourBlock,
@@ -99,9 +90,10 @@ func (r *JobRunner) Run(ctx context.Context) error {
 		return nil
 	}
 
-	if verifier != nil {
+	if verificationKeys != nil {
 		ise := &invalidSignatureError{}
-		switch err := r.verifyJob(verifier); {
+		key, err := r.verifyJob(verificationKeys)
+		switch {
 		case errors.Is(err, ErrNoSignature):
 			r.verificationFailureLogs(err, r.NoSignatureBehavior)
 			if r.NoSignatureBehavior == VerificationBehaviourBlock {
@@ -125,8 +117,12 @@ func (r *JobRunner) Run(ctx context.Context) error {
 			return nil
 
 		default: // no error, all good, keep going
-			r.logger.Info("Successfully verified job %s with signature %s", job.ID, job.Step.Signature.Value)
-			r.logStreamer.Process([]byte(fmt.Sprintf("✅ Verified job with signature %s\n", job.Step.Signature.Value)))
+			keyDesc := ""
+			if key.ID != "" {
+				keyDesc = fmt.Sprintf(" using key %q", key.ID)
+			}
+			r.logger.Info("Successfully verified job %s with signature %s%s", job.ID, job.Step.Signature.Value, keyDesc)
+			r.logStreamer.Process([]byte(fmt.Sprintf("✅ Verified job with signature %s%s\n", job.Step.Signature.Value, keyDesc)))
 		}
 	}
 
@@ -3,6 +3,7 @@ package agent
 import (
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/buildkite/agent/v3/internal/pipeline"
 )
@@ -40,44 +41,102 @@ func (r *JobRunner) verificationFailureLogs(err error, behavior string) {
 	}
 }
 
-func (r *JobRunner) verifyJob(verifier pipeline.Verifier) error {
-	step := r.conf.Job.Step
+// verificationEnabled reports whether the agent is configured to verify jobs.
+func (r *JobRunner) verificationEnabled() bool {
+	return r.conf.AgentConfiguration.JobVerificationKeyPath != "" || r.conf.AgentConfiguration.JobVerificationHelper != ""
+}
 
-	if step.Matrix != nil {
-		r.logger.Warn("Signing/Verification of matrix jobs is not currently supported")
-		r.logger.Warn("Watch this space 👀")
+// verificationKeys returns the keys trusted for verifying jobs: those read
+// from the verification key path, and the verification helper. It returns nil
+// if job verification isn't enabled.
+func (r *JobRunner) verificationKeys() (*pipeline.KeySet, error) {
+	if !r.verificationEnabled() {
+		return nil, nil
+	}
 
-		return nil
+	keys := &pipeline.KeySet{}
+	if path := r.conf.AgentConfiguration.JobVerificationKeyPath; path != "" {
+		ks, err := pipeline.ReadKeySet(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read job verification keys: %w", err)
+		}
+		keys = ks
 	}
+	if helper := r.conf.AgentConfiguration.JobVerificationHelper; helper != "" {
+		key, err := pipeline.NewSigningHelperKey(helper, r.conf.AgentConfiguration.JobVerificationHelperAlgorithm, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to use job verification helper: %w", err)
+		}
+		keys.Keys = append(keys.Keys, key)
+	}
+	return keys, nil
+}
+
+// verifyJob verifies the job's step signature using a trusted key from keys,
+// and returns the key that verified it.
+func (r *JobRunner) verifyJob(keys *pipeline.KeySet) (*pipeline.Key, error) {
+	step := r.conf.Job.Step
 
 	if step.Signature == nil {
-		return ErrNoSignature
+		return nil, ErrNoSignature
 	}
 
-	// Verify the signature
-	if err := step.Signature.Verify(&step, verifier); err != nil {
-		return newInvalidSignatureError(err)
+	// Verify the signature. The key set picks the key (and therefore the
+	// verifier) based on the key ID and algorithm the step was signed with.
+	key, err := keys.Verify(&step, step.Signature, time.Now())
+	if err != nil {
+		return nil, newInvalidSignatureError(err)
+	}
+
+	// The signature on a matrix step covers the whole matrix. Check that the permutation this job was given is one
+	// that the signed matrix allows, and substitute it into the step so the step can be compared with the job.
+	if err := step.InterpolateMatrixPermutation(r.conf.Job.MatrixPermutation); err != nil {
+		return nil, newInvalidSignatureError(err)
 	}
 
 	// Now that the signature of the job's step is verified, we need to check if the fields on the job match those on the
 	// step. If they don't, we need to fail the job - more or less the only reason that the job and the step would have
 	// different fields would be if someone had modified the job on the backend after it was signed (aka crimes)
-	signedFields := step.Signature.SignedFields
+	// The matrix itself isn't a field on the job (only the permutation is), and was checked above.
+	signedFields := make([]string, 0, len(step.Signature.SignedFields))
+	pluginsSigned := false
+	for _, field := range step.Signature.SignedFields {
+		switch field {
+		case "matrix":
+			continue
+		case "plugins":
+			pluginsSigned = true
+		}
+		signedFields = append(signedFields, field)
+	}
+
+	// Older signatures may not cover plugins. That's only OK if the job has no
+	// plugins, otherwise plugins could be added to the job without
+	// invalidating the signature.
+	if !pluginsSigned {
+		plugins, err := r.conf.Job.Plugins()
+		if err != nil {
+			return nil, newInvalidSignatureError(err)
+		}
+		if len(plugins) > 0 {
+			return nil, newInvalidSignatureError(fmt.Errorf("job %q has plugins, but the signature does not cover plugins", r.conf.Job.ID))
+		}
+	}
 	jobFields, err := r.conf.Job.ValuesForFields(signedFields)
 	if err != nil {
-		return fmt.Errorf("failed to get values for fields %v on job %s: %w", signedFields, r.conf.Job.ID, err)
+		return nil, fmt.Errorf("failed to get values for fields %v on job %s: %w", signedFields, r.conf.Job.ID, err)
 	}
 
-	stepFields, err := step.ValuesForFields(signedFields)
+	stepFields, err := step.ValuesForFields(step.Signature.SignedFields)
 	if err != nil {
-		return fmt.Errorf("failed to get values for fields %v on step: %w", signedFields, err)
+		return nil, fmt.Errorf("failed to get values for fields %v on step: %w", signedFields, err)
 	}
 
 	for _, field := range signedFields {
 		if jobFields[field] != stepFields[field] {
-			return newInvalidSignatureError(fmt.Errorf("job %q was signed with signature %q, but the value of field %q on the job (%q) does not match the value of the field on the step (%q)", r.conf.Job.ID, step.Signature.Value, field, jobFields[field], stepFields[field]))
+			return nil, newInvalidSignatureError(fmt.Errorf("job %q was signed with signature %q, but the value of field %q on the job (%q) does not match the value of the field on the step (%q)", r.conf.Job.ID, step.Signature.Value, field, jobFields[field], stepFields[field]))
 		}
 	}
 
-	return nil
+	return key, nil
 }
@@ -0,0 +1,99 @@
+package agent
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/internal/pipeline"
+	"github.com/google/go-cmp/cmp"
+)
+
+const matrixStepPipeline = `steps:
+  - command: echo {{matrix}}
+    env:
+      RUBY: "ruby:{{matrix}}"
+    plugins:
+      - docker#v5.8.0:
+          image: "ruby:{{matrix}}"
+          environment: ["VERSION={{matrix}}"]
+    matrix: ["3.1", "3.2"]
+`
+
+func parseCommandStep(t *testing.T, src string) *pipeline.CommandStep {
+	t.Helper()
+
+	p, err := pipeline.Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("pipeline.Parse(src) error = %v", err)
+	}
+	cs, ok := p.Steps[0].(*pipeline.CommandStep)
+	if !ok {
+		t.Fatalf("p.Steps[0] = %T, want *pipeline.CommandStep", p.Steps[0])
+	}
+	return cs
+}
+
+func TestVerifyJobLeavesStepUnchanged(t *testing.T) {
+	t.Parallel()
+
+	key, err := pipeline.ParseKey([]byte("alpacas-are-not-llamas"))
+	if err != nil {
+		t.Fatalf("pipeline.ParseKey(secret) error = %v", err)
+	}
+	signer, err := key.Signer()
+	if err != nil {
+		t.Fatalf("key.Signer() error = %v", err)
+	}
+
+	step := parseCommandStep(t, matrixStepPipeline)
+	step.Signature, err = pipeline.Sign(step, signer)
+	if err != nil {
+		t.Fatalf("pipeline.Sign(step, signer) error = %v", err)
+	}
+
+	// The job runs with the permutation substituted in.
+	perm := pipeline.MatrixPermutation{"": "3.2"}
+	interpolated := parseCommandStep(t, matrixStepPipeline)
+	if err := interpolated.InterpolateMatrixPermutation(perm); err != nil {
+		t.Fatalf("interpolated.InterpolateMatrixPermutation(%v) error = %v", perm, err)
+	}
+	plugins, err := json.Marshal(interpolated.Plugins)
+	if err != nil {
+		t.Fatalf("json.Marshal(interpolated.Plugins) error = %v", err)
+	}
+
+	job := &api.Job{
+		ID: "job",
+		Env: map[string]string{
+			"BUILDKITE_COMMAND": "echo 3.2",
+			"BUILDKITE_PLUGINS": string(plugins),
+			"RUBY":              "ruby:3.2",
+		},
+		Step:              *step,
+		MatrixPermutation: perm,
+	}
+	r := &JobRunner{conf: JobRunnerConfig{Job: job}}
+
+	if _, err := r.verifyJob(&pipeline.KeySet{Keys: []*pipeline.Key{key}}); err != nil {
+		t.Fatalf("r.verifyJob(keys) error = %v", err)
+	}
+
+	want := parseCommandStep(t, matrixStepPipeline)
+	want.Signature = step.Signature
+	if diff := cmp.Diff(marshalStep(t, &job.Step), marshalStep(t, want)); diff != "" {
+		t.Errorf("job step after verification diff (-got +want):\n%s", diff)
+	}
+}
+
+// marshalStep returns the step as JSON, for comparison.
+func marshalStep(t *testing.T, step *pipeline.CommandStep) string {
+	t.Helper()
+
+	b, err := json.Marshal(step)
+	if err != nil {
+		t.Fatalf("json.Marshal(step) error = %v", err)
+	}
+	return string(b)
+}
@@ -2,44 +2,77 @@ package api
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"strings"
 
 	"github.com/buildkite/agent/v3/internal/pipeline"
 )
 
 // Job represents a Buildkite Agent API Job
 type Job struct {
-	ID                 string               `json:"id,omitempty"`
-	Endpoint           string               `json:"endpoint"`
-	State              string               `json:"state,omitempty"`
-	Env                map[string]string    `json:"env,omitempty"`
-	Step               pipeline.CommandStep `json:"step,omitempty"`
-	ChunksMaxSizeBytes uint64               `json:"chunks_max_size_bytes,omitempty"`
-	LogMaxSizeBytes    uint64               `json:"log_max_size_bytes,omitempty"`
-	Token              string               `json:"token,omitempty"`
-	ExitStatus         string               `json:"exit_status,omitempty"`
-	Signal             string               `json:"signal,omitempty"`
-	SignalReason       string               `json:"signal_reason,omitempty"`
-	StartedAt          string               `json:"started_at,omitempty"`
-	FinishedAt         string               `json:"finished_at,omitempty"`
-	RunnableAt         string               `json:"runnable_at,omitempty"`
-	ChunksFailedCount  int                  `json:"chunks_failed_count,omitempty"`
+	ID                 string                     `json:"id,omitempty"`
+	Endpoint           string                     `json:"endpoint"`
+	State              string                     `json:"state,omitempty"`
+	Env                map[string]string          `json:"env,omitempty"`
+	Step               pipeline.CommandStep       `json:"step,omitempty"`
+	MatrixPermutation  pipeline.MatrixPermutation `json:"matrix_permutation,omitempty"`
+	ChunksMaxSizeBytes uint64                     `json:"chunks_max_size_bytes,omitempty"`
+	LogMaxSizeBytes    uint64                     `json:"log_max_size_bytes,omitempty"`
+	Token              string                     `json:"token,omitempty"`
+	ExitStatus         string                     `json:"exit_status,omitempty"`
+	Signal             string                     `json:"signal,omitempty"`
+	SignalReason       string                     `json:"signal_reason,omitempty"`
+	StartedAt          string                     `json:"started_at,omitempty"`
+	FinishedAt         string                     `json:"finished_at,omitempty"`
+	RunnableAt         string                     `json:"runnable_at,omitempty"`
+	ChunksFailedCount  int                        `json:"chunks_failed_count,omitempty"`
 }
 
+// ValuesForFields returns the values of the job that correspond to signed step
+// fields, taken from the env the job will run with: the command from
+// BUILDKITE_COMMAND, plugins from BUILDKITE_PLUGINS, and step env vars from
+// the vars of the same name.
 func (j *Job) ValuesForFields(fields []string) (map[string]string, error) {
 	o := make(map[string]string, len(fields))
 	for _, f := range fields {
 		switch f {
 		case "command":
 			o[f] = j.Env["BUILDKITE_COMMAND"]
+
+		case "plugins":
+			plugins, err := j.Plugins()
+			if err != nil {
+				return nil, err
+			}
+			p, err := plugins.CanonicalString()
+			if err != nil {
+				return nil, fmt.Errorf("canonicalising BUILDKITE_PLUGINS: %w", err)
+			}
+			o[f] = p
+
 		default:
-			return nil, fmt.Errorf("unknown or unsupported field on Job struct for signing/verification: %q", f)
+			if !strings.HasPrefix(f, pipeline.EnvNamespacePrefix) {
+				return nil, fmt.Errorf("unknown or unsupported field on Job struct for signing/verification: %q", f)
+			}
+			o[f] = j.Env[strings.TrimPrefix(f, pipeline.EnvNamespacePrefix)]
 		}
 	}
 
 	return o, nil
 }
 
+// Plugins parses the plugins the job will run with, from BUILDKITE_PLUGINS.
+func (j *Job) Plugins() (pipeline.Plugins, error) {
+	var plugins pipeline.Plugins
+	if pj := j.Env["BUILDKITE_PLUGINS"]; pj != "" {
+		if err := json.Unmarshal([]byte(pj), &plugins); err != nil {
+			return nil, fmt.Errorf("parsing BUILDKITE_PLUGINS: %w", err)
+		}
+	}
+	return plugins, nil
+}
+
 type JobState struct {
 	State string `json:"state,omitempty"`
 }
@@ -21,6 +21,7 @@ import (
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/hook"
 	"github.com/buildkite/agent/v3/internal/agentapi"
+	"github.com/buildkite/agent/v3/internal/gitmirrors"
 	"github.com/buildkite/agent/v3/internal/job/shell"
 	"github.com/buildkite/agent/v3/internal/utils"
 	"github.com/buildkite/agent/v3/logger"
@@ -30,6 +31,7 @@ import (
 	"github.com/buildkite/agent/v3/tracetools"
 	"github.com/buildkite/agent/v3/version"
 	"github.com/buildkite/shellwords"
+	"github.com/dustin/go-humanize"
 	"github.com/mitchellh/go-homedir"
 	"github.com/urfave/cli"
 	"golang.org/x/exp/maps"
@@ -73,6 +75,8 @@ type AgentStartConfig struct {
 
 	JobSigningKeyPath                       string `cli:"job-signing-key-path" normalize:"filepath"`
 	JobVerificationKeyPath                  string `cli:"job-verification-key-path" normalize:"filepath"`
+	JobVerificationHelper                   string `cli:"job-verification-helper"`
+	JobVerificationHelperAlgorithm          string `cli:"job-verification-helper-algorithm"`
 	JobVerificationNoSignatureBehavior      string `cli:"job-verification-no-signature-behavior"`
 	JobVerificationInvalidSignatureBehavior string `cli:"job-verification-invalid-signature-behavior"`
 
@@ -93,6 +97,8 @@ type AgentStartConfig struct {
 	SocketsPath string `cli:"sockets-path" normalize:"filepath"`
 	PluginsPath string `cli:"plugins-path" normalize:"filepath"`
 
+	AgentAPIPersistState bool `cli:"agent-api-persist-state"`
+
 	Shell           string `cli:"shell"`
 	BootstrapScript string `cli:"bootstrap-script" normalize:"commandpath"`
 	NoPTY           bool   `cli:"no-pty"`
@@ -114,15 +120,20 @@ type AgentStartConfig struct {
 	WaitForECSMetaDataTimeout string   `cli:"wait-for-ecs-meta-data-timeout"`
 	WaitForGCPLabelsTimeout   string   `cli:"wait-for-gcp-labels-timeout"`
 
-	GitCheckoutFlags      string `cli:"git-checkout-flags"`
-	GitCloneFlags         string `cli:"git-clone-flags"`
-	GitCloneMirrorFlags   string `cli:"git-clone-mirror-flags"`
-	GitCleanFlags         string `cli:"git-clean-flags"`
-	GitFetchFlags         string `cli:"git-fetch-flags"`
-	GitMirrorsPath        string `cli:"git-mirrors-path" normalize:"filepath"`
-	GitMirrorsLockTimeout int    `cli:"git-mirrors-lock-timeout"`
-	GitMirrorsSkipUpdate  bool   `cli:"git-mirrors-skip-update"`
-	NoGitSubmodules       bool   `cli:"no-git-submodules"`
+	GitCheckoutFlags      string        `cli:"git-checkout-flags"`
+	GitCloneFlags         string        `cli:"git-clone-flags"`
+	GitCloneMirrorFlags   string        `cli:"git-clone-mirror-flags"`
+	GitCleanFlags         string        `cli:"git-clean-flags"`
+	GitFetchFlags         string        `cli:"git-fetch-flags"`
+	GitPartialCloneFilter string        `cli:"git-partial-clone-filter"`
+	GitLFS                bool          `cli:"git-lfs"`
+	GitMirrorsPath        string        `cli:"git-mirrors-path" normalize:"filepath"`
+	GitMirrorsLockTimeout int           `cli:"git-mirrors-lock-timeout"`
+	GitMirrorsSkipUpdate  bool          `cli:"git-mirrors-skip-update"`
+	GitMirrorsWorktrees   bool          `cli:"git-mirrors-worktrees"`
+	GitMirrorsGCInterval  time.Duration `cli:"git-mirrors-gc-interval"`
+	GitMirrorsGCMaxAge    time.Duration `cli:"git-mirrors-gc-max-age"`
+	NoGitSubmodules       bool          `cli:"no-git-submodules"`
 
 	NoSSHKeyscan       bool `cli:"no-ssh-keyscan"`
 	NoCommandEval      bool `cli:"no-command-eval"`
@@ -429,6 +440,17 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Flags to pass to the \"git clone\" command when used for mirroring",
 			EnvVar: "BUILDKITE_GIT_CLONE_MIRROR_FLAGS",
 		},
+		cli.StringFlag{
+			Name:   "git-partial-clone-filter",
+			Value:  "",
+			Usage:  "Filter to use for partial clones and fetches of repositories and their mirrors, for example ′blob:none′ or ′tree:0′. Requires a git server that supports partial clone. Repositories cloned with a filter get a separate mirror for each filter",
+			EnvVar: "BUILDKITE_GIT_PARTIAL_CLONE_FILTER",
+		},
+		cli.BoolFlag{
+			Name:   "git-lfs",
+			Usage:  "Check out Git LFS files with a single batched fetch after the checkout, rather than one at a time while checking out. When using git mirrors, LFS objects are cached in the mirror. Requires git-lfs",
+			EnvVar: "BUILDKITE_GIT_LFS",
+		},
 		cli.StringFlag{
 			Name:   "git-mirrors-path",
 			Value:  "",
@@ -446,6 +468,21 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Skip updating the Git mirror",
 			EnvVar: "BUILDKITE_GIT_MIRRORS_SKIP_UPDATE",
 		},
+		cli.BoolFlag{
+			Name:   "git-mirrors-worktrees",
+			Usage:  "Check out repositories as worktrees of their mirrors, rather than as clones that reference them. Requires ′git-mirrors-path′",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_WORKTREES",
+		},
+		cli.DurationFlag{
+			Name:   "git-mirrors-gc-interval",
+			Usage:  "How often to run git maintenance on idle git mirrors, and remove unused ones (see ′git-mirrors-gc-max-age′). 0 disables this",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_GC_INTERVAL",
+		},
+		cli.DurationFlag{
+			Name:   "git-mirrors-gc-max-age",
+			Usage:  "Remove git mirrors that haven't been used for longer than this (for example, ′720h′) when ′git-mirrors-gc-interval′ is set. 0 means mirrors are never removed",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_GC_MAX_AGE",
+		},
 		cli.StringFlag{
 			Name:   "bootstrap-script",
 			Value:  "",
@@ -470,6 +507,11 @@ var AgentStartCommand = cli.Command{
 			Usage:  "Directory where the agent will place sockets",
 			EnvVar: "BUILDKITE_SOCKETS_PATH",
 		},
+		cli.BoolFlag{
+			Name:   "agent-api-persist-state",
+			Usage:  "Persist Agent API lock state in a file in the sockets path, so that it survives the leader agent restarting (requires the agent-api experiment)",
+			EnvVar: "BUILDKITE_AGENT_API_PERSIST_STATE",
+		},
 		cli.StringFlag{
 			Name:   "plugins-path",
 			Value:  "",
@@ -580,12 +622,22 @@ var AgentStartCommand = cli.Command{
 		},
 		cli.StringFlag{
 			Name:   "job-verification-key-path",
-			Usage:  "Path to a file containing a verification key. Passing this flag enables job verification. For hmac-sha256, the raw file content is used as the shared key",
+			Usage:  "Path to a file containing a verification key. Passing this flag enables job verification. The key may be a PEM or JWK public key (Ed25519, ECDSA P-256, or RSA, for the ed25519, ecdsa-p256-sha256, or rsa-pss-sha256 algorithms), otherwise the raw file content is used as a shared key for hmac-sha256. To trust several keys (e.g. while rotating keys), this may instead be a JSON Web Key Set file, or a directory of key files",
 			EnvVar: "BUILDKITE_AGENT_JOB_VERIFICATION_KEY_PATH",
 		},
+		cli.StringFlag{
+			Name:   "job-verification-helper",
+			Usage:  "A program to verify job signatures with, for keys held outside the agent (such as in a KMS). Passing this flag enables job verification. It is run with the argument ′verify′, given the signed data on stdin and the base64-encoded signature in $BUILDKITE_SIGNATURE, and must exit 0 if the signature is valid",
+			EnvVar: "BUILDKITE_AGENT_JOB_VERIFICATION_HELPER",
+		},
+		cli.StringFlag{
+			Name:   "job-verification-helper-algorithm",
+			Usage:  "The signing algorithm the job verification helper verifies (e.g. ed25519, ecdsa-p256-sha256, rsa-pss-sha256, or hmac-sha256). Required with --job-verification-helper",
+			EnvVar: "BUILDKITE_AGENT_JOB_VERIFICATION_HELPER_ALGORITHM",
+		},
 		cli.StringFlag{
 			Name:   "job-signing-key-path",
-			Usage:  "Path to a file containing a signing key. Passing this flag enables pipeline signing for all pipelines uploaded by this agent. For hmac-sha256, the raw file content is used as the shared key",
+			Usage:  "Path to a file containing a signing key. Passing this flag enables pipeline signing for all pipelines uploaded by this agent. The key may be a PEM or JWK private key (Ed25519, ECDSA P-256, or RSA), otherwise the raw file content is used as a shared key for hmac-sha256",
 			EnvVar: "BUILDKITE_PIPELINE_JOB_SIGNING_KEY_PATH",
 		},
 		cli.StringFlag{
@@ -670,7 +722,11 @@ var AgentStartCommand = cli.Command{
 			l.Fatal("Failed to unset config from environment: %v", err)
 		}
 
-		if cfg.JobVerificationKeyPath != "" {
+		if cfg.JobVerificationHelper != "" && cfg.JobVerificationHelperAlgorithm == "" {
+			l.Fatal("--job-verification-helper-algorithm is required when using --job-verification-helper")
+		}
+
+		if cfg.JobVerificationKeyPath != "" || cfg.JobVerificationHelper != "" {
 			if !slices.Contains(verificationFailureBehaviors, cfg.JobVerificationNoSignatureBehavior) {
 				l.Fatal("Invalid job verification no signature behavior %q. Must be one of: %v", cfg.JobVerificationNoSignatureBehavior, verificationFailureBehaviors)
 			}
@@ -786,10 +842,15 @@ var AgentStartCommand = cli.Command{
 		}
 
 		if experiments.IsEnabled(experiments.AgentAPI) {
-			shutdown := runAgentAPI(ctx, l, cfg.SocketsPath)
+			shutdown := runAgentAPI(ctx, l, cfg.SocketsPath, cfg.AgentAPIPersistState)
 			defer shutdown()
 		}
 
+		if cfg.GitMirrorsPath != "" && cfg.GitMirrorsGCInterval > 0 {
+			stop := runGitMirrorsGC(ctx, l, cfg.GitMirrorsPath, cfg.GitMirrorsGCInterval, cfg.GitMirrorsGCMaxAge)
+			defer stop()
+		}
+
 		// AgentConfiguration is the runtime configuration for an agent
 		agentConf := agent.AgentConfiguration{
 			BootstrapScript:                         cfg.BootstrapScript,
@@ -798,6 +859,7 @@ var AgentStartCommand = cli.Command{
 			GitMirrorsPath:                          cfg.GitMirrorsPath,
 			GitMirrorsLockTimeout:                   cfg.GitMirrorsLockTimeout,
 			GitMirrorsSkipUpdate:                    cfg.GitMirrorsSkipUpdate,
+			GitMirrorsWorktrees:                     cfg.GitMirrorsWorktrees,
 			HooksPath:                               cfg.HooksPath,
 			PluginsPath:                             cfg.PluginsPath,
 			GitCheckoutFlags:                        cfg.GitCheckoutFlags,
@@ -805,6 +867,8 @@ var AgentStartCommand = cli.Command{
 			GitCloneMirrorFlags:                     cfg.GitCloneMirrorFlags,
 			GitCleanFlags:                           cfg.GitCleanFlags,
 			GitFetchFlags:                           cfg.GitFetchFlags,
+			GitPartialCloneFilter:                   cfg.GitPartialCloneFilter,
+			GitLFS:                                  cfg.GitLFS,
 			GitSubmodules:                           !cfg.NoGitSubmodules,
 			SSHKeyscan:                              !cfg.NoSSHKeyscan,
 			CommandEval:                             !cfg.NoCommandEval,
@@ -830,6 +894,8 @@ var AgentStartCommand = cli.Command{
 			TracingServiceName:                      cfg.TracingServiceName,
 			JobSigningKeyPath:                       cfg.JobSigningKeyPath,
 			JobVerificationKeyPath:                  cfg.JobVerificationKeyPath,
+			JobVerificationHelper:                   cfg.JobVerificationHelper,
+			JobVerificationHelperAlgorithm:          cfg.JobVerificationHelperAlgorithm,
 			JobVerificationNoSignatureBehavior:      cfg.JobVerificationNoSignatureBehavior,
 			JobVerificationInvalidSignatureBehavior: cfg.JobVerificationInvalidSignatureBehavior,
 		}
@@ -1152,9 +1218,15 @@ func defaultSocketsPath() string {
 	return filepath.Join(home, ".buildkite-agent", "sockets")
 }
 
+const agentAPILocksStatusTmpl = `{{if not .}}No locks in use{{else}}<table>
+<tr><th>Key</th><th>Value or holder</th><th>Job</th><th>Agent</th><th>Acquired at</th><th>Expires at</th></tr>
+{{range .}}{{$key := .Key}}{{if .Holders}}{{range .Holders}}<tr><td><code>{{$key}}</code></td><td><code>{{.Token}}</code></td><td>{{.JobID}}</td><td>{{.AgentName}}</td><td>{{.AcquiredAt.Format "2006-01-02 15:04:05 MST"}}</td><td>{{if not .Expires.IsZero}}{{.Expires.Format "2006-01-02 15:04:05 MST"}}{{end}}</td></tr>
+{{end}}{{else}}<tr><td><code>{{.Key}}</code></td><td><code>{{.Value}}</code></td><td></td><td></td><td></td><td></td></tr>
+{{end}}{{end}}</table>{{end}}`
+
 // runAgentAPI runs an API socket that can be used to interact with this
 // (top-level) agent. It returns a shutdown function.
-func runAgentAPI(ctx context.Context, l logger.Logger, socketsPath string) func() {
+func runAgentAPI(ctx context.Context, l logger.Logger, socketsPath string, persistState bool) func() {
 	path := agentapi.DefaultSocketPath(socketsPath)
 	// There should be only one Agent API socket per agent process.
 	// If a previous agent crashed and left behind a socket, we can
@@ -1169,16 +1241,41 @@ func runAgentAPI(ctx context.Context, l logger.Logger, socketsPath string) func(
 		l.Fatal("Couldn't start Agent API server: %v", err)
 	}
 
+	// When this agent becomes leader, it carries on with the state left by
+	// the previous leader, if persisted.
+	var restoreState func()
+	if persistState {
+		restoreState = func() {
+			statePath := agentapi.LeaderStatePath(socketsPath)
+			if err := svr.PersistLocks(statePath); err != nil {
+				l.Error("Agent API: Couldn't persist leader state (locks) to %s: %v", statePath, err)
+			}
+		}
+	}
+
 	// Try to be the leader - no worries if this fails.
 	leaderPath := agentapi.LeaderPath(socketsPath)
 	if err := os.Symlink(path, leaderPath); err == nil {
 		l.Info("Agent API: This agent became leader")
+		if restoreState != nil {
+			restoreState()
+		}
 	}
 
 	// Whoever the leader is, ping them every so often as a health-check.
-	go leaderPinger(ctx, l, path, leaderPath)
+	go leaderPinger(ctx, l, path, leaderPath, restoreState)
+
+	// Show the locks held by the leader on the status page.
+	_, statusDone := status.AddItem(ctx, "Agent API Locks", agentAPILocksStatusTmpl, func(ctx context.Context) (any, error) {
+		cl, err := agentapi.NewClient(ctx, leaderPath)
+		if err != nil {
+			return nil, err
+		}
+		return cl.LockList(ctx)
+	})
 
 	return func() {
+		statusDone()
 		svr.Shutdown(ctx)
 		if d, err := os.Readlink(leaderPath); err == nil && d == path {
 			os.Remove(leaderPath)
@@ -1187,8 +1284,8 @@ func runAgentAPI(ctx context.Context, l logger.Logger, socketsPath string) func(
 }
 
 // leaderPinger pings the leader socket for liveness, and takes over if it
-// fails.
-func leaderPinger(ctx context.Context, l logger.Logger, path, leaderPath string) {
+// fails. If restoreState is not nil, it is called after taking over.
+func leaderPinger(ctx context.Context, l logger.Logger, path, leaderPath string, restoreState func()) {
 	pingLeader := func() error {
 		d, err := os.Readlink(leaderPath)
 		if err != nil {
@@ -1213,9 +1310,73 @@ func leaderPinger(ctx context.Context, l logger.Logger, path, leaderPath string)
 	for range time.Tick(100 * time.Millisecond) {
 		if err := pingLeader(); err != nil {
 			l.Warn("Agent API: Leader ping failed, staging coup: %v", err)
-			l.Warn("Agent API: Leader state (locks) has been lost!")
+			if restoreState == nil {
+				l.Warn("Agent API: Leader state (locks) has been lost!")
+			}
 			os.Remove(leaderPath)
-			os.Symlink(path, leaderPath)
+			if err := os.Symlink(path, leaderPath); err == nil && restoreState != nil {
+				restoreState()
+			}
+		}
+	}
+}
+
+// runGitMirrorsGC periodically maintains the git mirrors in path, and removes
+// any unused for longer than maxAge. It returns a function that stops it.
+func runGitMirrorsGC(ctx context.Context, l logger.Logger, path string, interval, maxAge time.Duration) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		_, setStatus, done := status.AddSimpleItem(ctx, "Git Mirrors GC")
+		defer done()
+		setStatus("⏳ Waiting for the first run")
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			setStatus("🧹 Cleaning up git mirrors")
+			mirrors, err := gitmirrors.GC(ctx, l, gitmirrors.GCConfig{
+				Path:        path,
+				MaxAge:      maxAge,
+				Maintenance: true,
+			})
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				l.Error("Git mirrors GC: %v", err)
+				setStatus(fmt.Sprintf("❌ Last run failed: %v", err))
+				continue
+			}
+
+			var removed int
+			var freed, total uint64
+			for _, m := range mirrors {
+				if m.Action == gitmirrors.ActionRemoved {
+					removed++
+					freed += uint64(m.Size)
+					continue
+				}
+				total += uint64(m.Size)
+			}
+			summary := fmt.Sprintf("%d mirrors using %s, removed %d (%s)", len(mirrors)-removed, humanize.Bytes(total), removed, humanize.Bytes(freed))
+			l.Info("Git mirrors GC: %s", summary)
+			setStatus(fmt.Sprintf("✅ Last run at %s: %s", time.Now().Format(time.RFC3339), summary))
 		}
+	}()
+
+	return func() {
+		cancel()
+		<-stopped
 	}
 }
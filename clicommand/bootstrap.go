@@ -68,7 +68,11 @@ type BootstrapConfig struct {
 	GitMirrorsPath               string   `cli:"git-mirrors-path" normalize:"filepath"`
 	GitMirrorsLockTimeout        int      `cli:"git-mirrors-lock-timeout"`
 	GitMirrorsSkipUpdate         bool     `cli:"git-mirrors-skip-update"`
+	GitMirrorsWorktrees          bool     `cli:"git-mirrors-worktrees"`
 	GitSubmoduleCloneConfig      []string `cli:"git-submodule-clone-config"`
+	GitPartialCloneFilter        string   `cli:"git-partial-clone-filter"`
+	GitLFS                       bool     `cli:"git-lfs"`
+	GitSparseCheckoutPaths       []string `cli:"git-sparse-checkout-paths" normalize:"list"`
 	BinPath                      string   `cli:"bin-path" normalize:"filepath"`
 	BuildPath                    string   `cli:"build-path" normalize:"filepath"`
 	HooksPath                    string   `cli:"hooks-path" normalize:"filepath"`
@@ -236,6 +240,23 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Comma separated key=value git config pairs applied before git submodule clone commands. For example, ′update --init′. If the config is needed to be applied to all git commands, supply it in a global git config file for the system that the agent runs in instead.",
 			EnvVar: "BUILDKITE_GIT_SUBMODULE_CLONE_CONFIG",
 		},
+		cli.StringFlag{
+			Name:   "git-partial-clone-filter",
+			Value:  "",
+			Usage:  "Filter to use for partial clones and fetches of the repository and its mirror, for example ′blob:none′ or ′tree:0′",
+			EnvVar: "BUILDKITE_GIT_PARTIAL_CLONE_FILTER",
+		},
+		cli.StringSliceFlag{
+			Name:   "git-sparse-checkout-paths",
+			Value:  &cli.StringSlice{},
+			Usage:  "Comma separated directories to check out using a cone-mode sparse checkout. If empty, the whole repository is checked out",
+			EnvVar: "BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS",
+		},
+		cli.BoolFlag{
+			Name:   "git-lfs",
+			Usage:  "Check out Git LFS files with a single batched fetch after the checkout, rather than one at a time while checking out. When using git mirrors, LFS objects are cached in the mirror. Requires git-lfs",
+			EnvVar: "BUILDKITE_GIT_LFS",
+		},
 		cli.StringFlag{
 			Name:   "git-mirrors-path",
 			Value:  "",
@@ -253,6 +274,11 @@ var BootstrapCommand = cli.Command{
 			Usage:  "Skip updating the Git mirror",
 			EnvVar: "BUILDKITE_GIT_MIRRORS_SKIP_UPDATE",
 		},
+		cli.BoolFlag{
+			Name:   "git-mirrors-worktrees",
+			Usage:  "Check out repositories as worktrees of their mirrors, rather than as clones that reference them. Requires ′git-mirrors-path′",
+			EnvVar: "BUILDKITE_GIT_MIRRORS_WORKTREES",
+		},
 		cli.StringFlag{
 			Name:   "bin-path",
 			Value:  "",
@@ -411,8 +437,12 @@ var BootstrapCommand = cli.Command{
 			GitMirrorsLockTimeout:        cfg.GitMirrorsLockTimeout,
 			GitMirrorsPath:               cfg.GitMirrorsPath,
 			GitMirrorsSkipUpdate:         cfg.GitMirrorsSkipUpdate,
+			GitMirrorsWorktrees:          cfg.GitMirrorsWorktrees,
 			GitSubmodules:                cfg.GitSubmodules,
 			GitSubmoduleCloneConfig:      cfg.GitSubmoduleCloneConfig,
+			GitPartialCloneFilter:        cfg.GitPartialCloneFilter,
+			GitSparseCheckoutPaths:       cfg.GitSparseCheckoutPaths,
+			GitLFS:                       cfg.GitLFS,
 			HooksPath:                    cfg.HooksPath,
 			JobID:                        cfg.JobID,
 			LocalHooksEnabled:            cfg.LocalHooksEnabled,
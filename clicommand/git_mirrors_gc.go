@@ -0,0 +1,158 @@
+package clicommand
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/gitmirrors"
+	"github.com/dustin/go-humanize"
+	"github.com/urfave/cli"
+)
+
+const gitMirrorsGCHelpDescription = `Usage:
+
+   buildkite-agent git-mirrors gc [options...]
+
+Description:
+   Cleans up the git mirrors kept in the git mirrors path. It runs git
+   maintenance (which repacks objects and prunes unreachable ones) on each
+   mirror, and with ′--max-age′, removes mirrors that no job has used for
+   longer than that. Mirrors that jobs are cloning or updating are left alone,
+   as are mirrors with worktrees checked out (see ′--git-mirrors-worktrees′).
+
+   It prints the size of each mirror, and what was done with it.
+
+   ′buildkite-agent start′ can also do this periodically, with
+   ′--git-mirrors-gc-interval′.
+
+Examples:
+
+   $ buildkite-agent git-mirrors gc --git-mirrors-path /var/lib/buildkite/git-mirrors --max-age 720h
+   MIRROR                                    SIZE    LAST USED      ACTION
+   git-github-com-buildkite-agent-git        152 MB  2m0s ago       maintained
+   git-github-com-buildkite-old-project-git  31 MB   1000h0m0s ago  removed
+`
+
+type GitMirrorsGCConfig struct {
+	GitMirrorsPath string        `cli:"git-mirrors-path" normalize:"filepath"`
+	MaxAge         time.Duration `cli:"max-age"`
+	NoMaintenance  bool          `cli:"no-maintenance"`
+	DryRun         bool          `cli:"dry-run"`
+	Format         string        `cli:"format"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+func gitMirrorsGCFlags() []cli.Flag {
+	return append(
+		[]cli.Flag{
+			cli.StringFlag{
+				Name:   "git-mirrors-path",
+				Value:  "",
+				Usage:  "Path to where mirrors of git repositories are stored",
+				EnvVar: "BUILDKITE_GIT_MIRRORS_PATH",
+			},
+			cli.DurationFlag{
+				Name:   "max-age",
+				Usage:  "Remove mirrors that haven't been used for longer than this (for example, ′720h′). 0 means mirrors are never removed",
+				EnvVar: "BUILDKITE_GIT_MIRRORS_GC_MAX_AGE",
+			},
+			cli.BoolFlag{
+				Name:   "no-maintenance",
+				Usage:  "Don't run git maintenance on the mirrors",
+				EnvVar: "BUILDKITE_GIT_MIRRORS_GC_NO_MAINTENANCE",
+			},
+			cli.BoolFlag{
+				Name:   "dry-run",
+				Usage:  "Print what would be done, without doing it",
+				EnvVar: "BUILDKITE_GIT_MIRRORS_GC_DRY_RUN",
+			},
+			cli.StringFlag{
+				Name:   "format",
+				Value:  "text",
+				Usage:  "Output format: text or json",
+				EnvVar: "BUILDKITE_GIT_MIRRORS_GC_FORMAT",
+			},
+		},
+		globalFlags()...,
+	)
+}
+
+var GitMirrorsGCCommand = cli.Command{
+	Name:        "gc",
+	Usage:       "Maintains git mirrors, and removes unused ones",
+	Description: gitMirrorsGCHelpDescription,
+	Flags:       gitMirrorsGCFlags(),
+	Action:      gitMirrorsGCAction,
+}
+
+func gitMirrorsGCAction(c *cli.Context) error {
+	if c.NArg() != 0 {
+		fmt.Fprint(c.App.ErrWriter, gitMirrorsGCHelpDescription)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	cfg, l, _, done := setupLoggerAndConfig[GitMirrorsGCConfig](c)
+	defer done()
+
+	if cfg.GitMirrorsPath == "" {
+		l.Fatal("A git mirrors path is required (--git-mirrors-path)")
+	}
+
+	mirrors, err := gitmirrors.GC(ctx, l, gitmirrors.GCConfig{
+		Path:        cfg.GitMirrorsPath,
+		MaxAge:      cfg.MaxAge,
+		Maintenance: !cfg.NoMaintenance,
+		DryRun:      cfg.DryRun,
+	})
+	if err != nil {
+		l.Fatal("Could not clean up git mirrors: %v", err)
+	}
+
+	if err := printGitMirrors(c.App.Writer, cfg.Format, mirrors, time.Now()); err != nil {
+		l.Fatal("Could not print git mirrors: %v", err)
+	}
+	return nil
+}
+
+// printGitMirrors writes the results of mirror GC to w in the given format.
+func printGitMirrors(w io.Writer, format string, mirrors []gitmirrors.Mirror, now time.Time) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(mirrors)
+
+	case "text":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join([]string{"MIRROR", "SIZE", "LAST USED", "ACTION"}, "\t"))
+		for _, m := range mirrors {
+			lastUsed := "-"
+			if !m.LastUsed.IsZero() {
+				lastUsed = now.Sub(m.LastUsed).Round(time.Second).String() + " ago"
+			}
+			action := string(m.Action)
+			if m.Error != "" {
+				action += ": " + m.Error
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", filepath.Base(m.Path), humanize.Bytes(uint64(m.Size)), lastUsed, action)
+		}
+		return tw.Flush()
+
+	default:
+		return fmt.Errorf("invalid format %q", format)
+	}
+}
@@ -0,0 +1,29 @@
+package clicommand
+
+import (
+	"context"
+
+	"github.com/buildkite/agent/v3/internal/agentapi"
+	"github.com/urfave/cli"
+)
+
+// Flags used by all local-kv subcommands.
+var localKVCommonFlags = []cli.Flag{
+	cli.StringFlag{
+		Name:   "config",
+		Value:  "",
+		Usage:  "Path to a configuration file",
+		EnvVar: "BUILDKITE_AGENT_CONFIG",
+	},
+	cli.StringFlag{
+		Name:   "sockets-path",
+		Value:  defaultSocketsPath(),
+		Usage:  "Directory where the agent will place sockets",
+		EnvVar: "BUILDKITE_SOCKETS_PATH",
+	},
+}
+
+// newLocalKVClient connects to the Agent API of the leader agent.
+func newLocalKVClient(ctx context.Context, socketsPath string) (*agentapi.Client, error) {
+	return agentapi.NewClient(ctx, agentapi.LeaderPath(socketsPath))
+}
@@ -0,0 +1,68 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+const localKVDeleteHelpDescription = `Usage:
+
+   buildkite-agent local-kv delete [key]
+
+Description:
+   Deletes a value from the key/value store shared by all jobs running on this
+   host. Deleting a key that has no value is not an error.
+
+   Note that this subcommand is only available when an agent has been started
+   with the ′agent-api′ experiment enabled.
+
+Examples:
+
+   $ buildkite-agent local-kv delete image-digest
+
+`
+
+type LocalKVDeleteConfig struct {
+	// Common config options
+	SocketsPath string `cli:"sockets-path" normalize:"filepath"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var LocalKVDeleteCommand = cli.Command{
+	Name:        "delete",
+	Usage:       "Deletes a value from the host-local key/value store",
+	Description: localKVDeleteHelpDescription,
+	Flags:       append(globalFlags(), localKVCommonFlags...),
+	Action:      localKVDeleteAction,
+}
+
+func localKVDeleteAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		fmt.Fprint(c.App.ErrWriter, localKVDeleteHelpDescription)
+		os.Exit(1)
+	}
+	key := c.Args()[0]
+
+	ctx := context.Background()
+	cfg, l, _, done := setupLoggerAndConfig[LocalKVDeleteConfig](c)
+	defer done()
+
+	client, err := newLocalKVClient(ctx, cfg.SocketsPath)
+	if err != nil {
+		l.Fatal(agentAPIClientErrMessage, err)
+	}
+
+	if _, err := client.KVDelete(ctx, key); err != nil {
+		l.Fatal("Couldn't delete value: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,98 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/urfave/cli"
+)
+
+const localKVGetHelpDescription = `Usage:
+
+   buildkite-agent local-kv get [key]
+
+Description:
+   Retrieves a value from the key/value store shared by all jobs running on
+   this host. If there is no value for the key (or it has expired), the
+   command fails, unless ′--default′ is given.
+
+   Note that this subcommand is only available when an agent has been started
+   with the ′agent-api′ experiment enabled.
+
+Examples:
+
+   $ buildkite-agent local-kv get go-version
+   go1.21.0
+
+   $ buildkite-agent local-kv get --default unknown image-digest
+   unknown
+
+`
+
+type LocalKVGetConfig struct {
+	Default string `cli:"default"`
+
+	// Common config options
+	SocketsPath string `cli:"sockets-path" normalize:"filepath"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+func localKVGetFlags() []cli.Flag {
+	flags := append(
+		[]cli.Flag{
+			cli.StringFlag{
+				Name:   "default",
+				Usage:  "If the key has no value, print this instead of failing",
+				EnvVar: "BUILDKITE_LOCAL_KV_DEFAULT",
+			},
+		},
+		localKVCommonFlags...,
+	)
+	return append(flags, globalFlags()...)
+}
+
+var LocalKVGetCommand = cli.Command{
+	Name:        "get",
+	Usage:       "Gets a value from the host-local key/value store",
+	Description: localKVGetHelpDescription,
+	Flags:       localKVGetFlags(),
+	Action:      localKVGetAction,
+}
+
+func localKVGetAction(c *cli.Context) error {
+	if c.NArg() != 1 {
+		fmt.Fprint(c.App.ErrWriter, localKVGetHelpDescription)
+		os.Exit(1)
+	}
+	key := c.Args()[0]
+
+	ctx := context.Background()
+	cfg, l, _, done := setupLoggerAndConfig[LocalKVGetConfig](c)
+	defer done()
+
+	client, err := newLocalKVClient(ctx, cfg.SocketsPath)
+	if err != nil {
+		l.Fatal(agentAPIClientErrMessage, err)
+	}
+
+	v, ok, err := client.KVGet(ctx, key)
+	if err != nil {
+		l.Fatal("Couldn't get value: %v", err)
+	}
+	if !ok {
+		if !c.IsSet("default") {
+			l.Fatal("No value for key %q", key)
+		}
+		v = cfg.Default
+	}
+
+	fmt.Fprintln(c.App.Writer, v)
+	return nil
+}
@@ -0,0 +1,107 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/urfave/cli"
+)
+
+const localKVSetHelpDescription = `Usage:
+
+   buildkite-agent local-kv set [key] [value]
+
+Description:
+   Stores a value in the key/value store shared by all jobs running on this
+   host, replacing any existing value. If no value is given as an argument, it
+   is read from standard input.
+
+   With ′--ttl′, the value expires after that long. Otherwise it is kept until
+   it is deleted, or the agent serving the store stops. Values are not written
+   to disk, so the store is only suitable as a cache.
+
+   Note that this subcommand is only available when an agent has been started
+   with the ′agent-api′ experiment enabled.
+
+Examples:
+
+   $ buildkite-agent local-kv set --ttl 1h go-version "$(go env GOVERSION)"
+
+   $ docker inspect --format '{{.Id}}' my-image | buildkite-agent local-kv set image-digest
+
+`
+
+type LocalKVSetConfig struct {
+	TTL time.Duration `cli:"ttl"`
+
+	// Common config options
+	SocketsPath string `cli:"sockets-path" normalize:"filepath"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+func localKVSetFlags() []cli.Flag {
+	flags := append(
+		[]cli.Flag{
+			cli.DurationFlag{
+				Name:   "ttl",
+				Usage:  "If specified, the value expires after this long",
+				EnvVar: "BUILDKITE_LOCAL_KV_TTL",
+			},
+		},
+		localKVCommonFlags...,
+	)
+	return append(flags, globalFlags()...)
+}
+
+var LocalKVSetCommand = cli.Command{
+	Name:        "set",
+	Usage:       "Sets a value in the host-local key/value store",
+	Description: localKVSetHelpDescription,
+	Flags:       localKVSetFlags(),
+	Action:      localKVSetAction,
+}
+
+func localKVSetAction(c *cli.Context) error {
+	if c.NArg() < 1 || c.NArg() > 2 {
+		fmt.Fprint(c.App.ErrWriter, localKVSetHelpDescription)
+		os.Exit(1)
+	}
+	key := c.Args()[0]
+
+	ctx := context.Background()
+	cfg, l, _, done := setupLoggerAndConfig[LocalKVSetConfig](c)
+	defer done()
+
+	var value string
+	if c.NArg() == 2 {
+		value = c.Args()[1]
+	} else {
+		// TODO: replace with c.App.Reader (or something like that) when we upgrade to urfave/cli v3
+		input, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			l.Fatal("Couldn't read from standard input: %v", err)
+		}
+		// A trailing newline is almost certainly not part of the value.
+		value = strings.TrimRight(string(input), "\r\n")
+	}
+
+	client, err := newLocalKVClient(ctx, cfg.SocketsPath)
+	if err != nil {
+		l.Fatal(agentAPIClientErrMessage, err)
+	}
+
+	if _, err := client.KVSet(ctx, key, value, cfg.TTL); err != nil {
+		l.Fatal("Couldn't set value: %v", err)
+	}
+	return nil
+}
@@ -23,6 +23,16 @@ Description:
    To prevent separate processes unlocking each other, the output from ′lock
    acquire′ should be stored, and passed to ′lock release′.
 
+   With ′--slots′, the lock is a counting semaphore that up to that many
+   processes can hold at once. Every process using the key must pass the same
+   number of slots.
+
+   With ′--ttl′, the lock is released automatically unless it is renewed with
+   ′lock renew′ within that duration. The lock is also released automatically
+   when the process given by ′--holder-pid′ exits. Within a job, this defaults
+   to the job's process, so that locks aren't held forever by a job that
+   crashed.
+
    Note that this subcommand is only available when an agent has been started
    with the ′agent-api′ experiment enabled.
 
@@ -32,6 +42,13 @@ Examples:
    $ critical_section()
    $ buildkite-agent lock release llama "${token}"
 
+   Allowing up to 3 processes at once, each of which must renew its lease at
+   least every minute:
+
+   $ token=$(buildkite-agent lock acquire --slots 3 --ttl 1m llama)
+   $ buildkite-agent lock renew llama "${token}"
+   $ buildkite-agent lock release llama "${token}"
+
 `
 
 type LockAcquireConfig struct {
@@ -40,6 +57,11 @@ type LockAcquireConfig struct {
 	SocketsPath string `cli:"sockets-path" normalize:"filepath"`
 
 	LockWaitTimeout time.Duration `cli:"lock-wait-timeout"`
+	Slots           int           `cli:"slots"`
+	TTL             time.Duration `cli:"ttl"`
+	HolderPID       int           `cli:"holder-pid"`
+	Job             string        `cli:"job"`
+	AgentName       string        `cli:"agent-name"`
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
@@ -57,6 +79,34 @@ func lockAcquireFlags() []cli.Flag {
 				Usage:  "If specified, sets a maximum duration to wait for a lock before giving up",
 				EnvVar: "BUILDKITE_LOCK_WAIT_TIMEOUT",
 			},
+			cli.IntFlag{
+				Name:   "slots",
+				Value:  1,
+				Usage:  "The number of processes that can hold the lock at once",
+				EnvVar: "BUILDKITE_LOCK_SLOTS",
+			},
+			cli.DurationFlag{
+				Name:   "ttl",
+				Usage:  "If specified, the lock is released automatically unless it is renewed within this duration",
+				EnvVar: "BUILDKITE_LOCK_TTL",
+			},
+			cli.IntFlag{
+				Name:   "holder-pid",
+				Usage:  "If specified, the lock is released automatically when the process with this ID exits",
+				EnvVar: "BUILDKITE_LOCK_HOLDER_PID",
+			},
+			cli.StringFlag{
+				Name:   "job",
+				Value:  "",
+				Usage:  "Which job is acquiring the lock (shown by ′lock list′)",
+				EnvVar: "BUILDKITE_JOB_ID",
+			},
+			cli.StringFlag{
+				Name:   "agent-name",
+				Value:  "",
+				Usage:  "Which agent is acquiring the lock (shown by ′lock list′)",
+				EnvVar: "BUILDKITE_AGENT_NAME",
+			},
 		},
 		lockCommonFlags...,
 	)
@@ -94,10 +144,15 @@ func lockAcquireAction(c *cli.Context) error {
 
 	client, err := lock.NewClient(ctx, cfg.SocketsPath)
 	if err != nil {
-		l.Fatal(lockClientErrMessage, err)
+		l.Fatal(agentAPIClientErrMessage, err)
 	}
 
-	token, err := client.Lock(ctx, key)
+	token, err := client.Lock(ctx, key,
+		lock.WithSlots(cfg.Slots),
+		lock.WithTTL(cfg.TTL),
+		lock.WithHolderPID(cfg.HolderPID),
+		lock.WithHolderInfo(cfg.Job, cfg.AgentName),
+	)
 	if err != nil {
 		l.Fatal("Could not acquire lock: %v\n", err)
 	}
@@ -2,7 +2,7 @@ package clicommand
 
 import "github.com/urfave/cli"
 
-const lockClientErrMessage = `Could not connect to Agent API: %v
+const agentAPIClientErrMessage = `Could not connect to Agent API: %v
 This command can only be used when at least one agent is running with the
 "agent-api" experiment enabled.
 `
@@ -100,7 +100,7 @@ func lockDoAction(c *cli.Context) error {
 
 	client, err := lock.NewClient(ctx, cfg.SocketsPath)
 	if err != nil {
-		l.Fatal(lockClientErrMessage, err)
+		l.Fatal(agentAPIClientErrMessage, err)
 	}
 
 	do, err := client.DoOnceStart(ctx, key)
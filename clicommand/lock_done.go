@@ -68,7 +68,7 @@ func lockDoneAction(c *cli.Context) error {
 
 	client, err := lock.NewClient(ctx, cfg.SocketsPath)
 	if err != nil {
-		l.Fatal(lockClientErrMessage, err)
+		l.Fatal(agentAPIClientErrMessage, err)
 	}
 
 	if err := client.DoOnceEnd(ctx, key); err != nil {
@@ -69,7 +69,7 @@ func lockGetAction(c *cli.Context) error {
 
 	client, err := lock.NewClient(ctx, cfg.SocketsPath)
 	if err != nil {
-		l.Fatal(lockClientErrMessage, err)
+		l.Fatal(agentAPIClientErrMessage, err)
 	}
 
 	v, err := client.Get(ctx, key)
@@ -0,0 +1,154 @@
+package clicommand
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/buildkite/agent/v3/lock"
+	"github.com/urfave/cli"
+)
+
+const lockListHelpDescription = `Usage:
+
+   buildkite-agent lock list
+
+Description:
+   Lists every lock currently in use on this host, with its value, or for
+   locks acquired with ′lock acquire′, which jobs and agents hold it and since
+   when.
+
+   Note that this subcommand is only available when an agent has been started
+   with the ′agent-api′ experiment enabled.
+
+Examples:
+
+   $ buildkite-agent lock list
+   KEY              HOLDER                         JOB                                   AGENT       ACQUIRED  EXPIRES
+   llama (2 slots)  acquired(pid=1234,otp=a1b2c3)  0189c3f2-7b4e-4f0a-9d3e-2f1c8a6b5d4e  my-agent-1  2m0s ago  -
+   setup            done                           -                                     -           -         -
+
+`
+
+type LockListConfig struct {
+	Format string `cli:"format"`
+
+	// Common config options
+	LockScope   string `cli:"lock-scope"`
+	SocketsPath string `cli:"sockets-path" normalize:"filepath"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+func lockListFlags() []cli.Flag {
+	flags := append(
+		[]cli.Flag{
+			cli.StringFlag{
+				Name:   "format",
+				Value:  "text",
+				Usage:  "Output format: text or json",
+				EnvVar: "BUILDKITE_LOCK_LIST_FORMAT",
+			},
+		},
+		lockCommonFlags...,
+	)
+	return append(flags, globalFlags()...)
+}
+
+var LockListCommand = cli.Command{
+	Name:        "list",
+	Usage:       "Lists the locks in use on this host",
+	Description: lockListHelpDescription,
+	Flags:       lockListFlags(),
+	Action:      lockListAction,
+}
+
+func lockListAction(c *cli.Context) error {
+	if c.NArg() != 0 {
+		fmt.Fprint(c.App.ErrWriter, lockListHelpDescription)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	cfg, l, _, done := setupLoggerAndConfig[LockListConfig](c)
+	defer done()
+
+	if cfg.LockScope != "machine" {
+		l.Fatal("Only 'machine' scope for locks is supported in this version.")
+	}
+
+	client, err := lock.NewClient(ctx, cfg.SocketsPath)
+	if err != nil {
+		l.Fatal(agentAPIClientErrMessage, err)
+	}
+
+	locks, err := client.List(ctx)
+	if err != nil {
+		l.Fatal("Could not list locks: %v", err)
+	}
+
+	if err := printLocks(c.App.Writer, cfg.Format, locks, time.Now()); err != nil {
+		l.Fatal("Could not print locks: %v", err)
+	}
+	return nil
+}
+
+// printLocks writes the locks to w in the given format.
+func printLocks(w io.Writer, format string, locks []lock.Info, now time.Time) error {
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(locks)
+
+	case "text":
+		orDash := func(s string) string {
+			if s == "" {
+				return "-"
+			}
+			return s
+		}
+		ago := func(t time.Time) string {
+			if t.IsZero() {
+				return "-"
+			}
+			return now.Sub(t).Round(time.Second).String() + " ago"
+		}
+		in := func(t time.Time) string {
+			if t.IsZero() {
+				return "-"
+			}
+			return "in " + t.Sub(now).Round(time.Second).String()
+		}
+
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join([]string{"KEY", "HOLDER", "JOB", "AGENT", "ACQUIRED", "EXPIRES"}, "\t"))
+		for _, lk := range locks {
+			if len(lk.Holders) == 0 {
+				fmt.Fprintf(tw, "%s\t%s\t-\t-\t-\t-\n", lk.Key, lk.Value)
+				continue
+			}
+			key := lk.Key
+			if lk.Slots > 1 {
+				key = fmt.Sprintf("%s (%d slots)", lk.Key, lk.Slots)
+			}
+			for _, h := range lk.Holders {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", key, h.Token, orDash(h.JobID), orDash(h.AgentName), ago(h.AcquiredAt), in(h.Expires))
+			}
+		}
+		return tw.Flush()
+
+	default:
+		return fmt.Errorf("invalid format %q", format)
+	}
+}
@@ -12,6 +12,7 @@ import (
 const lockReleaseHelpDescription = `Usage:
 
    buildkite-agent lock release [key] [token]
+   buildkite-agent lock release --force [key]
 
 Description:
    Releases the lock for the given key. This should only be called by the
@@ -19,6 +20,11 @@ Description:
    each other unintentionally, the output from ′lock acquire′ is required as the
    second argument.
 
+   With ′--force′, the lock is released whoever holds it (including every
+   holder of a lock acquired with ′--slots′), and no token is needed. This is
+   intended for cleaning up after a process that failed to release a lock,
+   such as one found with ′lock list′.
+
    Note that this subcommand is only available when an agent has been started
    with the ′agent-api′ experiment enabled.
 
@@ -28,6 +34,8 @@ Examples:
    $ critical_section()
    $ buildkite-agent lock release llama "${token}"
 
+   $ buildkite-agent lock release --force llama
+
 `
 
 type LockReleaseConfig struct {
@@ -35,6 +43,8 @@ type LockReleaseConfig struct {
 	LockScope   string `cli:"lock-scope"`
 	SocketsPath string `cli:"sockets-path" normalize:"filepath"`
 
+	Force bool `cli:"force"`
+
 	// Global flags
 	Debug       bool     `cli:"debug"`
 	LogLevel    string   `cli:"log-level"`
@@ -47,31 +57,56 @@ var LockReleaseCommand = cli.Command{
 	Name:        "release",
 	Usage:       "Releases a previously-acquired lock",
 	Description: lockReleaseHelpDescription,
-	Flags:       append(globalFlags(), lockCommonFlags...),
+	Flags:       lockReleaseFlags(),
 	Action:      lockReleaseAction,
 }
 
-func lockReleaseAction(c *cli.Context) error {
-	if c.NArg() != 2 {
-		fmt.Fprint(c.App.ErrWriter, lockReleaseHelpDescription)
-		os.Exit(1)
-	}
-	key, token := c.Args()[0], c.Args()[1]
+func lockReleaseFlags() []cli.Flag {
+	flags := append(
+		[]cli.Flag{
+			cli.BoolFlag{
+				Name:   "force",
+				Usage:  "Release the lock whoever holds it, without needing a token",
+				EnvVar: "BUILDKITE_LOCK_RELEASE_FORCE",
+			},
+		},
+		lockCommonFlags...,
+	)
+	return append(flags, globalFlags()...)
+}
 
+func lockReleaseAction(c *cli.Context) error {
 	ctx := context.Background()
 	cfg, l, _, done := setupLoggerAndConfig[LockReleaseConfig](c)
 	defer done()
 
+	wantArgs := 2
+	if cfg.Force {
+		wantArgs = 1
+	}
+	if c.NArg() != wantArgs {
+		fmt.Fprint(c.App.ErrWriter, lockReleaseHelpDescription)
+		os.Exit(1)
+	}
+	key := c.Args()[0]
+
 	if cfg.LockScope != "machine" {
 		l.Fatal("Only 'machine' scope for locks is supported in this version.")
 	}
 
 	client, err := lock.NewClient(ctx, cfg.SocketsPath)
 	if err != nil {
-		l.Fatal(lockClientErrMessage, err)
+		l.Fatal(agentAPIClientErrMessage, err)
+	}
+
+	if cfg.Force {
+		if err := client.ForceUnlock(ctx, key); err != nil {
+			l.Fatal("Could not force release lock: %v", err)
+		}
+		return nil
 	}
 
-	if err := client.Unlock(ctx, key, token); err != nil {
+	if err := client.Unlock(ctx, key, c.Args()[1]); err != nil {
 		l.Fatal("Could not release lock: %v", err)
 	}
 
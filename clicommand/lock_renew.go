@@ -0,0 +1,81 @@
+package clicommand
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/buildkite/agent/v3/lock"
+	"github.com/urfave/cli"
+)
+
+const lockRenewHelpDescription = `Usage:
+
+   buildkite-agent lock renew [key] [token]
+
+Description:
+   Renews the lease on a lock acquired with ′lock acquire --ttl′, so that it
+   isn't released automatically for another TTL. The output from ′lock acquire′
+   is required as the second argument.
+
+   Renewing fails if the lease has already expired, in which case the lock
+   may now be held by another process.
+
+   Note that this subcommand is only available when an agent has been started
+   with the ′agent-api′ experiment enabled.
+
+Examples:
+
+   $ token=$(buildkite-agent lock acquire --ttl 1m llama)
+   $ while long_critical_section_step; do buildkite-agent lock renew llama "${token}"; done
+   $ buildkite-agent lock release llama "${token}"
+
+`
+
+type LockRenewConfig struct {
+	// Common config options
+	LockScope   string `cli:"lock-scope"`
+	SocketsPath string `cli:"sockets-path" normalize:"filepath"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var LockRenewCommand = cli.Command{
+	Name:        "renew",
+	Usage:       "Renews the lease on a previously-acquired lock",
+	Description: lockRenewHelpDescription,
+	Flags:       append(globalFlags(), lockCommonFlags...),
+	Action:      lockRenewAction,
+}
+
+func lockRenewAction(c *cli.Context) error {
+	if c.NArg() != 2 {
+		fmt.Fprint(c.App.ErrWriter, lockRenewHelpDescription)
+		os.Exit(1)
+	}
+	key, token := c.Args()[0], c.Args()[1]
+
+	ctx := context.Background()
+	cfg, l, _, done := setupLoggerAndConfig[LockRenewConfig](c)
+	defer done()
+
+	if cfg.LockScope != "machine" {
+		l.Fatal("Only 'machine' scope for locks is supported in this version.")
+	}
+
+	client, err := lock.NewClient(ctx, cfg.SocketsPath)
+	if err != nil {
+		l.Fatal(agentAPIClientErrMessage, err)
+	}
+
+	if _, err := client.Renew(ctx, key, token); err != nil {
+		l.Fatal("Could not renew lock: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package clicommand
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/internal/pipeline"
+	"github.com/buildkite/agent/v3/internal/stdin"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/urfave/cli"
+)
+
+// Flags for signing pipelines with a signing helper, shared by the pipeline
+// upload and sign commands.
+var (
+	signingHelperFlag = cli.StringFlag{
+		Name:   "signing-helper",
+		Usage:  "A program to sign pipelines with, for keys held outside the agent (such as in a KMS). It is run with the argument ′sign′, given the data to sign on stdin, and must write the base64-encoded signature to stdout. Can't be used with --signing-key-path",
+		EnvVar: "BUILDKITE_PIPELINE_UPLOAD_SIGNING_HELPER",
+	}
+	signingHelperAlgorithmFlag = cli.StringFlag{
+		Name:   "signing-helper-algorithm",
+		Usage:  "The signing algorithm the signing helper uses (e.g. ed25519, ecdsa-p256-sha256, rsa-pss-sha256, or hmac-sha256). Required with --signing-helper",
+		EnvVar: "BUILDKITE_PIPELINE_UPLOAD_SIGNING_HELPER_ALGORITHM",
+	}
+	signingHelperKeyIDFlag = cli.StringFlag{
+		Name:   "signing-helper-key-id",
+		Usage:  "The ID of the key the signing helper uses, which is recorded in signatures and passed to the helper",
+		EnvVar: "BUILDKITE_PIPELINE_UPLOAD_SIGNING_HELPER_KEY_ID",
+	}
+)
+
+// pipelineSigner returns a signer using either the key in the file at keyPath,
+// or a signing helper. It returns nil if neither is configured.
+func pipelineSigner(keyPath, helper, helperAlgorithm, helperKeyID string) (pipeline.Signer, error) {
+	var key *pipeline.Key
+	switch {
+	case keyPath != "" && helper != "":
+		return nil, errors.New("only one of a signing key path or a signing helper can be used")
+
+	case keyPath != "":
+		// The algorithm is determined by the key: PEM and JWK keys use the
+		// matching public-key algorithm, anything else is hmac-sha256.
+		k, err := pipeline.ReadKeyFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+
+	case helper != "":
+		k, err := pipeline.NewSigningHelperKey(helper, helperAlgorithm, helperKeyID)
+		if err != nil {
+			return nil, err
+		}
+		key = k
+
+	default:
+		return nil, nil
+	}
+	return key.Signer()
+}
+
+// parsePipelineDocument reads and parses a pipeline document from the file at
+// path, or from stdin if path is empty. It also returns a name for the source,
+// for use in messages.
+func parsePipelineDocument(l logger.Logger, path string) (*pipeline.Document, string) {
+	var input io.Reader
+	src := path
+
+	switch {
+	case path != "":
+		l.Info("Reading pipeline config from %q", path)
+		file, err := os.Open(path)
+		if err != nil {
+			l.Fatal("Failed to read file: %v", err)
+		}
+		defer file.Close()
+		input = file
+
+	case stdin.IsReadable():
+		l.Info("Reading pipeline config from STDIN")
+		input = os.Stdin
+		src = "(stdin)"
+
+	default:
+		l.Fatal("No pipeline file was given, and nothing was piped to STDIN.")
+	}
+
+	doc, err := pipeline.ParseDocument(input)
+	if err != nil {
+		l.Fatal("Pipeline parsing of %q failed: %v", src, err)
+	}
+	return doc, src
+}
+
+// findDefaultPipelineFile searches the current directory for a pipeline file
+// in one of the default locations, and returns its path.
+func findDefaultPipelineFile(l logger.Logger) string {
+	l.Info("Searching for pipeline config...")
+
+	paths := []string{
+		"buildkite.yml",
+		"buildkite.yaml",
+		"buildkite.json",
+		filepath.FromSlash(".buildkite/pipeline.yml"),
+		filepath.FromSlash(".buildkite/pipeline.yaml"),
+		filepath.FromSlash(".buildkite/pipeline.json"),
+		filepath.FromSlash("buildkite/pipeline.yml"),
+		filepath.FromSlash("buildkite/pipeline.yaml"),
+		filepath.FromSlash("buildkite/pipeline.json"),
+	}
+
+	// Collect all the files that exist
+	exists := []string{}
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			exists = append(exists, path)
+		}
+	}
+
+	// If more than 1 of the config files exist, throw an
+	// error. There can only be one!!
+	if len(exists) > 1 {
+		l.Fatal("Found multiple configuration files: %s. Please only have 1 configuration file present.", strings.Join(exists, ", "))
+	}
+	if len(exists) == 0 {
+		l.Fatal("Could not find a default pipeline configuration file. See `buildkite-agent pipeline upload --help` for more information.")
+	}
+	return exists[0]
+}
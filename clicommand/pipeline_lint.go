@@ -0,0 +1,135 @@
+package clicommand
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/buildkite/agent/v3/internal/pipeline"
+	"github.com/buildkite/agent/v3/internal/stdin"
+	"github.com/urfave/cli"
+)
+
+const pipelineLintHelpDescription = `Usage:
+
+   buildkite-agent pipeline lint [file] [options...]
+
+Description:
+
+   Checks a pipeline file for problems before it is uploaded, such as YAML
+   syntax errors, unknown step types, unknown or misspelled attributes, and
+   attributes with the wrong type of value. Each problem is reported with its
+   line and column in the file. This command doesn't need an agent token or
+   network access.
+
+   The pipeline is checked as written, without variable interpolation.
+
+   If no file is given and nothing is piped to STDIN, the default pipeline
+   file locations are searched, in the same way as ′pipeline upload′.
+
+   The command exits with a non-zero status if any problems are found.
+
+   With ′--format json′, the problems are written to stdout as a JSON array
+   of objects with "file", "line", "column", "path", and "message" fields,
+   for use by editors and other tools.
+
+Example:
+
+   $ buildkite-agent pipeline lint
+   $ buildkite-agent pipeline lint .buildkite/pipeline.yml --format json
+   $ ./script/dynamic_step_generator | buildkite-agent pipeline lint`
+
+type PipelineLintConfig struct {
+	FilePath string `cli:"arg:0" label:"pipeline file"`
+	Format   string `cli:"format"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+// pipelineLintResult is a diagnostic in the JSON output of pipeline lint.
+type pipelineLintResult struct {
+	File string `json:"file"`
+	pipeline.LintDiagnostic
+}
+
+var PipelineLintCommand = cli.Command{
+	Name:        "lint",
+	Usage:       "Checks a pipeline file for problems",
+	Description: pipelineLintHelpDescription,
+	Flags: append(globalFlags(),
+		cli.StringFlag{
+			Name:   "format",
+			Usage:  "The output format, either ′text′ or ′json′",
+			Value:  "text",
+			EnvVar: "BUILDKITE_PIPELINE_LINT_FORMAT",
+		},
+	),
+	Action: func(c *cli.Context) {
+		cfg, l, _, done := setupLoggerAndConfig[PipelineLintConfig](c)
+		defer done()
+
+		if cfg.Format != "text" && cfg.Format != "json" {
+			l.Fatal("Unknown output format %q, expected text or json", cfg.Format)
+		}
+
+		var input io.Reader
+		src := cfg.FilePath
+		switch {
+		case cfg.FilePath != "":
+			l.Info("Reading pipeline config from %q", cfg.FilePath)
+
+		case stdin.IsReadable():
+			l.Info("Reading pipeline config from STDIN")
+			input = os.Stdin
+			src = "(stdin)"
+
+		default:
+			src = findDefaultPipelineFile(l)
+			l.Info("Found config file %q", src)
+		}
+
+		if input == nil {
+			file, err := os.Open(src)
+			if err != nil {
+				l.Fatal("Failed to read file: %v", err)
+			}
+			defer file.Close()
+			input = file
+		}
+
+		diags, err := pipeline.Lint(input)
+		if err != nil {
+			l.Fatal("Couldn't lint pipeline %q: %v", src, err)
+		}
+
+		switch cfg.Format {
+		case "json":
+			results := make([]pipelineLintResult, 0, len(diags))
+			for _, d := range diags {
+				results = append(results, pipelineLintResult{File: src, LintDiagnostic: d})
+			}
+			enc := json.NewEncoder(c.App.Writer)
+			enc.SetIndent("", "  ")
+			if err := enc.Encode(results); err != nil {
+				l.Fatal("Couldn't write lint results: %v", err)
+			}
+
+		default:
+			for _, d := range diags {
+				fmt.Fprintf(c.App.Writer, "%s:%s\n", src, d)
+			}
+		}
+
+		if len(diags) > 0 {
+			l.Error("Found %d problem(s) in %q", len(diags), src)
+			os.Exit(1)
+		}
+		l.Info("No problems found in %q", src)
+	},
+}
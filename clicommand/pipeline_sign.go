@@ -0,0 +1,141 @@
+package clicommand
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+const pipelineSignHelpDescription = `Usage:
+
+   buildkite-agent pipeline sign [file] [options...]
+
+Description:
+
+   Signs every command step in a pipeline file, adding a ′signature′ block to
+   each one. Other than the signatures, the order and content of the pipeline
+   are preserved, so that the signed file can be reviewed and committed. This
+   command doesn't need an agent token or network access.
+
+   By default the file is signed in place. If the pipeline is piped to the
+   command, the signed pipeline is written to STDOUT.
+
+   The pipeline is signed as written, without variable interpolation. If the
+   pipeline contains variables that would be interpolated, upload it with
+   ′buildkite-agent pipeline upload --no-interpolation′, otherwise the
+   interpolated steps will not match their signatures.
+
+Example:
+
+   $ buildkite-agent pipeline sign .buildkite/pipeline.yml --signing-key-path key.pem
+   $ cat pipeline.yml | buildkite-agent pipeline sign --signing-key-path key.pem > signed.yml
+   $ buildkite-agent pipeline sign pipeline.yml --signing-helper kms-sign --signing-helper-algorithm ecdsa-p256-sha256`
+
+type PipelineSignConfig struct {
+	FilePath       string `cli:"arg:0" label:"pipeline file"`
+	SigningKeyPath string `cli:"signing-key-path"`
+	OutputPath     string `cli:"output"`
+
+	SigningHelper          string `cli:"signing-helper"`
+	SigningHelperAlgorithm string `cli:"signing-helper-algorithm"`
+	SigningHelperKeyID     string `cli:"signing-helper-key-id"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var PipelineSignCommand = cli.Command{
+	Name:        "sign",
+	Usage:       "Signs the command steps in a pipeline file, without uploading it",
+	Description: pipelineSignHelpDescription,
+	Flags: append(globalFlags(),
+		cli.StringFlag{
+			Name:   "signing-key-path",
+			Usage:  "Path to a file containing a signing key. The key may be a PEM or JWK private key (Ed25519, ECDSA P-256, or RSA), otherwise the raw file content is used as a shared key for hmac-sha256",
+			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_SIGNING_KEY_PATH",
+		},
+		signingHelperFlag,
+		signingHelperAlgorithmFlag,
+		signingHelperKeyIDFlag,
+		cli.StringFlag{
+			Name:   "output",
+			Usage:  "Where to write the signed pipeline. Defaults to overwriting the input file, or STDOUT if the pipeline was read from STDIN. Use - for STDOUT",
+			EnvVar: "BUILDKITE_PIPELINE_SIGN_OUTPUT",
+		},
+	),
+	Action: func(c *cli.Context) {
+		cfg, l, _, done := setupLoggerAndConfig[PipelineSignConfig](c)
+		defer done()
+
+		doc, src := parsePipelineDocument(l, cfg.FilePath)
+
+		signer, err := pipelineSigner(cfg.SigningKeyPath, cfg.SigningHelper, cfg.SigningHelperAlgorithm, cfg.SigningHelperKeyID)
+		if err != nil {
+			l.Fatal("Couldn't create a pipeline signer: %v", err)
+		}
+		if signer == nil {
+			l.Fatal("One of --signing-key-path or --signing-helper is required")
+		}
+
+		if err := doc.Sign(signer); err != nil {
+			l.Fatal("Couldn't sign pipeline %q: %v", src, err)
+		}
+
+		output := cfg.OutputPath
+		if output == "" {
+			output = cfg.FilePath
+		}
+		if output == "" {
+			output = "-"
+		}
+
+		// JSON in, JSON out. Everything else is written as YAML.
+		formatPath := output
+		if formatPath == "-" {
+			formatPath = cfg.FilePath
+		}
+		var out bytes.Buffer
+		if strings.EqualFold(filepath.Ext(formatPath), ".json") {
+			b, err := json.MarshalIndent(doc, "", "  ")
+			if err != nil {
+				l.Fatal("Couldn't encode the signed pipeline: %v", err)
+			}
+			out.Write(b)
+			out.WriteByte('\n')
+		} else {
+			enc := yaml.NewEncoder(&out)
+			enc.SetIndent(2)
+			if err := enc.Encode(doc); err != nil {
+				l.Fatal("Couldn't encode the signed pipeline: %v", err)
+			}
+			if err := enc.Close(); err != nil {
+				l.Fatal("Couldn't encode the signed pipeline: %v", err)
+			}
+		}
+
+		if output == "-" {
+			if _, err := c.App.Writer.Write(out.Bytes()); err != nil {
+				l.Fatal("Couldn't write the signed pipeline: %v", err)
+			}
+			return
+		}
+
+		perm := os.FileMode(0o644)
+		if fi, err := os.Stat(output); err == nil {
+			perm = fi.Mode().Perm()
+		}
+		if err := os.WriteFile(output, out.Bytes(), perm); err != nil {
+			l.Fatal("Couldn't write the signed pipeline to %q: %v", output, err)
+		}
+		l.Info("Signed pipeline written to %q", output)
+	},
+}
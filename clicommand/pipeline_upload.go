@@ -1,8 +1,10 @@
 package clicommand
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"os"
 	"os/exec"
@@ -13,6 +15,7 @@ import (
 
 	"github.com/buildkite/agent/v3/agent"
 	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/cliconfig"
 	"github.com/buildkite/agent/v3/env"
 	"github.com/buildkite/agent/v3/internal/job/shell"
 	"github.com/buildkite/agent/v3/internal/pipeline"
@@ -45,9 +48,28 @@ Description:
    - buildkite/pipeline.json
 
    You can also pipe build pipelines to the command allowing you to create
-   scripts that generate dynamic pipelines. The configuration file has a
-   limit of 500 steps per file. Configuration files with over 500 steps
-   must be split into multiple files and uploaded in separate steps.
+   scripts that generate dynamic pipelines. Each upload is limited to 500
+   steps, so pipelines with more than 500 steps are automatically split into
+   several uploads, which are made in order. Group steps are never split
+   between uploads. When --replace is used, only the first upload replaces
+   the rest of the existing pipeline.
+
+   A pipeline can include the steps from other files with an include step
+   (for example ′- include: .buildkite/steps/*.yml′), and steps can share
+   configuration by extending named step templates defined under a top-level
+   ′templates′ key (for example ′extends: docker′). Include paths are
+   relative to the including file, and may be glob patterns. Includes and
+   templates are resolved before interpolation and signing, so --dry-run
+   shows the fully expanded pipeline.
+
+   Variables are interpolated into the pipeline from the environment, the
+   pipeline's env block, and optionally a file given with
+   --interpolation-vars-file. As well as ′$VAR′ and ′${VAR:-default}′, a
+   variable can be passed through functions, for example
+   ′${BUILDKITE_BRANCH|slug|substring(0,20)}′. The functions are lowercase,
+   slug, substring(offset[,length]), base64, and json-escape. With
+   --strict-interpolation, the upload fails if the pipeline refers to any
+   variable that isn't defined.
 
 Example:
 
@@ -56,15 +78,21 @@ Example:
    $ ./script/dynamic_step_generator | buildkite-agent pipeline upload`
 
 type PipelineUploadConfig struct {
-	FilePath        string   `cli:"arg:0" label:"upload paths"`
-	Replace         bool     `cli:"replace"`
-	Job             string   `cli:"job"` // required, but not in dry-run mode
-	DryRun          bool     `cli:"dry-run"`
-	DryRunFormat    string   `cli:"format"`
-	NoInterpolation bool     `cli:"no-interpolation"`
-	RedactedVars    []string `cli:"redacted-vars" normalize:"list"`
-	RejectSecrets   bool     `cli:"reject-secrets"`
-	SigningKeyPath  string   `cli:"signing-key-path"`
+	FilePath              string   `cli:"arg:0" label:"upload paths"`
+	Replace               bool     `cli:"replace"`
+	Job                   string   `cli:"job"` // required, but not in dry-run mode
+	DryRun                bool     `cli:"dry-run"`
+	DryRunFormat          string   `cli:"format"`
+	NoInterpolation       bool     `cli:"no-interpolation"`
+	StrictInterpolation   bool     `cli:"strict-interpolation"`
+	InterpolationVarsFile string   `cli:"interpolation-vars-file"`
+	RedactedVars          []string `cli:"redacted-vars" normalize:"list"`
+	RejectSecrets         bool     `cli:"reject-secrets"`
+	SigningKeyPath        string   `cli:"signing-key-path"`
+
+	SigningHelper          string `cli:"signing-helper"`
+	SigningHelperAlgorithm string `cli:"signing-helper-algorithm"`
+	SigningHelperKeyID     string `cli:"signing-helper-key-id"`
 
 	// Global flags
 	Debug       bool     `cli:"debug"`
@@ -103,7 +131,7 @@ var PipelineUploadCommand = cli.Command{
 		},
 		cli.StringFlag{
 			Name:   "format",
-			Usage:  "In dry-run mode, specifies the form to output the pipeline in. Must be one of: json,yaml",
+			Usage:  "In dry-run mode, specifies the form to output the pipeline in. Must be one of: json,yaml,dot,mermaid. The dot and mermaid formats draw the dependency graph of the steps, and fail if any depends_on refers to an unknown key or the dependencies form a cycle",
 			Value:  "json",
 			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_DRY_RUN_FORMAT",
 		},
@@ -112,6 +140,16 @@ var PipelineUploadCommand = cli.Command{
 			Usage:  "Skip variable interpolation the pipeline when uploaded",
 			EnvVar: "BUILDKITE_PIPELINE_NO_INTERPOLATION",
 		},
+		cli.BoolFlag{
+			Name:   "strict-interpolation",
+			Usage:  "Fail the upload if the pipeline refers to a variable that isn't defined (and has no default value)",
+			EnvVar: "BUILDKITE_PIPELINE_STRICT_INTERPOLATION",
+		},
+		cli.StringFlag{
+			Name:   "interpolation-vars-file",
+			Usage:  "Path to a file of extra variables to interpolate into the pipeline, either in dotenv format (KEY=value lines) or, if the path ends in .json, a JSON object. Variables in the environment take precedence over those in the file",
+			EnvVar: "BUILDKITE_PIPELINE_INTERPOLATION_VARS_FILE",
+		},
 		cli.BoolFlag{
 			Name:   "reject-secrets",
 			Usage:  "When true, fail the pipeline upload early if the pipeline contains secrets",
@@ -119,9 +157,12 @@ var PipelineUploadCommand = cli.Command{
 		},
 		cli.StringFlag{
 			Name:   "signing-key-path",
-			Usage:  "Path to a file containing a signing key. Passing this flag enables pipeline signing. For hmac-sha256, the raw file content is used as the shared key",
+			Usage:  "Path to a file containing a signing key. Passing this flag enables pipeline signing. The key may be a PEM or JWK private key (Ed25519, ECDSA P-256, or RSA, for the ed25519, ecdsa-p256-sha256, or rsa-pss-sha256 algorithms), otherwise the raw file content is used as a shared key for hmac-sha256",
 			EnvVar: "BUILDKITE_PIPELINE_UPLOAD_SIGNING_KEY_PATH",
 		},
+		signingHelperFlag,
+		signingHelperAlgorithmFlag,
+		signingHelperKeyIDFlag,
 
 		// API Flags
 		AgentAccessTokenFlag,
@@ -146,11 +187,16 @@ var PipelineUploadCommand = cli.Command{
 		var input *os.File
 		var filename string
 
+		// Relative include paths are resolved against the directory of the
+		// pipeline file, or the current directory for STDIN.
+		includeDir := "."
+
 		switch {
 		case cfg.FilePath != "":
 			l.Info("Reading pipeline config from %q", cfg.FilePath)
 
 			filename = filepath.Base(cfg.FilePath)
+			includeDir = filepath.Dir(cfg.FilePath)
 			file, err := os.Open(cfg.FilePath)
 			if err != nil {
 				l.Fatal("Failed to read file: %v", err)
@@ -165,43 +211,12 @@ var PipelineUploadCommand = cli.Command{
 			input = os.Stdin
 
 		default:
-			l.Info("Searching for pipeline config...")
-
-			paths := []string{
-				"buildkite.yml",
-				"buildkite.yaml",
-				"buildkite.json",
-				filepath.FromSlash(".buildkite/pipeline.yml"),
-				filepath.FromSlash(".buildkite/pipeline.yaml"),
-				filepath.FromSlash(".buildkite/pipeline.json"),
-				filepath.FromSlash("buildkite/pipeline.yml"),
-				filepath.FromSlash("buildkite/pipeline.yaml"),
-				filepath.FromSlash("buildkite/pipeline.json"),
-			}
-
-			// Collect all the files that exist
-			exists := []string{}
-			for _, path := range paths {
-				if _, err := os.Stat(path); err == nil {
-					exists = append(exists, path)
-				}
-			}
-
-			// If more than 1 of the config files exist, throw an
-			// error. There can only be one!!
-			if len(exists) > 1 {
-				l.Fatal("Found multiple configuration files: %s. Please only have 1 configuration file present.", strings.Join(exists, ", "))
-			}
-			if len(exists) == 0 {
-				l.Fatal("Could not find a default pipeline configuration file. See `buildkite-agent pipeline upload --help` for more information.")
-			}
-
-			found := exists[0]
-
+			found := findDefaultPipelineFile(l)
 			l.Info("Found config file %q", found)
 
 			// Read the default file
 			filename = path.Base(found)
+			includeDir = filepath.Dir(found)
 			file, err := os.Open(found)
 			if err != nil {
 				l.Fatal("Failed to read file %q: %v", found, err)
@@ -237,6 +252,18 @@ var PipelineUploadCommand = cli.Command{
 					environ.Set("BUILDKITE_COMMIT", trimmedCmdOut)
 				}
 			}
+
+			if cfg.InterpolationVarsFile != "" {
+				vars, err := loadInterpolationVars(cfg.InterpolationVarsFile)
+				if err != nil {
+					l.Fatal("Couldn't load interpolation variables: %v", err)
+				}
+				for k, v := range vars {
+					if !environ.Exists(k) {
+						environ.Set(k, v)
+					}
+				}
+			}
 		}
 
 		src := filename
@@ -244,13 +271,23 @@ var PipelineUploadCommand = cli.Command{
 			src = "(stdin)"
 		}
 
-		// Parse the pipeline
-		result, err := pipeline.Parse(input)
+		// The source is kept so that dry-run YAML output can follow it.
+		srcBytes, err := io.ReadAll(input)
+		if err != nil {
+			l.Fatal("Couldn't read pipeline %q: %v", src, err)
+		}
+
+		// Parse the pipeline, resolving includes and step templates
+		result, err := pipeline.ParseAndExpand(bytes.NewReader(srcBytes), includeDir)
 		if err != nil {
 			l.Fatal("Pipeline parsing of %q failed: %v", src, err)
 		}
 		if !cfg.NoInterpolation {
-			if err := result.Interpolate(environ); err != nil {
+			interpolate := result.Interpolate
+			if cfg.StrictInterpolation {
+				interpolate = result.InterpolateStrict
+			}
+			if err := interpolate(environ); err != nil {
 				l.Fatal("Pipeline interpolation of %q failed: %v", src, err)
 			}
 		}
@@ -262,24 +299,13 @@ var PipelineUploadCommand = cli.Command{
 			searchForSecrets(l, &cfg, envMap, result, src)
 		}
 
-		if cfg.SigningKeyPath != "" {
+		signer, err := pipelineSigner(cfg.SigningKeyPath, cfg.SigningHelper, cfg.SigningHelperAlgorithm, cfg.SigningHelperKeyID)
+		if err != nil {
+			l.Fatal("Couldn't create a pipeline signer: %v", err)
+		}
+		if signer != nil {
 			l.Warn("Pipeline signing is experimental and the user interface might change! Also it might not work, it might sign the pipeline only partially, or it might eat your pet dog. You have been warned!")
 
-			key, err := os.ReadFile(cfg.SigningKeyPath)
-			if err != nil {
-				l.Fatal("Couldn't read the signing key file: %v", err)
-			}
-
-			// TODO: Let the user choose an algorithm, then parse the key based
-			// on the algorithm, or put key parsing into
-			// pipeline.New{Signer,Verifier}.
-			// For now we only offer hmac-sha256, which takes []byte.
-
-			signer, err := pipeline.NewSigner("hmac-sha256", key)
-			if err != nil {
-				l.Fatal("Couldn't create a pipeline signer: %v", err)
-			}
-
 			if err := result.Sign(signer); err != nil {
 				l.Fatal("Couldn't sign pipeline: %v", err)
 			}
@@ -296,7 +322,18 @@ var PipelineUploadCommand = cli.Command{
 				encode = enc.Encode
 
 			case "yaml":
-				encode = yaml.NewEncoder(os.Stdout).Encode
+				encode = func(any) error { return writeDryRunYAML(os.Stdout, srcBytes, result) }
+
+			case "dot", "mermaid":
+				graph, err := result.Graph()
+				if err != nil {
+					l.Fatal("Pipeline %q has invalid step dependencies: %v", src, err)
+				}
+				write := graph.WriteDOT
+				if cfg.DryRunFormat == "mermaid" {
+					write = graph.WriteMermaid
+				}
+				encode = func(any) error { return write(os.Stdout) }
 
 			default:
 				l.Fatal("Unknown output format %q", cfg.DryRunFormat)
@@ -322,24 +359,102 @@ var PipelineUploadCommand = cli.Command{
 			l.Fatal("Missing agent-access-token parameter. Usually this is set in the environment for a Buildkite job via BUILDKITE_AGENT_ACCESS_TOKEN.")
 		}
 
-		uploader := &agent.PipelineUploader{
-			Client: api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken")),
-			JobID:  cfg.Job,
-			Change: &api.PipelineChange{
-				UUID:     api.NewUUID(),
-				Replace:  cfg.Replace,
-				Pipeline: result,
-			},
-			RetrySleepFunc: time.Sleep,
+		// The API limits the number of steps in each upload, so large
+		// pipelines are uploaded in several parts, in order. Only the first
+		// part replaces the rest of the existing pipeline.
+		parts, err := result.Split(pipeline.MaxStepsPerUpload)
+		if err != nil {
+			l.Fatal("Couldn't split pipeline %q into uploads: %v", src, err)
 		}
-		if err := uploader.Upload(ctx, l); err != nil {
-			l.Fatal("%v", err)
+		if len(parts) > 1 {
+			l.Info("Pipeline %q has more than %d steps, so it will be uploaded in %d parts", src, pipeline.MaxStepsPerUpload, len(parts))
+		}
+
+		client := api.NewClient(l, loadAPIClientConfig(cfg, "AgentAccessToken"))
+		for i, part := range parts {
+			uploader := &agent.PipelineUploader{
+				Client: client,
+				JobID:  cfg.Job,
+				Change: &api.PipelineChange{
+					UUID:     api.NewUUID(),
+					Replace:  cfg.Replace && i == 0,
+					Pipeline: part,
+				},
+				RetrySleepFunc: time.Sleep,
+			}
+			if err := uploader.Upload(ctx, l); err != nil {
+				if len(parts) > 1 {
+					l.Fatal("Uploading part %d of %d: %v", i+1, len(parts), err)
+				}
+				l.Fatal("%v", err)
+			}
+			if len(parts) > 1 {
+				l.Info("Uploaded part %d of %d", i+1, len(parts))
+			}
 		}
 
 		l.Info("Successfully uploaded and parsed pipeline config")
 	},
 }
 
+// writeDryRunYAML writes the pipeline parsed from src (and since expanded,
+// interpolated, and so on) as YAML. Parts of src that are unchanged are
+// written as they were, including comments, anchors and aliases.
+func writeDryRunYAML(w io.Writer, src []byte, result *pipeline.Pipeline) error {
+	doc, err := pipeline.NewDocument(bytes.NewReader(src), result)
+	if err != nil {
+		return err
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// loadInterpolationVars loads variables from a JSON file (if the path ends in
+// .json) or a dotenv file.
+func loadInterpolationVars(path string) (map[string]string, error) {
+	if !strings.EqualFold(filepath.Ext(path), ".json") {
+		f := &cliconfig.File{Path: path}
+		if err := f.Load(); err != nil {
+			return nil, err
+		}
+		return f.Config, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// Numbers are kept as written, rather than going through float64, which
+	// would turn 10000000 into 1e+07.
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var raw map[string]any
+	if err := dec.Decode(&raw); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("parsing %s: unexpected data after the JSON object", path)
+	}
+	vars := make(map[string]string, len(raw))
+	for k, v := range raw {
+		switch v := v.(type) {
+		case string:
+			vars[k] = v
+		case json.Number:
+			vars[k] = v.String()
+		case bool:
+			vars[k] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("parsing %s: value of %q must be a string, number, or boolean", path, k)
+		}
+	}
+	return vars, nil
+}
+
 func searchForSecrets(l logger.Logger, cfg *PipelineUploadConfig, environ map[string]string, result *pipeline.Pipeline, src string) {
 	// Get vars to redact, as both a map and a slice.
 	vars := redact.Vars(shell.StderrLogger, cfg.RedactedVars, environ)
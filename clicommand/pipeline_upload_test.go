@@ -1,8 +1,13 @@
 package clicommand
 
 import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/buildkite/agent/v3/env"
 	"github.com/buildkite/agent/v3/internal/pipeline"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/google/go-cmp/cmp"
@@ -64,3 +69,144 @@ func TestSearchForSecrets(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadInterpolationVars(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc     string
+		filename string
+		contents string
+		want     map[string]string
+		wantErr  bool
+	}{
+		{
+			desc:     "dotenv",
+			filename: "vars.env",
+			contents: "# Deployment settings\nREGION=ap-southeast-2\nGREETING=\"hello world\"\n",
+			want:     map[string]string{"REGION": "ap-southeast-2", "GREETING": "hello world"},
+		},
+		{
+			desc:     "json",
+			filename: "vars.json",
+			contents: `{"REGION": "ap-southeast-2", "REPLICAS": 3, "RATIO": 0.5, "CANARY": true}`,
+			want:     map[string]string{"REGION": "ap-southeast-2", "REPLICAS": "3", "RATIO": "0.5", "CANARY": "true"},
+		},
+		{
+			desc:     "json with large and precise numbers",
+			filename: "vars.json",
+			contents: `{"BIG": 10000000, "HUGE": 12345678901234567890, "PRECISE": 1.10}`,
+			want:     map[string]string{"BIG": "10000000", "HUGE": "12345678901234567890", "PRECISE": "1.10"},
+		},
+		{
+			desc:     "json with trailing data",
+			filename: "vars.json",
+			contents: `{"REGION": "ap-southeast-2"} {}`,
+			wantErr:  true,
+		},
+		{
+			desc:     "json with upper case extension",
+			filename: "VARS.JSON",
+			contents: `{"REGION": "ap-southeast-2"}`,
+			want:     map[string]string{"REGION": "ap-southeast-2"},
+		},
+		{
+			desc:     "malformed json",
+			filename: "vars.json",
+			contents: `{"REGION": "ap-southeast-2",}`,
+			wantErr:  true,
+		},
+		{
+			desc:     "json with an object value",
+			filename: "vars.json",
+			contents: `{"REGION": {"name": "ap-southeast-2"}}`,
+			wantErr:  true,
+		},
+		{
+			desc:     "json with a null value",
+			filename: "vars.json",
+			contents: `{"REGION": null}`,
+			wantErr:  true,
+		},
+		{
+			desc:     "json that isn't an object",
+			filename: "vars.json",
+			contents: `["ap-southeast-2"]`,
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), test.filename)
+			if err := os.WriteFile(path, []byte(test.contents), 0o600); err != nil {
+				t.Fatalf("os.WriteFile(%q) error = %v", path, err)
+			}
+
+			got, err := loadInterpolationVars(path)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("loadInterpolationVars(%q) = %v, want non-nil error", path, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("loadInterpolationVars(%q) error = %v", path, err)
+			}
+			if diff := cmp.Diff(got, test.want); diff != "" {
+				t.Errorf("loadInterpolationVars(%q) diff (-got +want):\n%s", path, diff)
+			}
+		})
+	}
+
+	t.Run("missing file", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(t.TempDir(), "missing.json")
+		if got, err := loadInterpolationVars(path); err == nil {
+			t.Errorf("loadInterpolationVars(%q) = %v, want non-nil error", path, got)
+		}
+	})
+}
+
+func TestWriteDryRunYAML(t *testing.T) {
+	t.Parallel()
+
+	src := `# top comment
+env: &e
+  GREETING: hello
+steps:
+  # say hi
+  - command: echo ${GREETING} ${BIG}
+    env: *e
+  - wait
+`
+	result, err := pipeline.ParseAndExpand(strings.NewReader(src), ".")
+	if err != nil {
+		t.Fatalf("pipeline.ParseAndExpand(src, .) error = %v", err)
+	}
+	if err := result.Interpolate(env.FromMap(map[string]string{"BIG": "10000000"})); err != nil {
+		t.Fatalf("result.Interpolate(env) error = %v", err)
+	}
+
+	var out bytes.Buffer
+	if err := writeDryRunYAML(&out, []byte(src), result); err != nil {
+		t.Fatalf("writeDryRunYAML(out, src, result) error = %v", err)
+	}
+
+	want := `# top comment
+env: &e
+  GREETING: hello
+steps:
+  # say hi
+  - command: echo hello 10000000
+    env: *e
+  - wait
+`
+	if diff := cmp.Diff(out.String(), want); diff != "" {
+		t.Errorf("writeDryRunYAML output diff (-got +want):\n%s", diff)
+	}
+}
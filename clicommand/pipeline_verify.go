@@ -0,0 +1,119 @@
+package clicommand
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/pipeline"
+	"github.com/urfave/cli"
+)
+
+const pipelineVerifyHelpDescription = `Usage:
+
+   buildkite-agent pipeline verify [file] [options...]
+
+Description:
+
+   Verifies the signature of every command step in a pipeline file, and
+   reports the result for each step. This command doesn't need an agent token
+   or network access, so it can be used to check a signed pipeline before it is
+   committed or uploaded.
+
+   The pipeline is verified as written, without variable interpolation.
+
+   The command exits with a non-zero status if any command step is unsigned, or
+   has a signature that can't be verified with the given keys.
+
+Example:
+
+   $ buildkite-agent pipeline verify .buildkite/pipeline.yml --verification-key-path public.pem
+   $ cat pipeline.yml | buildkite-agent pipeline verify --verification-key-path keys/`
+
+type PipelineVerifyConfig struct {
+	FilePath            string `cli:"arg:0" label:"pipeline file"`
+	VerificationKeyPath string `cli:"verification-key-path"`
+
+	VerificationHelper          string `cli:"verification-helper"`
+	VerificationHelperAlgorithm string `cli:"verification-helper-algorithm"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var PipelineVerifyCommand = cli.Command{
+	Name:        "verify",
+	Usage:       "Verifies the signatures of the command steps in a pipeline file",
+	Description: pipelineVerifyHelpDescription,
+	Flags: append(globalFlags(),
+		cli.StringFlag{
+			Name:   "verification-key-path",
+			Usage:  "Path to a file containing a verification key. The key may be a PEM or JWK public key (Ed25519, ECDSA P-256, or RSA), otherwise the raw file content is used as a shared key for hmac-sha256. To trust several keys, this may instead be a JSON Web Key Set file, or a directory of key files",
+			EnvVar: "BUILDKITE_PIPELINE_VERIFICATION_KEY_PATH",
+		},
+		cli.StringFlag{
+			Name:   "verification-helper",
+			Usage:  "A program to verify signatures with, for keys held outside the agent (such as in a KMS). It is run with the argument ′verify′, given the signed data on stdin and the base64-encoded signature in $BUILDKITE_SIGNATURE, and must exit 0 if the signature is valid",
+			EnvVar: "BUILDKITE_PIPELINE_VERIFICATION_HELPER",
+		},
+		cli.StringFlag{
+			Name:   "verification-helper-algorithm",
+			Usage:  "The signing algorithm the verification helper verifies (e.g. ed25519, ecdsa-p256-sha256, rsa-pss-sha256, or hmac-sha256). Required with --verification-helper",
+			EnvVar: "BUILDKITE_PIPELINE_VERIFICATION_HELPER_ALGORITHM",
+		},
+	),
+	Action: func(c *cli.Context) {
+		cfg, l, _, done := setupLoggerAndConfig[PipelineVerifyConfig](c)
+		defer done()
+
+		doc, src := parsePipelineDocument(l, cfg.FilePath)
+
+		keys := &pipeline.KeySet{}
+		if cfg.VerificationKeyPath != "" {
+			ks, err := pipeline.ReadKeySet(cfg.VerificationKeyPath)
+			if err != nil {
+				l.Fatal("Couldn't read the verification key: %v", err)
+			}
+			keys = ks
+		}
+		if cfg.VerificationHelper != "" {
+			key, err := pipeline.NewSigningHelperKey(cfg.VerificationHelper, cfg.VerificationHelperAlgorithm, "")
+			if err != nil {
+				l.Fatal("Couldn't use the verification helper: %v", err)
+			}
+			keys.Keys = append(keys.Keys, key)
+		}
+		if len(keys.Keys) == 0 {
+			l.Fatal("One of --verification-key-path or --verification-helper is required")
+		}
+
+		results, err := doc.Verify(keys, time.Now())
+		if err != nil {
+			l.Fatal("Couldn't verify pipeline %q: %v", src, err)
+		}
+
+		failed := 0
+		for _, res := range results {
+			if res.Err != nil {
+				failed++
+				fmt.Fprintf(c.App.Writer, "❌ %s (%s): %v\n", res.Path, res.Description, res.Err)
+				continue
+			}
+			if res.Key.ID != "" {
+				fmt.Fprintf(c.App.Writer, "✅ %s (%s): verified using key %q\n", res.Path, res.Description, res.Key.ID)
+			} else {
+				fmt.Fprintf(c.App.Writer, "✅ %s (%s): verified\n", res.Path, res.Description)
+			}
+		}
+
+		if failed > 0 {
+			l.Error("%d of %d command steps in %q failed verification", failed, len(results), src)
+			os.Exit(1)
+		}
+		l.Info("All %d command steps in %q were verified", len(results), src)
+	},
+}
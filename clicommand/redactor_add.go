@@ -0,0 +1,131 @@
+package clicommand
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/buildkite/agent/v3/jobapi"
+	"github.com/urfave/cli"
+)
+
+const redactorAddHelpDescription = `Usage:
+
+   buildkite-agent redactor add [values...]
+
+Description:
+   Adds values to redact from the job log. All subsequent output from the
+   job (including the hook or command that runs this) has each value replaced
+   with [REDACTED].
+
+   This is useful for secrets fetched during a job that aren't stored in
+   environment variables matching the ′redacted-vars′ patterns.
+
+   If no values are given as arguments, they are read from standard input:
+   with ′--format=none′ (the default) the whole input is one value, and with
+   ′--format=json′ the input must be a JSON object, and each of its string
+   values is redacted.
+
+   Note that this subcommand is only available from within the job executor with
+   the ′job-api′ experiment enabled.
+
+Examples:
+   Redacting a secret fetched from a secrets manager:
+
+   $ vault kv get -field=password secret/db | buildkite-agent redactor add
+
+   Redacting every field of a JSON secret:
+
+   $ vault kv get -format=json -field=data secret/db | buildkite-agent redactor add --format=json
+`
+
+type RedactorAddConfig struct {
+	Format string `cli:"format"`
+
+	// Global flags
+	Debug       bool     `cli:"debug"`
+	LogLevel    string   `cli:"log-level"`
+	NoColor     bool     `cli:"no-color"`
+	Experiments []string `cli:"experiment" normalize:"list"`
+	Profile     string   `cli:"profile"`
+}
+
+var RedactorAddCommand = cli.Command{
+	Name:        "add",
+	Usage:       "Adds values to redact from the job log",
+	Description: redactorAddHelpDescription,
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:   "format",
+			Usage:  "Format of values read from standard input: none or json",
+			EnvVar: "BUILDKITE_AGENT_REDACTOR_ADD_FORMAT",
+			Value:  "none",
+		},
+
+		// Global flags
+		NoColorFlag,
+		DebugFlag,
+		LogLevelFlag,
+		ExperimentsFlag,
+		ProfileFlag,
+	},
+	Action: func(c *cli.Context) error {
+		ctx := context.Background()
+		cfg, l, _, done := setupLoggerAndConfig[RedactorAddConfig](c)
+		defer done()
+
+		values := []string(c.Args())
+		if len(values) == 0 {
+			// TODO: replace with c.App.Reader (or something like that) when we upgrade to urfave/cli v3
+			input, err := io.ReadAll(os.Stdin)
+			if err != nil {
+				l.Fatal("Couldn't read from standard input: %v", err)
+			}
+			values, err = parseRedactions(cfg.Format, input)
+			if err != nil {
+				l.Fatal("Couldn't parse standard input: %v", err)
+			}
+		}
+
+		client, err := jobapi.NewDefaultClient(ctx)
+		if err != nil {
+			l.Fatal(envClientErrMessage, err)
+		}
+
+		n, err := client.RedactionCreate(ctx, values)
+		if err != nil {
+			l.Fatal("Couldn't add values to redact: %v", err)
+		}
+		l.Info("Added %d values to redact", n)
+
+		return nil
+	},
+}
+
+// parseRedactions parses values to redact read from standard input.
+func parseRedactions(format string, input []byte) ([]string, error) {
+	switch format {
+	case "none":
+		// A trailing newline is almost certainly not part of the secret.
+		return []string{strings.TrimRight(string(input), "\r\n")}, nil
+
+	case "json":
+		var obj map[string]any
+		if err := json.Unmarshal(input, &obj); err != nil {
+			return nil, err
+		}
+		values := make([]string, 0, len(obj))
+		for _, v := range obj {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values, nil
+
+	default:
+		return nil, fmt.Errorf("invalid format %q", format)
+	}
+}
@@ -2,14 +2,19 @@ package agentapi
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/http"
 	"net/url"
 	"time"
 
 	"github.com/buildkite/agent/v3/internal/socket"
 )
 
-const lockAPIPrefix = "http://agent/api/leader/v0/lock/"
+const (
+	lockAPIPrefix = "http://agent/api/leader/v0/lock/"
+	kvAPIPrefix   = "http://agent/api/leader/v0/kv/"
+)
 
 // Client is a client for the agent API socket.
 type Client struct {
@@ -67,3 +72,111 @@ func (c *Client) LockCompareAndSwap(ctx context.Context, key, old, new string) (
 	}
 	return resp.Value, resp.Swapped, nil
 }
+
+// LockAcquire acquires a lease on the lock, waiting until a slot is free or
+// ctx is done. It returns when the lease expires (zero if it has no TTL).
+func (c *Client) LockAcquire(ctx context.Context, key string, req *LockAcquireRequest) (time.Time, error) {
+	uk := "?key=" + url.QueryEscape(key)
+
+	var resp LockLeaseResponse
+	if err := c.sc.Do(ctx, "POST", lockAPIPrefix+"acquire"+uk, req, &resp); err != nil {
+		return time.Time{}, err
+	}
+	return resp.Expires, nil
+}
+
+// LockRenew extends the lease on the lock held by token, by the given TTL (or
+// if zero, by the TTL it was acquired with). It returns when the lease now
+// expires.
+func (c *Client) LockRenew(ctx context.Context, key, token string, ttl time.Duration) (time.Time, error) {
+	uk := "?key=" + url.QueryEscape(key)
+
+	req := LockRenewRequest{
+		Token: token,
+		TTL:   ttl,
+	}
+	var resp LockLeaseResponse
+	if err := c.sc.Do(ctx, "POST", lockAPIPrefix+"renew"+uk, &req, &resp); err != nil {
+		return time.Time{}, err
+	}
+	return resp.Expires, nil
+}
+
+// LockRelease releases the lease on the lock held by token. It reports
+// whether there was a lease to release.
+func (c *Client) LockRelease(ctx context.Context, key, token string) (bool, error) {
+	uk := "?key=" + url.QueryEscape(key)
+
+	req := LockReleaseRequest{Token: token}
+	var resp LockReleaseResponse
+	if err := c.sc.Do(ctx, "POST", lockAPIPrefix+"release"+uk, &req, &resp); err != nil {
+		return false, err
+	}
+	return resp.Released, nil
+}
+
+// LockDelete forcibly deletes the lock, whatever its value or whoever holds
+// it. It reports whether the lock was in use.
+func (c *Client) LockDelete(ctx context.Context, key string) (bool, error) {
+	uk := "?key=" + url.QueryEscape(key)
+
+	var resp LockDeleteResponse
+	if err := c.sc.Do(ctx, "DELETE", lockAPIPrefix+uk, nil, &resp); err != nil {
+		return false, err
+	}
+	return resp.Deleted, nil
+}
+
+// LockList lists every lock in use, sorted by key.
+func (c *Client) LockList(ctx context.Context) ([]LockInfo, error) {
+	var resp LockListResponse
+	if err := c.sc.Do(ctx, "GET", lockAPIPrefix+"list", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Locks, nil
+}
+
+// KVGet gets a value from the host-local key/value store. It reports false if
+// there is no value for the key (or it has expired).
+func (c *Client) KVGet(ctx context.Context, key string) (string, bool, error) {
+	uk := "?key=" + url.QueryEscape(key)
+
+	var resp KVGetResponse
+	if err := c.sc.Do(ctx, "GET", kvAPIPrefix+uk, nil, &resp); err != nil {
+		var apiErr socket.APIErr
+		if errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return resp.Value, true, nil
+}
+
+// KVSet sets a value in the host-local key/value store. If ttl is not zero,
+// the value expires after that long. It returns when the value expires (zero
+// if it doesn't).
+func (c *Client) KVSet(ctx context.Context, key, value string, ttl time.Duration) (time.Time, error) {
+	uk := "?key=" + url.QueryEscape(key)
+
+	req := KVSetRequest{
+		Value: value,
+		TTL:   ttl,
+	}
+	var resp KVSetResponse
+	if err := c.sc.Do(ctx, "PUT", kvAPIPrefix+uk, &req, &resp); err != nil {
+		return time.Time{}, err
+	}
+	return resp.Expires, nil
+}
+
+// KVDelete deletes a value from the host-local key/value store. It reports
+// whether there was a value to delete.
+func (c *Client) KVDelete(ctx context.Context, key string) (bool, error) {
+	uk := "?key=" + url.QueryEscape(key)
+
+	var resp KVDeleteResponse
+	if err := c.sc.Do(ctx, "DELETE", kvAPIPrefix+uk, nil, &resp); err != nil {
+		return false, err
+	}
+	return resp.Deleted, nil
+}
@@ -2,14 +2,19 @@ package agentapi
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"runtime"
 	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/buildkite/agent/v3/internal/socket"
 	"github.com/buildkite/agent/v3/logger"
+	"github.com/google/go-cmp/cmp"
 )
 
 var testSocketCounter uint32
@@ -110,3 +115,431 @@ func TestLockOperations(t *testing.T) {
 		t.Errorf("cli.LockGet(ctx, %q) = %q, want %q", key, got, want)
 	}
 }
+
+func TestLockSemaphore(t *testing.T) {
+	t.Parallel()
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	svr, cli := testServerAndClient(t, ctx)
+	t.Cleanup(func() { svr.Close() })
+
+	const key = "llamas"
+
+	// Two holders can hold the lock at once.
+	for _, token := range []string{"Kuzco", "Pacha"} {
+		req := &LockAcquireRequest{Token: token, Slots: 2}
+		if _, err := cli.LockAcquire(ctx, key, req); err != nil {
+			t.Fatalf("cli.LockAcquire(ctx, %q, %+v) = error %v", key, req, err)
+		}
+	}
+
+	if got, want := mustLockGet(t, ctx, cli, key), "Kuzco,Pacha"; got != want {
+		t.Errorf("cli.LockGet(ctx, %q) = %q, want %q", key, got, want)
+	}
+
+	// Disagreeing about the number of slots is an error.
+	req := &LockAcquireRequest{Token: "Yzma", Slots: 3}
+	_, err := cli.LockAcquire(ctx, key, req)
+	if apiErr := new(socket.APIErr); !errors.As(err, apiErr) || apiErr.StatusCode != 409 {
+		t.Errorf("cli.LockAcquire(ctx, %q, %+v) error = %v, want API status 409", key, req, err)
+	}
+
+	// A third has to wait until one is released.
+	acquired := make(chan error)
+	go func() {
+		_, err := cli.LockAcquire(ctx, key, &LockAcquireRequest{Token: "Kronk", Slots: 2})
+		acquired <- err
+	}()
+
+	select {
+	case err := <-acquired:
+		t.Fatalf("cli.LockAcquire(ctx, %q, Kronk) = %v before a slot was released", key, err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	released, err := cli.LockRelease(ctx, key, "Kuzco")
+	if err != nil || !released {
+		t.Errorf("cli.LockRelease(ctx, %q, Kuzco) = (%t, %v), want (true, nil)", key, released, err)
+	}
+	if err := <-acquired; err != nil {
+		t.Errorf("cli.LockAcquire(ctx, %q, Kronk) = error %v", key, err)
+	}
+
+	// Releasing again does nothing.
+	released, err = cli.LockRelease(ctx, key, "Kuzco")
+	if err != nil || released {
+		t.Errorf("cli.LockRelease(ctx, %q, Kuzco) = (%t, %v), want (false, nil)", key, released, err)
+	}
+
+	// A key used as a semaphore can't be swapped.
+	if _, ok, err := cli.LockCompareAndSwap(ctx, key, "", "Yzma"); err != nil || ok {
+		t.Errorf("cli.LockCompareAndSwap(ctx, %q, \"\", Yzma) = (_, %t, %v), want (_, false, nil)", key, ok, err)
+	}
+}
+
+func TestLockTTL(t *testing.T) {
+	t.Parallel()
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	svr, cli := testServerAndClient(t, ctx)
+	t.Cleanup(func() { svr.Close() })
+
+	const key, ttl = "llama", 200 * time.Millisecond
+
+	req := &LockAcquireRequest{Token: "Kuzco", TTL: ttl}
+	expires, err := cli.LockAcquire(ctx, key, req)
+	if err != nil {
+		t.Fatalf("cli.LockAcquire(ctx, %q, %+v) = error %v", key, req, err)
+	}
+	if expires.IsZero() {
+		t.Errorf("cli.LockAcquire(ctx, %q, %+v) = %v, want non-zero expiry", key, req, expires)
+	}
+
+	// Renewing keeps the lease past its original expiry.
+	time.Sleep(ttl / 2)
+	if _, err := cli.LockRenew(ctx, key, "Kuzco", 0); err != nil {
+		t.Errorf("cli.LockRenew(ctx, %q, Kuzco, 0) = error %v", key, err)
+	}
+	time.Sleep(ttl / 2)
+	if got, want := mustLockGet(t, ctx, cli, key), "Kuzco"; got != want {
+		t.Errorf("cli.LockGet(ctx, %q) = %q, want %q", key, got, want)
+	}
+
+	// Without renewal, the lease expires, letting another holder acquire it.
+	start := time.Now()
+	if _, err := cli.LockAcquire(ctx, key, &LockAcquireRequest{Token: "Pacha"}); err != nil {
+		t.Fatalf("cli.LockAcquire(ctx, %q, Pacha) = error %v", key, err)
+	}
+	if waited := time.Since(start); waited > time.Second {
+		t.Errorf("cli.LockAcquire(ctx, %q, Pacha) waited %v, want less than 1s", key, waited)
+	}
+
+	// The expired lease can't be renewed.
+	_, err = cli.LockRenew(ctx, key, "Kuzco", 0)
+	if apiErr := new(socket.APIErr); !errors.As(err, apiErr) || apiErr.StatusCode != 404 {
+		t.Errorf("cli.LockRenew(ctx, %q, Kuzco, 0) error = %v, want API status 404", key, err)
+	}
+}
+
+func TestLockHolderProcessExits(t *testing.T) {
+	t.Parallel()
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	svr, cli := testServerAndClient(t, ctx)
+	t.Cleanup(func() { svr.Close() })
+
+	// Run the test binary without any tests, to get the ID of a process that
+	// has exited.
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	if err := cmd.Run(); err != nil {
+		t.Fatalf("cmd.Run() = %v", err)
+	}
+	pid := cmd.Process.Pid
+
+	const key = "llama"
+	req := &LockAcquireRequest{Token: "Kuzco", PID: pid}
+	if _, err := cli.LockAcquire(ctx, key, req); err != nil {
+		t.Fatalf("cli.LockAcquire(ctx, %q, %+v) = error %v", key, req, err)
+	}
+
+	// The holder has exited, so the lock is free.
+	if _, err := cli.LockAcquire(ctx, key, &LockAcquireRequest{Token: "Pacha", PID: os.Getpid()}); err != nil {
+		t.Fatalf("cli.LockAcquire(ctx, %q, Pacha) = error %v", key, err)
+	}
+	if got, want := mustLockGet(t, ctx, cli, key), "Pacha"; got != want {
+		t.Errorf("cli.LockGet(ctx, %q) = %q, want %q", key, got, want)
+	}
+}
+
+func TestLockAcquireStopsWithServer(t *testing.T) {
+	t.Parallel()
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	svr, cli := testServerAndClient(t, ctx)
+
+	const key = "llama"
+	if _, err := cli.LockAcquire(ctx, key, &LockAcquireRequest{Token: "Kuzco"}); err != nil {
+		t.Fatalf("cli.LockAcquire(ctx, %q, Kuzco) = error %v", key, err)
+	}
+
+	acquired := make(chan error)
+	go func() {
+		_, err := cli.LockAcquire(ctx, key, &LockAcquireRequest{Token: "Pacha"})
+		acquired <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	if err := svr.Shutdown(ctx); err != nil {
+		t.Errorf("svr.Shutdown(ctx) = %v", err)
+	}
+	if err := <-acquired; err == nil {
+		t.Errorf("cli.LockAcquire(ctx, %q, Pacha) = nil, want non-nil error", key)
+	}
+}
+
+func mustLockGet(t *testing.T, ctx context.Context, cli *Client, key string) string {
+	t.Helper()
+	got, err := cli.LockGet(ctx, key)
+	if err != nil {
+		t.Fatalf("cli.LockGet(ctx, %q) = error %v", key, err)
+	}
+	return got
+}
+
+func TestPersistLocks(t *testing.T) {
+	t.Parallel()
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	statePath := filepath.Join(t.TempDir(), "agent-leader-state")
+
+	// The first leader does some work once, and holds a lock.
+	svr, cli := testServerAndClient(t, ctx)
+	if err := svr.PersistLocks(statePath); err != nil {
+		t.Fatalf("svr.PersistLocks(%q) = %v", statePath, err)
+	}
+	if _, ok, err := cli.LockCompareAndSwap(ctx, "once", "", "done"); err != nil || !ok {
+		t.Fatalf("cli.LockCompareAndSwap(ctx, once, \"\", done) = (_, %t, %v), want (_, true, nil)", ok, err)
+	}
+	for _, token := range []string{"Kuzco", "Pacha"} {
+		if _, err := cli.LockAcquire(ctx, "llama", &LockAcquireRequest{Token: token, Slots: 2}); err != nil {
+			t.Fatalf("cli.LockAcquire(ctx, llama, %q) = error %v", token, err)
+		}
+	}
+	if _, err := cli.LockRelease(ctx, "llama", "Kuzco"); err != nil {
+		t.Fatalf("cli.LockRelease(ctx, llama, Kuzco) = error %v", err)
+	}
+	if err := svr.Close(); err != nil {
+		t.Fatalf("svr.Close() = %v", err)
+	}
+
+	// A partial line, as if the leader had crashed while writing, is skipped.
+	f, err := os.OpenFile(statePath, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatalf("os.OpenFile(%q) error = %v", statePath, err)
+	}
+	if _, err := f.WriteString(`{"op":"set","key":"on`); err != nil {
+		t.Fatalf("f.WriteString(partial line) error = %v", err)
+	}
+	f.Close()
+
+	// The next leader carries on where the first left off.
+	svr, cli = testServerAndClient(t, ctx)
+	t.Cleanup(func() { svr.Close() })
+	if err := svr.PersistLocks(statePath); err != nil {
+		t.Fatalf("svr.PersistLocks(%q) = %v", statePath, err)
+	}
+
+	if got, want := mustLockGet(t, ctx, cli, "once"), "done"; got != want {
+		t.Errorf("cli.LockGet(ctx, once) = %q, want %q", got, want)
+	}
+	if got, want := mustLockGet(t, ctx, cli, "llama"), "Pacha"; got != want {
+		t.Errorf("cli.LockGet(ctx, llama) = %q, want %q", got, want)
+	}
+	released, err := cli.LockRelease(ctx, "llama", "Pacha")
+	if err != nil || !released {
+		t.Errorf("cli.LockRelease(ctx, llama, Pacha) = (%t, %v), want (true, nil)", released, err)
+	}
+}
+
+func TestPersistLocksWhenCompactionFails(t *testing.T) {
+	t.Parallel()
+	if runtime.GOOS == "windows" || os.Geteuid() == 0 {
+		t.Skip("needs a directory that can't be written to")
+	}
+
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "agent-leader-state")
+	s := newLockState()
+	if err := s.persist(statePath, logger.Discard); err != nil {
+		t.Fatalf("s.persist(%q, logger) = %v", statePath, err)
+	}
+	t.Cleanup(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.closeJournal()
+	})
+
+	// Compaction writes a new journal in the same directory, so it fails.
+	if err := os.Chmod(dir, 0o500); err != nil {
+		t.Fatalf("os.Chmod(%q, 0o500) = %v", dir, err)
+	}
+	t.Cleanup(func() { os.Chmod(dir, 0o700) })
+
+	// The changes are appended to the existing journal instead.
+	old := ""
+	for _, value := range []string{"do", "done"} {
+		s.mu.Lock()
+		s.journal.entries = journalCompactThreshold
+		s.mu.Unlock()
+		if _, ok := s.cas("once", old, value); !ok {
+			t.Fatalf("s.cas(once, %q, %q) = (_, false), want (_, true)", old, value)
+		}
+		old = value
+	}
+	if got, want := journalValue(t, statePath, "once"), "done"; got != want {
+		t.Errorf("once in journal = %q, want %q", got, want)
+	}
+
+	// Once the directory is writable again, compaction succeeds.
+	if err := os.Chmod(dir, 0o700); err != nil {
+		t.Fatalf("os.Chmod(%q, 0o700) = %v", dir, err)
+	}
+	s.mu.Lock()
+	s.journal.entries = journalCompactThreshold
+	s.mu.Unlock()
+	if _, ok := s.cas("other", "", "value"); !ok {
+		t.Fatalf("s.cas(other, \"\", value) = (_, false), want (_, true)")
+	}
+	entries, err := readJournal(statePath, logger.Discard)
+	if err != nil {
+		t.Fatalf("readJournal(%q, logger) error = %v", statePath, err)
+	}
+	want := []journalEntry{
+		{Op: journalSet, Key: "once", Value: "done"},
+		{Op: journalSet, Key: "other", Value: "value"},
+	}
+	if diff := cmp.Diff(entries, want); diff != "" {
+		t.Errorf("compacted journal diff (-got +want):\n%s", diff)
+	}
+}
+
+// journalValue replays the journal at path, and returns the value of key.
+func journalValue(t *testing.T, path, key string) string {
+	t.Helper()
+	entries, err := readJournal(path, logger.Discard)
+	if err != nil {
+		t.Fatalf("readJournal(%q, logger) error = %v", path, err)
+	}
+	s := newLockState()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range entries {
+		s.replay(e)
+	}
+	return s.locks[key]
+}
+
+func TestLockListAndDelete(t *testing.T) {
+	t.Parallel()
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	svr, cli := testServerAndClient(t, ctx)
+	t.Cleanup(func() { svr.Close() })
+
+	if _, _, err := cli.LockCompareAndSwap(ctx, "once", "", "done"); err != nil {
+		t.Fatalf("cli.LockCompareAndSwap(ctx, once, \"\", done) = error %v", err)
+	}
+	req := &LockAcquireRequest{
+		Token:     "Kuzco",
+		Slots:     2,
+		JobID:     "job-1",
+		AgentName: "agent-1",
+	}
+	if _, err := cli.LockAcquire(ctx, "llama", req); err != nil {
+		t.Fatalf("cli.LockAcquire(ctx, llama, %+v) = error %v", req, err)
+	}
+
+	locks, err := cli.LockList(ctx)
+	if err != nil {
+		t.Fatalf("cli.LockList(ctx) = error %v", err)
+	}
+	if len(locks) != 2 || len(locks[0].Holders) != 1 {
+		t.Fatalf("cli.LockList(ctx) = %+v, want 2 locks, the first with 1 holder", locks)
+	}
+	if got := locks[0].Holders[0].AcquiredAt; got.IsZero() {
+		t.Errorf("cli.LockList(ctx)[0].Holders[0].AcquiredAt = %v, want non-zero", got)
+	}
+	locks[0].Holders[0].AcquiredAt = time.Time{}
+	want := []LockInfo{
+		{
+			Key:   "llama",
+			Slots: 2,
+			Holders: []LockHolder{{
+				Token:     "Kuzco",
+				JobID:     "job-1",
+				AgentName: "agent-1",
+			}},
+		},
+		{Key: "once", Value: "done"},
+	}
+	if diff := cmp.Diff(locks, want); diff != "" {
+		t.Errorf("cli.LockList(ctx) diff (-got +want):\n%s", diff)
+	}
+
+	// Deleting releases the lock whatever it is.
+	for _, key := range []string{"llama", "once"} {
+		deleted, err := cli.LockDelete(ctx, key)
+		if err != nil || !deleted {
+			t.Errorf("cli.LockDelete(ctx, %q) = (%t, %v), want (true, nil)", key, deleted, err)
+		}
+		deleted, err = cli.LockDelete(ctx, key)
+		if err != nil || deleted {
+			t.Errorf("cli.LockDelete(ctx, %q) = (%t, %v), want (false, nil)", key, deleted, err)
+		}
+	}
+
+	locks, err = cli.LockList(ctx)
+	if err != nil {
+		t.Fatalf("cli.LockList(ctx) = error %v", err)
+	}
+	if len(locks) != 0 {
+		t.Errorf("cli.LockList(ctx) = %+v, want no locks", locks)
+	}
+}
+
+func TestKV(t *testing.T) {
+	t.Parallel()
+	ctx, canc := context.WithTimeout(context.Background(), 10*time.Second)
+	t.Cleanup(canc)
+
+	svr, cli := testServerAndClient(t, ctx)
+	t.Cleanup(func() { svr.Close() })
+
+	const key = "go-version"
+
+	if got, ok, err := cli.KVGet(ctx, key); err != nil || ok {
+		t.Errorf("cli.KVGet(ctx, %q) = (%q, %t, %v), want (\"\", false, nil)", key, got, ok, err)
+	}
+
+	if _, err := cli.KVSet(ctx, key, "go1.21.0", 0); err != nil {
+		t.Fatalf("cli.KVSet(ctx, %q, go1.21.0, 0) = error %v", key, err)
+	}
+	if got, ok, err := cli.KVGet(ctx, key); err != nil || !ok || got != "go1.21.0" {
+		t.Errorf("cli.KVGet(ctx, %q) = (%q, %t, %v), want (go1.21.0, true, nil)", key, got, ok, err)
+	}
+
+	deleted, err := cli.KVDelete(ctx, key)
+	if err != nil || !deleted {
+		t.Errorf("cli.KVDelete(ctx, %q) = (%t, %v), want (true, nil)", key, deleted, err)
+	}
+	if got, ok, err := cli.KVGet(ctx, key); err != nil || ok {
+		t.Errorf("cli.KVGet(ctx, %q) = (%q, %t, %v), want (\"\", false, nil)", key, got, ok, err)
+	}
+	deleted, err = cli.KVDelete(ctx, key)
+	if err != nil || deleted {
+		t.Errorf("cli.KVDelete(ctx, %q) = (%t, %v), want (false, nil)", key, deleted, err)
+	}
+
+	// Values with a TTL expire.
+	const ttl = 100 * time.Millisecond
+	expires, err := cli.KVSet(ctx, key, "go1.21.1", ttl)
+	if err != nil {
+		t.Fatalf("cli.KVSet(ctx, %q, go1.21.1, %v) = error %v", key, ttl, err)
+	}
+	if expires.IsZero() {
+		t.Errorf("cli.KVSet(ctx, %q, go1.21.1, %v) = %v, want non-zero expiry", key, ttl, expires)
+	}
+	if _, ok, err := cli.KVGet(ctx, key); err != nil || !ok {
+		t.Errorf("cli.KVGet(ctx, %q) = (_, %t, %v), want (_, true, nil)", key, ok, err)
+	}
+	time.Sleep(ttl)
+	if got, ok, err := cli.KVGet(ctx, key); err != nil || ok {
+		t.Errorf("cli.KVGet(ctx, %q) = (%q, %t, %v), want (\"\", false, nil)", key, got, ok, err)
+	}
+}
@@ -0,0 +1,150 @@
+package agentapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/socket"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/go-chi/chi/v5"
+)
+
+// kvMaxValueSize is the largest value that can be stored. The store is
+// intended for small values, like versions and digests.
+const kvMaxValueSize = 1 << 20
+
+// kvServer serves a key/value store shared by jobs on the host.
+type kvServer struct {
+	logger logger.Logger
+
+	mu      sync.Mutex
+	entries map[string]kvEntry
+}
+
+// kvEntry is a value in the store.
+type kvEntry struct {
+	value string
+
+	// expires is zero if the value doesn't expire.
+	expires time.Time
+}
+
+func (e kvEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// newKVServer creates a kvServer with an empty store.
+func newKVServer(logger logger.Logger) *kvServer {
+	return &kvServer{
+		logger:  logger,
+		entries: make(map[string]kvEntry),
+	}
+}
+
+// routes defines routes for the kvServer.
+func (s *kvServer) routes(r chi.Router) {
+	r.Get("/", s.getValue)
+	r.Put("/", s.putValue)
+	r.Delete("/", s.deleteValue)
+}
+
+// getValue retrieves a value that hasn't expired.
+func (s *kvServer) getValue(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		s.writeError(w, "key missing", http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	e, ok := s.entries[key]
+	if ok && e.expired(time.Now()) {
+		delete(s.entries, key)
+		ok = false
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		s.writeError(w, fmt.Sprintf("key %q not found", key), http.StatusNotFound)
+		return
+	}
+	s.writeResponse(w, &KVGetResponse{
+		Value:   e.value,
+		Expires: e.expires,
+	})
+}
+
+// putValue stores a value.
+func (s *kvServer) putValue(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		s.writeError(w, "key missing", http.StatusNotFound)
+		return
+	}
+
+	var req KVSetRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 2*kvMaxValueSize)).Decode(&req); err != nil {
+		s.writeError(w, fmt.Sprintf("couldn't decode request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(req.Value) > kvMaxValueSize {
+		s.writeError(w, fmt.Sprintf("value is %d bytes, but the maximum is %d bytes", len(req.Value), kvMaxValueSize), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if req.TTL < 0 {
+		s.writeError(w, "ttl must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	e := kvEntry{value: req.Value}
+	if req.TTL > 0 {
+		e.expires = now.Add(req.TTL)
+	}
+
+	s.mu.Lock()
+	// Nothing else removes expired values that are never read, so sweep them
+	// up here.
+	for k, old := range s.entries {
+		if old.expired(now) {
+			delete(s.entries, k)
+		}
+	}
+	s.entries[key] = e
+	s.mu.Unlock()
+
+	s.writeResponse(w, &KVSetResponse{Expires: e.expires})
+}
+
+// deleteValue removes a value.
+func (s *kvServer) deleteValue(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		s.writeError(w, "key missing", http.StatusNotFound)
+		return
+	}
+
+	s.mu.Lock()
+	e, ok := s.entries[key]
+	delete(s.entries, key)
+	s.mu.Unlock()
+
+	s.writeResponse(w, &KVDeleteResponse{
+		Deleted: ok && !e.expired(time.Now()),
+	})
+}
+
+func (s *kvServer) writeResponse(w http.ResponseWriter, resp any) {
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.logger.Error("Agent API: couldn't encode response body: %v", err)
+	}
+}
+
+func (s *kvServer) writeError(w http.ResponseWriter, msg string, code int) {
+	if err := socket.WriteError(w, msg, code); err != nil {
+		s.logger.Error("Agent API: couldn't write error: %v", err)
+	}
+}
@@ -0,0 +1,309 @@
+package agentapi
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+)
+
+// journalCompactThreshold is how many entries can be appended to the journal
+// before it is rewritten to contain only the current state.
+const journalCompactThreshold = 1000
+
+// Journal entry operations.
+const (
+	journalSet     = "set"
+	journalLease   = "lease"
+	journalRelease = "release"
+)
+
+// journalEntry is one line of the lock state journal. Each entry records a
+// change to the state of one key.
+type journalEntry struct {
+	Op  string `json:"op"`
+	Key string `json:"key"`
+
+	// Value is the new value for a set. An empty value deletes the key.
+	Value string `json:"value,omitempty"`
+
+	// Lease fields, for lease (acquired or renewed) and release.
+	Token   string        `json:"token,omitempty"`
+	Slots   int           `json:"slots,omitempty"`
+	TTL     time.Duration `json:"ttl,omitempty"`
+	PID     int           `json:"pid,omitempty"`
+	Expires time.Time     `json:"expires"`
+
+	// Holder information, for lease.
+	JobID      string    `json:"job_id,omitempty"`
+	AgentName  string    `json:"agent_name,omitempty"`
+	AcquiredAt time.Time `json:"acquired_at"`
+}
+
+// lockJournal is an append-only file of changes to the lock state.
+type lockJournal struct {
+	path    string
+	logger  logger.Logger
+	f       *os.File
+	entries int // appended since the last compaction
+}
+
+// persist loads the state from the journal at path (if it exists), replacing
+// the current state, and records all subsequent changes to it.
+func (s *lockState) persist(path string, logger logger.Logger) error {
+	entries, err := readJournal(path, logger)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closeJournal()
+	for _, sem := range s.sems {
+		for _, l := range sem.leases {
+			if l.timer != nil {
+				l.timer.Stop()
+			}
+		}
+	}
+	s.locks = make(map[string]string)
+	s.sems = make(map[string]*semaphore)
+
+	for _, e := range entries {
+		s.replay(e)
+	}
+	// Leases may have expired, or their holders exited, while nothing was
+	// watching.
+	for key := range s.sems {
+		s.prune(key)
+	}
+	s.notify()
+
+	s.journal = &lockJournal{path: path, logger: logger}
+	if err := s.compact(); err != nil {
+		s.closeJournal()
+		return err
+	}
+	return nil
+}
+
+// replay applies a journal entry to the state. s.mu must be held.
+func (s *lockState) replay(e journalEntry) {
+	switch e.Op {
+	case journalSet:
+		if e.Value == "" {
+			delete(s.locks, e.Key)
+			return
+		}
+		s.locks[e.Key] = e.Value
+
+	case journalLease:
+		sem := s.sems[e.Key]
+		if sem == nil {
+			sem = &semaphore{
+				slots:  e.Slots,
+				leases: make(map[string]*lease),
+			}
+			s.sems[e.Key] = sem
+		}
+		l := sem.leases[e.Token]
+		if l == nil {
+			l = &lease{}
+			sem.leases[e.Token] = l
+		}
+		l.pid, l.ttl, l.expires = e.PID, e.TTL, e.Expires
+		l.jobID, l.agentName, l.acquiredAt = e.JobID, e.AgentName, e.AcquiredAt
+		s.startTimer(e.Key, l)
+
+	case journalRelease:
+		sem := s.sems[e.Key]
+		if sem == nil {
+			return
+		}
+		if l := sem.leases[e.Token]; l != nil && l.timer != nil {
+			l.timer.Stop()
+		}
+		delete(sem.leases, e.Token)
+		if len(sem.leases) == 0 {
+			delete(s.sems, e.Key)
+		}
+	}
+}
+
+// record appends an entry to the journal, if the state is being persisted.
+// s.mu must be held.
+func (s *lockState) record(e journalEntry) {
+	j := s.journal
+	if j == nil {
+		return
+	}
+	if j.entries >= journalCompactThreshold {
+		err := s.compact()
+		if err == nil {
+			// The compacted journal already contains the change.
+			return
+		}
+		if j.f == nil {
+			j.logger.Error("Agent API: couldn't compact lock state journal, so lock state is no longer being persisted: %v", err)
+			s.closeJournal()
+			return
+		}
+		// Carry on appending to the existing journal, and try compacting
+		// again later.
+		j.logger.Error("Agent API: couldn't compact lock state journal: %v", err)
+		j.entries = 0
+	}
+	if err := writeJournalEntry(j.f, e); err != nil {
+		j.logger.Error("Agent API: couldn't write to lock state journal: %v", err)
+		return
+	}
+	j.entries++
+}
+
+// recordLease records a lease being acquired or renewed. s.mu must be held.
+func (s *lockState) recordLease(key, token string, slots int, l *lease) {
+	s.record(leaseEntry(key, token, slots, l))
+}
+
+// leaseEntry returns a journal entry recording the lease.
+func leaseEntry(key, token string, slots int, l *lease) journalEntry {
+	return journalEntry{
+		Op:         journalLease,
+		Key:        key,
+		Token:      token,
+		Slots:      slots,
+		TTL:        l.ttl,
+		PID:        l.pid,
+		Expires:    l.expires,
+		JobID:      l.jobID,
+		AgentName:  l.agentName,
+		AcquiredAt: l.acquiredAt,
+	}
+}
+
+// compact replaces the journal with one containing only the current state.
+// If it fails, the existing journal can still be appended to, unless j.f is
+// nil (because the journal was replaced, but couldn't be reopened). s.mu must
+// be held.
+func (s *lockState) compact() error {
+	j := s.journal
+
+	tmp, err := os.CreateTemp(filepath.Dir(j.path), ".agent-leader-state-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	for _, e := range s.snapshot() {
+		if err := writeJournalEntry(tmp, e); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), j.path); err != nil {
+		return err
+	}
+
+	// The existing file has been replaced, so appending to it would be
+	// pointless.
+	if j.f != nil {
+		j.f.Close()
+		j.f = nil
+	}
+	f, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	j.f, j.entries = f, 0
+	return nil
+}
+
+// snapshot returns journal entries that recreate the current state. s.mu
+// must be held.
+func (s *lockState) snapshot() []journalEntry {
+	var entries []journalEntry
+	for key, value := range s.locks {
+		entries = append(entries, journalEntry{Op: journalSet, Key: key, Value: value})
+	}
+	for key, sem := range s.sems {
+		for token, l := range sem.leases {
+			entries = append(entries, leaseEntry(key, token, sem.slots, l))
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Key != entries[j].Key {
+			return entries[i].Key < entries[j].Key
+		}
+		return entries[i].Token < entries[j].Token
+	})
+	return entries
+}
+
+// closeJournal stops persisting the state. s.mu must be held.
+func (s *lockState) closeJournal() {
+	if s.journal == nil {
+		return
+	}
+	if s.journal.f != nil {
+		s.journal.f.Close()
+	}
+	s.journal = nil
+}
+
+// readJournal reads the entries from the journal at path. A missing journal
+// has no entries. Lines that can't be decoded (such as a partial line written
+// by a leader that crashed) are skipped.
+func readJournal(path string, logger logger.Logger) ([]journalEntry, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []journalEntry
+	r := bufio.NewReader(f)
+	for line := 1; ; line++ {
+		b, err := r.ReadBytes('\n')
+		if len(b) > 0 {
+			var e journalEntry
+			if jerr := json.Unmarshal(b, &e); jerr != nil {
+				logger.Warn("Agent API: skipping line %d of lock state journal %s: %v", line, path, jerr)
+			} else {
+				entries = append(entries, e)
+			}
+		}
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("reading lock state journal: %w", err)
+		}
+	}
+}
+
+func writeJournalEntry(w io.Writer, e journalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
@@ -4,16 +4,26 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/buildkite/agent/v3/internal/socket"
 	"github.com/buildkite/agent/v3/logger"
 	"github.com/go-chi/chi/v5"
 )
 
+// leaseCheckInterval is how often a blocked acquire checks whether the
+// processes holding the lock still exist.
+const leaseCheckInterval = time.Second
+
 // lockServer serves lock requests using a lockState.
 type lockServer struct {
 	logger logger.Logger
 	locks  *lockState
+
+	// done is closed when the server is stopping, to end blocked acquires.
+	done     chan struct{}
+	stopOnce sync.Once
 }
 
 // newLockServer creates a lockServer containing a new empty lockState.
@@ -21,6 +31,7 @@ func newLockServer(logger logger.Logger) *lockServer {
 	return &lockServer{
 		logger: logger,
 		locks:  newLockState(),
+		done:   make(chan struct{}),
 	}
 }
 
@@ -28,40 +39,46 @@ func newLockServer(logger logger.Logger) *lockServer {
 func (s *lockServer) routes(r chi.Router) {
 	r.Get("/", s.getLock)
 	r.Patch("/", s.patchLock)
+	r.Delete("/", s.deleteLock)
+	r.Get("/list", s.listLocks)
+	r.Post("/acquire", s.acquireLock)
+	r.Post("/renew", s.renewLock)
+	r.Post("/release", s.releaseLock)
+}
+
+// stop ends any blocked acquires, and stops persisting the lock state.
+func (s *lockServer) stop() {
+	s.stopOnce.Do(func() { close(s.done) })
+
+	s.locks.mu.Lock()
+	defer s.locks.mu.Unlock()
+	s.locks.closeJournal()
 }
 
 // getLock atomically retrieves the current lock value.
 func (s *lockServer) getLock(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 	if key == "" {
-		if err := socket.WriteError(w, "key missing", http.StatusNotFound); err != nil {
-			s.logger.Error("Agent API: couldn't write error: %v", err)
-		}
+		s.writeError(w, "key missing", http.StatusNotFound)
 		return
 	}
 	resp := &ValueResponse{
 		Value: s.locks.load(key),
 	}
-	if err := json.NewEncoder(w).Encode(resp); err != nil {
-		s.logger.Error("Agent API: couldn't encode response body: %v", err)
-	}
+	s.writeResponse(w, resp)
 }
 
 // patchLock tries to atomically update the lock value.
 func (s *lockServer) patchLock(w http.ResponseWriter, r *http.Request) {
 	key := r.URL.Query().Get("key")
 	if key == "" {
-		if err := socket.WriteError(w, "key missing", http.StatusNotFound); err != nil {
-			s.logger.Error("Agent API: couldn't write error: %v", err)
-		}
+		s.writeError(w, "key missing", http.StatusNotFound)
 		return
 	}
 
 	var req LockCASRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		if err := socket.WriteError(w, fmt.Sprintf("couldn't decode request body: %v", err), http.StatusBadRequest); err != nil {
-			s.logger.Error("Agent API: couldn't write error: %v", err)
-		}
+		s.writeError(w, fmt.Sprintf("couldn't decode request body: %v", err), http.StatusBadRequest)
 		return
 	}
 
@@ -70,7 +87,135 @@ func (s *lockServer) patchLock(w http.ResponseWriter, r *http.Request) {
 		Value:   v,
 		Swapped: ok,
 	}
+	s.writeResponse(w, resp)
+}
+
+// deleteLock forcibly deletes the lock, releasing any leases on it.
+func (s *lockServer) deleteLock(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		s.writeError(w, "key missing", http.StatusNotFound)
+		return
+	}
+	s.writeResponse(w, &LockDeleteResponse{
+		Deleted: s.locks.delete(key),
+	})
+}
+
+// listLocks lists every lock in use.
+func (s *lockServer) listLocks(w http.ResponseWriter, r *http.Request) {
+	s.writeResponse(w, &LockListResponse{
+		Locks: s.locks.list(),
+	})
+}
+
+// acquireLock acquires a lease on the lock, waiting until a slot is free.
+func (s *lockServer) acquireLock(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		s.writeError(w, "key missing", http.StatusNotFound)
+		return
+	}
+
+	var req LockAcquireRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, fmt.Sprintf("couldn't decode request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.Token == "" {
+		s.writeError(w, "token missing", http.StatusBadRequest)
+		return
+	}
+	if req.Slots == 0 {
+		req.Slots = 1
+	}
+	if req.Slots < 0 || req.TTL < 0 {
+		s.writeError(w, "slots and ttl must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	for {
+		expires, ok, changed, err := s.locks.acquire(key, &req)
+		if err != nil {
+			s.writeError(w, err.Error(), http.StatusConflict)
+			return
+		}
+		if ok {
+			s.writeResponse(w, &LockLeaseResponse{Expires: expires})
+			return
+		}
+
+		// Wait for something to change, periodically checking for holders
+		// that have exited.
+		t := time.NewTimer(leaseCheckInterval)
+		select {
+		case <-changed:
+		case <-t.C:
+		case <-r.Context().Done():
+			t.Stop()
+			return
+		case <-s.done:
+			t.Stop()
+			s.writeError(w, "Agent API server is stopping", http.StatusServiceUnavailable)
+			return
+		}
+		t.Stop()
+	}
+}
+
+// renewLock extends a lease on the lock.
+func (s *lockServer) renewLock(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		s.writeError(w, "key missing", http.StatusNotFound)
+		return
+	}
+
+	var req LockRenewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, fmt.Sprintf("couldn't decode request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if req.TTL < 0 {
+		s.writeError(w, "ttl must not be negative", http.StatusBadRequest)
+		return
+	}
+
+	expires, ok := s.locks.renew(key, req.Token, req.TTL)
+	if !ok {
+		s.writeError(w, "lock is not held with that token", http.StatusNotFound)
+		return
+	}
+	s.writeResponse(w, &LockLeaseResponse{Expires: expires})
+}
+
+// releaseLock ends a lease on the lock.
+func (s *lockServer) releaseLock(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		s.writeError(w, "key missing", http.StatusNotFound)
+		return
+	}
+
+	var req LockReleaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.writeError(w, fmt.Sprintf("couldn't decode request body: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.writeResponse(w, &LockReleaseResponse{
+		Released: s.locks.release(key, req.Token),
+	})
+}
+
+func (s *lockServer) writeResponse(w http.ResponseWriter, resp any) {
 	if err := json.NewEncoder(w).Encode(resp); err != nil {
 		s.logger.Error("Agent API: couldn't encode response body: %v", err)
 	}
 }
+
+func (s *lockServer) writeError(w http.ResponseWriter, msg string, code int) {
+	if err := socket.WriteError(w, msg, code); err != nil {
+		s.logger.Error("Agent API: couldn't write error: %v", err)
+	}
+}
@@ -1,36 +1,313 @@
 package agentapi
 
-import "sync"
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
 
-// lockState is really just a concurrent map.
+// lockState holds the value for each key (for compare-and-swap), and the
+// leases held on each key used as a semaphore. A key is in use either as a
+// value or as a semaphore, never both at once.
 type lockState struct {
 	mu    sync.Mutex
 	locks map[string]string
+	sems  map[string]*semaphore
+
+	// changed is closed (and replaced) whenever a value changes or a lease
+	// ends, to wake up anything waiting to acquire.
+	changed chan struct{}
+
+	// journal records changes to the state, if it is being persisted.
+	journal *lockJournal
+}
+
+// semaphore is a key with a fixed number of slots, each of which can be held
+// by one lease.
+type semaphore struct {
+	slots  int
+	leases map[string]*lease // by token
+}
+
+// lease is one holder of a semaphore slot.
+type lease struct {
+	// pid is the ID of the process holding the lease, which is released if
+	// the process no longer exists. Zero means no process is watched.
+	pid int
+
+	// ttl is how long the lease lasts without being renewed. Zero means
+	// forever.
+	ttl     time.Duration
+	expires time.Time
+	timer   *time.Timer
+
+	// Information about the holder, for listing locks.
+	jobID      string
+	agentName  string
+	acquiredAt time.Time
 }
 
-// newLockState creates a new empty lockServer.
+// newLockState creates a new empty lockState.
 func newLockState() *lockState {
 	return &lockState{
-		locks: make(map[string]string),
+		locks:   make(map[string]string),
+		sems:    make(map[string]*semaphore),
+		changed: make(chan struct{}),
 	}
 }
 
-// load atomically retrieves the current value for the lock.
+// load atomically retrieves the current value for the lock. For a key used as
+// a semaphore, the value is the tokens of the current leases, separated by
+// commas.
 func (s *lockState) load(key string) string {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	return s.locks[key]
+	s.prune(key)
+	return s.value(key)
 }
 
 // cas atomically attempts to swap the old value for the key for a new
 // value. It reports whether the swap succeeded, returning the (new or existing)
-// value.
+// value. Values of keys used as semaphores can't be swapped.
 func (s *lockState) cas(key, old, new string) (string, bool) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	if s.locks[key] == old {
-		s.locks[key] = new
-		return new, true
+	s.prune(key)
+	if _, isSem := s.sems[key]; isSem || s.locks[key] != old {
+		return s.value(key), false
+	}
+	s.locks[key] = new
+	if new == "" {
+		delete(s.locks, key)
+	}
+	if new != old {
+		s.record(journalEntry{Op: journalSet, Key: key, Value: new})
+		s.notify()
+	}
+	return new, true
+}
+
+// acquire attempts to acquire a lease on one of the slots of the key for the
+// token in the request. If the key is busy, it returns false and a channel
+// that is closed when it is worth trying again. Acquiring a lease already held
+// by the token renews it.
+func (s *lockState) acquire(key string, req *LockAcquireRequest) (time.Time, bool, <-chan struct{}, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(key)
+
+	if s.locks[key] != "" {
+		return time.Time{}, false, s.changed, nil
+	}
+
+	sem := s.sems[key]
+	if sem == nil {
+		sem = &semaphore{
+			slots:  req.Slots,
+			leases: make(map[string]*lease),
+		}
+		s.sems[key] = sem
+	}
+	if sem.slots != req.Slots {
+		return time.Time{}, false, nil, fmt.Errorf("lock %q has %d slots, not %d", key, sem.slots, req.Slots)
 	}
-	return s.locks[key], false
+
+	l := sem.leases[req.Token]
+	if l == nil {
+		if len(sem.leases) >= sem.slots {
+			return time.Time{}, false, s.changed, nil
+		}
+		l = &lease{
+			pid:        req.PID,
+			jobID:      req.JobID,
+			agentName:  req.AgentName,
+			acquiredAt: time.Now(),
+		}
+		sem.leases[req.Token] = l
+	}
+	expires := s.renewLease(key, l, req.TTL)
+	s.recordLease(key, req.Token, sem.slots, l)
+	return expires, true, nil, nil
+}
+
+// renew extends the lease held by the token on the key. If ttl is zero, the
+// lease is extended by its existing TTL. It reports false if the token doesn't
+// hold a lease (for example, because it has expired).
+func (s *lockState) renew(key, token string, ttl time.Duration) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(key)
+
+	sem := s.sems[key]
+	if sem == nil || sem.leases[token] == nil {
+		return time.Time{}, false
+	}
+	l := sem.leases[token]
+	expires := s.renewLease(key, l, ttl)
+	s.recordLease(key, token, sem.slots, l)
+	return expires, true
+}
+
+// release ends the lease held by the token on the key. For compatibility with
+// clients that lock by compare-and-swap, it also clears the value of the key
+// if it equals the token. It reports whether anything was released.
+func (s *lockState) release(key, token string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(key)
+
+	if token != "" && s.locks[key] == token {
+		delete(s.locks, key)
+		s.record(journalEntry{Op: journalSet, Key: key})
+		s.notify()
+		return true
+	}
+	sem := s.sems[key]
+	if sem == nil || sem.leases[token] == nil {
+		return false
+	}
+	s.endLease(key, token)
+	return true
+}
+
+// delete forcibly deletes the key, whether it has a value or is used as a
+// semaphore. It reports whether there was anything to delete.
+func (s *lockState) delete(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune(key)
+
+	if s.locks[key] != "" {
+		delete(s.locks, key)
+		s.record(journalEntry{Op: journalSet, Key: key})
+		s.notify()
+		return true
+	}
+	sem := s.sems[key]
+	if sem == nil {
+		return false
+	}
+	for token := range sem.leases {
+		s.endLease(key, token)
+	}
+	return true
+}
+
+// list returns every key in use, sorted by key.
+func (s *lockState) list() []LockInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key := range s.sems {
+		s.prune(key)
+	}
+
+	infos := make([]LockInfo, 0, len(s.locks)+len(s.sems))
+	for key, value := range s.locks {
+		infos = append(infos, LockInfo{Key: key, Value: value})
+	}
+	for key, sem := range s.sems {
+		info := LockInfo{Key: key, Slots: sem.slots}
+		for token, l := range sem.leases {
+			info.Holders = append(info.Holders, LockHolder{
+				Token:      token,
+				JobID:      l.jobID,
+				AgentName:  l.agentName,
+				PID:        l.pid,
+				AcquiredAt: l.acquiredAt,
+				Expires:    l.expires,
+			})
+		}
+		sort.Slice(info.Holders, func(i, j int) bool {
+			return info.Holders[i].AcquiredAt.Before(info.Holders[j].AcquiredAt)
+		})
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Key < infos[j].Key })
+	return infos
+}
+
+// renewLease sets the expiry of the lease, if it has a TTL. s.mu must be
+// held.
+func (s *lockState) renewLease(key string, l *lease, ttl time.Duration) time.Time {
+	if ttl > 0 {
+		l.ttl = ttl
+	}
+	if l.ttl == 0 {
+		return time.Time{}
+	}
+	l.expires = time.Now().Add(l.ttl)
+	s.startTimer(key, l)
+	return l.expires
+}
+
+// startTimer starts a timer to end the lease when it expires. s.mu must be
+// held.
+func (s *lockState) startTimer(key string, l *lease) {
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+	if l.expires.IsZero() {
+		return
+	}
+	l.timer = time.AfterFunc(time.Until(l.expires), func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.prune(key)
+	})
+}
+
+// prune ends leases on the key that have expired, or whose process has
+// exited. s.mu must be held.
+func (s *lockState) prune(key string) {
+	sem := s.sems[key]
+	if sem == nil {
+		return
+	}
+	now := time.Now()
+	for token, l := range sem.leases {
+		expired := !l.expires.IsZero() && !now.Before(l.expires)
+		if expired || (l.pid > 0 && !processExists(l.pid)) {
+			s.endLease(key, token)
+		}
+	}
+	if len(sem.leases) == 0 {
+		delete(s.sems, key)
+	}
+}
+
+// endLease removes a lease. s.mu must be held.
+func (s *lockState) endLease(key, token string) {
+	sem := s.sems[key]
+	if l := sem.leases[token]; l.timer != nil {
+		l.timer.Stop()
+	}
+	delete(sem.leases, token)
+	if len(sem.leases) == 0 {
+		delete(s.sems, key)
+	}
+	s.record(journalEntry{Op: journalRelease, Key: key, Token: token})
+	s.notify()
+}
+
+// value returns the value of the key. s.mu must be held.
+func (s *lockState) value(key string) string {
+	sem := s.sems[key]
+	if sem == nil {
+		return s.locks[key]
+	}
+	tokens := make([]string, 0, len(sem.leases))
+	for token := range sem.leases {
+		tokens = append(tokens, token)
+	}
+	sort.Strings(tokens)
+	return strings.Join(tokens, ",")
+}
+
+// notify wakes up anything waiting to acquire. s.mu must be held.
+func (s *lockState) notify() {
+	close(s.changed)
+	s.changed = make(chan struct{})
 }
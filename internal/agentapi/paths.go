@@ -15,3 +15,9 @@ func DefaultSocketPath(base string) string {
 func LeaderPath(base string) string {
 	return filepath.Join(base, "agent-leader")
 }
+
+// LeaderStatePath returns the path to the journal file used by the leader
+// agent to persist the lock state.
+func LeaderStatePath(base string) string {
+	return filepath.Join(base, "agent-leader-state")
+}
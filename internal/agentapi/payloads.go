@@ -23,3 +23,113 @@ type LockCASResponse struct {
 	Value   string `json:"value"`
 	Swapped bool   `json:"swapped"`
 }
+
+// LockAcquireRequest is the request body for the POST /lock/acquire endpoint.
+type LockAcquireRequest struct {
+	// Token identifies the holder of the lease.
+	Token string `json:"token"`
+
+	// Slots is how many holders the lock can have at once. Zero means 1.
+	Slots int `json:"slots,omitempty"`
+
+	// TTL is how long the lease lasts unless it is renewed. Zero means it
+	// lasts until released.
+	TTL time.Duration `json:"ttl,omitempty"`
+
+	// PID is the ID of a process to watch. The lease is released if the
+	// process exits. Zero means no process is watched.
+	PID int `json:"pid,omitempty"`
+
+	// JobID and AgentName describe the holder, for listing locks.
+	JobID     string `json:"job_id,omitempty"`
+	AgentName string `json:"agent_name,omitempty"`
+}
+
+// LockRenewRequest is the request body for the POST /lock/renew endpoint.
+type LockRenewRequest struct {
+	Token string `json:"token"`
+
+	// TTL is the new TTL for the lease. Zero means to keep the existing TTL.
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+// LockLeaseResponse is the response body for the POST /lock/acquire and
+// POST /lock/renew endpoints.
+type LockLeaseResponse struct {
+	// Expires is when the lease expires unless it is renewed. It is zero if
+	// the lease has no TTL.
+	Expires time.Time `json:"expires"`
+}
+
+// LockReleaseRequest is the request body for the POST /lock/release endpoint.
+type LockReleaseRequest struct {
+	Token string `json:"token"`
+}
+
+// LockReleaseResponse is the response body for the POST /lock/release
+// endpoint.
+type LockReleaseResponse struct {
+	Released bool `json:"released"`
+}
+
+// LockListResponse is the response body for the GET /lock/list endpoint.
+type LockListResponse struct {
+	Locks []LockInfo `json:"locks"`
+}
+
+// LockInfo describes a lock key that is in use.
+type LockInfo struct {
+	Key string `json:"key"`
+
+	// Value is the value of a key used for compare-and-swap.
+	Value string `json:"value,omitempty"`
+
+	// Slots and Holders describe a key used as a semaphore.
+	Slots   int          `json:"slots,omitempty"`
+	Holders []LockHolder `json:"holders,omitempty"`
+}
+
+// LockHolder describes a lease on a lock.
+type LockHolder struct {
+	Token      string    `json:"token"`
+	JobID      string    `json:"job_id,omitempty"`
+	AgentName  string    `json:"agent_name,omitempty"`
+	PID        int       `json:"pid,omitempty"`
+	AcquiredAt time.Time `json:"acquired_at"`
+
+	// Expires is zero if the lease has no TTL.
+	Expires time.Time `json:"expires"`
+}
+
+// LockDeleteResponse is the response body for the DELETE /lock endpoint.
+type LockDeleteResponse struct {
+	Deleted bool `json:"deleted"`
+}
+
+// KVGetResponse is the response body for the GET /kv endpoint.
+type KVGetResponse struct {
+	Value string `json:"value"`
+
+	// Expires is zero if the value doesn't expire.
+	Expires time.Time `json:"expires"`
+}
+
+// KVSetRequest is the request body for the PUT /kv endpoint.
+type KVSetRequest struct {
+	Value string `json:"value"`
+
+	// TTL is how long the value is kept. Zero means until the leader agent
+	// stops.
+	TTL time.Duration `json:"ttl,omitempty"`
+}
+
+// KVSetResponse is the response body for the PUT /kv endpoint.
+type KVSetResponse struct {
+	// Expires is zero if the value doesn't expire.
+	Expires time.Time `json:"expires"`
+}
+
+// KVDeleteResponse is the response body for the DELETE /kv endpoint.
+type KVDeleteResponse struct {
+	Deleted bool `json:"deleted"`
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package agentapi
+
+import (
+	"errors"
+	"syscall"
+)
+
+// processExists reports whether a process with the given ID exists.
+func processExists(pid int) bool {
+	// Signal 0 performs the existence and permission checks without sending a
+	// signal. EPERM means it exists, but belongs to someone else.
+	err := syscall.Kill(pid, 0)
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -25,6 +25,7 @@ func (s *Server) router(log logger.Logger) chi.Router {
 	r.Route("/api/leader/v0", func(r chi.Router) {
 		r.Get("/ping", pingHandler(log))
 		r.Route("/lock", s.lockSvr.routes)
+		r.Route("/kv", s.kvSvr.routes)
 	})
 
 	return r
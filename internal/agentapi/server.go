@@ -1,6 +1,8 @@
 package agentapi
 
 import (
+	"context"
+
 	"github.com/buildkite/agent/v3/internal/socket"
 	"github.com/buildkite/agent/v3/logger"
 )
@@ -10,6 +12,7 @@ type Server struct {
 	*socket.Server
 
 	lockSvr *lockServer
+	kvSvr   *kvServer
 }
 
 // NewServer creates a new Agent API server that, when started, listens on the
@@ -17,6 +20,7 @@ type Server struct {
 func NewServer(socketPath string, log logger.Logger) (*Server, error) {
 	s := &Server{
 		lockSvr: newLockServer(log),
+		kvSvr:   newKVServer(log),
 	}
 	svr, err := socket.NewServer(socketPath, s.router(log))
 	if err != nil {
@@ -25,3 +29,24 @@ func NewServer(socketPath string, log logger.Logger) (*Server, error) {
 	s.Server = svr
 	return s, nil
 }
+
+// PersistLocks loads the lock state from the journal file at path (if it
+// exists), replacing the current state, and records all subsequent changes to
+// the journal. This allows a new leader to carry on where the previous leader
+// left off.
+func (s *Server) PersistLocks(path string) error {
+	return s.lockSvr.locks.persist(path, s.lockSvr.logger)
+}
+
+// Close immediately closes down the server. Prefer Shutdown for ordinary use.
+func (s *Server) Close() error {
+	s.lockSvr.stop()
+	return s.Server.Close()
+}
+
+// Shutdown gracefully shuts down the server. Any requests waiting to acquire
+// a lock fail.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lockSvr.stop()
+	return s.Server.Shutdown(ctx)
+}
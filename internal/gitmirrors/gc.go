@@ -0,0 +1,297 @@
+// Package gitmirrors manages the git mirrors that the job executor keeps in
+// the git mirrors path, for reference by checkouts.
+package gitmirrors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/gofrs/flock"
+)
+
+// The job executor guards each mirror with flocks on files next to it. These
+// are the names it uses (it adds "f" to the lock paths it's given, so flocks
+// never share a name with the older style of lock file).
+const (
+	cloneLockSuffix  = ".clonelockf"
+	updateLockSuffix = ".updatelockf"
+
+	// lastUsedSuffix is the file whose modification time is when the mirror
+	// was last used by a job.
+	lastUsedSuffix = ".lastused"
+)
+
+// Action is what GC did with a mirror.
+type Action string
+
+const (
+	// ActionKept means the mirror was left as it was.
+	ActionKept Action = "kept"
+
+	// ActionMaintained means git maintenance was run on the mirror.
+	ActionMaintained Action = "maintained"
+
+	// ActionRemoved means the mirror was removed, because it hadn't been
+	// used for longer than the maximum age.
+	ActionRemoved Action = "removed"
+
+	// ActionBusy means the mirror was in use, so it was left alone.
+	ActionBusy Action = "busy"
+
+	// ActionFailed means maintaining or removing the mirror failed.
+	ActionFailed Action = "failed"
+)
+
+// GCConfig configures GC.
+type GCConfig struct {
+	// Path is the directory containing the mirrors.
+	Path string
+
+	// MaxAge is how long a mirror can go unused before it is removed. Zero
+	// means mirrors are never removed.
+	MaxAge time.Duration
+
+	// Maintenance enables running git maintenance (which repacks objects and
+	// prunes unreachable ones) on mirrors that aren't removed.
+	Maintenance bool
+
+	// DryRun reports what would be done to each mirror, without doing it.
+	DryRun bool
+}
+
+// Mirror is the result of GC for one mirror.
+type Mirror struct {
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"` // in bytes, after any maintenance
+	LastUsed time.Time `json:"last_used"`
+	Action   Action    `json:"action"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// MarkUsed records that the mirror in dir was used just now, so GC knows not
+// to remove it.
+func MarkUsed(dir string) error {
+	path := dir + lastUsedSuffix
+	now := time.Now()
+	err := os.Chtimes(path, now, now)
+	if errors.Is(err, os.ErrNotExist) {
+		return os.WriteFile(path, nil, 0o666)
+	}
+	return err
+}
+
+// GC maintains the mirrors in cfg.Path, and removes any that haven't been used
+// for longer than cfg.MaxAge. Mirrors that are being cloned or updated are
+// left alone. It returns the result for each mirror, sorted by path.
+func GC(ctx context.Context, l logger.Logger, cfg GCConfig) ([]Mirror, error) {
+	entries, err := os.ReadDir(cfg.Path)
+	if err != nil {
+		return nil, err
+	}
+
+	var mirrors []Mirror
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return mirrors, ctx.Err()
+		}
+		if !entry.IsDir() {
+			// Lock files and last used markers.
+			continue
+		}
+
+		m := gcMirror(ctx, l, cfg, filepath.Join(cfg.Path, entry.Name()))
+		mirrors = append(mirrors, m)
+	}
+
+	sort.Slice(mirrors, func(i, j int) bool { return mirrors[i].Path < mirrors[j].Path })
+	return mirrors, nil
+}
+
+// gcMirror maintains or removes one mirror.
+func gcMirror(ctx context.Context, l logger.Logger, cfg GCConfig, dir string) Mirror {
+	m := Mirror{
+		Path:   dir,
+		Action: ActionKept,
+	}
+	fail := func(err error) Mirror {
+		l.Warn("Git mirrors GC: %s: %v", dir, err)
+		m.Action, m.Error = ActionFailed, err.Error()
+		m.Size, _ = dirSize(dir)
+		return m
+	}
+
+	// Jobs take the clone lock (briefly, unless they are cloning the mirror)
+	// and then the update lock (while fetching into the mirror, or into a
+	// worktree of it), in that order. Trying rather than waiting for the locks
+	// means GC never holds up a job for long.
+	cloneLock, ok, err := tryLock(dir + cloneLockSuffix)
+	if err != nil {
+		return fail(err)
+	}
+	if !ok {
+		m.Action = ActionBusy
+		m.Size, _ = dirSize(dir)
+		return m
+	}
+	defer cloneLock.Unlock()
+
+	updateLock, ok, err := tryLock(dir + updateLockSuffix)
+	if err != nil {
+		return fail(err)
+	}
+	if !ok {
+		m.Action = ActionBusy
+		m.Size, _ = dirSize(dir)
+		return m
+	}
+	defer updateLock.Unlock()
+
+	// Jobs record when they used the mirror while holding the clone lock.
+	m.LastUsed = lastUsed(dir, !cfg.DryRun)
+	unused := cfg.MaxAge > 0 && time.Since(m.LastUsed) > cfg.MaxAge
+	if unused {
+		worktrees, err := liveWorktrees(dir)
+		if err != nil {
+			return fail(err)
+		}
+		if len(worktrees) > 0 {
+			l.Debug("Git mirrors GC: keeping %s, which has worktrees checked out in %s", dir, strings.Join(worktrees, ", "))
+			unused = false
+		}
+	}
+
+	if unused {
+		m.Size, _ = dirSize(dir)
+		m.Action = ActionRemoved
+		if cfg.DryRun {
+			return m
+		}
+		// The lock files stay, since a job may be waiting on them.
+		if err := os.RemoveAll(dir); err != nil {
+			return fail(err)
+		}
+		if err := os.Remove(dir + lastUsedSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			l.Warn("Git mirrors GC: couldn't remove %s: %v", dir+lastUsedSuffix, err)
+		}
+		return m
+	}
+
+	// Nothing else can be cloning the mirror now that it exists, so jobs
+	// needn't wait for maintenance to check it.
+	cloneLock.Unlock()
+
+	if cfg.Maintenance {
+		m.Action = ActionMaintained
+		if !cfg.DryRun {
+			if err := maintain(ctx, dir); err != nil {
+				return fail(err)
+			}
+		}
+	}
+
+	m.Size, _ = dirSize(dir)
+	return m
+}
+
+// maintain runs git maintenance on the mirror.
+func maintain(ctx context.Context, dir string) error {
+	for _, args := range [][]string{
+		// Worktrees whose checkouts are gone would stop their objects being
+		// pruned.
+		{"worktree", "prune"},
+		{"maintenance", "run", "--task=gc"},
+	} {
+		cmd := exec.CommandContext(ctx, "git", append([]string{"--git-dir", dir}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git %s: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+// lastUsed returns when the mirror was last used by a job. For mirrors last
+// used before jobs recorded this, it falls back to the modification time of
+// the mirror (which changes whenever it's fetched into), and if record is set,
+// records it, since maintaining the mirror changes it too.
+func lastUsed(dir string, record bool) time.Time {
+	path := dir + lastUsedSuffix
+	if fi, err := os.Stat(path); err == nil {
+		return fi.ModTime()
+	}
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return time.Time{}
+	}
+	t := fi.ModTime()
+	if record {
+		if err := os.WriteFile(path, nil, 0o666); err == nil {
+			// If this fails, the mirror looks newly used, which is safe.
+			_ = os.Chtimes(path, t, t)
+		}
+	}
+	return t
+}
+
+// liveWorktrees returns the checkout directories of worktrees of the mirror
+// that still exist.
+func liveWorktrees(dir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, "worktrees"))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var live []string
+	for _, entry := range entries {
+		// gitdir holds the path to the .git file in the checkout.
+		b, err := os.ReadFile(filepath.Join(dir, "worktrees", entry.Name(), "gitdir"))
+		if err != nil {
+			continue
+		}
+		dotGit := strings.TrimSpace(string(b))
+		if _, err := os.Stat(dotGit); err == nil {
+			live = append(live, filepath.Dir(dotGit))
+		}
+	}
+	return live, nil
+}
+
+// tryLock tries to take the flock at path, without waiting for it.
+func tryLock(path string) (*flock.Flock, bool, error) {
+	lock := flock.New(path)
+	ok, err := lock.TryLock()
+	if err != nil {
+		return nil, false, fmt.Errorf("locking %s: %w", path, err)
+	}
+	return lock, ok, nil
+}
+
+// dirSize returns the total size of the files in dir.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.Type().IsRegular() {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
@@ -0,0 +1,150 @@
+package gitmirrors
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/gofrs/flock"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestGC(t *testing.T) {
+	t.Parallel()
+
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+
+	ctx, canc := context.WithTimeout(context.Background(), time.Minute)
+	t.Cleanup(canc)
+
+	src := t.TempDir()
+	mustGit(t, src, "init")
+	mustGit(t, src, "-c", "user.name=Test", "-c", "user.email=test@example.com", "commit", "--allow-empty", "-m", "Initial commit")
+
+	path := t.TempDir()
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{"recent", "old", "old-busy", "old-worktree"} {
+		dir := filepath.Join(path, name)
+		mustGit(t, path, "clone", "--mirror", "--", src, dir)
+		if err := MarkUsed(dir); err != nil {
+			t.Fatalf("MarkUsed(%q) = %v", dir, err)
+		}
+		if name == "recent" {
+			continue
+		}
+		if err := os.Chtimes(dir+lastUsedSuffix, old, old); err != nil {
+			t.Fatalf("os.Chtimes(%q) = %v", dir+lastUsedSuffix, err)
+		}
+	}
+
+	// A job is updating old-busy.
+	lock := flock.New(filepath.Join(path, "old-busy") + updateLockSuffix)
+	if err := lock.Lock(); err != nil {
+		t.Fatalf("lock.Lock() = %v", err)
+	}
+	defer lock.Unlock()
+
+	// old-worktree has a worktree checked out.
+	worktree := filepath.Join(t.TempDir(), "checkout")
+	mustGit(t, path, "--git-dir", filepath.Join(path, "old-worktree"), "worktree", "add", "--detach", worktree)
+
+	cfg := GCConfig{
+		Path:        path,
+		MaxAge:      24 * time.Hour,
+		Maintenance: true,
+	}
+
+	// A dry run shouldn't change anything.
+	dryCfg := cfg
+	dryCfg.DryRun = true
+	mirrors, err := GC(ctx, logger.Discard, dryCfg)
+	if err != nil {
+		t.Fatalf("GC(ctx, logger, %+v) error = %v", dryCfg, err)
+	}
+	want := map[string]Action{
+		"old":          ActionRemoved,
+		"old-busy":     ActionBusy,
+		"old-worktree": ActionMaintained,
+		"recent":       ActionMaintained,
+	}
+	if diff := cmp.Diff(actions(mirrors), want); diff != "" {
+		t.Errorf("GC(dry run) actions diff (-got +want):\n%s", diff)
+	}
+	if _, err := os.Stat(filepath.Join(path, "old")); err != nil {
+		t.Errorf("os.Stat(old) error = %v, want the dry run to leave it", err)
+	}
+
+	mirrors, err = GC(ctx, logger.Discard, cfg)
+	if err != nil {
+		t.Fatalf("GC(ctx, logger, %+v) error = %v", cfg, err)
+	}
+	if diff := cmp.Diff(actions(mirrors), want); diff != "" {
+		t.Errorf("GC actions diff (-got +want):\n%s", diff)
+	}
+	for _, m := range mirrors {
+		if m.Size <= 0 {
+			t.Errorf("mirror %s Size = %d, want > 0", m.Path, m.Size)
+		}
+	}
+
+	if _, err := os.Stat(filepath.Join(path, "old")); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(old) error = %v, want not exist", err)
+	}
+	if _, err := os.Stat(filepath.Join(path, "old") + lastUsedSuffix); !os.IsNotExist(err) {
+		t.Errorf("os.Stat(old.lastused) error = %v, want not exist", err)
+	}
+	for _, name := range []string{"recent", "old-busy", "old-worktree"} {
+		if _, err := os.Stat(filepath.Join(path, name)); err != nil {
+			t.Errorf("os.Stat(%s) error = %v, want it to be kept", name, err)
+		}
+	}
+}
+
+func TestGCRecordsLastUsedForOlderMirrors(t *testing.T) {
+	t.Parallel()
+
+	path := t.TempDir()
+	dir := filepath.Join(path, "mirror")
+	if err := os.Mkdir(dir, 0o700); err != nil {
+		t.Fatalf("os.Mkdir(%q) = %v", dir, err)
+	}
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(dir, old, old); err != nil {
+		t.Fatalf("os.Chtimes(%q) = %v", dir, err)
+	}
+
+	if got := lastUsed(dir, true); !got.Equal(old) {
+		t.Errorf("lastUsed(%q, true) = %v, want %v", dir, got, old)
+	}
+
+	// Changes to the mirror no longer count as it being used.
+	if err := os.Chtimes(dir, time.Now(), time.Now()); err != nil {
+		t.Fatalf("os.Chtimes(%q) = %v", dir, err)
+	}
+	if got := lastUsed(dir, true); !got.Equal(old) {
+		t.Errorf("lastUsed(%q, true) after changing mirror = %v, want %v", dir, got, old)
+	}
+}
+
+func actions(mirrors []Mirror) map[string]Action {
+	got := make(map[string]Action)
+	for _, m := range mirrors {
+		got[filepath.Base(m.Path)] = m.Action
+	}
+	return got
+}
+
+func mustGit(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("git %q error = %v\nout = %s", args, err, out)
+	}
+}
@@ -3,9 +3,13 @@ package job
 import (
 	"fmt"
 
+	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/experiments"
+	"github.com/buildkite/agent/v3/internal/job/shell"
 	"github.com/buildkite/agent/v3/internal/socket"
 	"github.com/buildkite/agent/v3/jobapi"
+	"github.com/buildkite/agent/v3/logger"
+	"github.com/buildkite/agent/v3/version"
 )
 
 // startJobAPI starts the job API server, iff the job API experiment is enabled, and the OS of the box supports it
@@ -30,7 +34,16 @@ func (e *Executor) startJobAPI() (cleanup func(), err error) {
 		return cleanup, fmt.Errorf("creating job API socket path: %v", err)
 	}
 
-	srv, token, err := jobapi.NewServer(e.shell.Logger, socketPath, e.shell.Env)
+	opts := []jobapi.ServerOpt{
+		jobapi.WithRedactedVars(e.ExecutorConfig.RedactedVars),
+		jobapi.WithRedactor(e.addRedactions),
+		jobapi.WithValuesToRedact(e.eventValuesToRedact),
+	}
+	if client := e.jobAPIClient(); client != nil {
+		opts = append(opts, jobapi.WithAPIClient(client))
+	}
+
+	srv, token, err := jobapi.NewServer(e.shell.Logger, socketPath, e.shell.Env, opts...)
 	if err != nil {
 		return cleanup, fmt.Errorf("creating job API server: %v", err)
 	}
@@ -41,11 +54,68 @@ func (e *Executor) startJobAPI() (cleanup func(), err error) {
 	if err := srv.Start(); err != nil {
 		return cleanup, fmt.Errorf("starting Job API server: %v", err)
 	}
+	e.jobAPI = srv
 
 	return func() {
+		e.jobAPI = nil
 		err = srv.Stop()
 		if err != nil {
 			e.shell.Errorf("Error stopping Job API server: %v", err)
 		}
 	}, nil
 }
+
+// jobAPIClient returns a Buildkite API client authenticated as the job, for
+// the Job API endpoints that proxy to the Buildkite API, or nil if the job
+// has no access token.
+func (e *Executor) jobAPIClient() *api.Client {
+	token, hasToken := e.shell.Env.Get("BUILDKITE_AGENT_ACCESS_TOKEN")
+	if !hasToken || token == "" {
+		return nil
+	}
+	endpoint, _ := e.shell.Env.Get("BUILDKITE_AGENT_ENDPOINT")
+	return api.NewClient(logger.Discard, api.Config{
+		Endpoint:  endpoint,
+		Token:     token,
+		UserAgent: version.UserAgent(),
+	})
+}
+
+// publishEvent publishes a job lifecycle event to subscribers of the Job API
+// events endpoint, if the Job API is running.
+func (e *Executor) publishEvent(ev jobapi.Event) {
+	if e.jobAPI != nil {
+		e.jobAPI.PublishEvent(ev)
+	}
+}
+
+// startPhase publishes a phase start event, and returns a func that publishes
+// the matching phase finish event.
+func (e *Executor) startPhase(name string) (finish func(error)) {
+	e.phase = name
+	e.publishEvent(jobapi.Event{Type: jobapi.EventPhaseStart, Phase: name})
+	return func(err error) {
+		ev := jobapi.Event{Type: jobapi.EventPhaseFinish, Phase: name}
+		if err != nil {
+			ev.Error = err.Error()
+		}
+		e.publishEvent(ev)
+		e.phase = ""
+	}
+}
+
+// eventValuesToRedact returns the values to redact from Job API events. It's
+// valuesToRedact, without warning (again) about values too short to redact.
+func (e *Executor) eventValuesToRedact() []string {
+	return e.redactionValuesFor(shell.DiscardLogger)
+}
+
+// addRedactions adds values to redact from all subsequent output.
+func (e *Executor) addRedactions(values []string) {
+	e.redactionMu.Lock()
+	e.redactionValues = append(e.redactionValues, values...)
+	redactors := e.redactors
+	e.redactionMu.Unlock()
+
+	redactors.Reset(e.valuesToRedact())
+}
@@ -86,6 +86,18 @@ type ExecutorConfig struct {
 	// Flags to pass to "git clean" command
 	GitCleanFlags string `env:"BUILDKITE_GIT_CLEAN_FLAGS"`
 
+	// Filter for partial clones and fetches of the repository and its mirror,
+	// e.g. "blob:none" or "tree:0"
+	GitPartialCloneFilter string `env:"BUILDKITE_GIT_PARTIAL_CLONE_FILTER"`
+
+	// Paths (directories) to check out using a cone-mode sparse checkout.
+	// If empty, the whole repository is checked out
+	GitSparseCheckoutPaths []string `env:"BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS" normalize:"list"`
+
+	// Check out Git LFS files with one batched fetch after the checkout,
+	// instead of having git-lfs fetch them one by one during it
+	GitLFS bool `env:"BUILDKITE_GIT_LFS"`
+
 	// Config key=value pairs to pass to "git" when submodule init commands are invoked
 	GitSubmoduleCloneConfig []string `env:"BUILDKITE_GIT_SUBMODULE_CLONE_CONFIG" normalize:"list"`
 
@@ -125,6 +137,10 @@ type ExecutorConfig struct {
 	// Skip updating the Git mirror before using it
 	GitMirrorsSkipUpdate bool `env:"BUILDKITE_GIT_MIRRORS_SKIP_UPDATE"`
 
+	// Check out the repository as a worktree of its mirror, instead of a clone
+	// that references the mirror
+	GitMirrorsWorktrees bool
+
 	// Path to the buildkite-agent binary
 	BinPath string
 
@@ -16,17 +16,20 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/buildkite/agent/v3/agent/plugin"
 	"github.com/buildkite/agent/v3/env"
 	"github.com/buildkite/agent/v3/experiments"
 	"github.com/buildkite/agent/v3/hook"
+	"github.com/buildkite/agent/v3/internal/gitmirrors"
 	"github.com/buildkite/agent/v3/internal/job/shell"
 	"github.com/buildkite/agent/v3/internal/redact"
 	"github.com/buildkite/agent/v3/internal/replacer"
 	"github.com/buildkite/agent/v3/internal/shellscript"
 	"github.com/buildkite/agent/v3/internal/utils"
+	"github.com/buildkite/agent/v3/jobapi"
 	"github.com/buildkite/agent/v3/kubernetes"
 	"github.com/buildkite/agent/v3/process"
 	"github.com/buildkite/agent/v3/tracetools"
@@ -57,6 +60,18 @@ type Executor struct {
 
 	// A channel to track cancellation
 	cancelCh chan struct{}
+
+	// The Job API server, if it's running
+	jobAPI *jobapi.Server
+
+	// The phase currently running, for Job API events
+	phase string
+
+	// Values to redact added through the Job API, and the redactors
+	// currently in use
+	redactionMu     sync.Mutex
+	redactionValues []string
+	redactors       replacer.Mux
 }
 
 // New returns a new executor instance
@@ -119,6 +134,13 @@ func (e *Executor) Run(ctx context.Context) (exitCode int) {
 	// Create an empty env for us to keep track of our env changes in
 	e.shell.Env = env.FromSlice(os.Environ())
 
+	// Locks acquired during the job (with `buildkite-agent lock acquire`) are
+	// released automatically if this process exits without releasing them.
+	// In Kubernetes, the agent can't see the processes in other containers.
+	if !experiments.IsEnabled(experiments.KubernetesExec) {
+		e.shell.Env.Set("BUILDKITE_LOCK_HOLDER_PID", strconv.Itoa(os.Getpid()))
+	}
+
 	// Initialize the job API, iff the experiment is enabled. Noop otherwise
 	cleanup, err := e.startJobAPI()
 	if err != nil {
@@ -163,12 +185,16 @@ func (e *Executor) Run(ctx context.Context) (exitCode int) {
 		phaseErr = e.preparePlugins()
 
 		if phaseErr == nil {
+			finishPhase := e.startPhase("plugin")
 			phaseErr = e.PluginPhase(ctx)
+			finishPhase(phaseErr)
 		}
 	}
 
 	if phaseErr == nil && includePhase("checkout") {
+		finishPhase := e.startPhase("checkout")
 		phaseErr = e.CheckoutPhase(cancelCtx)
+		finishPhase(phaseErr)
 	} else {
 		checkoutDir, exists := e.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
 		if exists {
@@ -177,12 +203,20 @@ func (e *Executor) Run(ctx context.Context) (exitCode int) {
 	}
 
 	if phaseErr == nil && includePhase("plugin") {
+		finishPhase := e.startPhase("vendored-plugin")
 		phaseErr = e.VendoredPluginPhase(ctx)
+		finishPhase(phaseErr)
 	}
 
 	if phaseErr == nil && includePhase("command") {
 		var commandErr error
+		finishPhase := e.startPhase("command")
 		phaseErr, commandErr = e.CommandPhase(ctx)
+		if phaseErr != nil {
+			finishPhase(phaseErr)
+		} else {
+			finishPhase(commandErr)
+		}
 		/*
 			Five possible states at this point:
 
@@ -208,7 +242,10 @@ func (e *Executor) Run(ctx context.Context) (exitCode int) {
 		}
 
 		// Only upload artifacts as part of the command phase
-		if err = e.artifactPhase(ctx); err != nil {
+		finishPhase = e.startPhase("artifact")
+		err = e.artifactPhase(ctx)
+		finishPhase(err)
+		if err != nil {
 			e.shell.Errorf("%v", err)
 
 			if commandErr != nil {
@@ -300,6 +337,21 @@ func (e *Executor) executeHook(ctx context.Context, hookCfg HookConfig) error {
 
 	e.shell.Headerf("Running %s hook", hookName)
 
+	e.publishEvent(jobapi.Event{Type: jobapi.EventHookStart, Phase: e.phase, Hook: hookName})
+	err = e.runHook(ctx, hookName, hookCfg)
+
+	exitStatus := shell.GetExitCode(err)
+	finished := jobapi.Event{Type: jobapi.EventHookFinish, Phase: e.phase, Hook: hookName, ExitStatus: &exitStatus}
+	if err != nil {
+		finished.Error = err.Error()
+	}
+	e.publishEvent(finished)
+
+	return err
+}
+
+// runHook runs a hook script, wrapped or unwrapped depending on its type.
+func (e *Executor) runHook(ctx context.Context, hookName string, hookCfg HookConfig) error {
 	if !experiments.IsEnabled(experiments.PolyglotHooks) {
 		return e.runWrappedShellScriptHook(ctx, hookName, hookCfg)
 	}
@@ -448,9 +500,12 @@ func (e *Executor) applyEnvironmentChanges(changes hook.HookScriptChanges, redac
 	}
 
 	e.shell.Env.Apply(changes.Diff)
+	if e.jobAPI != nil {
+		e.jobAPI.PublishEnvChange(changes.Diff)
+	}
 
 	// reset output redactors based on new environment variable values
-	redactors.Reset(redact.Values(e.shell, e.ExecutorConfig.RedactedVars, e.shell.Env.Dump()))
+	redactors.Reset(e.valuesToRedact())
 
 	// First, let see any of the environment variables are supposed
 	// to change the job configuration at run time.
@@ -573,6 +628,18 @@ func dirForRepository(repository string) string {
 	return badCharsPattern.ReplaceAllString(repository, "-")
 }
 
+// mirrorDirForRepository returns the directory of the mirror of repository.
+// The main repository is mirrored with the partial clone filter, and a
+// partial mirror can't be referenced by clones without the filter (they'd be
+// missing objects), so there's a separate mirror for each filter.
+func (e *Executor) mirrorDirForRepository(repository string) string {
+	dir := dirForRepository(repository)
+	if repository == e.Repository && e.GitPartialCloneFilter != "" {
+		dir += "-filter-" + dirForRepository(e.GitPartialCloneFilter)
+	}
+	return filepath.Join(e.ExecutorConfig.GitMirrorsPath, dir)
+}
+
 // Given a repository, it will add the host to the set of SSH known_hosts on the machine
 func addRepositoryHostToSSHKnownHosts(ctx context.Context, sh *shell.Shell, repository string) {
 	if utils.FileExists(repository) {
@@ -1071,9 +1138,13 @@ func (e *Executor) checkoutPlugin(ctx context.Context, p *plugin.Plugin) (*plugi
 	return checkout, nil
 }
 
-func (e *Executor) removeCheckoutDir() error {
+func (e *Executor) removeCheckoutDir(ctx context.Context) error {
 	checkoutPath, _ := e.shell.Env.Get("BUILDKITE_BUILD_CHECKOUT_PATH")
 
+	// A worktree is also registered with its mirror, which needs pruning once
+	// the worktree is gone.
+	worktreeDir, isWorktree := worktreeGitDir(checkoutPath)
+
 	// on windows, sometimes removing large dirs can fail for various reasons
 	// for instance having files open
 	// see https://github.com/golang/go/issues/20841
@@ -1083,6 +1154,9 @@ func (e *Executor) removeCheckoutDir() error {
 			e.shell.Errorf("Failed to remove \"%s\" (%s)", checkoutPath, err)
 		} else {
 			if _, err := os.Stat(checkoutPath); os.IsNotExist(err) {
+				if isWorktree {
+					e.pruneMirrorWorktrees(ctx, worktreeMirrorDir(worktreeDir))
+				}
 				return nil
 			} else {
 				e.shell.Errorf("Failed to remove %s", checkoutPath)
@@ -1133,7 +1207,7 @@ func (e *Executor) CheckoutPhase(ctx context.Context) error {
 	// Remove the checkout directory if BUILDKITE_CLEAN_CHECKOUT is present
 	if e.CleanCheckout {
 		e.shell.Headerf("Cleaning pipeline checkout")
-		if err = e.removeCheckoutDir(); err != nil {
+		if err = e.removeCheckoutDir(ctx); err != nil {
 			return err
 		}
 	}
@@ -1217,7 +1291,7 @@ func (e *Executor) CheckoutPhase(ctx context.Context) error {
 				// This removes the checkout dir, which means the next checkout
 				// will be a lot slower (clone vs fetch), but hopefully will
 				// allow the agent to self-heal
-				if err := e.removeCheckoutDir(); err != nil {
+				if err := e.removeCheckoutDir(ctx); err != nil {
 					e.shell.Printf("Failed to remove checkout dir while cleaning up after a checkout error.")
 				}
 
@@ -1292,7 +1366,7 @@ func hasGitCommit(ctx context.Context, sh *shell.Shell, gitDir string, commit st
 
 func (e *Executor) updateGitMirror(ctx context.Context, repository string) (string, error) {
 	// Create a unique directory for the repository mirror
-	mirrorDir := filepath.Join(e.ExecutorConfig.GitMirrorsPath, dirForRepository(repository))
+	mirrorDir := e.mirrorDirForRepository(repository)
 	isMainRepository := repository == e.Repository
 
 	// Create the mirrors path if it doesn't exist
@@ -1323,6 +1397,9 @@ func (e *Executor) updateGitMirror(ctx context.Context, repository string) (stri
 	if !utils.FileExists(mirrorDir) {
 		e.shell.Commentf("Cloning a mirror of the repository to %q", mirrorDir)
 		flags := "--mirror " + e.GitCloneMirrorFlags
+		if isMainRepository && e.GitPartialCloneFilter != "" {
+			flags += fmt.Sprintf(" --filter=%q", e.GitPartialCloneFilter)
+		}
 		if err := gitClone(ctx, e.shell, flags, repository, mirrorDir); err != nil {
 			e.shell.Commentf("Removing mirror dir %q due to failed clone", mirrorDir)
 			if err := os.RemoveAll(mirrorDir); err != nil {
@@ -1331,9 +1408,14 @@ func (e *Executor) updateGitMirror(ctx context.Context, repository string) (stri
 			return "", err
 		}
 
+		e.markMirrorUsed(mirrorDir)
 		return mirrorDir, nil
 	}
 
+	// Recorded while holding the clone lock, so that mirror GC (which takes
+	// it too) can't remove the mirror from under us.
+	e.markMirrorUsed(mirrorDir)
+
 	// If it exists, immediately release the clone lock
 	mirrorCloneLock.Unlock()
 
@@ -1345,12 +1427,8 @@ func (e *Executor) updateGitMirror(ctx context.Context, repository string) (stri
 		}
 	}
 
-	if e.Debug {
-		e.shell.Commentf("Acquiring mirror repository update lock")
-	}
-
 	// Lock the mirror dir to prevent concurrent updates
-	mirrorUpdateLock, err := e.shell.LockFile(ctx, mirrorDir+".updatelock", lockTimeout)
+	mirrorUpdateLock, err := e.lockMirrorUpdate(ctx, mirrorDir)
 	if err != nil {
 		return "", err
 	}
@@ -1374,16 +1452,23 @@ func (e *Executor) updateGitMirror(ctx context.Context, repository string) (stri
 	}
 
 	if isMainRepository {
+		// Checkouts that reference the mirror are filtered the same way, so
+		// they can fetch any objects the mirror is missing.
+		fetchArgs := []string{"--git-dir", mirrorDir, "fetch"}
+		if e.GitPartialCloneFilter != "" {
+			fetchArgs = append(fetchArgs, "--filter="+e.GitPartialCloneFilter)
+		}
+
 		if e.PullRequest != "false" && strings.Contains(e.PipelineProvider, "github") {
 			e.shell.Commentf("Fetch and mirror pull request head from GitHub")
 			refspec := fmt.Sprintf("refs/pull/%s/head", e.PullRequest)
 			// Fetch the PR head from the upstream repository into the mirror.
-			if err := e.shell.Run(ctx, "git", "--git-dir", mirrorDir, "fetch", "origin", refspec); err != nil {
+			if err := e.shell.Run(ctx, "git", append(fetchArgs, "origin", refspec)...); err != nil {
 				return "", err
 			}
 		} else {
 			// Fetch the build branch from the upstream repository into the mirror.
-			if err := e.shell.Run(ctx, "git", "--git-dir", mirrorDir, "fetch", "origin", e.Branch); err != nil {
+			if err := e.shell.Run(ctx, "git", append(fetchArgs, "origin", e.Branch)...); err != nil {
 				return "", err
 			}
 		}
@@ -1456,19 +1541,192 @@ func (e *Executor) updateRemoteURL(ctx context.Context, gitDir, repository strin
 	return true, e.shell.Run(ctx, "git", args...)
 }
 
+// updateSparseCheckout sets the directories checked out by a sparse checkout
+// to GitSparseCheckoutPaths, or disables sparse checkout if there are none and
+// an existing checkout was sparse.
+func (e *Executor) updateSparseCheckout(ctx context.Context) error {
+	if len(e.GitSparseCheckoutPaths) > 0 {
+		e.shell.Commentf("Using a sparse checkout of %s", strings.Join(e.GitSparseCheckoutPaths, ", "))
+		return gitSparseCheckout(ctx, e.shell, e.GitSparseCheckoutPaths)
+	}
+
+	// Checkouts that have never been sparse have no sparse-checkout file, so
+	// this avoids asking git in the common case. In a linked worktree, .git
+	// is a file, and the sparse-checkout file is in the worktree's git
+	// directory instead.
+	gitDir := filepath.Join(e.shell.Getwd(), ".git")
+	if dir, ok := worktreeGitDir(e.shell.Getwd()); ok {
+		gitDir = dir
+	}
+	if !utils.FileExists(filepath.Join(gitDir, "info", "sparse-checkout")) {
+		return nil
+	}
+	sparse, _ := e.shell.RunAndCapture(ctx, "git", "config", "--bool", "core.sparseCheckout")
+	if sparse != "true" {
+		return nil
+	}
+
+	e.shell.Commentf("Disabling the sparse checkout left by a previous job")
+	return gitSparseCheckout(ctx, e.shell, nil)
+}
+
+// skipGitLFSSmudge stops git-lfs from fetching LFS files as they are checked
+// out, leaving pointer files in their place. It returns a function that
+// restores the previous behaviour, which submodule updates and the job itself
+// rely on.
+func (e *Executor) skipGitLFSSmudge() func() {
+	prev, hadPrev := e.shell.Env.Get("GIT_LFS_SKIP_SMUDGE")
+	e.shell.Env.Set("GIT_LFS_SKIP_SMUDGE", "1")
+
+	restored := false
+	return func() {
+		if restored {
+			return
+		}
+		restored = true
+		if hadPrev {
+			e.shell.Env.Set("GIT_LFS_SKIP_SMUDGE", prev)
+		} else {
+			e.shell.Env.Remove("GIT_LFS_SKIP_SMUDGE")
+		}
+	}
+}
+
+// checkoutGitLFS fetches and checks out the Git LFS files of the checked out
+// commit, if the repository uses Git LFS. Given a mirror, the LFS objects are
+// cached in it, where they can be reused by other checkouts of the repository.
+func (e *Executor) checkoutGitLFS(ctx context.Context, mirrorDir string) error {
+	uses, err := usesGitLFS(ctx, e.shell)
+	if err != nil {
+		return fmt.Errorf("listing Git LFS files: %w", err)
+	}
+	if !uses {
+		return nil
+	}
+
+	e.shell.Commentf("Git LFS detected, fetching LFS files")
+
+	storage := ""
+	if mirrorDir != "" {
+		// Where git-lfs keeps objects for the mirror itself (and so for
+		// worktrees of it).
+		storage = filepath.Join(mirrorDir, "lfs")
+	}
+	return gitLFSFetchAndCheckout(ctx, e.shell, storage, e.GitSparseCheckoutPaths)
+}
+
+// markMirrorUsed records that the mirror is in use, so mirror GC doesn't remove
+// it for being unused.
+func (e *Executor) markMirrorUsed(mirrorDir string) {
+	if err := gitmirrors.MarkUsed(mirrorDir); err != nil {
+		e.shell.Warningf("Couldn't record that the git mirror %s was used: %v", mirrorDir, err)
+	}
+}
+
+// lockMirrorUpdate locks the mirror to prevent concurrent updates to it,
+// including fetches into worktrees of it.
+func (e *Executor) lockMirrorUpdate(ctx context.Context, mirrorDir string) (shell.LockFile, error) {
+	if e.Debug {
+		e.shell.Commentf("Acquiring mirror repository update lock")
+	}
+	lockTimeout := time.Second * time.Duration(e.GitMirrorsLockTimeout)
+	return e.shell.LockFile(ctx, mirrorDir+".updatelock", lockTimeout)
+}
+
+// checkoutMirrorWorktree makes the checkout directory a worktree of the mirror,
+// unless it already is one. If the worktree can't be created (for example,
+// because the mirror is corrupt), it reports false, and the checkout
+// directory is left for a clone.
+func (e *Executor) checkoutMirrorWorktree(ctx context.Context, mirrorDir string) (bool, error) {
+	checkoutDir := e.shell.Getwd()
+
+	if utils.FileExists(filepath.Join(checkoutDir, ".git")) {
+		if e.isMirrorWorktree(ctx, checkoutDir, mirrorDir) {
+			return true, nil
+		}
+
+		e.shell.Commentf("Replacing the existing checkout with a worktree of the mirror")
+		if err := e.removeCheckoutDir(ctx); err != nil {
+			return false, err
+		}
+		if err := e.createCheckoutDir(); err != nil {
+			return false, err
+		}
+	}
+
+	mirrorUpdateLock, err := e.lockMirrorUpdate(ctx, mirrorDir)
+	if err != nil {
+		return false, err
+	}
+	defer mirrorUpdateLock.Unlock()
+
+	// The mirror may have a stale worktree registered for this directory
+	// (for example, if it was removed by something other than the agent),
+	// which would prevent adding it again.
+	if err := e.shell.Run(ctx, "git", "--git-dir", mirrorDir, "worktree", "prune"); err != nil {
+		e.shell.Warningf("Couldn't prune worktrees of the git mirror: %v", err)
+	}
+
+	// The commit is checked out after fetching, like a clone.
+	if err := e.shell.Run(ctx, "git", "--git-dir", mirrorDir, "worktree", "add", "--detach", "--no-checkout", checkoutDir); err != nil {
+		e.shell.Warningf("Couldn't create a worktree of the git mirror, falling back to a clone: %v", err)
+		return false, nil
+	}
+	return true, nil
+}
+
+// isMirrorWorktree reports whether dir is a usable worktree of the mirror.
+func (e *Executor) isMirrorWorktree(ctx context.Context, dir, mirrorDir string) bool {
+	worktreeDir, ok := worktreeGitDir(dir)
+	if !ok {
+		return false
+	}
+
+	got, err := os.Stat(worktreeMirrorDir(worktreeDir))
+	if err != nil {
+		return false
+	}
+	want, err := os.Stat(mirrorDir)
+	if err != nil || !os.SameFile(got, want) {
+		return false
+	}
+
+	if _, err := e.shell.RunAndCapture(ctx, "git", "rev-parse", "--verify", "HEAD"); err != nil {
+		e.shell.Warningf("The existing worktree of the git mirror is broken: %v", err)
+		return false
+	}
+	return true
+}
+
+// pruneMirrorWorktrees removes the mirror's records of worktrees that no
+// longer exist.
+func (e *Executor) pruneMirrorWorktrees(ctx context.Context, mirrorDir string) {
+	mirrorUpdateLock, err := e.lockMirrorUpdate(ctx, mirrorDir)
+	if err != nil {
+		e.shell.Warningf("Couldn't lock the git mirror to prune worktrees: %v", err)
+		return
+	}
+	defer mirrorUpdateLock.Unlock()
+
+	if err := e.shell.Run(ctx, "git", "--git-dir", mirrorDir, "worktree", "prune"); err != nil {
+		e.shell.Warningf("Couldn't prune worktrees of the git mirror: %v", err)
+	}
+}
+
 func (e *Executor) getOrUpdateMirrorDir(ctx context.Context, repository string) (string, error) {
 	var mirrorDir string
 	// Skip updating the Git mirror before using it?
 	if e.ExecutorConfig.GitMirrorsSkipUpdate {
-		mirrorDir = filepath.Join(e.ExecutorConfig.GitMirrorsPath, dirForRepository(repository))
+		mirrorDir = e.mirrorDirForRepository(repository)
 		e.shell.Commentf("Skipping update and using existing mirror for repository %s at %s.", repository, mirrorDir)
 
 		// Check if specified mirrorDir exists, otherwise the clone will fail.
 		if !utils.FileExists(mirrorDir) {
 			// Fall back to a clean clone, rather than failing the clone and therefore the build
 			e.shell.Commentf("No existing mirror found for repository %s at %s.", repository, mirrorDir)
-			mirrorDir = ""
+			return "", nil
 		}
+		e.markMirrorUsed(mirrorDir)
 		return mirrorDir, nil
 	}
 
@@ -1513,16 +1771,60 @@ func (e *Executor) defaultCheckoutPhase(ctx context.Context) error {
 	if mirrorDir != "" {
 		gitCloneFlags += fmt.Sprintf(" --reference %q", mirrorDir)
 	}
+	if e.GitPartialCloneFilter != "" {
+		gitCloneFlags += fmt.Sprintf(" --filter=%q", e.GitPartialCloneFilter)
+	}
+	if len(e.GitSparseCheckoutPaths) > 0 {
+		// The commit is checked out once the sparse checkout is set up, so
+		// there's no need to check out the default branch in full first.
+		gitCloneFlags += " --no-checkout"
+	}
+
+	useWorktree := false
+	if e.GitMirrorsWorktrees && mirrorDir != "" {
+		useWorktree, err = e.checkoutMirrorWorktree(ctx, mirrorDir)
+		if err != nil {
+			return fmt.Errorf("creating worktree of git mirror: %w", err)
+		}
+	} else if _, isWorktree := worktreeGitDir(e.shell.Getwd()); isWorktree {
+		// Left by a job that used worktrees, but this one can't.
+		e.shell.Commentf("Removing the existing worktree of a git mirror")
+		if err := e.removeCheckoutDir(ctx); err != nil {
+			return fmt.Errorf("removing worktree: %w", err)
+		}
+		if err := e.createCheckoutDir(); err != nil {
+			return fmt.Errorf("creating checkout dir: %w", err)
+		}
+	}
+
+	// Git LFS files are fetched in one batch once the commit is checked out,
+	// rather than by the smudge filter one at a time while checking out.
+	gitLFS := false
+	restoreLFSSmudge := func() {}
+	if e.GitLFS {
+		if _, err := e.shell.RunAndCapture(ctx, "git", "lfs", "version"); err != nil {
+			e.shell.Warningf("Git LFS is enabled, but git-lfs doesn't appear to be installed: %v", err)
+		} else {
+			gitLFS = true
+			restoreLFSSmudge = e.skipGitLFSSmudge()
+			defer restoreLFSSmudge()
+		}
+	}
 
 	// Does the git directory exist?
 	existingGitDir := filepath.Join(e.shell.Getwd(), ".git")
-	if utils.FileExists(existingGitDir) {
+	switch {
+	case useWorktree:
+		// The mirror's remote URL was updated along with the mirror.
+
+	case utils.FileExists(existingGitDir):
 		// Update the origin of the repository so we can gracefully handle
 		// repository renames
 		if _, err := e.updateRemoteURL(ctx, "", e.Repository); err != nil {
 			return fmt.Errorf("setting origin: %w", err)
 		}
-	} else {
+
+	default:
 		if err := gitClone(ctx, e.shell, gitCloneFlags, e.Repository, "."); err != nil {
 			return fmt.Errorf("cloning git repository: %w", err)
 		}
@@ -1541,6 +1843,26 @@ func (e *Executor) defaultCheckoutPhase(ctx context.Context) error {
 	}
 
 	gitFetchFlags := e.GitFetchFlags
+	if e.GitPartialCloneFilter != "" {
+		gitFetchFlags += fmt.Sprintf(" --filter=%q", e.GitPartialCloneFilter)
+	}
+
+	var mirrorUpdateLock shell.LockFile
+	if useWorktree {
+		// Fetching into a worktree writes to the mirror, so it mustn't happen
+		// while the mirror is being updated.
+		mirrorUpdateLock, err = e.lockMirrorUpdate(ctx, mirrorDir)
+		if err != nil {
+			return err
+		}
+		defer mirrorUpdateLock.Unlock()
+
+		// A sparse checkout in any worktree enables per-worktree config,
+		// which moves the mirror's core.bare setting where other worktrees
+		// can't see it. Git then treats the mirror's default branch as
+		// checked out, and refuses to fetch into it.
+		gitFetchFlags += " --update-head-ok"
+	}
 
 	switch {
 	case e.RefSpec != "":
@@ -1590,6 +1912,14 @@ func (e *Executor) defaultCheckoutPhase(ctx context.Context) error {
 		}
 	}
 
+	if mirrorUpdateLock != nil {
+		mirrorUpdateLock.Unlock()
+	}
+
+	if err := e.updateSparseCheckout(ctx); err != nil {
+		return fmt.Errorf("updating sparse checkout: %w", err)
+	}
+
 	gitCheckoutFlags := e.GitCheckoutFlags
 
 	if e.Commit == "HEAD" {
@@ -1602,6 +1932,13 @@ func (e *Executor) defaultCheckoutPhase(ctx context.Context) error {
 		}
 	}
 
+	if gitLFS {
+		if err := e.checkoutGitLFS(ctx, mirrorDir); err != nil {
+			return fmt.Errorf("checking out Git LFS files: %w", err)
+		}
+	}
+	restoreLFSSmudge()
+
 	gitSubmodules := false
 	if hasGitSubmodules(e.shell) {
 		if e.GitSubmodules {
@@ -1629,24 +1966,29 @@ func (e *Executor) defaultCheckoutPhase(ctx context.Context) error {
 		}
 
 		// Checking for submodule repositories
-		submoduleRepos, err := gitEnumerateSubmoduleURLs(ctx, e.shell)
+		submodules, err := gitEnumerateSubmodules(ctx, e.shell)
 		if err != nil {
 			e.shell.Warningf("Failed to enumerate git submodules: %v", err)
 		} else {
 			mirrorSubmodules := e.ExecutorConfig.GitMirrorsPath != ""
-			for _, repository := range submoduleRepos {
-				submoduleArgs := append([]string(nil), args...)
+			for _, submodule := range submodules {
 				// submodules might need their fingerprints verified too
 				if e.SSHKeyscan {
-					addRepositoryHostToSSHKnownHosts(ctx, e.shell, repository)
+					addRepositoryHostToSSHKnownHosts(ctx, e.shell, submodule.URL)
 				}
 
-				if !mirrorSubmodules {
+				if !mirrorSubmodules || submodule.Path == "" {
+					continue
+				}
+				if strings.HasPrefix(submodule.URL, "./") || strings.HasPrefix(submodule.URL, "../") {
+					// Relative to the parent repository's remote, so it can't
+					// be mirrored on its own. It's updated without a mirror
+					// below.
 					continue
 				}
 				// It's all mirrored submodules for the rest of the loop.
 
-				mirrorDir, err := e.getOrUpdateMirrorDir(ctx, repository)
+				mirrorDir, err := e.getOrUpdateMirrorDir(ctx, submodule.URL)
 				if err != nil {
 					return fmt.Errorf("getting/updating mirror dir for submodules: %w", err)
 				}
@@ -1656,36 +1998,31 @@ func (e *Executor) defaultCheckoutPhase(ctx context.Context) error {
 					return fmt.Errorf("creating checkout dir: %w", err)
 				}
 
-				// Tests use a local temp path for the repository, real repositories don't. Handle both.
-				var repositoryPath string
-				if !utils.FileExists(repository) {
-					repositoryPath = filepath.Join(e.ExecutorConfig.GitMirrorsPath, dirForRepository(repository))
-				} else {
-					repositoryPath = repository
-				}
-
-				if mirrorDir != "" {
-					submoduleArgs = append(submoduleArgs, "submodule", "update", "--init", "--recursive", "--force", "--reference", repositoryPath)
-				} else {
-					// Fall back to a clean update, rather than failing the checkout and therefore the build
-					submoduleArgs = append(submoduleArgs, "submodule", "update", "--init", "--recursive", "--force")
+				if mirrorDir == "" {
+					// Fall back to a clean update below, rather than failing
+					// the checkout and therefore the build
+					continue
 				}
 
+				// Each submodule is updated on its own, so that it can
+				// reference its own mirror.
+				submoduleArgs := append([]string(nil), args...)
+				submoduleArgs = append(submoduleArgs, "submodule", "update", "--init", "--force", "--reference", mirrorDir, "--", submodule.Path)
 				if err := e.shell.Run(ctx, "git", submoduleArgs...); err != nil {
-					return fmt.Errorf("updating submodules: %w", err)
+					return fmt.Errorf("updating submodule %q: %w", submodule.Path, err)
 				}
 			}
+		}
 
-			if !mirrorSubmodules {
-				args = append(args, "submodule", "update", "--init", "--recursive", "--force")
-				if err := e.shell.Run(ctx, "git", args...); err != nil {
-					return fmt.Errorf("updating submodules: %w", err)
-				}
-			}
+		// Update any submodules that weren't updated from mirrors above, and
+		// any nested submodules.
+		args = append(args, "submodule", "update", "--init", "--recursive", "--force")
+		if err := e.shell.Run(ctx, "git", args...); err != nil {
+			return fmt.Errorf("updating submodules: %w", err)
+		}
 
-			if err := e.shell.Run(ctx, "git", "submodule", "foreach", "--recursive", "git reset --hard"); err != nil {
-				return fmt.Errorf("resetting submodules: %w", err)
-			}
+		if err := e.shell.Run(ctx, "git", "submodule", "foreach", "--recursive", "git reset --hard"); err != nil {
+			return fmt.Errorf("resetting submodules: %w", err)
 		}
 	}
 
@@ -2223,8 +2560,11 @@ func (e *Executor) ignoredEnv() []string {
 // matching environment vars.
 // redactor.Mux (possibly empty) is returned so the caller can `defer redactor.Flush()`
 func (e *Executor) setupRedactors() replacer.Mux {
-	valuesToRedact := redact.Values(e.shell, e.ExecutorConfig.RedactedVars, e.shell.Env.Dump())
-	if len(valuesToRedact) == 0 {
+	valuesToRedact := e.valuesToRedact()
+
+	// If the Job API is running, values to redact can be added at any time,
+	// so the output needs to be wrapped regardless.
+	if len(valuesToRedact) == 0 && e.jobAPI == nil {
 		return nil
 	}
 
@@ -2264,9 +2604,29 @@ func (e *Executor) setupRedactors() replacer.Mux {
 		mux = append(mux, rdc)
 	}
 
+	e.redactionMu.Lock()
+	e.redactors = mux
+	e.redactionMu.Unlock()
+
 	return mux
 }
 
+// valuesToRedact returns the values of environment variables matching
+// RedactedVars, and any values added through the Job API.
+func (e *Executor) valuesToRedact() []string {
+	return e.redactionValuesFor(e.shell)
+}
+
+// redactionValuesFor is valuesToRedact, logging any problems with the redacted
+// vars to logger.
+func (e *Executor) redactionValuesFor(logger shell.Logger) []string {
+	values := redact.Values(logger, e.ExecutorConfig.RedactedVars, e.shell.Env.Dump())
+
+	e.redactionMu.Lock()
+	defer e.redactionMu.Unlock()
+	return append(values, e.redactionValues...)
+}
+
 type pluginCheckout struct {
 	*plugin.Plugin
 	*plugin.Definition
@@ -1,9 +1,11 @@
 package job
 
 import (
+	"bytes"
 	"context"
 	"testing"
 
+	"github.com/buildkite/agent/v3/env"
 	"github.com/buildkite/agent/v3/internal/job/shell"
 	"github.com/buildkite/agent/v3/internal/redact"
 	"github.com/buildkite/agent/v3/tracetools"
@@ -82,6 +84,40 @@ func TestValuesToRedactEmpty(t *testing.T) {
 	}
 }
 
+func TestAddRedactions(t *testing.T) {
+	t.Parallel()
+
+	sh, err := shell.New()
+	if err != nil {
+		t.Fatalf("shell.New() error = %v", err)
+	}
+	var out bytes.Buffer
+	sh.Writer = &out
+	sh.Logger = shell.DiscardLogger
+	sh.Env = env.FromMap(map[string]string{"DATABASE_PASSWORD": "hunter22"})
+
+	e := New(ExecutorConfig{RedactedVars: []string{"*_PASSWORD"}})
+	e.shell = sh
+
+	redactors := e.setupRedactors()
+	e.addRedactions([]string{"swordfish"})
+
+	if _, err := e.shell.Writer.Write([]byte("hunter22 swordfish\n")); err != nil {
+		t.Fatalf("e.shell.Writer.Write(...) error = %v", err)
+	}
+	if err := redactors.Flush(); err != nil {
+		t.Fatalf("redactors.Flush() error = %v", err)
+	}
+	if got, want := out.String(), "[REDACTED] [REDACTED]\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+
+	// The added value survives the redactors being reset from the environment.
+	if got := e.valuesToRedact(); !cmp.Equal(got, []string{"hunter22", "swordfish"}) {
+		t.Errorf("e.valuesToRedact() = %q, want [hunter22 swordfish]", got)
+	}
+}
+
 func TestStartTracing_NoTracingBackend(t *testing.T) {
 	var err error
 
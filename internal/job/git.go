@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
@@ -26,6 +27,9 @@ const (
 	gitErrorFetchBadObject
 	gitErrorClean
 	gitErrorCleanSubmodules
+	gitErrorSparseCheckout
+	gitErrorLFSFetch
+	gitErrorLFSCheckout
 )
 
 var errNoHostname = errors.New("no hostname found")
@@ -160,19 +164,81 @@ func gitFetch(ctx context.Context, sh shellRunner, gitFetchFlags, repository str
 	return nil
 }
 
-func gitEnumerateSubmoduleURLs(ctx context.Context, sh *shell.Shell) ([]string, error) {
-	urls := []string{}
+// gitSparseCheckout restricts the working tree to the given directories
+// (and the files at the top level of the repository), using a cone-mode
+// sparse checkout. With no directories, it disables sparse checkout.
+func gitSparseCheckout(ctx context.Context, sh shellRunner, paths []string) error {
+	commandArgs := []string{"sparse-checkout", "disable"}
+	if len(paths) > 0 {
+		commandArgs = append([]string{"sparse-checkout", "set", "--cone", "--"}, paths...)
+	}
+
+	if err := sh.Run(ctx, "git", commandArgs...); err != nil {
+		return &gitError{error: err, Type: gitErrorSparseCheckout}
+	}
+
+	return nil
+}
+
+// gitLFSFetchAndCheckout fetches the Git LFS objects for HEAD in one batch, and
+// then replaces the LFS pointer files in the working tree with their contents.
+// If storage is not empty, it is used as the LFS object storage directory
+// (lfs.storage), for example to share objects between checkouts. If paths is
+// not empty, only LFS files within those paths are fetched and checked out.
+func gitLFSFetchAndCheckout(ctx context.Context, sh shellRunner, storage string, paths []string) error {
+	var configArgs []string
+	if storage != "" {
+		configArgs = []string{"-c", "lfs.storage=" + storage}
+	}
+
+	fetchArgs := append(append([]string(nil), configArgs...), "lfs", "fetch")
+	if len(paths) > 0 {
+		fetchArgs = append(fetchArgs, "--include="+strings.Join(paths, ","))
+	}
+	if err := sh.Run(ctx, "git", fetchArgs...); err != nil {
+		return &gitError{error: err, Type: gitErrorLFSFetch}
+	}
 
+	checkoutArgs := append(append([]string(nil), configArgs...), "lfs", "checkout")
+	if len(paths) > 0 {
+		checkoutArgs = append(append(checkoutArgs, "--"), paths...)
+	}
+	if err := sh.Run(ctx, "git", checkoutArgs...); err != nil {
+		return &gitError{error: err, Type: gitErrorLFSCheckout}
+	}
+
+	return nil
+}
+
+// gitSubmodule is a submodule, as configured in .gitmodules.
+type gitSubmodule struct {
+	Name string
+	Path string
+	URL  string
+}
+
+// gitEnumerateSubmodules returns the submodules configured in .gitmodules, in
+// the order they appear there. Submodules without a URL are left out.
+func gitEnumerateSubmodules(ctx context.Context, sh *shell.Shell) ([]gitSubmodule, error) {
 	// The output of this command looks like:
+	// submodule.bitbucket-git-docker-example.path\nbitbucket-git-docker-example\0
 	// submodule.bitbucket-git-docker-example.url\ngit@bitbucket.org:lox24/docker-example.git\0
-	// submodule.bitbucket-https-docker-example.url\nhttps://lox24@bitbucket.org/lox24/docker-example.git\0
-	// submodule.github-git-docker-example.url\ngit@github.com:buildkite/docker-example.git\0
+	// submodule.github-https-docker-example.path\ngithub-https-docker-example\0
 	// submodule.github-https-docker-example.url\nhttps://github.com/buildkite/docker-example.git\0
-	output, err := sh.RunAndCapture(ctx, "git", "config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.url")
+	output, err := sh.RunAndCapture(ctx, "git", "config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.(path|url)")
 	if err != nil {
 		return nil, err
 	}
 
+	return parseSubmoduleConfig(output)
+}
+
+// parseSubmoduleConfig parses the output of git config --null --get-regexp
+// for the path and url keys of submodules.
+func parseSubmoduleConfig(output string) ([]gitSubmodule, error) {
+	var names []string
+	byName := make(map[string]*gitSubmodule)
+
 	// splits lines on null-bytes to gracefully handle line endings and repositories with newlines
 	lines := strings.Split(strings.TrimRight(output, "\x00"), "\x00")
 
@@ -182,10 +248,80 @@ func gitEnumerateSubmoduleURLs(ctx context.Context, sh *shell.Shell) ([]string,
 		if len(tokens) != 2 {
 			return nil, fmt.Errorf("Failed to parse .gitmodules line %q", line)
 		}
-		urls = append(urls, tokens[1])
+
+		// Submodule names can contain dots, but the key can't.
+		key, value := tokens[0], tokens[1]
+		dot := strings.LastIndex(key, ".")
+		if !strings.HasPrefix(key, "submodule.") || dot < len("submodule.") {
+			return nil, fmt.Errorf("Failed to parse .gitmodules line %q", line)
+		}
+		name := key[len("submodule."):dot]
+
+		submodule := byName[name]
+		if submodule == nil {
+			submodule = &gitSubmodule{Name: name}
+			byName[name] = submodule
+			names = append(names, name)
+		}
+		switch key[dot+1:] {
+		case "path":
+			submodule.Path = value
+		case "url":
+			submodule.URL = value
+		}
+	}
+
+	submodules := make([]gitSubmodule, 0, len(names))
+	for _, name := range names {
+		if submodule := byName[name]; submodule.URL != "" {
+			submodules = append(submodules, *submodule)
+		}
+	}
+	return submodules, nil
+}
+
+// worktreeGitDir returns the git directory of the linked worktree (such as a
+// worktree of a mirror) in dir. It reports false if dir isn't a linked
+// worktree, for example because it is a clone.
+func worktreeGitDir(dir string) (string, bool) {
+	// In a linked worktree, .git is a file pointing at the git directory,
+	// rather than being the git directory itself.
+	b, err := os.ReadFile(filepath.Join(dir, ".git"))
+	if err != nil {
+		return "", false
+	}
+	line := strings.TrimSpace(string(b))
+	if !strings.HasPrefix(line, "gitdir: ") {
+		return "", false
+	}
+	gitDir := strings.TrimPrefix(line, "gitdir: ")
+	if !filepath.IsAbs(gitDir) {
+		gitDir = filepath.Join(dir, gitDir)
 	}
 
-	return urls, nil
+	// Linked worktrees have git directories in the worktrees directory of
+	// the repository they belong to.
+	if filepath.Base(filepath.Dir(gitDir)) != "worktrees" {
+		return "", false
+	}
+	return gitDir, true
+}
+
+// worktreeMirrorDir returns the git directory of the repository (the mirror)
+// that the worktree with the given git directory belongs to.
+func worktreeMirrorDir(worktreeGitDir string) string {
+	return filepath.Dir(filepath.Dir(worktreeGitDir))
+}
+
+// usesGitLFS reports whether any files in the repository checked out in the
+// shell's working directory use the Git LFS filter. Git works this out from
+// all the .gitattributes files, including those in subdirectories.
+func usesGitLFS(ctx context.Context, sh *shell.Shell) (bool, error) {
+	files, err := sh.RunAndCapture(ctx, "git", "ls-files", "--", ":(attr:filter=lfs)")
+	if err != nil {
+		return false, err
+	}
+	return files != "", nil
 }
 
 func gitRevParseInWorkingDirectory(ctx context.Context, sh *shell.Shell, workingDirectory string, extraRevParseArgs ...string) (string, error) {
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/buildkite/agent/v3/internal/job/shell"
@@ -217,6 +218,183 @@ func TestGitFetch(t *testing.T) {
 	require.NoError(t, err)
 }
 
+func TestGitSparseCheckout(t *testing.T) {
+	sh := new(mockShellRunner).Expect("git", "sparse-checkout", "set", "--cone", "--", "app", "lib/foo")
+	defer sh.Check(t)
+	err := gitSparseCheckout(context.Background(), sh, []string{"app", "lib/foo"})
+	require.NoError(t, err)
+}
+
+func TestGitSparseCheckoutDisable(t *testing.T) {
+	sh := new(mockShellRunner).Expect("git", "sparse-checkout", "disable")
+	defer sh.Check(t)
+	err := gitSparseCheckout(context.Background(), sh, nil)
+	require.NoError(t, err)
+}
+
+func TestGitLFSFetchAndCheckout(t *testing.T) {
+	sh := new(mockShellRunner).
+		Expect("git", "lfs", "fetch").
+		Expect("git", "lfs", "checkout")
+	defer sh.Check(t)
+	err := gitLFSFetchAndCheckout(context.Background(), sh, "", nil)
+	require.NoError(t, err)
+}
+
+func TestGitLFSFetchAndCheckoutWithStorageAndPaths(t *testing.T) {
+	sh := new(mockShellRunner).
+		Expect("git", "-c", "lfs.storage=/mirrors/repo/lfs", "lfs", "fetch", "--include=app,lib/foo").
+		Expect("git", "-c", "lfs.storage=/mirrors/repo/lfs", "lfs", "checkout", "--", "app", "lib/foo")
+	defer sh.Check(t)
+	err := gitLFSFetchAndCheckout(context.Background(), sh, "/mirrors/repo/lfs", []string{"app", "lib/foo"})
+	require.NoError(t, err)
+}
+
+func TestUsesGitLFS(t *testing.T) {
+	t.Parallel()
+
+	const lfsAttributes = "*.psd filter=lfs diff=lfs merge=lfs -text\n"
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		want  bool
+	}{
+		{
+			name:  "no gitattributes",
+			files: map[string]string{"image.psd": "psd"},
+		},
+		{
+			name: "lfs",
+			files: map[string]string{
+				".gitattributes": "*.txt text\n" + lfsAttributes,
+				"image.psd":      "psd",
+			},
+			want: true,
+		},
+		{
+			name: "lfs in subdirectory",
+			files: map[string]string{
+				"assets/.gitattributes": lfsAttributes,
+				"assets/image.psd":      "psd",
+			},
+			want: true,
+		},
+		{
+			name: "no lfs files",
+			files: map[string]string{
+				".gitattributes": lfsAttributes,
+				"readme.txt":     "readme",
+			},
+		},
+		{
+			name: "no lfs",
+			files: map[string]string{
+				".gitattributes": "*.txt text eol=lf\n*.png binary\n",
+				"image.png":      "png",
+			},
+		},
+		{
+			name: "commented out",
+			files: map[string]string{
+				".gitattributes": "# " + lfsAttributes,
+				"image.psd":      "psd",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			dir := t.TempDir()
+			for name, content := range test.files {
+				path := filepath.Join(dir, filepath.FromSlash(name))
+				require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+				require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+			}
+
+			sh := shell.NewTestShell(t)
+			require.NoError(t, sh.Chdir(dir))
+			require.NoError(t, sh.Run(ctx, "git", "init"))
+			require.NoError(t, sh.Run(ctx, "git", "add", "--all"))
+
+			got, err := usesGitLFS(ctx, sh)
+			require.NoError(t, err)
+			assert.Equal(t, test.want, got)
+		})
+	}
+}
+
+func TestParseSubmoduleConfig(t *testing.T) {
+	t.Parallel()
+
+	output := "submodule.docker-example.path\ndocker-example\x00" +
+		"submodule.docker-example.url\ngit@github.com:buildkite/docker-example.git\x00" +
+		"submodule.vendor/dotted.name.url\nhttps://github.com/buildkite/dotted.git\x00" +
+		"submodule.vendor/dotted.name.path\nvendor/dotted\x00" +
+		"submodule.no-url.path\nno-url\x00"
+
+	got, err := parseSubmoduleConfig(output)
+	require.NoError(t, err)
+	assert.Equal(t, []gitSubmodule{
+		{Name: "docker-example", Path: "docker-example", URL: "git@github.com:buildkite/docker-example.git"},
+		{Name: "vendor/dotted.name", Path: "vendor/dotted", URL: "https://github.com/buildkite/dotted.git"},
+	}, got)
+}
+
+func TestWorktreeGitDir(t *testing.T) {
+	t.Parallel()
+
+	mirrorDir := filepath.Join(t.TempDir(), "mirror")
+	worktreeDir := filepath.Join(mirrorDir, "worktrees", "checkout")
+
+	tests := []struct {
+		name   string
+		dotGit string // contents of .git, or "" for a directory
+		want   string
+		wantOK bool
+	}{
+		{
+			name:   "worktree",
+			dotGit: "gitdir: " + worktreeDir + "\n",
+			want:   worktreeDir,
+			wantOK: true,
+		},
+		{
+			name:   "separate git dir",
+			dotGit: "gitdir: " + mirrorDir + "\n",
+		},
+		{
+			name: "clone",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			dotGit := filepath.Join(dir, ".git")
+			if test.dotGit == "" {
+				require.NoError(t, os.Mkdir(dotGit, 0o700))
+			} else {
+				require.NoError(t, os.WriteFile(dotGit, []byte(test.dotGit), 0o600))
+			}
+
+			got, ok := worktreeGitDir(dir)
+			assert.Equal(t, test.want, got)
+			assert.Equal(t, test.wantOK, ok)
+			if ok {
+				assert.Equal(t, mirrorDir, worktreeMirrorDir(got))
+			}
+		})
+	}
+}
+
 // mockShellRunner implements shellRunner for testing expected calls.
 type mockShellRunner struct {
 	got, want [][]string
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"sync/atomic"
@@ -148,6 +149,65 @@ func TestCheckingOutLocalGitProject_WithGitMirrors(t *testing.T) {
 	tester.RunAndCheck(t, env...)
 }
 
+func TestCheckingOutGitLFSFiles_WithGitMirrors(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	if err := tester.EnableGitMirrors(); err != nil {
+		t.Fatalf("EnableGitMirrors() error = %v", err)
+	}
+
+	addGitLFSFile(t, tester.Repo, "")
+
+	env := []string{
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+		"BUILDKITE_GIT_LFS=true",
+	}
+
+	// LFS objects are cached in the mirror
+	lfsStorage := bintest.MatchPattern("^" + regexp.QuoteMeta("lfs.storage="+filepath.Clean(tester.GitMirrorsDir)) + ".+lfs$")
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// But assert which ones are called
+	git.ExpectAll([][]any{
+		{"clone", "--mirror", "-v", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
+		{"lfs", "version"},
+		{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--", tester.Repo.Path, "."},
+		{"clean", "-fdq"},
+		{"fetch", "-v", "--", "origin", "main"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"ls-files", "--", ":(attr:filter=lfs)"},
+		{"-c", lfsStorage, "lfs", "fetch"},
+		{"-c", lfsStorage, "lfs", "checkout"},
+		{"clean", "-fdq"},
+		{"--no-pager", "show", "HEAD", "-s", "--no-color", gitShowFormatArg},
+	})
+
+	// git runs git-lfs for the lfs subcommands
+	lfs := tester.MustMock(t, "git-lfs")
+	lfs.Expect("version").AndExitWith(0)
+	lfs.Expect("fetch").AndExitWith(0)
+	lfs.Expect("checkout").AndExitWith(0)
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+}
+
 func TestCheckingOutLocalGitProjectWithSubmodules_WithGitMirrors(t *testing.T) {
 	t.Parallel()
 
@@ -204,8 +264,9 @@ func TestCheckingOutLocalGitProjectWithSubmodules_WithGitMirrors(t *testing.T) {
 		{"fetch", "-v", "--", "origin", "main"},
 		{"checkout", "-f", "FETCH_HEAD"},
 		{"submodule", "sync", "--recursive"},
-		{"config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.url"},
-		{"-c", "protocol.file.allow=always", "submodule", "update", "--init", "--recursive", "--force", "--reference", submoduleRepo.Path},
+		{"config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.(path|url)"},
+		{"-c", "protocol.file.allow=always", "submodule", "update", "--init", "--force", "--reference", matchSubDir(tester.GitMirrorsDir), "--", filepath.Base(submoduleRepo.Path)},
+		{"-c", "protocol.file.allow=always", "submodule", "update", "--init", "--recursive", "--force"},
 		{"submodule", "foreach", "--recursive", "git reset --hard"},
 		{"clean", "-fdq"},
 		{"submodule", "foreach", "--recursive", "git clean -fdq"},
@@ -218,6 +279,22 @@ func TestCheckingOutLocalGitProjectWithSubmodules_WithGitMirrors(t *testing.T) {
 	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
 
 	tester.RunAndCheck(t, env...)
+
+	// The submodule should borrow objects from its own mirror.
+	alternates := filepath.Join(tester.CheckoutDir(), ".git", "modules", filepath.Base(submoduleRepo.Path), "objects", "info", "alternates")
+	b, err := os.ReadFile(alternates)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q) error = %v", alternates, err)
+	}
+	var want string
+	for _, mirror := range gitMirrorDirs(t, tester.GitMirrorsDir) {
+		if strings.HasSuffix(mirror, filepath.Base(submoduleRepo.Path)) {
+			want = filepath.Join(mirror, "objects")
+		}
+	}
+	if got := strings.TrimSpace(string(b)); got != want {
+		t.Errorf("submodule alternates = %q, want %q", got, want)
+	}
 }
 
 func TestCheckingOutLocalGitProjectWithSubmodulesDisabled_WithGitMirrors(t *testing.T) {
@@ -330,6 +407,267 @@ func TestCheckingOutShallowCloneOfLocalGitProject_WithGitMirrors(t *testing.T) {
 	tester.RunAndCheck(t, env...)
 }
 
+func TestCheckingOutSparsePartialCloneOfLocalGitProject_WithGitMirrors(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	if err := tester.EnableGitMirrors(); err != nil {
+		t.Fatalf("EnableGitMirrors() error = %v", err)
+	}
+
+	bare := createSparseTestGitRepository(t, tester.Repo)
+	defer bare.Close()
+
+	env := []string{
+		"BUILDKITE_REPO=" + bare.URL(),
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLONE_MIRROR_FLAGS=--bare",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+		"BUILDKITE_GIT_PARTIAL_CLONE_FILTER=tree:0",
+		"BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS=app",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// But assert which ones are called
+	git.ExpectAll([][]any{
+		{"clone", "--mirror", "--bare", "--filter=tree:0", "--", bare.URL(), matchSubDir(tester.GitMirrorsDir)},
+		{"clone", "-v", "--reference", matchSubDir(tester.GitMirrorsDir), "--filter=tree:0", "--no-checkout", "--", bare.URL(), "."},
+		{"clean", "-fdq"},
+		{"fetch", "-v", "--filter=tree:0", "--", "origin", "main"},
+		{"sparse-checkout", "set", "--cone", "--", "app"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"clean", "-fdq"},
+		{"--no-pager", "show", "HEAD", "-s", "--no-color", gitShowFormatArg},
+	})
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+
+	assertCheckedOut(t, tester.CheckoutDir(), map[string]bool{
+		"test.txt":    true,
+		"app/app.txt": true,
+		"lib/lib.txt": false,
+	})
+
+	mirrors := gitMirrorDirs(t, tester.GitMirrorsDir)
+	if len(mirrors) != 1 {
+		t.Fatalf("mirrors = %q, want 1 mirror", mirrors)
+	}
+	filter, err := gitConfigInDir(mirrors[0], "remote.origin.partialclonefilter")
+	if err != nil {
+		t.Fatalf("gitConfigInDir(mirror, remote.origin.partialclonefilter) error = %v", err)
+	}
+	if filter != "tree:0" {
+		t.Errorf("mirror remote.origin.partialclonefilter = %q, want %q", filter, "tree:0")
+	}
+}
+
+func TestPartialAndFullClonesUseSeparateMirrors_WithGitMirrors(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	if err := tester.EnableGitMirrors(); err != nil {
+		t.Fatalf("EnableGitMirrors() error = %v", err)
+	}
+
+	bare := createSparseTestGitRepository(t, tester.Repo)
+	defer bare.Close()
+
+	// The bootstrap runs twice, so the mocks are only checked at the end
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").Exactly(2).AndExitWith(0)
+
+	run := func(env ...string) {
+		t.Helper()
+		env = append(env, "BUILDKITE_REPO="+bare.URL())
+		if err := tester.Run(t, env...); err != nil {
+			t.Fatalf("BootstrapTester.Run(%q) = %v\nout = %s", env, err, tester.Output)
+		}
+	}
+
+	// A job with a filter, followed by one without (in a fresh checkout, so
+	// that it clones from the mirror).
+	run("BUILDKITE_GIT_PARTIAL_CLONE_FILTER=blob:none")
+	run("BUILDKITE_CLEAN_CHECKOUT=true")
+
+	tester.CheckMocks(t)
+
+	assertCheckedOut(t, tester.CheckoutDir(), map[string]bool{
+		"test.txt":    true,
+		"app/app.txt": true,
+		"lib/lib.txt": true,
+	})
+
+	mirrors := gitMirrorDirs(t, tester.GitMirrorsDir)
+	if len(mirrors) != 2 {
+		t.Fatalf("mirrors = %q, want 2 mirrors (one partial, one full)", mirrors)
+	}
+	filters := make(map[string]bool)
+	for _, mirror := range mirrors {
+		filter, _ := gitConfigInDir(mirror, "remote.origin.partialclonefilter")
+		filters[filter] = true
+	}
+	if !filters["blob:none"] || !filters[""] {
+		t.Errorf("mirror partial clone filters = %v, want blob:none and none", filters)
+	}
+}
+
+func TestCheckingOutWorktree_WithGitMirrors(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	if err := tester.EnableGitMirrors(); err != nil {
+		t.Fatalf("EnableGitMirrors() error = %v", err)
+	}
+
+	env := []string{
+		"BUILDKITE_GIT_CLONE_MIRROR_FLAGS=--bare",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+		"BUILDKITE_GIT_MIRRORS_WORKTREES=true",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// But assert which ones are called
+	git.ExpectAll([][]any{
+		{"clone", "--mirror", "--bare", "--", tester.Repo.Path, matchSubDir(tester.GitMirrorsDir)},
+		{"--git-dir", matchSubDir(tester.GitMirrorsDir), "worktree", "prune"},
+		{"--git-dir", matchSubDir(tester.GitMirrorsDir), "worktree", "add", "--detach", "--no-checkout", tester.CheckoutDir()},
+		{"clean", "-fdq"},
+		{"fetch", "-v", "--update-head-ok", "--", "origin", "main"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"clean", "-fdq"},
+		{"--no-pager", "show", "HEAD", "-s", "--no-color", gitShowFormatArg},
+	})
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+
+	// In a worktree, .git is a file pointing into the mirror.
+	fi, err := os.Stat(filepath.Join(tester.CheckoutDir(), ".git"))
+	if err != nil {
+		t.Fatalf("os.Stat(.git) error = %v", err)
+	}
+	if fi.IsDir() {
+		t.Errorf(".git is a directory, want a file")
+	}
+	assertCheckedOut(t, tester.CheckoutDir(), map[string]bool{"test.txt": true})
+}
+
+func TestReusingAndReplacingWorktrees_WithGitMirrors(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	if err := tester.EnableGitMirrors(); err != nil {
+		t.Fatalf("EnableGitMirrors() error = %v", err)
+	}
+
+	// The bootstrap runs several times, so the mocks are only checked at the
+	// end
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").Exactly(4).AndExitWith(0)
+
+	run := func(env ...string) {
+		t.Helper()
+		env = append(env, "BUILDKITE_GIT_MIRRORS_WORKTREES=true")
+		if err := tester.Run(t, env...); err != nil {
+			t.Fatalf("BootstrapTester.Run(%q) = %v\nout = %s", env, err, tester.Output)
+		}
+	}
+
+	// The first job creates the worktree, and the second reuses it.
+	run()
+	run()
+	if strings.Contains(tester.Output, "worktree add") {
+		t.Errorf("tester.Output contains %q, want existing worktree to be reused", "worktree add")
+	}
+
+	mirrors := gitMirrorDirs(t, tester.GitMirrorsDir)
+	if len(mirrors) != 1 {
+		t.Fatalf("mirrors = %q, want 1 mirror", mirrors)
+	}
+	mirror := &gitRepository{Path: mirrors[0]}
+
+	// Removing the mirror's record of the worktree breaks it, so it should be
+	// replaced.
+	if err := os.RemoveAll(filepath.Join(mirror.Path, "worktrees")); err != nil {
+		t.Fatalf("os.RemoveAll(mirror/worktrees) = %v", err)
+	}
+	run()
+	if !strings.Contains(tester.Output, "Replacing the existing checkout with a worktree of the mirror") {
+		t.Errorf("tester.Output does not contain %q", "Replacing the existing checkout with a worktree of the mirror")
+	}
+	assertCheckedOut(t, tester.CheckoutDir(), map[string]bool{"test.txt": true})
+
+	// A clean checkout removes the worktree, which should be pruned from the
+	// mirror before a new one is added.
+	run("BUILDKITE_CLEAN_CHECKOUT=true")
+	out, err := mirror.Execute("worktree", "list", "--porcelain")
+	if err != nil {
+		t.Fatalf("mirror.Execute(worktree, list, --porcelain) error = %v\nout = %s", err, out)
+	}
+	if got := strings.Count(out, "worktree "); got != 2 {
+		t.Errorf("mirror worktree list has %d entries, want 2 (the mirror and the checkout)\nout = %s", got, out)
+	}
+
+	tester.CheckMocks(t)
+}
+
+// gitMirrorDirs returns the mirrors in the git mirrors dir, ignoring lock
+// files.
+func gitMirrorDirs(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("os.ReadDir(%q) error = %v", dir, err)
+	}
+	var mirrors []string
+	for _, e := range entries {
+		if e.IsDir() {
+			mirrors = append(mirrors, filepath.Join(dir, e.Name()))
+		}
+	}
+	return mirrors
+}
+
 func TestCheckingOutSetsCorrectGitMetadataAndSendsItToBuildkite_WithGitMirrors(t *testing.T) {
 	t.Parallel()
 
@@ -158,7 +158,7 @@ func TestCheckingOutLocalGitProjectWithSubmodules(t *testing.T) {
 		{"fetch", "-v", "--", "origin", "main"},
 		{"checkout", "-f", "FETCH_HEAD"},
 		{"submodule", "sync", "--recursive"},
-		{"config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.url"},
+		{"config", "--file", ".gitmodules", "--null", "--get-regexp", "submodule\\..+\\.(path|url)"},
 		{"-c", "protocol.file.allow=always", "submodule", "update", "--init", "--recursive", "--force"},
 		{"submodule", "foreach", "--recursive", "git reset --hard"},
 		{"clean", "-fdq"},
@@ -274,6 +274,266 @@ func TestCheckingOutShallowCloneOfLocalGitProject(t *testing.T) {
 	tester.RunAndCheck(t, env...)
 }
 
+func TestCheckingOutSparsePartialCloneOfLocalGitProject(t *testing.T) {
+	t.Parallel()
+
+	tester, err := NewBootstrapTester()
+	if err != nil {
+		t.Fatalf("NewBootstrapTester() error = %v", err)
+	}
+	defer tester.Close()
+
+	bare := createSparseTestGitRepository(t, tester.Repo)
+	defer bare.Close()
+
+	env := []string{
+		"BUILDKITE_REPO=" + bare.URL(),
+		"BUILDKITE_GIT_CLONE_FLAGS=-v",
+		"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+		"BUILDKITE_GIT_FETCH_FLAGS=-v",
+		"BUILDKITE_GIT_PARTIAL_CLONE_FILTER=blob:none",
+		"BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS=app",
+	}
+
+	// Actually execute git commands, but with expectations
+	git := tester.
+		MustMock(t, "git").
+		PassthroughToLocalCommand()
+
+	// But assert which ones are called
+	git.ExpectAll([][]any{
+		{"clone", "-v", "--filter=blob:none", "--no-checkout", "--", bare.URL(), "."},
+		{"clean", "-fdq"},
+		{"fetch", "-v", "--filter=blob:none", "--", "origin", "main"},
+		{"sparse-checkout", "set", "--cone", "--", "app"},
+		{"checkout", "-f", "FETCH_HEAD"},
+		{"clean", "-fdq"},
+		{"--no-pager", "show", "HEAD", "-s", "--no-color", gitShowFormatArg},
+	})
+
+	// Mock out the meta-data calls to the agent after checkout
+	agent := tester.MockAgent(t)
+	agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+	agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+	tester.RunAndCheck(t, env...)
+
+	assertCheckedOut(t, tester.CheckoutDir(), map[string]bool{
+		"test.txt":    true,
+		"app/app.txt": true,
+		"lib/lib.txt": false,
+	})
+
+	filter, err := gitConfigInDir(tester.CheckoutDir(), "remote.origin.partialclonefilter")
+	if err != nil {
+		t.Fatalf("gitConfigInDir(checkout, remote.origin.partialclonefilter) error = %v", err)
+	}
+	if filter != "blob:none" {
+		t.Errorf("remote.origin.partialclonefilter = %q, want %q", filter, "blob:none")
+	}
+}
+
+func TestCheckingOutDisablesPreviousSparseCheckout(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		worktrees bool
+	}{
+		{name: "clone"},
+		{name: "worktree", worktrees: true},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tester, err := NewBootstrapTester()
+			if err != nil {
+				t.Fatalf("NewBootstrapTester() error = %v", err)
+			}
+			defer tester.Close()
+
+			bare := createSparseTestGitRepository(t, tester.Repo)
+			defer bare.Close()
+
+			env := []string{
+				"BUILDKITE_REPO=" + bare.URL(),
+				"BUILDKITE_GIT_PARTIAL_CLONE_FILTER=blob:none",
+			}
+			if test.worktrees {
+				if err := tester.EnableGitMirrors(); err != nil {
+					t.Fatalf("EnableGitMirrors() error = %v", err)
+				}
+				env = append(env, "BUILDKITE_GIT_MIRRORS_WORKTREES=true")
+			}
+
+			// The bootstrap runs twice, so the mocks are only checked after the second
+			agent := tester.MockAgent(t)
+			agent.Expect("meta-data", "exists", "buildkite:git:commit").Exactly(2).AndExitWith(0)
+
+			sparseEnv := append(env, "BUILDKITE_GIT_SPARSE_CHECKOUT_PATHS=app")
+			if err := tester.Run(t, sparseEnv...); err != nil {
+				t.Fatalf("BootstrapTester.Run(%q) = %v\nout = %s", sparseEnv, err, tester.Output)
+			}
+			assertCheckedOut(t, tester.CheckoutDir(), map[string]bool{
+				"app/app.txt": true,
+				"lib/lib.txt": false,
+			})
+
+			// Without any paths, the next job should get the whole repository.
+			tester.RunAndCheck(t, env...)
+			assertCheckedOut(t, tester.CheckoutDir(), map[string]bool{
+				"app/app.txt": true,
+				"lib/lib.txt": true,
+			})
+			if !strings.Contains(tester.Output, "Disabling the sparse checkout") {
+				t.Errorf("tester.Output does not contain %q", "Disabling the sparse checkout")
+			}
+		})
+	}
+}
+
+// createSparseTestGitRepository adds a couple of directories to repo, and
+// returns a bare copy of it that can be partially cloned.
+func TestCheckingOutGitLFSFiles(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		dir  string // where the .gitattributes file is
+	}{
+		{name: "root"},
+		{name: "subdirectory", dir: "assets"},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			tester, err := NewBootstrapTester()
+			if err != nil {
+				t.Fatalf("NewBootstrapTester() error = %v", err)
+			}
+			defer tester.Close()
+
+			addGitLFSFile(t, tester.Repo, test.dir)
+
+			env := []string{
+				"BUILDKITE_GIT_CLONE_FLAGS=-v",
+				"BUILDKITE_GIT_CLEAN_FLAGS=-fdq",
+				"BUILDKITE_GIT_FETCH_FLAGS=-v",
+				"BUILDKITE_GIT_LFS=true",
+			}
+
+			// Actually execute git commands, but with expectations
+			git := tester.
+				MustMock(t, "git").
+				PassthroughToLocalCommand()
+
+			// But assert which ones are called
+			git.ExpectAll([][]any{
+				{"lfs", "version"},
+				{"clone", "-v", "--", tester.Repo.Path, "."},
+				{"clean", "-fdq"},
+				{"fetch", "-v", "--", "origin", "main"},
+				{"checkout", "-f", "FETCH_HEAD"},
+				{"ls-files", "--", ":(attr:filter=lfs)"},
+				{"lfs", "fetch"},
+				{"lfs", "checkout"},
+				{"clean", "-fdq"},
+				{"--no-pager", "show", "HEAD", "-s", "--no-color", gitShowFormatArg},
+			})
+
+			// git runs git-lfs for the lfs subcommands
+			lfs := tester.MustMock(t, "git-lfs")
+			lfs.Expect("version").AndExitWith(0)
+			lfs.Expect("fetch").AndExitWith(0)
+			lfs.Expect("checkout").AndExitWith(0)
+
+			// Mock out the meta-data calls to the agent after checkout
+			agent := tester.MockAgent(t)
+			agent.Expect("meta-data", "exists", "buildkite:git:commit").AndExitWith(1)
+			agent.Expect("meta-data", "set", "buildkite:git:commit").WithStdin(commitPattern)
+
+			tester.RunAndCheck(t, env...)
+		})
+	}
+}
+
+// addGitLFSFile commits a .gitattributes file that tracks binaries with Git
+// LFS, and a binary, to dir in the repository.
+func addGitLFSFile(t *testing.T, repo *gitRepository, dir string) {
+	t.Helper()
+
+	files := map[string]string{
+		".gitattributes": "*.bin filter=lfs diff=lfs merge=lfs -text\n",
+		"image.bin":      "binary",
+	}
+	for name, content := range files {
+		path := filepath.Join(repo.Path, dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatalf("os.MkdirAll(%q, 0o700) = %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("os.WriteFile(%q) = %v", path, err)
+		}
+		if err := repo.Add(path); err != nil {
+			t.Fatalf("repo.Add(%q) = %v", path, err)
+		}
+	}
+	if err := repo.Commit("Track binaries with Git LFS"); err != nil {
+		t.Fatalf(`repo.Commit("Track binaries with Git LFS") = %v`, err)
+	}
+}
+
+func createSparseTestGitRepository(t *testing.T, repo *gitRepository) *gitRepository {
+	t.Helper()
+
+	for _, name := range []string{"app/app.txt", "lib/lib.txt"} {
+		path := filepath.Join(repo.Path, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatalf("os.MkdirAll(%q, 0o700) = %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0o600); err != nil {
+			t.Fatalf("os.WriteFile(%q, %q, 0o600) = %v", path, name, err)
+		}
+		if err := repo.Add(path); err != nil {
+			t.Fatalf("repo.Add(%q) = %v", path, err)
+		}
+	}
+	if err := repo.Commit("Add app and lib"); err != nil {
+		t.Fatalf(`repo.Commit("Add app and lib") = %v`, err)
+	}
+
+	bare, err := createBareGitRepository(repo)
+	if err != nil {
+		t.Fatalf("createBareGitRepository(repo) error = %v", err)
+	}
+	return bare
+}
+
+// assertCheckedOut checks whether each file exists in the checkout.
+func assertCheckedOut(t *testing.T, dir string, files map[string]bool) {
+	t.Helper()
+
+	for name, want := range files {
+		_, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if got := err == nil; got != want {
+			t.Errorf("os.Stat(%q) error = %v, want file to exist = %t", name, err, want)
+		}
+	}
+}
+
+// gitConfigInDir returns the value of a git config key for the repository in
+// dir.
+func gitConfigInDir(dir, key string) (string, error) {
+	out, err := (&gitRepository{Path: dir}).Execute("config", "--get", key)
+	return strings.TrimSpace(out), err
+}
+
 func TestCheckoutErrorIsRetried(t *testing.T) {
 	t.Parallel()
 
@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 )
 
 func createTestGitRespository() (*gitRepository, error) {
@@ -56,6 +57,31 @@ func createTestGitRespository() (*gitRepository, error) {
 	return repo, nil
 }
 
+// createBareGitRepository creates a bare copy of repo (including all of its
+// refs) that allows partial clones.
+func createBareGitRepository(repo *gitRepository) (*gitRepository, error) {
+	tempDirRaw, err := os.MkdirTemp("", "git-bare-repo")
+	if err != nil {
+		return nil, fmt.Errorf("Error creating temp dir: %v", err)
+	}
+
+	// See newGitRepository.
+	tempDir, err := filepath.EvalSymlinks(tempDirRaw)
+	if err != nil {
+		return nil, fmt.Errorf("EvalSymlinks for temp dir: %v", err)
+	}
+
+	if _, err := repo.Execute("clone", "--mirror", "--", repo.Path, tempDir); err != nil {
+		return nil, err
+	}
+
+	bare := &gitRepository{Path: tempDir}
+	if _, err := bare.Execute("config", "uploadpack.allowFilter", "true"); err != nil {
+		return nil, err
+	}
+	return bare, nil
+}
+
 type gitRepository struct {
 	Path string
 }
@@ -125,6 +151,17 @@ func (gr *gitRepository) CreateBranch(branch string) error {
 	return nil
 }
 
+// URL returns a file:// URL for the repository. Git clones from a URL the same
+// way as from a remote, rather than copying the objects as it does for a local
+// path, so partial clone filters are respected.
+func (gr *gitRepository) URL() string {
+	path := filepath.ToSlash(gr.Path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return "file://" + path
+}
+
 func (gr *gitRepository) Close() error {
 	return os.RemoveAll(gr.Path)
 }
@@ -24,6 +24,10 @@ var _ interface {
 type Map[K comparable, V any] struct {
 	items []Tuple[K, V]
 	index map[K]int
+
+	// src is the YAML the map was decoded from, if it was decoded by
+	// DecodeYAMLRoundTrip.
+	src *yamlSource
 }
 
 // MapSS is a convenience alias to reduce keyboard wear.
@@ -283,6 +287,10 @@ func (m *Map[K, V]) MarshalJSON() ([]byte, error) {
 // MarshalYAML returns a *yaml.Node encoding this map (in order), or an error
 // if any of the items could not be encoded into a *yaml.Node.
 func (m *Map[K, V]) MarshalYAML() (any, error) {
+	if om, ok := any(m).(*Map[string, any]); ok && om.src != nil {
+		return om.marshalRoundTrip()
+	}
+
 	n := &yaml.Node{
 		Kind: yaml.MappingNode,
 		Tag:  "!!map",
@@ -11,12 +11,13 @@ import (
 // map[string]any for unmarshaling mappings into any, DecodeYAML chooses
 // *Map[string, any] instead.
 func DecodeYAML(n *yaml.Node) (any, error) {
-	return decodeYAML(make(map[*yaml.Node]bool), n)
+	return decodeYAML(make(map[*yaml.Node]bool), nil, n)
 }
 
 // decode recursively unmarshals n into a generic type (any, []any, or
-// *Map[string, any]) depending on the kind of n.
-func decodeYAML(seen map[*yaml.Node]bool, n *yaml.Node) (any, error) {
+// *Map[string, any]) depending on the kind of n. If rt is not nil, each map
+// records its source for round-tripping (see DecodeYAMLRoundTrip).
+func decodeYAML(seen map[*yaml.Node]bool, rt *roundTrip, n *yaml.Node) (any, error) {
 	// nil decodes to nil.
 	if n == nil {
 		return nil, nil
@@ -60,25 +61,37 @@ func decodeYAML(seen map[*yaml.Node]bool, n *yaml.Node) (any, error) {
 
 	case yaml.SequenceNode:
 		v := make([]any, 0, len(n.Content))
-		for _, c := range n.Content {
-			cv, err := decodeYAML(seen, c)
+		for i, c := range n.Content {
+			cv, err := decodeYAML(seen, rt, c)
 			if err != nil {
 				return nil, err
 			}
 			v = append(v, cv)
+			if rt != nil && c.Anchor != "" && rt.anchors[c] == nil {
+				i := i
+				rt.anchors[c] = func() any { return v[i] }
+			}
 		}
 		return v, nil
 
 	case yaml.MappingNode:
 		m := NewMap[string, any](len(n.Content) / 2)
+		if rt != nil {
+			m.src = &yamlSource{node: n, rt: rt}
+		}
 		// Why not call m.UnmarshalYAML(n) ?
 		// Because we can't pass `seen` through that.
 		err := rangeYAMLMap(n, func(key string, val *yaml.Node) error {
-			v, err := decodeYAML(seen, val)
+			v, err := decodeYAML(seen, rt, val)
 			if err != nil {
 				return err
 			}
 			m.Set(key, v)
+			// The anchored value is decoded again for each alias (or merge),
+			// but only the first time is the anchored value itself.
+			if rt != nil && val.Anchor != "" && rt.anchors[val] == nil {
+				rt.anchors[val] = func() any { v, _ := m.Get(key); return v }
+			}
 			return nil
 		})
 		if err != nil {
@@ -89,14 +102,26 @@ func decodeYAML(seen map[*yaml.Node]bool, n *yaml.Node) (any, error) {
 	case yaml.AliasNode:
 		// This is one of the two ways this can blow up recursively.
 		// The other (map merges) is handled by rangeMap.
-		return decodeYAML(seen, n.Alias)
+		v, err := decodeYAML(seen, rt, n.Alias)
+		if err != nil {
+			return nil, err
+		}
+		if m, ok := v.(*Map[string, any]); ok && m.src != nil {
+			// This is a copy of the anchored map, not the anchored map itself.
+			m.src.alias = n
+		}
+		return v, nil
 
 	case yaml.DocumentNode:
 		switch len(n.Content) {
 		case 0:
 			return nil, nil
 		case 1:
-			return decodeYAML(seen, n.Content[0])
+			v, err := decodeYAML(seen, rt, n.Content[0])
+			if m, ok := v.(*Map[string, any]); ok && m.src != nil {
+				m.src.doc = n
+			}
+			return v, err
 		default:
 			return nil, fmt.Errorf("line %d, col %d: document contains more than 1 content item (%d)", n.Line, n.Column, len(n.Content))
 		}
@@ -0,0 +1,335 @@
+package ordered
+
+import (
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v3"
+)
+
+// DecodeYAMLRoundTrip is like DecodeYAML, but each *Map[string, any] it
+// returns remembers the YAML it was decoded from. When such a map is marshaled
+// back to YAML, anything that is unchanged since decoding is written exactly
+// as it was in the source, including comments, anchors and aliases, merges
+// (`<<: *defaults`), and scalar styles. Anything that has changed is
+// re-encoded, keeping the comments (and anchor) of the value it replaced.
+//
+// Aliases are only kept while the anchored value and the aliased value are
+// both unchanged; otherwise the alias is written out in full. Comments on
+// sequence items are kept by position.
+func DecodeYAMLRoundTrip(n *yaml.Node) (any, error) {
+	rt := &roundTrip{anchors: make(map[*yaml.Node]func() any)}
+	return decodeYAML(make(map[*yaml.Node]bool), rt, n)
+}
+
+// roundTrip is shared by the maps decoded from one document.
+type roundTrip struct {
+	// anchors maps each anchored node to a func returning the current value
+	// decoded from it.
+	anchors map[*yaml.Node]func() any
+}
+
+// yamlSource is the YAML a map was decoded from.
+type yamlSource struct {
+	// node is the mapping node.
+	node *yaml.Node
+
+	// alias is the alias node, if the map was decoded via an alias.
+	alias *yaml.Node
+
+	// doc is the document node, if the map is the document's content.
+	doc *yaml.Node
+
+	rt *roundTrip
+}
+
+// marshalRoundTrip implements MarshalYAML for maps decoded by
+// DecodeYAMLRoundTrip.
+func (m *Map[K, V]) marshalRoundTrip() (*yaml.Node, error) {
+	om := any(m).(*Map[string, any])
+	n, err := om.src.rt.encodeMap(om)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reused nodes come from the source, so make a copy before fixing up
+	// aliases in place.
+	n = copyNode(n)
+	fixAliases(n, make(map[string]*yaml.Node))
+	return n, nil
+}
+
+// encodeMap encodes a map decoded by DecodeYAMLRoundTrip (possibly since
+// altered).
+func (rt *roundTrip) encodeMap(m *Map[string, any]) (*yaml.Node, error) {
+	src := m.src
+	if src.alias != nil && rt.unchanged(m, src.alias) {
+		return src.alias, nil
+	}
+
+	sn := src.node
+	out := &yaml.Node{
+		Kind:  yaml.MappingNode,
+		Tag:   "!!map",
+		Style: sn.Style,
+	}
+	if src.alias != nil {
+		copyComments(out, src.alias)
+	} else {
+		copyComments(out, sn)
+		out.Anchor = sn.Anchor
+	}
+	if src.doc != nil {
+		copyComments(out, src.doc)
+		if out.HeadComment != "" && out.HeadComment == src.doc.HeadComment {
+			// Keep the comment separate from the first item.
+			out.HeadComment += "\n\n"
+		}
+	}
+
+	// Find the explicit items, and the items provided by each merge.
+	type pair struct{ key, value *yaml.Node }
+	explicit := make(map[string]pair)
+	seen := make(map[string]bool)
+	var mergeIdx []int
+	for i := 0; i < len(sn.Content)-1; i += 2 {
+		k := sn.Content[i]
+		if k.Tag == "!!merge" {
+			mergeIdx = append(mergeIdx, i)
+			continue
+		}
+		ck, err := canonicalMapKey(k)
+		if err != nil {
+			return nil, err
+		}
+		explicit[ck] = pair{k, sn.Content[i+1]}
+		seen[ck] = true
+	}
+
+	// mergedFrom maps each merged key to its merge (as an index into
+	// mergeIdx), and mergedValue to the value node.
+	mergedFrom := make(map[string]int)
+	mergedValue := make(map[string]*yaml.Node)
+	for j, i := range mergeIdx {
+		err := rangeYAMLMapImpl(make(map[*yaml.Node]bool), sn.Content[i+1], func(k string, v *yaml.Node) error {
+			if seen[k] {
+				return nil
+			}
+			seen[k] = true
+			mergedFrom[k] = j
+			mergedValue[k] = v
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// A merge can be kept if what it refers to is unchanged, and every item it
+	// provides is still in the map, unchanged.
+	intact := make([]bool, len(mergeIdx))
+	for j, i := range mergeIdx {
+		intact[j] = rt.aliasesUnchanged(sn.Content[i+1], make(map[*yaml.Node]bool))
+	}
+	for k, j := range mergedFrom {
+		v, has := m.Get(k)
+		if !has || !rt.unchanged(v, mergedValue[k]) {
+			intact[j] = false
+		}
+	}
+
+	emitted := make([]bool, len(mergeIdx))
+	err := m.Range(func(k string, v any) error {
+		if j, ok := mergedFrom[k]; ok && intact[j] {
+			if !emitted[j] {
+				i := mergeIdx[j]
+				out.Content = append(out.Content, sn.Content[i], sn.Content[i+1])
+				emitted[j] = true
+			}
+			return nil
+		}
+
+		var kn, vsrc *yaml.Node
+		if p, ok := explicit[k]; ok {
+			kn, vsrc = p.key, p.value
+		} else {
+			// New, or no longer provided by a merge.
+			vsrc = mergedValue[k]
+			kn = new(yaml.Node)
+			if err := kn.Encode(k); err != nil {
+				return err
+			}
+		}
+		vn, err := rt.encode(v, vsrc)
+		if err != nil {
+			return err
+		}
+		out.Content = append(out.Content, kn, vn)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// encode encodes v, reusing src (the node v was decoded from, if known) if v
+// is unchanged.
+func (rt *roundTrip) encode(v any, src *yaml.Node) (*yaml.Node, error) {
+	if src != nil && rt.unchanged(v, src) {
+		return src, nil
+	}
+
+	var n *yaml.Node
+	switch v := v.(type) {
+	case *Map[string, any]:
+		if v.src != nil && v.src.rt == rt {
+			mn, err := rt.encodeMap(v)
+			if err != nil {
+				return nil, err
+			}
+			n = mn
+			break
+		}
+		n = new(yaml.Node)
+		if err := n.Encode(v); err != nil {
+			return nil, err
+		}
+
+	case []any:
+		seq := src
+		if seq != nil && seq.Kind == yaml.AliasNode {
+			seq = seq.Alias
+		}
+		if seq != nil && seq.Kind != yaml.SequenceNode {
+			seq = nil
+		}
+		n = &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		if seq != nil {
+			n.Style = seq.Style
+		}
+		for i, e := range v {
+			var esrc *yaml.Node
+			if seq != nil && i < len(seq.Content) {
+				esrc = seq.Content[i]
+			}
+			en, err := rt.encode(e, esrc)
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, en)
+		}
+
+	default:
+		n = new(yaml.Node)
+		if err := n.Encode(v); err != nil {
+			return nil, err
+		}
+	}
+
+	if src != nil {
+		copyComments(n, src)
+		if src.Kind != yaml.AliasNode && n.Kind != yaml.AliasNode && n.Anchor == "" {
+			n.Anchor = src.Anchor
+		}
+	}
+	return n, nil
+}
+
+// unchanged reports whether v is the same as the value decoded from n, and
+// any aliases within n refer to anchored values that are also unchanged.
+func (rt *roundTrip) unchanged(v any, n *yaml.Node) bool {
+	orig, err := DecodeYAML(n)
+	if err != nil || !valuesEqual(v, orig) {
+		return false
+	}
+	return rt.aliasesUnchanged(n, make(map[*yaml.Node]bool))
+}
+
+func (rt *roundTrip) aliasesUnchanged(n *yaml.Node, checked map[*yaml.Node]bool) bool {
+	if n.Kind == yaml.AliasNode {
+		if checked[n.Alias] {
+			return true
+		}
+		checked[n.Alias] = true
+		current, ok := rt.anchors[n.Alias]
+		if !ok {
+			return false
+		}
+		orig, err := DecodeYAML(n.Alias)
+		return err == nil && valuesEqual(current(), orig)
+	}
+	for _, c := range n.Content {
+		if !rt.aliasesUnchanged(c, checked) {
+			return false
+		}
+	}
+	return true
+}
+
+// fixAliases replaces each alias in n that doesn't refer to an earlier anchor
+// with the same content as the alias's original target, with a copy of that
+// content. This can happen when an anchored value has been changed or
+// removed. defined tracks the anchors defined so far.
+func fixAliases(n *yaml.Node, defined map[string]*yaml.Node) {
+	if n.Anchor != "" {
+		defined[n.Anchor] = n
+	}
+	for i, c := range n.Content {
+		if c.Kind == yaml.AliasNode && c.Alias != nil {
+			if target := defined[c.Value]; target == nil || !sameContent(target, c.Alias) {
+				expanded := copyNode(c.Alias)
+				expanded.Anchor = ""
+				expanded.HeadComment = c.HeadComment
+				expanded.LineComment = c.LineComment
+				expanded.FootComment = c.FootComment
+				n.Content[i] = expanded
+			}
+		}
+		fixAliases(n.Content[i], defined)
+	}
+}
+
+func sameContent(a, b *yaml.Node) bool {
+	av, err := DecodeYAML(a)
+	if err != nil {
+		return false
+	}
+	bv, err := DecodeYAML(b)
+	if err != nil {
+		return false
+	}
+	return valuesEqual(av, bv)
+}
+
+// copyNode deeply copies a node. Aliases still refer to their original
+// targets.
+func copyNode(n *yaml.Node) *yaml.Node {
+	c := *n
+	if c.Tag == "!!merge" {
+		// Otherwise the tag is written out explicitly.
+		c.Tag = ""
+	}
+	if n.Content != nil {
+		c.Content = make([]*yaml.Node, len(n.Content))
+		for i, e := range n.Content {
+			c.Content[i] = copyNode(e)
+		}
+	}
+	return &c
+}
+
+// copyComments copies comments from src to dst, where dst has none.
+func copyComments(dst, src *yaml.Node) {
+	if dst.HeadComment == "" {
+		dst.HeadComment = src.HeadComment
+	}
+	if dst.LineComment == "" {
+		dst.LineComment = src.LineComment
+	}
+	if dst.FootComment == "" {
+		dst.FootComment = src.FootComment
+	}
+}
+
+func valuesEqual(a, b any) bool {
+	return cmp.Equal(a, b, cmp.Comparer(EqualSS), cmp.Comparer(EqualSA))
+}
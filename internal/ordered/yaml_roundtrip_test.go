@@ -0,0 +1,186 @@
+package ordered
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v3"
+)
+
+func TestDecodeYAMLRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	const input = `# Head of document
+
+defaults: &defaults
+    queue: default # the usual queue
+    timeout: 10
+steps:
+    # First step
+    - label: "Test"
+      command: 'go test'
+      <<: *defaults
+    - wait # barrier
+    - label: Deploy
+      agents: *defaults
+# Foot of document
+`
+
+	tests := []struct {
+		desc string
+		edit func(*MapSA)
+		want string
+	}{
+		{
+			desc: "unchanged",
+			edit: func(*MapSA) {},
+			want: input,
+		},
+		{
+			desc: "added key",
+			edit: func(m *MapSA) {
+				step := steps(m)[0].(*MapSA)
+				step.Set("key", "test")
+			},
+			want: `# Head of document
+
+defaults: &defaults
+    queue: default # the usual queue
+    timeout: 10
+steps:
+    # First step
+    - label: "Test"
+      command: 'go test'
+      <<: *defaults
+      key: test
+    - wait # barrier
+    - label: Deploy
+      agents: *defaults
+# Foot of document
+`,
+		},
+		{
+			desc: "changed value",
+			edit: func(m *MapSA) {
+				step := steps(m)[0].(*MapSA)
+				step.Set("command", "go test ./...")
+			},
+			want: `# Head of document
+
+defaults: &defaults
+    queue: default # the usual queue
+    timeout: 10
+steps:
+    # First step
+    - label: "Test"
+      command: go test ./...
+      <<: *defaults
+    - wait # barrier
+    - label: Deploy
+      agents: *defaults
+# Foot of document
+`,
+		},
+		{
+			desc: "changed merged value",
+			edit: func(m *MapSA) {
+				step := steps(m)[0].(*MapSA)
+				step.Set("timeout", 20)
+			},
+			want: `# Head of document
+
+defaults: &defaults
+    queue: default # the usual queue
+    timeout: 10
+steps:
+    # First step
+    - label: "Test"
+      command: 'go test'
+      queue: default # the usual queue
+      timeout: 20
+    - wait # barrier
+    - label: Deploy
+      agents: *defaults
+# Foot of document
+`,
+		},
+		{
+			desc: "changed anchored value",
+			edit: func(m *MapSA) {
+				defaults, _ := m.Get("defaults")
+				defaults.(*MapSA).Set("timeout", 30)
+			},
+			want: `# Head of document
+
+defaults: &defaults
+    queue: default # the usual queue
+    timeout: 30
+steps:
+    # First step
+    - label: "Test"
+      command: 'go test'
+      queue: default # the usual queue
+      timeout: 10
+    - wait # barrier
+    - label: Deploy
+      agents:
+        queue: default # the usual queue
+        timeout: 10
+# Foot of document
+`,
+		},
+		{
+			desc: "deleted anchored value",
+			edit: func(m *MapSA) {
+				m.Delete("defaults")
+				steps(m)[1] = "block"
+			},
+			want: `# Head of document
+
+steps:
+    # First step
+    - label: "Test"
+      command: 'go test'
+      queue: default # the usual queue
+      timeout: 10
+    - block # barrier
+    - label: Deploy
+      agents:
+        queue: default # the usual queue
+        timeout: 10
+# Foot of document
+`,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			var n yaml.Node
+			if err := yaml.Unmarshal([]byte(input), &n); err != nil {
+				t.Fatalf("yaml.Unmarshal(input, &n) error = %v", err)
+			}
+			got, err := DecodeYAMLRoundTrip(&n)
+			if err != nil {
+				t.Fatalf("DecodeYAMLRoundTrip(n) error = %v", err)
+			}
+			m := got.(*MapSA)
+			test.edit(m)
+
+			out, err := yaml.Marshal(m)
+			if err != nil {
+				t.Fatalf("yaml.Marshal(m) error = %v", err)
+			}
+			if diff := cmp.Diff(string(out), test.want); diff != "" {
+				t.Errorf("yaml.Marshal(m) diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func steps(m *MapSA) []any {
+	s, _ := m.Get("steps")
+	return s.([]any)
+}
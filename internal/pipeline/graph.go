@@ -0,0 +1,532 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/buildkite/agent/v3/internal/ordered"
+)
+
+// StepGraph is the dependency graph of the steps in a pipeline.
+//
+// Edges come from two sources. Explicit edges come from depends_on. Implicit
+// edges come from the order of steps: a wait step depends on the steps before
+// it (back to the previous wait or block step), and a step after a wait or
+// block step depends on that step (unless it has `depends_on: ~`). Wait and
+// block steps within a group step only affect steps in that group.
+type StepGraph struct {
+	// Nodes are the top-level steps, in order. Group steps contain their
+	// steps as children.
+	Nodes []*GraphNode
+
+	// Edges are the dependencies between steps, in the order they were found.
+	Edges []GraphEdge
+}
+
+// GraphNode is a step in a StepGraph.
+type GraphNode struct {
+	// ID uniquely identifies the node within the graph, and is suitable as a
+	// node identifier in DOT or Mermaid.
+	ID string
+
+	// Path is the location of the step in the pipeline, e.g. "steps[2]".
+	Path string
+
+	// Key is the step's key, if it has one.
+	Key string
+
+	// Label is a short description of the step.
+	Label string
+
+	// Kind is one of "command", "wait", "block", "input", "trigger", "group",
+	// or "unknown".
+	Kind string
+
+	// Children are the steps within a group step.
+	Children []*GraphNode
+}
+
+// GraphEdge is a dependency between two steps in a StepGraph.
+type GraphEdge struct {
+	// From is the ID of the step depended on, and To is the ID of the
+	// dependent step.
+	From, To string
+
+	// Implicit is true for edges that come from the order of steps, rather
+	// than depends_on.
+	Implicit bool
+
+	// AllowFailure is true if the dependency has allow_failure set.
+	AllowFailure bool
+}
+
+// Graph builds the dependency graph of the pipeline. It returns an error
+// describing every depends_on that refers to an unknown key, any duplicate
+// keys, and any dependency cycles.
+func (p *Pipeline) Graph() (*StepGraph, error) {
+	b := &graphBuilder{
+		graph:  &StepGraph{},
+		byKey:  make(map[string]*GraphNode),
+		parent: make(map[string]*GraphNode),
+	}
+	b.graph.Nodes = b.addSteps(p.Steps, "steps")
+	b.resolveDependencies()
+	b.findCycles()
+
+	if len(b.problems) > 0 {
+		return b.graph, &GraphError{Problems: b.problems}
+	}
+	return b.graph, nil
+}
+
+// GraphError lists the problems found while building a StepGraph.
+type GraphError struct {
+	Problems []string
+}
+
+func (e *GraphError) Error() string {
+	if len(e.Problems) == 1 {
+		return e.Problems[0]
+	}
+	return fmt.Sprintf("%d problems with step dependencies:\n  %s", len(e.Problems), strings.Join(e.Problems, "\n  "))
+}
+
+// graphDependency is a depends_on entry waiting to be resolved.
+type graphDependency struct {
+	node         *GraphNode
+	key          string
+	allowFailure bool
+}
+
+type graphBuilder struct {
+	graph    *StepGraph
+	byKey    map[string]*GraphNode
+	parent   map[string]*GraphNode
+	deps     []graphDependency
+	problems []string
+	count    int
+}
+
+// addSteps adds a sequence of steps (top-level or within a group), and the
+// implicit edges between them.
+func (b *graphBuilder) addSteps(steps Steps, path string) []*GraphNode {
+	var nodes []*GraphNode
+	var barrier *GraphNode
+	var since []*GraphNode
+
+	for i, step := range steps {
+		fields := stepFields(step)
+		n := b.addNode(step, fields, fmt.Sprintf("%s[%d]", path, i))
+		nodes = append(nodes, n)
+
+		switch n.Kind {
+		case "wait":
+			if len(since) == 0 && barrier != nil {
+				b.addEdge(GraphEdge{From: barrier.ID, To: n.ID, Implicit: true})
+			}
+			for _, prev := range since {
+				b.addEdge(GraphEdge{From: prev.ID, To: n.ID, Implicit: true})
+			}
+			barrier, since = n, nil
+
+		case "block":
+			if barrier != nil {
+				b.addEdge(GraphEdge{From: barrier.ID, To: n.ID, Implicit: true})
+			}
+			barrier, since = n, nil
+
+		default:
+			// `depends_on: ~` means the step doesn't wait for anything.
+			if dependsOn, has := fields["depends_on"]; barrier != nil && !(has && dependsOn == nil) {
+				b.addEdge(GraphEdge{From: barrier.ID, To: n.ID, Implicit: true})
+			}
+			since = append(since, n)
+		}
+
+		if g, ok := step.(*GroupStep); ok {
+			n.Children = b.addSteps(g.Steps, n.Path+".steps")
+			for _, c := range n.Children {
+				b.parent[c.ID] = n
+			}
+		}
+	}
+	return nodes
+}
+
+// addNode creates a node for a step, and records its key and dependencies.
+func (b *graphBuilder) addNode(step Step, fields map[string]any, path string) *GraphNode {
+	b.count++
+	n := &GraphNode{
+		ID:   "step" + strconv.Itoa(b.count),
+		Path: path,
+		Key:  stepKey(fields),
+		Kind: "unknown",
+	}
+
+	switch s := step.(type) {
+	case *CommandStep:
+		n.Kind = "command"
+		n.Label = firstLine(s.Command)
+	case *WaitStep:
+		n.Kind = "wait"
+		n.Label = "wait"
+	case *InputStep:
+		// "manual" is an old name for block.
+		n.Kind = "block"
+		if s.Scalar == "input" || hasKey(s.Contents, "input") {
+			n.Kind = "input"
+		}
+		n.Label = firstString(s.Scalar, fields["block"], fields["input"])
+	case TriggerStep:
+		n.Kind = "trigger"
+		n.Label = firstString(fields["trigger"])
+	case *GroupStep:
+		n.Kind = "group"
+		n.Label = firstString(s.Group)
+	}
+	if l := firstString(fields["label"], fields["name"]); l != "" {
+		n.Label = l
+	}
+	if n.Label == "" {
+		n.Label = firstString(n.Key, n.Kind)
+	}
+
+	if n.Key != "" {
+		if prev, exists := b.byKey[n.Key]; exists {
+			b.problems = append(b.problems, fmt.Sprintf("%s: key %q is already used by %s", path, n.Key, prev.Path))
+		} else {
+			b.byKey[n.Key] = n
+		}
+	}
+
+	b.collectDependencies(n, fields["depends_on"])
+	return n
+}
+
+// collectDependencies records the depends_on of a step, which may be a key,
+// a sequence of keys, or a sequence of mappings with "step" and
+// "allow_failure".
+func (b *graphBuilder) collectDependencies(n *GraphNode, dependsOn any) {
+	switch d := dependsOn.(type) {
+	case nil:
+		return
+
+	case string:
+		b.deps = append(b.deps, graphDependency{node: n, key: d})
+
+	case []any:
+		for _, item := range d {
+			switch item := item.(type) {
+			case string:
+				b.deps = append(b.deps, graphDependency{node: n, key: item})
+
+			case *ordered.MapSA:
+				step, _ := item.Get("step")
+				allowFailure, _ := item.Get("allow_failure")
+				key, _ := step.(string)
+				allow, _ := allowFailure.(bool)
+				b.deps = append(b.deps, graphDependency{node: n, key: key, allowFailure: allow})
+
+			default:
+				b.problems = append(b.problems, fmt.Sprintf("%s: depends_on contains %T, want a key or a mapping with \"step\"", n.Path, item))
+			}
+		}
+
+	default:
+		b.problems = append(b.problems, fmt.Sprintf("%s: depends_on is %T, want a key or a sequence", n.Path, d))
+	}
+}
+
+// resolveDependencies turns depends_on keys into edges.
+func (b *graphBuilder) resolveDependencies() {
+	for _, d := range b.deps {
+		target, ok := b.byKey[d.key]
+		if !ok {
+			b.problems = append(b.problems, fmt.Sprintf("%s: depends_on refers to unknown key %q", d.node.Path, d.key))
+			continue
+		}
+		b.addEdge(GraphEdge{From: target.ID, To: d.node.ID, AllowFailure: d.allowFailure})
+	}
+}
+
+func (b *graphBuilder) addEdge(e GraphEdge) {
+	b.graph.Edges = append(b.graph.Edges, e)
+}
+
+// findCycles reports each dependency cycle. A group step is treated as
+// depending on each of its steps, so a step depending on its own group is a
+// cycle.
+func (b *graphBuilder) findCycles() {
+	nodes := make(map[string]*GraphNode)
+	var order []string
+	var walk func([]*GraphNode)
+	walk = func(ns []*GraphNode) {
+		for _, n := range ns {
+			nodes[n.ID] = n
+			order = append(order, n.ID)
+			walk(n.Children)
+		}
+	}
+	walk(b.graph.Nodes)
+
+	// dependents[x] are the nodes that depend on x.
+	dependents := make(map[string][]string)
+	for _, e := range b.graph.Edges {
+		dependents[e.From] = append(dependents[e.From], e.To)
+	}
+	for child, group := range b.parent {
+		dependents[child] = append(dependents[child], group.ID)
+	}
+	for _, ds := range dependents {
+		sort.Slice(ds, func(i, j int) bool { return nodeIndex(ds[i]) < nodeIndex(ds[j]) })
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	state := make(map[string]int)
+	var stack []string
+	var visit func(id string)
+	visit = func(id string) {
+		state[id] = visiting
+		stack = append(stack, id)
+		for _, next := range dependents[id] {
+			switch state[next] {
+			case unvisited:
+				visit(next)
+			case visiting:
+				// Found a cycle: it's the part of the stack from next onwards.
+				var cycle []string
+				for i := len(stack) - 1; i >= 0; i-- {
+					if stack[i] == next {
+						for _, c := range stack[i:] {
+							cycle = append(cycle, nodes[c].describe())
+						}
+						break
+					}
+				}
+				cycle = append(cycle, nodes[next].describe())
+				b.problems = append(b.problems, "dependency cycle: "+strings.Join(cycle, " -> "))
+			}
+		}
+		stack = stack[:len(stack)-1]
+		state[id] = done
+	}
+	for _, id := range order {
+		if state[id] == unvisited {
+			visit(id)
+		}
+	}
+}
+
+// describe names a node in messages, preferring its key.
+func (n *GraphNode) describe() string {
+	if n.Key != "" {
+		return strconv.Quote(n.Key)
+	}
+	return n.Path
+}
+
+// nodeIndex returns the number in a generated node ID, for sorting.
+func nodeIndex(id string) int {
+	i, _ := strconv.Atoi(strings.TrimPrefix(id, "step"))
+	return i
+}
+
+// WriteDOT writes the graph in the Graphviz DOT language. Group steps are
+// drawn as clusters, and implicit edges are dashed.
+func (g *StepGraph) WriteDOT(w io.Writer) error {
+	var sb strings.Builder
+	sb.WriteString("digraph pipeline {\n")
+	sb.WriteString("  compound=true;\n")
+	sb.WriteString("  node [shape=box];\n")
+
+	// DOT edges can't start or end at a cluster, so edges to or from a group
+	// use one of its steps, clipped to the cluster boundary.
+	clusters := make(map[string]*GraphNode)
+
+	var writeNodes func(ns []*GraphNode, indent string)
+	writeNodes = func(ns []*GraphNode, indent string) {
+		for _, n := range ns {
+			if n.Kind == "group" && len(n.Children) > 0 {
+				clusters[n.ID] = n
+				fmt.Fprintf(&sb, "%ssubgraph %s {\n", indent, dotQuote("cluster_"+n.ID))
+				fmt.Fprintf(&sb, "%s  label=%s;\n", indent, dotQuote(n.displayLabel()))
+				writeNodes(n.Children, indent+"  ")
+				fmt.Fprintf(&sb, "%s}\n", indent)
+				continue
+			}
+			fmt.Fprintf(&sb, "%s%s [label=%s%s];\n", indent, dotQuote(n.ID), dotQuote(n.displayLabel()), dotShape(n.Kind))
+		}
+	}
+	writeNodes(g.Nodes, "  ")
+
+	for _, e := range g.Edges {
+		from, to := e.From, e.To
+		var attrs []string
+		if c, ok := clusters[from]; ok {
+			from = lastLeaf(c).ID
+			attrs = append(attrs, "ltail="+dotQuote("cluster_"+c.ID))
+		}
+		if c, ok := clusters[to]; ok {
+			to = firstLeaf(c).ID
+			attrs = append(attrs, "lhead="+dotQuote("cluster_"+c.ID))
+		}
+		if e.Implicit {
+			attrs = append(attrs, "style=dashed")
+		}
+		if e.AllowFailure {
+			attrs = append(attrs, `label="allow failure"`)
+		}
+		fmt.Fprintf(&sb, "  %s -> %s", dotQuote(from), dotQuote(to))
+		if len(attrs) > 0 {
+			fmt.Fprintf(&sb, " [%s]", strings.Join(attrs, ", "))
+		}
+		sb.WriteString(";\n")
+	}
+
+	sb.WriteString("}\n")
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// WriteMermaid writes the graph as a Mermaid flowchart. Group steps are drawn
+// as subgraphs, and implicit edges are dotted.
+func (g *StepGraph) WriteMermaid(w io.Writer) error {
+	var sb strings.Builder
+	sb.WriteString("flowchart TD\n")
+
+	var writeNodes func(ns []*GraphNode, indent string)
+	writeNodes = func(ns []*GraphNode, indent string) {
+		for _, n := range ns {
+			label := mermaidQuote(n.displayLabel())
+			if n.Kind == "group" {
+				fmt.Fprintf(&sb, "%ssubgraph %s[%s]\n", indent, n.ID, label)
+				writeNodes(n.Children, indent+"  ")
+				fmt.Fprintf(&sb, "%send\n", indent)
+				continue
+			}
+			switch n.Kind {
+			case "wait":
+				fmt.Fprintf(&sb, "%s%s{%s}\n", indent, n.ID, label)
+			case "block", "input":
+				fmt.Fprintf(&sb, "%s%s{{%s}}\n", indent, n.ID, label)
+			case "trigger":
+				fmt.Fprintf(&sb, "%s%s[[%s]]\n", indent, n.ID, label)
+			default:
+				fmt.Fprintf(&sb, "%s%s[%s]\n", indent, n.ID, label)
+			}
+		}
+	}
+	writeNodes(g.Nodes, "  ")
+
+	for _, e := range g.Edges {
+		arrow := "-->"
+		if e.Implicit {
+			arrow = "-.->"
+		}
+		if e.AllowFailure {
+			arrow += "|allow failure|"
+		}
+		fmt.Fprintf(&sb, "  %s %s %s\n", e.From, arrow, e.To)
+	}
+
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// displayLabel is the text drawn for a node.
+func (n *GraphNode) displayLabel() string {
+	if n.Key != "" && n.Key != n.Label {
+		return fmt.Sprintf("%s [%s]", n.Label, n.Key)
+	}
+	return n.Label
+}
+
+func firstLeaf(n *GraphNode) *GraphNode {
+	for n.Kind == "group" && len(n.Children) > 0 {
+		n = n.Children[0]
+	}
+	return n
+}
+
+func lastLeaf(n *GraphNode) *GraphNode {
+	for n.Kind == "group" && len(n.Children) > 0 {
+		n = n.Children[len(n.Children)-1]
+	}
+	return n
+}
+
+func dotShape(kind string) string {
+	switch kind {
+	case "wait":
+		return ", shape=diamond"
+	case "block", "input":
+		return ", shape=hexagon"
+	case "trigger":
+		return ", shape=cds"
+	default:
+		return ""
+	}
+}
+
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func mermaidQuote(s string) string {
+	return `"` + strings.NewReplacer(`"`, "#quot;", "\n", " ").Replace(s) + `"`
+}
+
+// stepFields returns the mapping items of a step, other than the ones
+// modelled by struct fields.
+func stepFields(step Step) map[string]any {
+	switch s := step.(type) {
+	case *CommandStep:
+		return s.RemainingFields
+	case *WaitStep:
+		return s.Contents
+	case *InputStep:
+		return s.Contents
+	case TriggerStep:
+		return s
+	case *GroupStep:
+		return s.RemainingFields
+	default:
+		return nil
+	}
+}
+
+// stepKey returns the key of a step. "identifier" and "id" are aliases for
+// "key".
+func stepKey(fields map[string]any) string {
+	return firstString(fields["key"], fields["identifier"], fields["id"])
+}
+
+// firstString returns the first of the values that is a non-empty string.
+func firstString(vals ...any) string {
+	for _, v := range vals {
+		if s, ok := v.(string); ok && s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		return s[:i] + " …"
+	}
+	return s
+}
+
+func hasKey(m map[string]any, k string) bool {
+	_, has := m[k]
+	return has
+}
@@ -0,0 +1,176 @@
+package pipeline
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPipelineGraph(t *testing.T) {
+	t.Parallel()
+
+	input := `steps:
+  - label: Lint
+    key: lint
+    command: make lint
+  - command: make test
+    key: test
+  - wait
+  - group: Deploy
+    key: deploy
+    steps:
+      - command: deploy staging
+      - block: Promote?
+      - command: deploy prod
+        depends_on:
+          - step: test
+            allow_failure: true
+  - trigger: downstream
+    depends_on: deploy
+  - command: early
+    depends_on: ~
+`
+	p, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Parse(input) error = %v", err)
+	}
+	graph, err := p.Graph()
+	if err != nil {
+		t.Fatalf("p.Graph() error = %v", err)
+	}
+
+	var dot strings.Builder
+	if err := graph.WriteDOT(&dot); err != nil {
+		t.Fatalf("graph.WriteDOT() error = %v", err)
+	}
+	const wantDOT = `digraph pipeline {
+  compound=true;
+  node [shape=box];
+  "step1" [label="Lint [lint]"];
+  "step2" [label="make test [test]"];
+  "step3" [label="wait", shape=diamond];
+  subgraph "cluster_step4" {
+    label="Deploy [deploy]";
+    "step5" [label="deploy staging"];
+    "step6" [label="Promote?", shape=hexagon];
+    "step7" [label="deploy prod"];
+  }
+  "step8" [label="downstream", shape=cds];
+  "step9" [label="early"];
+  "step1" -> "step3" [style=dashed];
+  "step2" -> "step3" [style=dashed];
+  "step3" -> "step5" [lhead="cluster_step4", style=dashed];
+  "step6" -> "step7" [style=dashed];
+  "step3" -> "step8" [style=dashed];
+  "step2" -> "step7" [label="allow failure"];
+  "step7" -> "step8" [ltail="cluster_step4"];
+}
+`
+	if diff := cmp.Diff(dot.String(), wantDOT); diff != "" {
+		t.Errorf("graph.WriteDOT() output diff (-got +want):\n%s", diff)
+	}
+
+	var mermaid strings.Builder
+	if err := graph.WriteMermaid(&mermaid); err != nil {
+		t.Fatalf("graph.WriteMermaid() error = %v", err)
+	}
+	const wantMermaid = `flowchart TD
+  step1["Lint [lint]"]
+  step2["make test [test]"]
+  step3{"wait"}
+  subgraph step4["Deploy [deploy]"]
+    step5["deploy staging"]
+    step6{{"Promote?"}}
+    step7["deploy prod"]
+  end
+  step8[["downstream"]]
+  step9["early"]
+  step1 -.-> step3
+  step2 -.-> step3
+  step3 -.-> step4
+  step6 -.-> step7
+  step3 -.-> step8
+  step2 -->|allow failure| step7
+  step4 --> step8
+`
+	if diff := cmp.Diff(mermaid.String(), wantMermaid); diff != "" {
+		t.Errorf("graph.WriteMermaid() output diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestPipelineGraphErrors(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc  string
+		input string
+		want  []string
+	}{
+		{
+			desc: "unknown key",
+			input: `steps:
+  - command: a
+    depends_on: [nope]
+`,
+			want: []string{`steps[0]: depends_on refers to unknown key "nope"`},
+		},
+		{
+			desc: "duplicate key",
+			input: `steps:
+  - command: a
+    key: a
+  - command: b
+    key: a
+`,
+			want: []string{`steps[1]: key "a" is already used by steps[0]`},
+		},
+		{
+			desc: "cycle",
+			input: `steps:
+  - command: a
+    key: a
+    depends_on: c
+  - command: b
+    key: b
+    depends_on: a
+  - command: c
+    key: c
+    depends_on: b
+`,
+			want: []string{`dependency cycle: "a" -> "b" -> "c" -> "a"`},
+		},
+		{
+			desc: "depends on own group",
+			input: `steps:
+  - group: g
+    key: g
+    steps:
+      - command: a
+        depends_on: g
+`,
+			want: []string{`dependency cycle: "g" -> steps[0].steps[0] -> "g"`},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			p, err := Parse(strings.NewReader(test.input))
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", test.input, err)
+			}
+			_, err = p.Graph()
+			var gerr *GraphError
+			if !errors.As(err, &gerr) {
+				t.Fatalf("p.Graph() error = %v, want *GraphError", err)
+			}
+			if diff := cmp.Diff(gerr.Problems, test.want); diff != "" {
+				t.Errorf("p.Graph() problems diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,444 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/buildkite/agent/v3/internal/ordered"
+)
+
+// A pipeline can be assembled from several files, and steps can share
+// configuration through named templates. For example:
+//
+//	templates:
+//	  docker:
+//	    agents:
+//	      queue: docker
+//	    env:
+//	      DOCKER_BUILDKIT: "1"
+//
+//	steps:
+//	  - include: .buildkite/steps/*.yml
+//	  - label: Build
+//	    extends: docker
+//	    command: make build
+//
+// An include step is replaced by the steps from each file it names, in order.
+// Paths are relative to the directory of the including file, and may be glob
+// patterns (matching files are included in lexical order). An included file
+// contains either a sequence of steps, or a mapping with "steps" and
+// "templates" (and nothing else). Include steps may also appear within group
+// steps.
+//
+// A step (or template) that extends one or more templates is merged on top of
+// them, in order: mappings (such as env or agents) are merged recursively, and
+// other values (including sequences) are replaced. Templates may be defined in
+// any of the files that make up the pipeline.
+//
+// Includes and templates are resolved before interpolation, and the templates
+// and extends keys don't appear in the resulting pipeline.
+const (
+	includeKey   = "include"
+	templatesKey = "templates"
+	extendsKey   = "extends"
+)
+
+// ParseAndExpand parses a pipeline, then resolves include steps and step
+// templates (see above). Relative include paths in the pipeline are resolved
+// against dir. Like Parse, it does not apply interpolation.
+func ParseAndExpand(src io.Reader, dir string) (*Pipeline, error) {
+	raw, err := parseRaw(src)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &expander{
+		templates: make(map[string]*template),
+		resolved:  make(map[string]*ordered.MapSA),
+	}
+	if raw, err = e.expand(raw, dir); err != nil {
+		return nil, err
+	}
+
+	p := new(Pipeline)
+	return p, p.unmarshalAny(raw)
+}
+
+// template is a named step template, and the file it was defined in.
+type template struct {
+	step   *ordered.MapSA
+	source string
+}
+
+// expander resolves includes and templates in a raw pipeline.
+type expander struct {
+	templates map[string]*template
+	resolved  map[string]*ordered.MapSA
+
+	// including is the chain of files currently being included, used to
+	// detect include cycles.
+	including []string
+}
+
+// expand resolves includes and templates in a top-level pipeline.
+func (e *expander) expand(raw any, dir string) (any, error) {
+	// Includes first, since templates can be defined in any included file.
+	switch raw := raw.(type) {
+	case *ordered.MapSA:
+		if tmpls, has := raw.Get(templatesKey); has {
+			if err := e.addTemplates(tmpls, "the pipeline"); err != nil {
+				return nil, err
+			}
+			raw.Delete(templatesKey)
+		}
+		steps, has := raw.Get("steps")
+		if !has {
+			return raw, nil
+		}
+		expanded, err := e.expandIncludes(steps, dir)
+		if err != nil {
+			return nil, err
+		}
+		if err := e.applyTemplates(expanded); err != nil {
+			return nil, err
+		}
+		raw.Set("steps", expanded)
+		return raw, nil
+
+	case []any:
+		expanded, err := e.expandIncludes(raw, dir)
+		if err != nil {
+			return nil, err
+		}
+		return expanded, e.applyTemplates(expanded)
+
+	default:
+		// Let unmarshalAny report the problem.
+		return raw, nil
+	}
+}
+
+// expandIncludes replaces include steps in a sequence of steps (and within
+// group steps) with the steps from the included files.
+func (e *expander) expandIncludes(o any, dir string) ([]any, error) {
+	steps, ok := o.([]any)
+	if !ok {
+		if o == nil {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("steps must be a sequence, but got %T", o)
+	}
+
+	out := make([]any, 0, len(steps))
+	for _, st := range steps {
+		m, ok := st.(*ordered.MapSA)
+		if !ok {
+			out = append(out, st)
+			continue
+		}
+
+		if inc, has := m.Get(includeKey); has {
+			if m.Len() != 1 {
+				return nil, fmt.Errorf("an include step must not have any keys other than %q", includeKey)
+			}
+			paths, err := includePaths(inc, dir)
+			if err != nil {
+				return nil, err
+			}
+			for _, path := range paths {
+				included, err := e.includeFile(path)
+				if err != nil {
+					return nil, err
+				}
+				out = append(out, included...)
+			}
+			continue
+		}
+
+		// Group steps contain steps.
+		if inner, has := m.Get("steps"); has {
+			expanded, err := e.expandIncludes(inner, dir)
+			if err != nil {
+				return nil, err
+			}
+			m.Set("steps", expanded)
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// includeFile parses a file and returns the steps in it, with includes
+// expanded. Any templates it defines are added to the expander.
+func (e *expander) includeFile(path string) ([]any, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for i, inc := range e.including {
+		if inc == abs {
+			cycle := append(append([]string{}, e.including[i:]...), abs)
+			return nil, fmt.Errorf("include cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	e.including = append(e.including, abs)
+	defer func() { e.including = e.including[:len(e.including)-1] }()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("including %q: %w", path, err)
+	}
+	defer f.Close()
+
+	raw, err := parseRaw(f)
+	if errors.Is(err, io.EOF) {
+		// An empty file contains no steps.
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("including %q: %w", path, err)
+	}
+
+	var steps any
+	switch raw := raw.(type) {
+	case *ordered.MapSA:
+		err := raw.Range(func(k string, v any) error {
+			switch k {
+			case "steps":
+				steps = v
+				return nil
+			case templatesKey:
+				return e.addTemplates(v, path)
+			default:
+				return fmt.Errorf("an included pipeline can only contain steps and %s, but has %q", templatesKey, k)
+			}
+		})
+		if err != nil {
+			return nil, fmt.Errorf("including %q: %w", path, err)
+		}
+
+	case []any:
+		steps = raw
+
+	case nil:
+		return nil, nil
+
+	default:
+		return nil, fmt.Errorf("including %q: pipeline must be a mapping or a sequence of steps, but got %T", path, raw)
+	}
+
+	expanded, err := e.expandIncludes(steps, filepath.Dir(path))
+	if err != nil {
+		return nil, fmt.Errorf("including %q: %w", path, err)
+	}
+	return expanded, nil
+}
+
+// includePaths returns the files named by the value of an include step, in
+// order. Each path is relative to dir, and may be a glob pattern.
+func includePaths(inc any, dir string) ([]string, error) {
+	var patterns []string
+	switch inc := inc.(type) {
+	case string:
+		patterns = []string{inc}
+
+	case []any:
+		for _, p := range inc {
+			s, ok := p.(string)
+			if !ok {
+				return nil, fmt.Errorf("include paths must be strings, but got %T", p)
+			}
+			patterns = append(patterns, s)
+		}
+
+	default:
+		return nil, fmt.Errorf("include must be a path or a sequence of paths, but got %T", inc)
+	}
+
+	var paths []string
+	for _, pattern := range patterns {
+		if pattern == "" {
+			return nil, errors.New("include path is empty")
+		}
+		pattern = filepath.FromSlash(pattern)
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+
+		if !strings.ContainsAny(pattern, "*?[") {
+			paths = append(paths, pattern)
+			continue
+		}
+
+		// filepath.Glob returns matches in lexical order.
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("include pattern %q: %w", pattern, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("include pattern %q matched no files", pattern)
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// addTemplates adds the templates in a templates mapping.
+func (e *expander) addTemplates(o any, source string) error {
+	tmpls, ok := o.(*ordered.MapSA)
+	if !ok {
+		return fmt.Errorf("%s in %s must be a mapping of names to steps, but got %T", templatesKey, source, o)
+	}
+	return tmpls.Range(func(name string, v any) error {
+		step, ok := v.(*ordered.MapSA)
+		if !ok {
+			return fmt.Errorf("template %q in %s must be a mapping, but got %T", name, source, v)
+		}
+		if prev, exists := e.templates[name]; exists {
+			return fmt.Errorf("template %q is defined in both %s and %s", name, prev.source, source)
+		}
+		e.templates[name] = &template{step: step, source: source}
+		return nil
+	})
+}
+
+// applyTemplates replaces each step (including steps within group steps) that
+// extends templates with the merged result.
+func (e *expander) applyTemplates(steps []any) error {
+	for i, st := range steps {
+		m, ok := st.(*ordered.MapSA)
+		if !ok {
+			continue
+		}
+		merged, err := e.extend(m, nil)
+		if err != nil {
+			return fmt.Errorf("step %d: %w", i+1, err)
+		}
+		steps[i] = merged
+
+		if inner, has := merged.Get("steps"); has {
+			if inner, ok := inner.([]any); ok {
+				if err := e.applyTemplates(inner); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// extend merges a step or template on top of the templates it extends. chain
+// is the chain of templates being resolved, used to detect cycles.
+func (e *expander) extend(m *ordered.MapSA, chain []string) (*ordered.MapSA, error) {
+	ext, has := m.Get(extendsKey)
+	if !has {
+		return m, nil
+	}
+
+	var names []string
+	switch ext := ext.(type) {
+	case string:
+		names = []string{ext}
+
+	case []any:
+		for _, n := range ext {
+			s, ok := n.(string)
+			if !ok {
+				return nil, fmt.Errorf("%s must contain template names, but got %T", extendsKey, n)
+			}
+			names = append(names, s)
+		}
+
+	default:
+		return nil, fmt.Errorf("%s must be a template name or a sequence of names, but got %T", extendsKey, ext)
+	}
+
+	out := ordered.NewMap[string, any](m.Len())
+	for _, name := range names {
+		base, err := e.resolveTemplate(name, chain)
+		if err != nil {
+			return nil, err
+		}
+		mergeInto(out, base)
+	}
+
+	own := ordered.NewMap[string, any](m.Len())
+	m.Range(func(k string, v any) error {
+		if k != extendsKey {
+			own.Set(k, v)
+		}
+		return nil
+	})
+	mergeInto(out, own)
+	return out, nil
+}
+
+// resolveTemplate returns the named template, merged with any templates it
+// extends.
+func (e *expander) resolveTemplate(name string, chain []string) (*ordered.MapSA, error) {
+	for i, n := range chain {
+		if n == name {
+			cycle := append(append([]string{}, chain[i:]...), name)
+			return nil, fmt.Errorf("template cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+	if r, ok := e.resolved[name]; ok {
+		return r, nil
+	}
+
+	t, ok := e.templates[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown template %q", name)
+	}
+	r, err := e.extend(t.step, append(chain, name))
+	if err != nil {
+		return nil, err
+	}
+	e.resolved[name] = r
+	return r, nil
+}
+
+// mergeInto merges src into dst. Mappings present in both are merged
+// recursively, and all other values in src replace those in dst. Values are
+// copied, so that steps sharing a template don't share mappings or sequences.
+func mergeInto(dst, src *ordered.MapSA) {
+	src.Range(func(k string, v any) error {
+		if sm, ok := v.(*ordered.MapSA); ok {
+			if prev, has := dst.Get(k); has {
+				if dm, ok := prev.(*ordered.MapSA); ok {
+					mergeInto(dm, sm)
+					return nil
+				}
+			}
+		}
+		dst.Set(k, copyRaw(v))
+		return nil
+	})
+}
+
+// copyRaw deeply copies a value produced by ordered.DecodeYAML.
+func copyRaw(o any) any {
+	switch o := o.(type) {
+	case *ordered.MapSA:
+		out := ordered.NewMap[string, any](o.Len())
+		o.Range(func(k string, v any) error {
+			out.Set(k, copyRaw(v))
+			return nil
+		})
+		return out
+
+	case []any:
+		out := make([]any, len(o))
+		for i, v := range o {
+			out[i] = copyRaw(v)
+		}
+		return out
+
+	default:
+		return o
+	}
+}
@@ -0,0 +1,208 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// writeFiles writes files (relative path -> content) under dir.
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatalf("os.MkdirAll(%q) error = %v", filepath.Dir(path), err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatalf("os.WriteFile(%q) error = %v", path, err)
+		}
+	}
+}
+
+func TestParseAndExpand(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"steps/a.yml": `steps:
+  - label: a
+    extends: docker
+    command: make a
+`,
+		"steps/b.yml": `- label: b
+  extends: [docker, large]
+  command: make b
+  env:
+    TARGET: b
+`,
+		"steps/nested/c.yml": `templates:
+  large:
+    agents:
+      size: large
+steps:
+  - include: ../../shared.yml
+`,
+		"shared.yml": `- wait
+`,
+	})
+
+	input := `templates:
+  docker:
+    agents:
+      queue: docker
+    env:
+      DOCKER_BUILDKIT: "1"
+      TARGET: all
+    plugins:
+      - docker#v5.0.0:
+          image: golang
+steps:
+  - include: steps/*.yml
+  - group: Nested
+    steps:
+      - include: [steps/nested/c.yml]
+`
+	got, err := ParseAndExpand(strings.NewReader(input), dir)
+	if err != nil {
+		t.Fatalf("ParseAndExpand(input, %q) error = %v", dir, err)
+	}
+
+	gotJSON, err := json.MarshalIndent(got, "", "  ")
+	if err != nil {
+		t.Fatalf(`json.MarshalIndent(got, "", "  ") error = %v`, err)
+	}
+
+	const wantJSON = `{
+  "steps": [
+    {
+      "agents": {
+        "queue": "docker"
+      },
+      "command": "make a",
+      "env": {
+        "DOCKER_BUILDKIT": "1",
+        "TARGET": "all"
+      },
+      "label": "a",
+      "plugins": [
+        {
+          "docker#v5.0.0": {
+            "image": "golang"
+          }
+        }
+      ]
+    },
+    {
+      "agents": {
+        "queue": "docker",
+        "size": "large"
+      },
+      "command": "make b",
+      "env": {
+        "DOCKER_BUILDKIT": "1",
+        "TARGET": "b"
+      },
+      "label": "b",
+      "plugins": [
+        {
+          "docker#v5.0.0": {
+            "image": "golang"
+          }
+        }
+      ]
+    },
+    {
+      "group": "Nested",
+      "steps": [
+        "wait"
+      ]
+    }
+  ]
+}`
+	if diff := cmp.Diff(string(gotJSON), wantJSON); diff != "" {
+		t.Errorf("expanded pipeline JSON diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestParseAndExpandErrors(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"loop-a.yml": "- include: loop-b.yml\n",
+		"loop-b.yml": "- include: loop-a.yml\n",
+		"env.yml":    "env:\n  FOO: bar\nsteps: []\n",
+		"dup.yml":    "templates:\n  t:\n    command: x\nsteps: []\n",
+	})
+
+	tests := []struct {
+		desc, input, wantErr string
+	}{
+		{
+			desc:    "include cycle",
+			input:   "steps:\n  - include: loop-a.yml\n",
+			wantErr: "include cycle: ",
+		},
+		{
+			desc:    "missing file",
+			input:   "steps:\n  - include: nope.yml\n",
+			wantErr: "no such file or directory",
+		},
+		{
+			desc:    "glob without matches",
+			input:   "steps:\n  - include: nope/*.yml\n",
+			wantErr: "matched no files",
+		},
+		{
+			desc:    "include with other keys",
+			input:   "steps:\n  - include: env.yml\n    label: x\n",
+			wantErr: `an include step must not have any keys other than "include"`,
+		},
+		{
+			desc:    "included pipeline with env",
+			input:   "steps:\n  - include: env.yml\n",
+			wantErr: `an included pipeline can only contain steps and templates, but has "env"`,
+		},
+		{
+			desc:    "duplicate template",
+			input:   "templates:\n  t:\n    command: y\nsteps:\n  - include: dup.yml\n",
+			wantErr: `template "t" is defined in both the pipeline and `,
+		},
+		{
+			desc:    "unknown template",
+			input:   "steps:\n  - command: x\n    extends: nope\n",
+			wantErr: `step 1: unknown template "nope"`,
+		},
+		{
+			desc: "template cycle",
+			input: `templates:
+  a:
+    extends: b
+  b:
+    extends: [c, a]
+  c:
+    command: x
+steps:
+  - extends: a
+`,
+			wantErr: "step 1: template cycle: a -> b -> a",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := ParseAndExpand(strings.NewReader(test.input), dir)
+			if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+				t.Errorf("ParseAndExpand(%q, %q) error = %v, want error containing %q", test.input, dir, err, test.wantErr)
+			}
+		})
+	}
+}
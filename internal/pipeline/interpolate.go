@@ -9,7 +9,7 @@ import (
 // pipeline objects.
 
 // selfInterpolater describes types that can interpolate themselves in-place.
-// They can call interpolate.Interpolate on strings, or
+// They can call interpolateString on strings, or
 // interpolate{Slice,Map,OrderedMap,Any} on their other contents, to do this.
 type selfInterpolater interface {
 	interpolate(interpolate.Env) error
@@ -29,7 +29,7 @@ func interpolateAny[T any](env interpolate.Env, o T) (T, error) {
 		err = t.interpolate(env)
 
 	case string:
-		a, err = interpolate.Interpolate(env, t)
+		a, err = interpolateString(env, t)
 
 	case []any:
 		err = interpolateSlice(env, t)
@@ -0,0 +1,431 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/buildkite/interpolate"
+)
+
+// In addition to the expansions supported by buildkite/interpolate ($VAR,
+// ${VAR}, ${VAR:-default}, etc), pipelines can pass a variable through a chain
+// of functions:
+//
+//	${BUILDKITE_BRANCH|slug|substring(0,20)}
+//
+// The functions are:
+//   - lowercase: converts the value to lower case
+//   - slug: lower case, with each run of characters other than letters and
+//     digits replaced with "-" (e.g. "Feature/Add Llamas" -> "feature-add-llamas")
+//   - substring(offset[,length]): the part of the value starting at offset
+//     characters (counting from the end if negative), up to length characters
+//   - base64: the standard base64 encoding of the value
+//   - json-escape: the value escaped for use inside a JSON string
+//
+// Function expansions can't be nested within other expansions.
+
+// funcExpansionRE matches the start of a function expansion.
+var funcExpansionRE = regexp.MustCompile(`^\$\{([A-Za-z_][A-Za-z0-9_]*)\|`)
+
+// interpolationFuncs are the functions available in function expansions.
+var interpolationFuncs = map[string]func(val string, args []int) (string, error){
+	"lowercase": func(val string, args []int) (string, error) {
+		return strings.ToLower(val), checkArgCount(args, 0, 0)
+	},
+	"slug": func(val string, args []int) (string, error) {
+		return slugify(val), checkArgCount(args, 0, 0)
+	},
+	"substring": func(val string, args []int) (string, error) {
+		if err := checkArgCount(args, 1, 2); err != nil {
+			return "", err
+		}
+		return substring(val, args), nil
+	},
+	"base64": func(val string, args []int) (string, error) {
+		return base64.StdEncoding.EncodeToString([]byte(val)), checkArgCount(args, 0, 0)
+	},
+	"json-escape": func(val string, args []int) (string, error) {
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(val); err != nil {
+			return "", err
+		}
+		// Strip the quotes and newline added by the encoder.
+		out := strings.TrimSuffix(buf.String(), "\n")
+		return out[1 : len(out)-1], checkArgCount(args, 0, 0)
+	},
+}
+
+// interpolateString interpolates env into s, including function expansions.
+func interpolateString(env interpolate.Env, s string) (string, error) {
+	segs, err := splitFuncExpansions(s)
+	if err != nil {
+		return "", err
+	}
+	if len(segs) == 1 && segs[0].fn == nil {
+		return interpolate.Interpolate(env, s)
+	}
+
+	var b strings.Builder
+	for _, seg := range segs {
+		var out string
+		if seg.fn != nil {
+			out, err = seg.fn.expand(env)
+		} else {
+			out, err = interpolate.Interpolate(env, seg.text)
+		}
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(out)
+	}
+	return b.String(), nil
+}
+
+// undefinedVariables returns the variables referred to by s that aren't
+// defined in env, and would be expanded (that is, ignoring variables with a
+// default value, or that must be set).
+func undefinedVariables(env interpolate.Env, s string) ([]string, error) {
+	segs, err := splitFuncExpansions(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var undefined []string
+	for _, seg := range segs {
+		if seg.fn != nil {
+			if _, has := env.Get(seg.fn.variable); !has {
+				undefined = append(undefined, seg.fn.variable)
+			}
+			continue
+		}
+		expr, err := interpolate.NewParser(seg.text).Parse()
+		if err != nil {
+			return nil, err
+		}
+		undefined = append(undefined, undefinedInExpression(env, expr)...)
+	}
+	return undefined, nil
+}
+
+func undefinedInExpression(env interpolate.Env, expr interpolate.Expression) []string {
+	var undefined []string
+	for _, item := range expr {
+		switch e := item.Expansion.(type) {
+		case interpolate.VariableExpansion:
+			if _, has := env.Get(e.Identifier); !has {
+				undefined = append(undefined, e.Identifier)
+			}
+
+		case interpolate.SubstringExpansion:
+			if _, has := env.Get(e.Identifier); !has {
+				undefined = append(undefined, e.Identifier)
+			}
+
+		case interpolate.EmptyValueExpansion:
+			// The default is used if the variable is unset or empty.
+			if val, _ := env.Get(e.Identifier); val == "" {
+				undefined = append(undefined, undefinedInExpression(env, e.Content)...)
+			}
+
+		case interpolate.UnsetValueExpansion:
+			if _, has := env.Get(e.Identifier); !has {
+				undefined = append(undefined, undefinedInExpression(env, e.Content)...)
+			}
+
+			// RequiredExpansion reports unset variables itself.
+		}
+	}
+	return undefined
+}
+
+// stringSegment is either text to interpolate with buildkite/interpolate, or
+// a function expansion.
+type stringSegment struct {
+	text string
+	fn   *funcExpansion
+}
+
+// funcExpansion is a variable passed through a chain of functions.
+type funcExpansion struct {
+	variable string
+	calls    []funcCall
+}
+
+type funcCall struct {
+	name string
+	args []int
+}
+
+func (f *funcExpansion) expand(env interpolate.Env) (string, error) {
+	val, _ := env.Get(f.variable)
+	for _, call := range f.calls {
+		out, err := interpolationFuncs[call.name](val, call.args)
+		if err != nil {
+			return "", fmt.Errorf("${%s|...}: %s: %w", f.variable, call.name, err)
+		}
+		val = out
+	}
+	return val, nil
+}
+
+// splitFuncExpansions splits s into function expansions and the text between
+// them. Escapes ("\$" and "$$") and other expansions are left in the text, so
+// that buildkite/interpolate can handle them.
+func splitFuncExpansions(s string) ([]stringSegment, error) {
+	var segs []stringSegment
+	start := 0
+	for i := 0; i < len(s); {
+		rest := s[i:]
+		switch {
+		case strings.HasPrefix(rest, `\\`), strings.HasPrefix(rest, `\$`), strings.HasPrefix(rest, `$$`):
+			i += 2
+
+		case strings.HasPrefix(rest, "${"):
+			m := funcExpansionRE.FindStringSubmatch(rest)
+			if m == nil {
+				// Some other expansion, which may contain nested expansions.
+				n, err := matchingBrace(rest)
+				if err != nil {
+					return nil, err
+				}
+				i += n
+				continue
+			}
+			end := strings.IndexByte(rest, '}')
+			if end < 0 {
+				return nil, fmt.Errorf("function expansion %q is missing a closing }", rest)
+			}
+			fn, err := parseFuncExpansion(m[1], rest[len(m[0]):end])
+			if err != nil {
+				return nil, err
+			}
+			if start < i {
+				segs = append(segs, stringSegment{text: s[start:i]})
+			}
+			segs = append(segs, stringSegment{fn: fn})
+			i += end + 1
+			start = i
+
+		default:
+			i++
+		}
+	}
+	if start < len(s) || len(segs) == 0 {
+		segs = append(segs, stringSegment{text: s[start:]})
+	}
+	return segs, nil
+}
+
+// matchingBrace returns the length of the brace expansion at the start of s,
+// or len(s) if it is unterminated. It returns an error if the expansion
+// contains a function expansion, since buildkite/interpolate can't expand
+// them.
+func matchingBrace(s string) (int, error) {
+	depth := 0
+	for i := 0; i < len(s); {
+		rest := s[i:]
+		switch {
+		case strings.HasPrefix(rest, `\\`), strings.HasPrefix(rest, `\$`), strings.HasPrefix(rest, `$$`):
+			i += 2
+		case strings.HasPrefix(rest, "${"):
+			if depth > 0 && funcExpansionRE.MatchString(rest) {
+				nested := rest
+				if end := strings.IndexByte(rest, '}'); end >= 0 {
+					nested = rest[:end+1]
+				}
+				return 0, fmt.Errorf("function expansion %q can't be nested within another expansion", nested)
+			}
+			depth++
+			i += 2
+		case rest[0] == '}':
+			depth--
+			i++
+			if depth == 0 {
+				return i, nil
+			}
+		default:
+			i++
+		}
+	}
+	return len(s), nil
+}
+
+// parseFuncExpansion parses the chain of function calls in a function
+// expansion, e.g. "slug|substring(0,20)".
+func parseFuncExpansion(variable, chain string) (*funcExpansion, error) {
+	f := &funcExpansion{variable: variable}
+	for _, call := range strings.Split(chain, "|") {
+		call = strings.TrimSpace(call)
+		name, argList := call, ""
+		if open := strings.IndexByte(call, '('); open >= 0 {
+			if !strings.HasSuffix(call, ")") {
+				return nil, fmt.Errorf("${%s|%s}: function call %q is missing a closing )", variable, chain, call)
+			}
+			name, argList = strings.TrimSpace(call[:open]), call[open+1:len(call)-1]
+		}
+		if _, ok := interpolationFuncs[name]; !ok {
+			return nil, fmt.Errorf("${%s|%s}: unknown function %q", variable, chain, name)
+		}
+
+		var args []int
+		if strings.TrimSpace(argList) != "" {
+			for _, a := range strings.Split(argList, ",") {
+				n, err := strconv.Atoi(strings.TrimSpace(a))
+				if err != nil {
+					return nil, fmt.Errorf("${%s|%s}: %s argument %q is not an integer", variable, chain, name, a)
+				}
+				args = append(args, n)
+			}
+		}
+		f.calls = append(f.calls, funcCall{name: name, args: args})
+	}
+	return f, nil
+}
+
+func checkArgCount(args []int, min, max int) error {
+	switch {
+	case len(args) < min:
+		return fmt.Errorf("want at least %d arguments, got %d", min, len(args))
+	case len(args) > max:
+		return fmt.Errorf("want at most %d arguments, got %d", max, len(args))
+	}
+	return nil
+}
+
+// slugify converts s to lower case, and replaces each run of characters other
+// than letters and digits with a single "-".
+func slugify(s string) string {
+	var b strings.Builder
+	dash := false
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if dash && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			dash = false
+			b.WriteRune(r)
+			continue
+		}
+		dash = true
+	}
+	return b.String()
+}
+
+// substring works like ${VAR:offset:length}, but counts characters rather
+// than bytes.
+func substring(s string, args []int) string {
+	rs := []rune(s)
+	from := args[0]
+	if from < 0 {
+		from += len(rs)
+	}
+	if from < 0 {
+		from = 0
+	}
+	if from > len(rs) {
+		from = len(rs)
+	}
+	if len(args) < 2 {
+		return string(rs[from:])
+	}
+
+	to := args[1]
+	if to >= 0 {
+		to += from
+	} else {
+		to += len(rs)
+	}
+	if to < from {
+		to = from
+	}
+	if to > len(rs) {
+		to = len(rs)
+	}
+	return string(rs[from:to])
+}
+
+// UndefinedVariablesError is returned by InterpolateStrict when the pipeline
+// refers to variables that aren't defined.
+type UndefinedVariablesError struct {
+	References []UndefinedReference
+}
+
+// UndefinedReference is a reference to an undefined variable.
+type UndefinedReference struct {
+	// Path locates the reference within the pipeline, e.g. "steps[2].command".
+	Path string
+
+	// Variable is the name of the undefined variable.
+	Variable string
+}
+
+func (e *UndefinedVariablesError) Error() string {
+	refs := make([]string, 0, len(e.References))
+	for _, r := range e.References {
+		refs = append(refs, fmt.Sprintf("%s: $%s is not defined", r.Path, r.Variable))
+	}
+	if len(refs) == 1 {
+		return refs[0]
+	}
+	return fmt.Sprintf("%d references to undefined variables:\n  %s", len(refs), strings.Join(refs, "\n  "))
+}
+
+// findUndefined walks o (a value decoded from JSON) and appends references to
+// undefined variables in its keys and strings.
+func findUndefined(env interpolate.Env, path string, o any, refs []UndefinedReference) ([]UndefinedReference, error) {
+	check := func(path, s string) error {
+		vars, err := undefinedVariables(env, s)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		for _, v := range vars {
+			refs = append(refs, UndefinedReference{Path: path, Variable: v})
+		}
+		return nil
+	}
+
+	switch o := o.(type) {
+	case string:
+		if err := check(path, o); err != nil {
+			return nil, err
+		}
+
+	case []any:
+		for i, v := range o {
+			var err error
+			if refs, err = findUndefined(env, fmt.Sprintf("%s[%d]", path, i), v, refs); err != nil {
+				return nil, err
+			}
+		}
+
+	case map[string]any:
+		keys := make([]string, 0, len(o))
+		for k := range o {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			p := k
+			if path != "" {
+				p = path + "." + k
+			}
+			if err := check(p, k); err != nil {
+				return nil, err
+			}
+			var err error
+			if refs, err = findUndefined(env, p, o[k], refs); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return refs, nil
+}
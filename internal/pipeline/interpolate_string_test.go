@@ -0,0 +1,152 @@
+package pipeline
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestInterpolateStringFunctions(t *testing.T) {
+	t.Parallel()
+
+	environ := env.FromMap(map[string]string{
+		"BRANCH": "Feature/Add Llamas!",
+		"QUOTE":  `say "hi" <now>`,
+		"EMOJI":  "🦙🦙🦙alpaca",
+	})
+
+	tests := []struct {
+		input, want string
+	}{
+		{"${BRANCH|lowercase}", "feature/add llamas!"},
+		{"${BRANCH|slug}", "feature-add-llamas"},
+		{"branch-${BRANCH|slug|substring(0,7)}-x", "branch-feature-x"},
+		{"${BRANCH|substring(-7)}", "Llamas!"},
+		{"${EMOJI|substring(1,3)}", "🦙🦙a"},
+		{"${BRANCH|base64}", "RmVhdHVyZS9BZGQgTGxhbWFzIQ=="},
+		{`{"q": "${QUOTE|json-escape}"}`, `{"q": "say \"hi\" <now>"}`},
+		{"${MISSING|lowercase}", ""},
+		// Other expansions and escapes still work alongside functions.
+		{"${MISSING:-${BRANCH}} ${BRANCH|slug}", "Feature/Add Llamas! feature-add-llamas"},
+		{"$${BRANCH|slug} ${BRANCH|slug}", "${BRANCH|slug} feature-add-llamas"},
+	}
+
+	for _, test := range tests {
+		got, err := interpolateString(environ, test.input)
+		if err != nil {
+			t.Errorf("interpolateString(env, %q) error = %v", test.input, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("interpolateString(env, %q) = %q, want %q", test.input, got, test.want)
+		}
+	}
+}
+
+func TestInterpolateStringFunctionErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, input := range []string{
+		"${BRANCH|shout}",
+		"${BRANCH|substring}",
+		"${BRANCH|substring(a)}",
+		"${BRANCH|lowercase(1)}",
+		"${BRANCH|slug",
+	} {
+		if _, err := interpolateString(env.New(), input); err == nil {
+			t.Errorf("interpolateString(env, %q) error = %v, want non-nil error", input, err)
+		}
+	}
+}
+
+func TestInterpolateStringNestedFunctionExpansion(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		input   string
+		wantErr string
+	}{
+		{
+			input:   "${A:-${B|slug}}",
+			wantErr: `function expansion "${B|slug}" can't be nested within another expansion`,
+		},
+		{
+			input:   "x ${A:+${B:-${C|lowercase|substring(0,3)}}} y",
+			wantErr: `function expansion "${C|lowercase|substring(0,3)}" can't be nested within another expansion`,
+		},
+		{
+			input:   "${A|slug} ${B?${C|base64}}",
+			wantErr: `function expansion "${C|base64}" can't be nested within another expansion`,
+		},
+		{
+			input:   "${A:-${B|slug",
+			wantErr: `function expansion "${B|slug" can't be nested within another expansion`,
+		},
+	}
+
+	for _, test := range tests {
+		_, err := interpolateString(env.New(), test.input)
+		if err == nil || err.Error() != test.wantErr {
+			t.Errorf("interpolateString(env, %q) error = %v, want %q", test.input, err, test.wantErr)
+		}
+	}
+}
+
+func TestInterpolateStrict(t *testing.T) {
+	t.Parallel()
+
+	input := `env:
+  GREETING: "hello ${NAME}"
+  DEFAULTED: "${MAYBE:-fine}"
+steps:
+  - command: echo $GREETING $DEFAULTED $$ESCAPED
+  - label: ":llama: ${LLAMA_COUNT}"
+    command: echo ${BRANCH|slug}
+  - group: g
+    steps:
+      - command: echo ${REQUIRED?}
+        env:
+          ${KEY_VAR}: x
+`
+	p, err := Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Parse(input) error = %v", err)
+	}
+
+	err = p.InterpolateStrict(env.FromMap(map[string]string{"REQUIRED": "yes"}))
+	var uerr *UndefinedVariablesError
+	if !errors.As(err, &uerr) {
+		t.Fatalf("p.InterpolateStrict(env) error = %v, want *UndefinedVariablesError", err)
+	}
+	want := []UndefinedReference{
+		{Path: "env.GREETING", Variable: "NAME"},
+		{Path: "steps[1].command", Variable: "BRANCH"},
+		{Path: "steps[1].label", Variable: "LLAMA_COUNT"},
+		{Path: "steps[2].steps[0].env.${KEY_VAR}", Variable: "KEY_VAR"},
+	}
+	if diff := cmp.Diff(uerr.References, want); diff != "" {
+		t.Errorf("UndefinedVariablesError.References diff (-got +want):\n%s", diff)
+	}
+
+	// With everything defined, it works like Interpolate.
+	p, err = Parse(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Parse(input) error = %v", err)
+	}
+	environ := env.FromMap(map[string]string{
+		"NAME":        "llama",
+		"LLAMA_COUNT": "3",
+		"BRANCH":      "main",
+		"REQUIRED":    "yes",
+		"KEY_VAR":     "K",
+	})
+	if err := p.InterpolateStrict(environ); err != nil {
+		t.Fatalf("p.InterpolateStrict(env) error = %v", err)
+	}
+	if got, want := p.Steps[0].(*CommandStep).Command, "echo hello llama fine $ESCAPED"; got != want {
+		t.Errorf("steps[0].command = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,517 @@
+package pipeline
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/buildkite/agent/v3/internal/ordered"
+	"github.com/qri-io/jsonschema"
+	"gopkg.in/yaml.v3"
+)
+
+// lintSchemaJSON contains a JSON schema for the pipeline itself ("pipeline"),
+// and for each kind of step ("command", "wait", "input", "trigger", and
+// "group").
+//
+//go:embed lint_schema.json
+var lintSchemaJSON []byte
+
+// LintDiagnostic is a problem found in a pipeline by Lint.
+type LintDiagnostic struct {
+	// Line and Column locate the problem in the source (starting at 1). They
+	// are 0 if the position is unknown.
+	Line   int `json:"line"`
+	Column int `json:"column"`
+
+	// Path locates the problem within the pipeline, e.g.
+	// "steps[2].timeout_in_minutes". It is empty for problems with the
+	// pipeline as a whole.
+	Path string `json:"path,omitempty"`
+
+	// Message describes the problem.
+	Message string `json:"message"`
+}
+
+// String formats the diagnostic as "line:column: path: message".
+func (d LintDiagnostic) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d:%d: ", d.Line, d.Column)
+	if d.Path != "" {
+		b.WriteString(d.Path)
+		b.WriteString(": ")
+	}
+	b.WriteString(d.Message)
+	return b.String()
+}
+
+// Lint parses a pipeline, and checks the pipeline and each step in it against
+// a JSON schema for its kind of step. Unlike Parse, which accepts almost
+// anything (leaving the rest for the backend to reject), Lint reports as many
+// problems as it can find, in source order, each with the position of the
+// problem in the source. The error is non-nil only if src could not be read.
+func Lint(src io.Reader) ([]LintDiagnostic, error) {
+	b, err := io.ReadAll(src)
+	if err != nil {
+		return nil, err
+	}
+
+	n := new(yaml.Node)
+	if err := yaml.Unmarshal(b, n); err != nil {
+		return []LintDiagnostic{yamlErrorDiagnostic(err)}, nil
+	}
+	if n.Kind == 0 {
+		return []LintDiagnostic{{Line: 1, Column: 1, Message: "pipeline is empty"}}, nil
+	}
+
+	raw, err := ordered.DecodeYAML(n)
+	if err != nil {
+		return []LintDiagnostic{{Line: n.Line, Column: n.Column, Message: formatYAMLError(err).Error()}}, nil
+	}
+
+	schemas, err := loadLintSchemas()
+	if err != nil {
+		return nil, err
+	}
+
+	l := &linter{schemas: schemas, root: n}
+	switch raw := raw.(type) {
+	case *ordered.MapSA:
+		l.checkSchema(nil, "pipeline", raw)
+		steps, _ := raw.Get("steps")
+		l.lintSteps([]string{"steps"}, steps)
+
+	case []any:
+		// A legacy pipeline that is only a sequence of steps.
+		l.lintSteps(nil, raw)
+
+	default:
+		l.report(nil, nil, fmt.Sprintf("pipeline must be a mapping or a sequence of steps, but is %s", yamlKindName(raw)))
+	}
+
+	sort.SliceStable(l.diags, func(i, j int) bool {
+		if l.diags[i].Line != l.diags[j].Line {
+			return l.diags[i].Line < l.diags[j].Line
+		}
+		return l.diags[i].Column < l.diags[j].Column
+	})
+	return l.diags, nil
+}
+
+// linter accumulates diagnostics.
+type linter struct {
+	schemas map[string]*lintSchema
+	root    *yaml.Node
+	diags   []LintDiagnostic
+}
+
+// lintSteps lints a sequence of steps at path.
+func (l *linter) lintSteps(path []string, o any) {
+	steps, ok := o.([]any)
+	if !ok {
+		// The schema for the containing pipeline or group step reports this.
+		return
+	}
+
+	for i, st := range steps {
+		stepPath := appendPath(path, strconv.Itoa(i))
+
+		switch st := st.(type) {
+		case string:
+			if _, err := NewScalarStep(st); err != nil {
+				l.report(stepPath, nil, fmt.Sprintf("unknown step %q, want one of %v", st, validStepScalars))
+			}
+
+		case *ordered.MapSA:
+			l.lintStep(stepPath, st)
+
+		default:
+			l.report(stepPath, nil, fmt.Sprintf("step must be a mapping or a string, but is %s", yamlKindName(st)))
+		}
+	}
+}
+
+// lintStep lints a single step (in mapping form) at path.
+func (l *linter) lintStep(path []string, m *ordered.MapSA) {
+	if m.Contains(includeKey) {
+		// The included files are linted separately.
+		l.checkSchema(path, "include", m)
+		return
+	}
+
+	var step Step
+	var err error
+	if sType, hasType := m.Get("type"); hasType {
+		sTypeStr, ok := sType.(string)
+		if !ok {
+			l.report(appendPath(path, "type"), nil, fmt.Sprintf("step type must be a string, but is %s", yamlKindName(sType)))
+			return
+		}
+		if step, err = stepByType(sTypeStr); err != nil {
+			l.report(appendPath(path, "type"), nil, err.Error())
+			return
+		}
+	} else if step, err = stepByKeyInference(m); err != nil {
+		if m.Contains(extendsKey) {
+			// The type of step may come from the template.
+			return
+		}
+		l.report(path, nil, err.Error())
+		return
+	}
+
+	var kind string
+	switch step.(type) {
+	case *CommandStep:
+		kind = "command"
+	case *WaitStep:
+		kind = "wait"
+	case *InputStep:
+		kind = "input"
+	case TriggerStep:
+		kind = "trigger"
+	case *GroupStep:
+		kind = "group"
+	default:
+		l.report(path, nil, "unknown step type: a step must contain one of command, commands, plugins, wait, block, input, trigger, or group")
+		// A misspelling of one of those keys is a likely cause.
+		m.Range(func(k string, _ any) error {
+			if suggestion := closestKey(k, stepTypeKeys); suggestion != "" {
+				l.reportKey(appendPath(path, k), fmt.Sprintf("unknown key %q (did you mean %q?)", k, suggestion))
+			}
+			return nil
+		})
+		return
+	}
+
+	if !l.checkSchema(path, kind, m) {
+		// Decoding the step is likely to fail for the same reasons.
+		return
+	}
+
+	if kind == "group" {
+		steps, _ := m.Get("steps")
+		l.lintSteps(appendPath(path, "steps"), steps)
+		return
+	}
+
+	// The schema doesn't describe everything the parser checks (for example,
+	// the structure of a matrix).
+	if err := step.unmarshalMap(m); err != nil {
+		l.report(path, nil, err.Error())
+	}
+}
+
+// checkSchema validates o against the named schema, and checks for keys that
+// aren't in the schema. It reports whether o is valid.
+func (l *linter) checkSchema(path []string, name string, o *ordered.MapSA) bool {
+	schema := l.schemas[name]
+	valid := true
+
+	o.Range(func(k string, _ any) error {
+		if _, known := schema.properties[k]; known {
+			return nil
+		}
+		valid = false
+		msg := fmt.Sprintf("unknown key %q for a %s", k, schemaDescription(name))
+		if suggestion := closestKey(k, schema.properties); suggestion != "" {
+			msg += fmt.Sprintf(" (did you mean %q?)", suggestion)
+		}
+		l.reportKey(appendPath(path, k), msg)
+		return nil
+	})
+
+	// The schema library validates the JSON form of the value.
+	b, err := json.Marshal(o)
+	if err != nil {
+		l.report(path, nil, err.Error())
+		return false
+	}
+	keyErrs, err := schema.ValidateBytes(context.Background(), b)
+	if err != nil {
+		l.report(path, nil, err.Error())
+		return false
+	}
+	for _, ke := range keyErrs {
+		valid = false
+		l.report(path, jsonPointerTokens(ke.PropertyPath), ke.Message)
+	}
+	return valid
+}
+
+// report adds a diagnostic for the value at path (followed by rel, a path
+// relative to it). The position is that of the deepest node along the path
+// that exists.
+func (l *linter) report(path, rel []string, msg string) {
+	full := append(append([]string{}, path...), rel...)
+	n := yamlNodeAt(l.root, full, false)
+	l.diags = append(l.diags, LintDiagnostic{
+		Line:    n.Line,
+		Column:  n.Column,
+		Path:    formatLintPath(full),
+		Message: msg,
+	})
+}
+
+// reportKey is like report, but uses the position of the mapping key at the end
+// of the path, rather than its value.
+func (l *linter) reportKey(path []string, msg string) {
+	n := yamlNodeAt(l.root, path, true)
+	l.diags = append(l.diags, LintDiagnostic{
+		Line:    n.Line,
+		Column:  n.Column,
+		Path:    formatLintPath(path),
+		Message: msg,
+	})
+}
+
+// stepTypeKeys are the keys used to infer the type of a step.
+var stepTypeKeys = map[string]json.RawMessage{
+	"command": nil, "commands": nil, "plugins": nil,
+	"wait": nil, "waiter": nil,
+	"block": nil, "input": nil, "manual": nil,
+	"trigger": nil, "group": nil,
+}
+
+// lintSchema is a compiled schema, together with the names of the properties
+// it describes.
+type lintSchema struct {
+	*jsonschema.Schema
+	properties map[string]json.RawMessage
+}
+
+var (
+	lintSchemasOnce sync.Once
+	lintSchemas     map[string]*lintSchema
+	lintSchemasErr  error
+)
+
+// loadLintSchemas parses the embedded schemas (once).
+func loadLintSchemas() (map[string]*lintSchema, error) {
+	lintSchemasOnce.Do(func() {
+		var raws map[string]json.RawMessage
+		if err := json.Unmarshal(lintSchemaJSON, &raws); err != nil {
+			lintSchemasErr = fmt.Errorf("parsing lint schema: %w", err)
+			return
+		}
+		schemas := make(map[string]*lintSchema, len(raws))
+		for name, raw := range raws {
+			s := &lintSchema{Schema: new(jsonschema.Schema)}
+			if err := json.Unmarshal(raw, s.Schema); err != nil {
+				lintSchemasErr = fmt.Errorf("parsing lint schema %q: %w", name, err)
+				return
+			}
+			var props struct {
+				Properties map[string]json.RawMessage `json:"properties"`
+			}
+			if err := json.Unmarshal(raw, &props); err != nil {
+				lintSchemasErr = fmt.Errorf("parsing lint schema %q: %w", name, err)
+				return
+			}
+			s.properties = props.Properties
+			schemas[name] = s
+		}
+		lintSchemas = schemas
+	})
+	return lintSchemas, lintSchemasErr
+}
+
+// schemaDescription describes what the named schema applies to.
+func schemaDescription(name string) string {
+	if name == "pipeline" {
+		return "pipeline"
+	}
+	return name + " step"
+}
+
+// closestKey returns the known key closest to k, if it is close enough to
+// be a likely typo.
+func closestKey(k string, known map[string]json.RawMessage) string {
+	best, bestDist := "", 3
+	for candidate := range known {
+		if d := editDistance(k, candidate); d < bestDist || (d == bestDist && best != "" && candidate < best) {
+			best, bestDist = candidate, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	curr := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min3(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev, curr = curr, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// yamlNodeAt follows path from n, and returns the deepest node found along the
+// path. If key is true and the whole path is found, it returns the mapping key
+// node for the last element of the path instead of the value node.
+func yamlNodeAt(n *yaml.Node, path []string, key bool) *yaml.Node {
+	for n.Kind == yaml.DocumentNode && len(n.Content) == 1 {
+		n = n.Content[0]
+	}
+	for n.Kind == yaml.AliasNode && n.Alias != nil {
+		n = n.Alias
+	}
+	if len(path) == 0 {
+		return n
+	}
+
+	switch n.Kind {
+	case yaml.MappingNode:
+		k, v := yamlMappingLookup(n, path[0])
+		if v == nil {
+			return n
+		}
+		if key && len(path) == 1 {
+			return k
+		}
+		return yamlNodeAt(v, path[1:], key)
+
+	case yaml.SequenceNode:
+		i, err := strconv.Atoi(path[0])
+		if err != nil || i < 0 || i >= len(n.Content) {
+			return n
+		}
+		return yamlNodeAt(n.Content[i], path[1:], key)
+	}
+	return n
+}
+
+// yamlMappingLookup finds the key and value nodes for k in a mapping node,
+// including keys merged into the mapping with "<<".
+func yamlMappingLookup(n *yaml.Node, k string) (key, value *yaml.Node) {
+	var merges []*yaml.Node
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		kn, vn := n.Content[i], n.Content[i+1]
+		if kn.Value == k {
+			return kn, vn
+		}
+		if kn.Tag == "!!merge" {
+			merges = append(merges, vn)
+		}
+	}
+	for _, m := range merges {
+		for m.Kind == yaml.AliasNode && m.Alias != nil {
+			m = m.Alias
+		}
+		switch m.Kind {
+		case yaml.MappingNode:
+			if kn, vn := yamlMappingLookup(m, k); vn != nil {
+				return kn, vn
+			}
+		case yaml.SequenceNode:
+			for _, mm := range m.Content {
+				for mm.Kind == yaml.AliasNode && mm.Alias != nil {
+					mm = mm.Alias
+				}
+				if kn, vn := yamlMappingLookup(mm, k); vn != nil {
+					return kn, vn
+				}
+			}
+		}
+	}
+	return nil, nil
+}
+
+// jsonPointerTokens splits a JSON pointer (RFC 6901) into its tokens.
+func jsonPointerTokens(ptr string) []string {
+	ptr = strings.TrimPrefix(ptr, "/")
+	if ptr == "" {
+		return nil
+	}
+	tokens := strings.Split(ptr, "/")
+	for i, t := range tokens {
+		tokens[i] = strings.NewReplacer("~1", "/", "~0", "~").Replace(t)
+	}
+	return tokens
+}
+
+// formatLintPath formats a path like "steps[2].steps[0].key".
+func formatLintPath(path []string) string {
+	var b strings.Builder
+	for _, p := range path {
+		if _, err := strconv.Atoi(p); err == nil {
+			fmt.Fprintf(&b, "[%s]", p)
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteByte('.')
+		}
+		b.WriteString(p)
+	}
+	return b.String()
+}
+
+// appendPath returns a new path with elems appended to path.
+func appendPath(path []string, elems ...string) []string {
+	return append(append(make([]string, 0, len(path)+len(elems)), path...), elems...)
+}
+
+// yamlKindName describes the kind of a value decoded by ordered.DecodeYAML.
+func yamlKindName(o any) string {
+	switch o.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	case int, int64, uint64, float64:
+		return "a number"
+	case []any:
+		return "a sequence"
+	case *ordered.MapSA:
+		return "a mapping"
+	default:
+		return fmt.Sprintf("%T", o)
+	}
+}
+
+var yamlErrorLineRE = regexp.MustCompile(`^yaml: line (\d+): `)
+
+// yamlErrorDiagnostic converts a YAML syntax error into a diagnostic.
+func yamlErrorDiagnostic(err error) LintDiagnostic {
+	var te *yaml.TypeError
+	if errors.As(err, &te) {
+		return LintDiagnostic{Message: strings.Join(te.Errors, "; ")}
+	}
+	msg := err.Error()
+	if m := yamlErrorLineRE.FindStringSubmatch(msg); m != nil {
+		line, _ := strconv.Atoi(m[1])
+		return LintDiagnostic{Line: line, Message: strings.TrimPrefix(msg, m[0])}
+	}
+	return LintDiagnostic{Message: formatYAMLError(err).Error()}
+}
@@ -0,0 +1,144 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestLint(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		desc  string
+		input string
+		want  []LintDiagnostic
+	}{
+		{
+			desc: "valid pipeline",
+			input: `env:
+  LLAMAS: alpacas
+steps:
+  - command: echo hello
+    timeout_in_minutes: 5
+  - wait
+  - block: Deploy?
+    fields:
+      - key: target
+  - trigger: deploy-pipeline
+    build:
+      branch: main
+  - group: Tests
+    steps:
+      - label: unit
+        commands:
+          - make test
+`,
+			want: nil,
+		},
+		{
+			desc: "legacy sequence of steps",
+			input: `- command: echo hello
+- wait: ~
+`,
+			want: nil,
+		},
+		{
+			desc: "wrong types",
+			input: `steps:
+  - command: echo hello
+    timeout_in_minutes: "five"
+  - wait: ~
+    continue_on_failure: "yes"
+`,
+			want: []LintDiagnostic{
+				{Line: 3, Column: 25, Path: "steps[0].timeout_in_minutes", Message: "type should be integer, got string"},
+				{Line: 5, Column: 26, Path: "steps[1].continue_on_failure", Message: "type should be boolean, got string"},
+			},
+		},
+		{
+			desc: "unknown key with suggestion",
+			input: `steps:
+  - command: echo hello
+    artefact_paths: "*.log"
+`,
+			want: []LintDiagnostic{
+				{Line: 3, Column: 5, Path: "steps[0].artefact_paths", Message: `unknown key "artefact_paths" for a command step (did you mean "artifact_paths"?)`},
+			},
+		},
+		{
+			desc: "nested in group",
+			input: `steps:
+  - group: Tests
+    steps:
+      - command: make test
+        parallelism: 0
+`,
+			want: []LintDiagnostic{
+				{Line: 5, Column: 22, Path: "steps[0].steps[0].parallelism", Message: "must be greater than or equal to 1"},
+			},
+		},
+		{
+			desc: "missing steps",
+			input: `env:
+  LLAMAS: alpacas
+`,
+			want: []LintDiagnostic{
+				{Line: 1, Column: 1, Message: `"steps" value is required`},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.desc, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := Lint(strings.NewReader(test.input))
+			if err != nil {
+				t.Fatalf("Lint(%q) error = %v", test.input, err)
+			}
+			if diff := cmp.Diff(got, test.want); diff != "" {
+				t.Errorf("Lint(%q) diagnostics diff (-got +want):\n%s", test.input, diff)
+			}
+		})
+	}
+}
+
+func TestLintUnknownStep(t *testing.T) {
+	t.Parallel()
+
+	input := `steps:
+  - comand: echo hello
+`
+	got, err := Lint(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Lint(%q) error = %v", input, err)
+	}
+	want := []LintDiagnostic{
+		{Line: 2, Column: 5, Path: "steps[0]", Message: "unknown step type: a step must contain one of command, commands, plugins, wait, block, input, trigger, or group"},
+		{Line: 2, Column: 5, Path: "steps[0].comand", Message: `unknown key "comand" (did you mean "command"?)`},
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("Lint(%q) diagnostics diff (-got +want):\n%s", input, diff)
+	}
+}
+
+func TestLintYAMLSyntaxError(t *testing.T) {
+	t.Parallel()
+
+	input := `steps:
+  - command: "echo hello
+`
+	got, err := Lint(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("Lint(%q) error = %v", input, err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("Lint(%q) = %v, want 1 diagnostic", input, got)
+	}
+	if got, want := got[0].Line, 2; got != want {
+		t.Errorf("diagnostic Line = %d, want %d", got, want)
+	}
+}
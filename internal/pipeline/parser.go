@@ -11,10 +11,23 @@ import (
 
 // Parse parses a pipeline. It does not apply interpolation.
 func Parse(src io.Reader) (*Pipeline, error) {
+	o, err := parseRaw(src)
+	if err != nil {
+		return nil, err
+	}
+
+	// Then decode _that_ into a pipeline.
+	p := new(Pipeline)
+	return p, p.unmarshalAny(o)
+}
+
+// parseRaw parses YAML (or JSON) into *ordered.MapSA, []any, or any
+// (recursively).
+func parseRaw(src io.Reader) (any, error) {
 	// First get yaml.v3 to give us a raw document (*yaml.Node).
-	n := new(yaml.Node)
-	if err := yaml.NewDecoder(src).Decode(n); err != nil {
-		return nil, formatYAMLError(err)
+	n, err := parseNode(src)
+	if err != nil {
+		return nil, err
 	}
 
 	// Instead of unmarshalling into structs, which is easy-ish to use but
@@ -23,14 +36,16 @@ func Parse(src io.Reader) (*Pipeline, error) {
 	// This resolves aliases and merges and gives a more convenient form to work
 	// with when handling different structural representations of the same
 	// configuration.
-	o, err := ordered.DecodeYAML(n)
-	if err != nil {
-		return nil, err
-	}
+	return ordered.DecodeYAML(n)
+}
 
-	// Then decode _that_ into a pipeline.
-	p := new(Pipeline)
-	return p, p.unmarshalAny(o)
+// parseNode parses YAML (or JSON) into a *yaml.Node.
+func parseNode(src io.Reader) (*yaml.Node, error) {
+	n := new(yaml.Node)
+	if err := yaml.NewDecoder(src).Decode(n); err != nil {
+		return nil, formatYAMLError(err)
+	}
+	return n, nil
 }
 
 func formatYAMLError(err error) error {
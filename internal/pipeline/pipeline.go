@@ -1,12 +1,12 @@
 package pipeline
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/buildkite/agent/v3/env"
 	"github.com/buildkite/agent/v3/internal/ordered"
 	"github.com/buildkite/agent/v3/tracetools"
-	"github.com/buildkite/interpolate"
 )
 
 // Pipeline models a pipeline.
@@ -94,6 +94,19 @@ func (p *Pipeline) unmarshalAny(o any) error {
 //   - Interpolate pipeline.Env and copy the results into envMap to apply later.
 //   - Interpolate any string value in the rest of the pipeline.
 func (p *Pipeline) Interpolate(envMap *env.Environment) error {
+	return p.interpolate(envMap, false)
+}
+
+// InterpolateStrict is like Interpolate, but first checks that every variable
+// that would be expanded is defined (in envMap, or earlier in p.Env). If any
+// are not, it returns an *UndefinedVariablesError listing each reference, and
+// the rest of the pipeline is left uninterpolated. References with a default
+// value (${VAR:-default} or ${VAR-default}) are allowed.
+func (p *Pipeline) InterpolateStrict(envMap *env.Environment) error {
+	return p.interpolate(envMap, true)
+}
+
+func (p *Pipeline) interpolate(envMap *env.Environment, strict bool) error {
 	if envMap == nil {
 		envMap = env.New()
 	}
@@ -108,10 +121,20 @@ func (p *Pipeline) Interpolate(envMap *env.Environment) error {
 
 	// Preprocess any env that are defined in the top level block and place them
 	// into env for later interpolation into the rest of the pipeline.
-	if err := p.interpolateEnvBlock(envMap); err != nil {
+	var undefined []UndefinedReference
+	if err := p.interpolateEnvBlock(envMap, strict, &undefined); err != nil {
 		return err
 	}
 
+	if strict {
+		if err := p.findUndefined(envMap, &undefined); err != nil {
+			return err
+		}
+		if len(undefined) > 0 {
+			return &UndefinedVariablesError{References: undefined}
+		}
+	}
+
 	// Recursively go through the rest of the pipeline and perform environment
 	// variable interpolation on strings. Interpolation is performed in-place.
 	if err := interpolateSlice(envMap, p.Steps); err != nil {
@@ -120,21 +143,34 @@ func (p *Pipeline) Interpolate(envMap *env.Environment) error {
 	return interpolateMap(envMap, p.RemainingFields)
 }
 
-// interpolateEnvBlock runs interpolate.Interpolate on each pair in p.Env,
+// interpolateEnvBlock runs interpolateString on each pair in p.Env,
 // interpolating with the variables defined in envMap, and then adding the
 // results back into both p.Env and envMap. Each environment variable can
 // be interpolated into later environment variables, making the input ordering
-// of p.Env potentially important.
-func (p *Pipeline) interpolateEnvBlock(envMap *env.Environment) error {
+// of p.Env potentially important. In strict mode, references to undefined
+// variables are appended to undefined.
+func (p *Pipeline) interpolateEnvBlock(envMap *env.Environment, strict bool, undefined *[]UndefinedReference) error {
 	return p.Env.Range(func(k, v string) error {
+		if strict {
+			for _, s := range []string{k, v} {
+				vars, err := undefinedVariables(envMap, s)
+				if err != nil {
+					return fmt.Errorf("env.%s: %w", k, err)
+				}
+				for _, name := range vars {
+					*undefined = append(*undefined, UndefinedReference{Path: "env." + k, Variable: name})
+				}
+			}
+		}
+
 		// We interpolate both keys and values.
-		intk, err := interpolate.Interpolate(envMap, k)
+		intk, err := interpolateString(envMap, k)
 		if err != nil {
 			return err
 		}
 
 		// v is always a string in this case.
-		intv, err := interpolate.Interpolate(envMap, v)
+		intv, err := interpolateString(envMap, v)
 		if err != nil {
 			return err
 		}
@@ -148,6 +184,35 @@ func (p *Pipeline) interpolateEnvBlock(envMap *env.Environment) error {
 	})
 }
 
+// findUndefined appends references to undefined variables in the steps and
+// other top-level fields to undefined. Each part is checked in its JSON form,
+// which is what will be uploaded.
+func (p *Pipeline) findUndefined(envMap *env.Environment, undefined *[]UndefinedReference) error {
+	parts := []struct {
+		path string
+		o    any
+	}{
+		{"steps", p.Steps},
+		{"", p.RemainingFields},
+	}
+	for _, part := range parts {
+		b, err := json.Marshal(part.o)
+		if err != nil {
+			return err
+		}
+		var o any
+		if err := json.Unmarshal(b, &o); err != nil {
+			return err
+		}
+		refs, err := findUndefined(envMap, part.path, o, *undefined)
+		if err != nil {
+			return err
+		}
+		*undefined = refs
+	}
+	return nil
+}
+
 // Sign signs each signable part of the pipeline. Currently this is limited to
 // command steps (including command steps within group steps). The Signer is
 // reset before starting, and after each part. Parts are mutated directly, so an
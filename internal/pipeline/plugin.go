@@ -2,7 +2,9 @@ package pipeline
 
 import (
 	"encoding/json"
+	"strings"
 
+	"github.com/buildkite/agent/v3/internal/ordered"
 	"github.com/buildkite/interpolate"
 	"gopkg.in/yaml.v3"
 )
@@ -44,7 +46,7 @@ func (p *Plugin) MarshalYAML() (any, error) {
 }
 
 func (p *Plugin) interpolate(env interpolate.Env) error {
-	name, err := interpolate.Interpolate(env, p.Name)
+	name, err := interpolateString(env, p.Name)
 	if err != nil {
 		return err
 	}
@@ -56,3 +58,85 @@ func (p *Plugin) interpolate(env interpolate.Env) error {
 	p.Config = cfg
 	return nil
 }
+
+// fullSource splits the plugin name into a location and version, and expands
+// shorthand locations the same way Buildkite does:
+//
+//   - "docker" becomes "github.com/buildkite-plugins/docker-buildkite-plugin"
+//   - "my-org/docker" becomes "github.com/my-org/docker-buildkite-plugin"
+//
+// Locations that are URLs, paths, or that include a host are returned
+// unaltered.
+func (p *Plugin) fullSource() (location, version string) {
+	location, version, _ = strings.Cut(p.Name, "#")
+
+	if location == "" ||
+		strings.Contains(location, "://") ||
+		strings.Contains(location, ":") ||
+		strings.HasPrefix(location, ".") ||
+		strings.HasPrefix(location, "/") ||
+		strings.HasPrefix(location, "~") {
+		return location, version
+	}
+
+	parts := strings.Split(location, "/")
+	switch len(parts) {
+	case 1:
+		return "github.com/buildkite-plugins/" + withPluginSuffix(parts[0]), version
+	case 2:
+		return "github.com/" + parts[0] + "/" + withPluginSuffix(parts[1]), version
+	default:
+		return location, version
+	}
+}
+
+// withPluginSuffix appends "-buildkite-plugin" to a repository name if it
+// doesn't end in it already.
+func withPluginSuffix(repo string) string {
+	if strings.HasSuffix(repo, "-buildkite-plugin") {
+		return repo
+	}
+	return repo + "-buildkite-plugin"
+}
+
+// canonicalConfig converts plugin configuration into a form where every map is
+// a map[string]any, which encoding/json marshals with sorted keys. Empty
+// configuration is treated the same as no configuration.
+func canonicalConfig(o any) any {
+	c := canonicalConfigValue(o)
+	if m, ok := c.(map[string]any); ok && len(m) == 0 {
+		return nil
+	}
+	return c
+}
+
+// canonicalConfigValue recursively converts ordered maps within o into
+// map[string]any.
+func canonicalConfigValue(o any) any {
+	switch o := o.(type) {
+	case *ordered.MapSA:
+		m := make(map[string]any, o.Len())
+		o.Range(func(k string, v any) error {
+			m[k] = canonicalConfigValue(v)
+			return nil
+		})
+		return m
+
+	case map[string]any:
+		m := make(map[string]any, len(o))
+		for k, v := range o {
+			m[k] = canonicalConfigValue(v)
+		}
+		return m
+
+	case []any:
+		s := make([]any, 0, len(o))
+		for _, v := range o {
+			s = append(s, canonicalConfigValue(v))
+		}
+		return s
+
+	default:
+		return o
+	}
+}
@@ -1,14 +1,69 @@
 package pipeline
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/buildkite/agent/v3/internal/ordered"
+	"gopkg.in/yaml.v3"
 )
 
+var _ json.Unmarshaler = (*Plugins)(nil)
+
 // Plugins is a sequence of plugins. It is useful for unmarshaling.
 type Plugins []*Plugin
 
+// UnmarshalJSON unmarshals plugins from JSON (such as the step on a job from
+// the Agent API, or the BUILDKITE_PLUGINS env var). Because YAML is a superset
+// of JSON, it is parsed with the same rules as plugins in a pipeline file.
+func (p *Plugins) UnmarshalJSON(b []byte) error {
+	n := new(yaml.Node)
+	if err := yaml.Unmarshal(b, n); err != nil {
+		return err
+	}
+	o, err := ordered.DecodeYAML(n)
+	if err != nil {
+		return err
+	}
+	if o == nil {
+		*p = nil
+		return nil
+	}
+	return p.unmarshalAny(o)
+}
+
+// CanonicalString returns a canonical string form of the plugins, suitable for
+// signing. Each plugin is normalised into its full location, version, and
+// configuration, so that equivalent ways of writing the same plugin (e.g.
+// "docker#v1.0.0" and
+// "github.com/buildkite-plugins/docker-buildkite-plugin#v1.0.0") have the
+// same canonical form.
+func (p Plugins) CanonicalString() (string, error) {
+	type canonicalPlugin struct {
+		Location string `json:"location"`
+		Version  string `json:"version,omitempty"`
+		Config   any    `json:"config,omitempty"`
+	}
+
+	cps := make([]canonicalPlugin, 0, len(p))
+	for _, plugin := range p {
+		location, version := plugin.fullSource()
+		cps = append(cps, canonicalPlugin{
+			Location: location,
+			Version:  version,
+			Config:   canonicalConfig(plugin.Config),
+		})
+	}
+
+	// encoding/json sorts the keys of map[string]any, and canonicalConfig
+	// converts ordered maps into map[string]any.
+	b, err := json.Marshal(cps)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
 // unmarshalAny unmarshals Plugins from either
 //   - []any - originally a sequence of "one-item mappings" (normal form), or
 //   - *ordered.MapSA - a mapping (where order is important...non-normal form).
@@ -0,0 +1,87 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestPluginsCanonicalString(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name  string
+		yaml  string
+		json  string
+		equal bool
+	}{
+		{
+			name:  "shorthand and full location",
+			yaml:  `[{docker#v5.8.0: {image: golang, propagate-environment: true}}]`,
+			json:  `[{"github.com/buildkite-plugins/docker-buildkite-plugin#v5.8.0":{"propagate-environment":true,"image":"golang"}}]`,
+			equal: true,
+		},
+		{
+			name:  "org shorthand",
+			yaml:  `[my-org/thing#v1.0.0]`,
+			json:  `["github.com/my-org/thing-buildkite-plugin#v1.0.0"]`,
+			equal: true,
+		},
+		{
+			name:  "no config and empty config",
+			yaml:  `[{docker#v5.8.0: null}]`,
+			json:  `[{"docker#v5.8.0":{}}]`,
+			equal: true,
+		},
+		{
+			name:  "legacy mapping form",
+			yaml:  `{docker#v5.8.0: {image: golang}, ./local: {x: 1}}`,
+			json:  `[{"docker#v5.8.0":{"image":"golang"}},{"./local":{"x":1}}]`,
+			equal: true,
+		},
+		{
+			name: "different version",
+			yaml: `[docker#v5.8.0]`,
+			json: `["docker#v5.9.0"]`,
+		},
+		{
+			name: "different config",
+			yaml: `[{docker#v5.8.0: {image: golang}}]`,
+			json: `[{"docker#v5.8.0":{"image":"crimes"}}]`,
+		},
+		{
+			name: "different order",
+			yaml: `[docker#v5.8.0, ecr#v2.7.0]`,
+			json: `["ecr#v2.7.0", "docker#v5.8.0"]`,
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			p, err := Parse(strings.NewReader("steps: [{command: x, plugins: " + test.yaml + "}]"))
+			if err != nil {
+				t.Fatalf("Parse(%q) error = %v", test.yaml, err)
+			}
+			fromYAML, err := p.Steps[0].(*CommandStep).Plugins.CanonicalString()
+			if err != nil {
+				t.Fatalf("Plugins.CanonicalString() error = %v", err)
+			}
+
+			var plugins Plugins
+			if err := json.Unmarshal([]byte(test.json), &plugins); err != nil {
+				t.Fatalf("json.Unmarshal(%q) error = %v", test.json, err)
+			}
+			fromJSON, err := plugins.CanonicalString()
+			if err != nil {
+				t.Fatalf("Plugins.CanonicalString() error = %v", err)
+			}
+
+			if got := fromYAML == fromJSON; got != test.equal {
+				t.Errorf("canonical forms equal = %t, want %t\nYAML: %s\nJSON: %s", got, test.equal, fromYAML, fromJSON)
+			}
+		})
+	}
+}
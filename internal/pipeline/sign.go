@@ -18,14 +18,20 @@ import (
 // Signature models a signature (on a step, etc).
 type Signature struct {
 	Algorithm    string   `json:"algorithm" yaml:"algorithm"`
+	KeyID        string   `json:"key_id,omitempty" yaml:"key_id,omitempty"`
 	SignedFields []string `json:"signed_fields" yaml:"signed_fields"`
 	Value        string   `json:"value" yaml:"value"`
 }
 
 // Sign computes a new signature for an object containing values using a given
-// signer. Sign resets the signer after use.
+// signer. Sign resets the signer after use. If the signer knows the ID of its
+// key (such as Signers returned by Key.Signer), the ID is recorded in the
+// signature.
 func Sign(sf SignedFielder, signer Signer) (*Signature, error) {
-	values := sf.SignedFields()
+	values, err := sf.SignedFields()
+	if err != nil {
+		return nil, err
+	}
 	if len(values) == 0 {
 		return nil, errors.New("sign: no fields to sign")
 	}
@@ -44,8 +50,14 @@ func Sign(sf SignedFielder, signer Signer) (*Signature, error) {
 		return nil, err
 	}
 
+	var keyID string
+	if k, ok := signer.(keyIDer); ok {
+		keyID = k.KeyID()
+	}
+
 	return &Signature{
 		Algorithm:    signer.AlgorithmName(),
+		KeyID:        keyID,
 		SignedFields: fields,
 		Value:        base64.StdEncoding.EncodeToString(sig),
 	}, nil
@@ -103,6 +115,13 @@ func (s *Signature) unmarshalAny(o any) error {
 			}
 			s.Algorithm = a
 
+		case "key_id":
+			a, ok := v.(string)
+			if !ok {
+				return fmt.Errorf("unmarshaling signature: key_id has type %T, want string", v)
+			}
+			s.KeyID = a
+
 		case "signed_fields":
 			os, ok := v.([]any)
 			if !ok {
@@ -137,7 +156,7 @@ func (s *Signature) unmarshalAny(o any) error {
 type SignedFielder interface {
 	// SignedFields returns the default set of fields to sign, and their values.
 	// This is called by Sign.
-	SignedFields() map[string]string
+	SignedFields() (map[string]string, error)
 
 	// ValuesForFields looks up each field and produces a map of values. This is
 	// called by Verify. The set of fields might differ from the default, e.g.
@@ -150,21 +169,45 @@ type SignedFielder interface {
 
 // NewSigner returns a new Signer for the given algorithm,
 // provided with a signing/verification key.
+// Asymmetric algorithms require a private key (ed25519.PrivateKey,
+// *ecdsa.PrivateKey, or *rsa.PrivateKey). If the key is a *SigningHelper,
+// signing is delegated to the helper, whatever the algorithm.
 func NewSigner(algorithm string, key any) (Signer, error) {
+	if helper, ok := key.(*SigningHelper); ok {
+		return newHelperSignerVerifier(algorithm, helper)
+	}
 	switch algorithm {
-	case "hmac-sha256":
+	case AlgorithmHMACSHA256:
 		return newHMACSHA256(key)
+	case AlgorithmEd25519:
+		return newEd25519Signer(key)
+	case AlgorithmECDSAP256SHA256:
+		return newECDSAP256Signer(key)
+	case AlgorithmRSAPSSSHA256:
+		return newRSAPSSSigner(key)
 	default:
 		return nil, fmt.Errorf("unknown signing algorithm %q", algorithm)
 	}
 }
 
-// NewSigner returns a new Verifier for the given algorithm,
+// NewVerifier returns a new Verifier for the given algorithm,
 // provided with a signing/verification key.
+// Asymmetric algorithms accept either the public key or the private key (from
+// which the public key is derived). If the key is a *SigningHelper,
+// verification is delegated to the helper, whatever the algorithm.
 func NewVerifier(algorithm string, key any) (Verifier, error) {
+	if helper, ok := key.(*SigningHelper); ok {
+		return newHelperSignerVerifier(algorithm, helper)
+	}
 	switch algorithm {
-	case "hmac-sha256":
+	case AlgorithmHMACSHA256:
 		return newHMACSHA256(key)
+	case AlgorithmEd25519:
+		return newEd25519Verifier(key)
+	case AlgorithmECDSAP256SHA256:
+		return newECDSAP256Verifier(key)
+	case AlgorithmRSAPSSSHA256:
+		return newRSAPSSVerifier(key)
 	default:
 		return nil, fmt.Errorf("unknown signing algorithm %q", algorithm)
 	}
@@ -199,6 +242,11 @@ type Verifier interface {
 	Verify([]byte) error
 }
 
+// keyIDer is implemented by Signers that know the ID of their key.
+type keyIDer interface {
+	KeyID() string
+}
+
 type hmacSHA256 struct {
 	hash.Hash
 }
@@ -220,7 +268,7 @@ func newHMACSHA256(key any) (hmacSHA256, error) {
 	}, nil
 }
 
-func (h hmacSHA256) AlgorithmName() string { return "hmac-sha256" }
+func (h hmacSHA256) AlgorithmName() string { return AlgorithmHMACSHA256 }
 
 func (h hmacSHA256) Sign() ([]byte, error) {
 	return h.Hash.Sum(nil), nil
@@ -0,0 +1,211 @@
+package pipeline
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+)
+
+// Names of the public-key signing algorithms. Each of these signs the SHA-256
+// digest of the data written to the Signer.
+const (
+	AlgorithmHMACSHA256      = "hmac-sha256"
+	AlgorithmEd25519         = "ed25519"
+	AlgorithmECDSAP256SHA256 = "ecdsa-p256-sha256"
+	AlgorithmRSAPSSSHA256    = "rsa-pss-sha256"
+)
+
+// ed25519SHA256 signs and verifies SHA-256 digests with Ed25519.
+type ed25519SHA256 struct {
+	hash.Hash
+	priv ed25519.PrivateKey
+	pub  ed25519.PublicKey
+}
+
+func newEd25519Signer(key any) (*ed25519SHA256, error) {
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("wrong key type (got %T, want ed25519.PrivateKey)", key)
+	}
+	if len(priv) != ed25519.PrivateKeySize {
+		return nil, fmt.Errorf("invalid ed25519 private key length %d", len(priv))
+	}
+	return &ed25519SHA256{
+		Hash: sha256.New(),
+		priv: priv,
+		pub:  priv.Public().(ed25519.PublicKey),
+	}, nil
+}
+
+func newEd25519Verifier(key any) (*ed25519SHA256, error) {
+	var pub ed25519.PublicKey
+	switch tkey := key.(type) {
+	case ed25519.PublicKey:
+		pub = tkey
+
+	case ed25519.PrivateKey:
+		pub = tkey.Public().(ed25519.PublicKey)
+
+	default:
+		return nil, fmt.Errorf("wrong key type (got %T, want ed25519.PublicKey)", key)
+	}
+	if len(pub) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid ed25519 public key length %d", len(pub))
+	}
+	return &ed25519SHA256{
+		Hash: sha256.New(),
+		pub:  pub,
+	}, nil
+}
+
+func (e *ed25519SHA256) AlgorithmName() string { return AlgorithmEd25519 }
+
+func (e *ed25519SHA256) Sign() ([]byte, error) {
+	if e.priv == nil {
+		return nil, errors.New("no private key available for signing")
+	}
+	return ed25519.Sign(e.priv, e.Hash.Sum(nil)), nil
+}
+
+func (e *ed25519SHA256) Verify(sig []byte) error {
+	if !ed25519.Verify(e.pub, e.Hash.Sum(nil), sig) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// ecdsaP256SHA256 signs and verifies SHA-256 digests with ECDSA on the P-256
+// curve. Signatures are ASN.1 DER encoded.
+type ecdsaP256SHA256 struct {
+	hash.Hash
+	priv *ecdsa.PrivateKey
+	pub  *ecdsa.PublicKey
+}
+
+func newECDSAP256Signer(key any) (*ecdsaP256SHA256, error) {
+	priv, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("wrong key type (got %T, want *ecdsa.PrivateKey)", key)
+	}
+	if priv.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("wrong curve (got %s, want P-256)", priv.Curve.Params().Name)
+	}
+	return &ecdsaP256SHA256{
+		Hash: sha256.New(),
+		priv: priv,
+		pub:  &priv.PublicKey,
+	}, nil
+}
+
+func newECDSAP256Verifier(key any) (*ecdsaP256SHA256, error) {
+	var pub *ecdsa.PublicKey
+	switch tkey := key.(type) {
+	case *ecdsa.PublicKey:
+		pub = tkey
+
+	case *ecdsa.PrivateKey:
+		pub = &tkey.PublicKey
+
+	default:
+		return nil, fmt.Errorf("wrong key type (got %T, want *ecdsa.PublicKey)", key)
+	}
+	if pub.Curve != elliptic.P256() {
+		return nil, fmt.Errorf("wrong curve (got %s, want P-256)", pub.Curve.Params().Name)
+	}
+	return &ecdsaP256SHA256{
+		Hash: sha256.New(),
+		pub:  pub,
+	}, nil
+}
+
+func (e *ecdsaP256SHA256) AlgorithmName() string { return AlgorithmECDSAP256SHA256 }
+
+func (e *ecdsaP256SHA256) Sign() ([]byte, error) {
+	if e.priv == nil {
+		return nil, errors.New("no private key available for signing")
+	}
+	return ecdsa.SignASN1(rand.Reader, e.priv, e.Hash.Sum(nil))
+}
+
+func (e *ecdsaP256SHA256) Verify(sig []byte) error {
+	if !ecdsa.VerifyASN1(e.pub, e.Hash.Sum(nil), sig) {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
+
+// rsaPSSSHA256 signs and verifies SHA-256 digests with RSASSA-PSS. The salt
+// length is equal to the hash length.
+type rsaPSSSHA256 struct {
+	hash.Hash
+	priv *rsa.PrivateKey
+	pub  *rsa.PublicKey
+}
+
+// minRSAKeyBits is the smallest RSA modulus accepted for signing or
+// verification.
+const minRSAKeyBits = 2048
+
+var rsaPSSOptions = &rsa.PSSOptions{
+	SaltLength: rsa.PSSSaltLengthEqualsHash,
+	Hash:       crypto.SHA256,
+}
+
+func newRSAPSSSigner(key any) (*rsaPSSSHA256, error) {
+	priv, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("wrong key type (got %T, want *rsa.PrivateKey)", key)
+	}
+	if bits := priv.N.BitLen(); bits < minRSAKeyBits {
+		return nil, fmt.Errorf("RSA key is too small (got %d bits, want at least %d)", bits, minRSAKeyBits)
+	}
+	return &rsaPSSSHA256{
+		Hash: sha256.New(),
+		priv: priv,
+		pub:  &priv.PublicKey,
+	}, nil
+}
+
+func newRSAPSSVerifier(key any) (*rsaPSSSHA256, error) {
+	var pub *rsa.PublicKey
+	switch tkey := key.(type) {
+	case *rsa.PublicKey:
+		pub = tkey
+
+	case *rsa.PrivateKey:
+		pub = &tkey.PublicKey
+
+	default:
+		return nil, fmt.Errorf("wrong key type (got %T, want *rsa.PublicKey)", key)
+	}
+	if bits := pub.N.BitLen(); bits < minRSAKeyBits {
+		return nil, fmt.Errorf("RSA key is too small (got %d bits, want at least %d)", bits, minRSAKeyBits)
+	}
+	return &rsaPSSSHA256{
+		Hash: sha256.New(),
+		pub:  pub,
+	}, nil
+}
+
+func (r *rsaPSSSHA256) AlgorithmName() string { return AlgorithmRSAPSSSHA256 }
+
+func (r *rsaPSSSHA256) Sign() ([]byte, error) {
+	if r.priv == nil {
+		return nil, errors.New("no private key available for signing")
+	}
+	return rsa.SignPSS(rand.Reader, r.priv, crypto.SHA256, r.Hash.Sum(nil), rsaPSSOptions)
+}
+
+func (r *rsaPSSSHA256) Verify(sig []byte) error {
+	if err := rsa.VerifyPSS(r.pub, crypto.SHA256, r.Hash.Sum(nil), sig, rsaPSSOptions); err != nil {
+		return errors.New("signature mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/buildkite/shellwords"
+)
+
+// SigningHelper is key "material" for keys held outside the agent, such as in
+// a KMS. Signing and verifying are delegated to a helper program, in a similar
+// way to git's gpg.program.
+//
+// To sign, the helper is run with the argument "sign". The payload to sign is
+// written to its stdin, and it must write the base64-encoded signature to
+// stdout.
+//
+// To verify, the helper is run with the argument "verify". The payload is
+// written to its stdin, and the base64-encoded signature is provided in the
+// BUILDKITE_SIGNATURE env var. The helper must exit with status 0 if the
+// signature is valid, and non-zero otherwise.
+//
+// In both cases, the helper also receives the algorithm name in
+// BUILDKITE_SIGNING_ALGORITHM and the key ID (if any) in
+// BUILDKITE_SIGNING_KEY_ID. So that signatures made by the helper can be
+// verified with ordinary keys (and vice versa), a helper implementing one of
+// the public-key algorithms should sign the SHA-256 digest of the payload, and
+// a helper implementing hmac-sha256 should compute the HMAC of the payload.
+type SigningHelper struct {
+	// Path is the helper program.
+	Path string
+
+	// Args are passed to the helper before the "sign" or "verify" argument.
+	Args []string
+
+	// KeyID is passed to the helper in BUILDKITE_SIGNING_KEY_ID.
+	KeyID string
+}
+
+// NewSigningHelperKey returns a key that delegates to a signing helper. The
+// command is split into the helper path and arguments using shell quoting
+// rules. The algorithm is recorded in signatures made by the helper, and the
+// key ID (which may be empty) is recorded in signatures and passed to the
+// helper.
+func NewSigningHelperKey(command, algorithm, keyID string) (*Key, error) {
+	words, err := shellwords.Split(command)
+	if err != nil {
+		return nil, fmt.Errorf("parsing signing helper command: %w", err)
+	}
+	if len(words) == 0 {
+		return nil, errors.New("signing helper command is empty")
+	}
+	if algorithm == "" {
+		return nil, errors.New("an algorithm is required when using a signing helper")
+	}
+	return &Key{
+		ID:        keyID,
+		Algorithm: algorithm,
+		Key: &SigningHelper{
+			Path:  words[0],
+			Args:  words[1:],
+			KeyID: keyID,
+		},
+	}, nil
+}
+
+// helperSignerVerifier implements Signer and Verifier by running a signing
+// helper. Data written to it is buffered to send to the helper, and also
+// hashed, so that it satisfies hash.Hash.
+type helperSignerVerifier struct {
+	hash.Hash
+	payload   bytes.Buffer
+	helper    *SigningHelper
+	algorithm string
+}
+
+func newHelperSignerVerifier(algorithm string, helper *SigningHelper) (*helperSignerVerifier, error) {
+	if algorithm == "" {
+		return nil, errors.New("an algorithm is required when using a signing helper")
+	}
+	return &helperSignerVerifier{
+		Hash:      sha256.New(),
+		helper:    helper,
+		algorithm: algorithm,
+	}, nil
+}
+
+func (h *helperSignerVerifier) Write(b []byte) (int, error) {
+	h.payload.Write(b)
+	return h.Hash.Write(b)
+}
+
+func (h *helperSignerVerifier) Reset() {
+	h.payload.Reset()
+	h.Hash.Reset()
+}
+
+func (h *helperSignerVerifier) AlgorithmName() string { return h.algorithm }
+
+func (h *helperSignerVerifier) Sign() ([]byte, error) {
+	out, err := h.run("sign")
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(out)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding signature from signing helper: %w", err)
+	}
+	if len(sig) == 0 {
+		return nil, errors.New("signing helper returned an empty signature")
+	}
+	return sig, nil
+}
+
+func (h *helperSignerVerifier) Verify(sig []byte) error {
+	_, err := h.run("verify", "BUILDKITE_SIGNATURE="+base64.StdEncoding.EncodeToString(sig))
+	if err != nil {
+		return fmt.Errorf("signature mismatch: %w", err)
+	}
+	return nil
+}
+
+// run runs the helper with the given mode and extra env vars, passing the
+// payload on stdin, and returns its stdout.
+func (h *helperSignerVerifier) run(mode string, env ...string) ([]byte, error) {
+	cmd := exec.Command(h.helper.Path, append(append([]string{}, h.helper.Args...), mode)...)
+	cmd.Stdin = bytes.NewReader(h.payload.Bytes())
+	cmd.Env = append(os.Environ(),
+		"BUILDKITE_SIGNING_ALGORITHM="+h.algorithm,
+		"BUILDKITE_SIGNING_KEY_ID="+h.helper.KeyID,
+	)
+	cmd.Env = append(cmd.Env, env...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("signing helper %q (%s): %w: %s", h.helper.Path, mode, err, msg)
+		}
+		return nil, fmt.Errorf("signing helper %q (%s): %w", h.helper.Path, mode, err)
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,133 @@
+package pipeline
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hmacHelperScript is a stand-in for a signing helper backed by a KMS. It
+// computes hmac-sha256 with a key that only the helper knows, and records the
+// key ID it was asked to use.
+const hmacHelperScript = `#!/bin/sh
+set -eu
+echo "$BUILDKITE_SIGNING_ALGORITHM $BUILDKITE_SIGNING_KEY_ID" >> "$HELPER_LOG"
+mac=$(openssl dgst -sha256 -hmac alpacas -binary | base64)
+case "$1" in
+  sign)
+    echo "$mac"
+    ;;
+  verify)
+    if [ "$mac" != "$BUILDKITE_SIGNATURE" ]; then
+      echo "the llamas are displeased" >&2
+      exit 1
+    fi
+    ;;
+esac
+`
+
+// writeHelperScript writes the script to a temporary directory, and returns
+// the path to the script and the path to its log.
+func writeHelperScript(t *testing.T, script string) (helper, log string) {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("signing helper script requires a POSIX shell")
+	}
+	if _, err := exec.LookPath("openssl"); err != nil {
+		t.Skip("signing helper script requires openssl")
+	}
+
+	dir := t.TempDir()
+	helper = filepath.Join(dir, "helper.sh")
+	if err := os.WriteFile(helper, []byte(script), 0o755); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", helper, err)
+	}
+	log = filepath.Join(dir, "helper.log")
+	t.Setenv("HELPER_LOG", log)
+	return helper, log
+}
+
+func TestSigningHelper(t *testing.T) {
+	helper, log := writeHelperScript(t, hmacHelperScript)
+
+	key, err := NewSigningHelperKey(helper, AlgorithmHMACSHA256, "kms-key-1")
+	if err != nil {
+		t.Fatalf("NewSigningHelperKey(%q, hmac-sha256, kms-key-1) error = %v", helper, err)
+	}
+	signer, err := key.Signer()
+	if err != nil {
+		t.Fatalf("key.Signer() error = %v", err)
+	}
+
+	cs := &CommandStep{Command: "llamas"}
+	sig, err := Sign(cs, signer)
+	if err != nil {
+		t.Fatalf("Sign(CommandStep, helper signer) error = %v", err)
+	}
+	if got, want := sig.KeyID, "kms-key-1"; got != want {
+		t.Errorf("sig.KeyID = %q, want %q", got, want)
+	}
+
+	// The helper's signature is an ordinary hmac-sha256 signature.
+	verifier, err := NewVerifier(AlgorithmHMACSHA256, "alpacas")
+	if err != nil {
+		t.Fatalf("NewVerifier(hmac-sha256, alpacas) error = %v", err)
+	}
+	if err := sig.Verify(cs, verifier); err != nil {
+		t.Errorf("sig.Verify(CommandStep, hmac verifier) = %v", err)
+	}
+
+	// And the helper can verify it too. A helper without a configured key ID
+	// is told which key made the signature.
+	verifyKey, err := NewSigningHelperKey(helper, AlgorithmHMACSHA256, "")
+	if err != nil {
+		t.Fatalf("NewSigningHelperKey(%q, hmac-sha256, \"\") error = %v", helper, err)
+	}
+	keys := &KeySet{Keys: []*Key{verifyKey}}
+	if _, err := keys.Verify(cs, sig, time.Now()); err != nil {
+		t.Errorf("keys.Verify(CommandStep, sig, now) error = %v", err)
+	}
+
+	cs.Command = "crimes"
+	_, err = keys.Verify(cs, sig, time.Now())
+	if err == nil || !strings.Contains(err.Error(), "the llamas are displeased") {
+		t.Errorf("keys.Verify(altered CommandStep, sig, now) error = %v, want error containing helper stderr", err)
+	}
+
+	gotLog, err := os.ReadFile(log)
+	if err != nil {
+		t.Fatalf("os.ReadFile(%q) error = %v", log, err)
+	}
+	wantLog := "hmac-sha256 kms-key-1\nhmac-sha256 kms-key-1\nhmac-sha256 kms-key-1\n"
+	if string(gotLog) != wantLog {
+		t.Errorf("helper log = %q, want %q", gotLog, wantLog)
+	}
+}
+
+func TestSigningHelperErrors(t *testing.T) {
+	helper, _ := writeHelperScript(t, "#!/bin/sh\necho 'not base64!'\n")
+
+	if _, err := NewSigningHelperKey(helper, "", ""); err == nil {
+		t.Errorf("NewSigningHelperKey(%q, \"\", \"\") error = %v, want non-nil error", helper, err)
+	}
+	if _, err := NewSigningHelperKey("", AlgorithmEd25519, ""); err == nil {
+		t.Errorf("NewSigningHelperKey(\"\", ed25519, \"\") error = %v, want non-nil error", err)
+	}
+
+	key, err := NewSigningHelperKey(helper, AlgorithmEd25519, "")
+	if err != nil {
+		t.Fatalf("NewSigningHelperKey(%q, ed25519, \"\") error = %v", helper, err)
+	}
+	signer, err := key.Signer()
+	if err != nil {
+		t.Fatalf("key.Signer() error = %v", err)
+	}
+	if _, err := Sign(&CommandStep{Command: "llamas"}, signer); err == nil {
+		t.Errorf("Sign(CommandStep, helper signer) error = %v, want non-nil error", err)
+	}
+}
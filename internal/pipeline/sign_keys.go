@@ -0,0 +1,416 @@
+package pipeline
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"time"
+)
+
+// Key is a signing or verification key, together with the algorithm it is
+// intended to be used with.
+type Key struct {
+	// ID identifies the key within a KeySet. It is recorded in signatures
+	// made with the key. It may be empty.
+	ID string
+
+	// Algorithm is the signing algorithm name (e.g. "ed25519").
+	Algorithm string
+
+	// Expiry is the time after which the key is no longer trusted for
+	// verification. The zero value means the key does not expire.
+	Expiry time.Time
+
+	// Revoked keys are never trusted for verification.
+	Revoked bool
+
+	// Key is the key material. It is one of []byte (hmac-sha256),
+	// ed25519.PrivateKey, ed25519.PublicKey, *ecdsa.PrivateKey,
+	// *ecdsa.PublicKey, *rsa.PrivateKey, or *rsa.PublicKey. For keys held
+	// outside the agent, it is a *SigningHelper.
+	Key any
+}
+
+// Signer returns a new Signer using the key. Signatures made with the Signer
+// record the key's ID.
+func (k *Key) Signer() (Signer, error) {
+	signer, err := NewSigner(k.Algorithm, k.Key)
+	if err != nil {
+		return nil, err
+	}
+	if k.ID == "" {
+		return signer, nil
+	}
+	return keyedSigner{Signer: signer, keyID: k.ID}, nil
+}
+
+// keyedSigner is a Signer that knows the ID of its key.
+type keyedSigner struct {
+	Signer
+	keyID string
+}
+
+func (s keyedSigner) KeyID() string { return s.keyID }
+
+// checkTrusted returns an error if the key is revoked, or expired as at now.
+func (k *Key) checkTrusted(now time.Time) error {
+	if k.Revoked {
+		return fmt.Errorf("key %q has been revoked", k.ID)
+	}
+	if !k.Expiry.IsZero() && !now.Before(k.Expiry) {
+		return fmt.Errorf("key %q expired at %s", k.ID, k.Expiry.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Verifier returns a new Verifier using the key, for signatures made with the
+// given algorithm. The algorithm must match the key's algorithm - this
+// prevents a signature from choosing a weaker algorithm than the key is
+// intended for.
+func (k *Key) Verifier(algorithm string) (Verifier, error) {
+	if algorithm != k.Algorithm {
+		return nil, fmt.Errorf("signature algorithm %q does not match the verification key algorithm %q", algorithm, k.Algorithm)
+	}
+	return NewVerifier(k.Algorithm, k.Key)
+}
+
+// ReadKeyFile reads a signing or verification key from a file.
+// See ParseKey for the supported formats.
+func ReadKeyFile(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParseKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing key file %q: %w", path, err)
+	}
+	return key, nil
+}
+
+// ParseKey parses a signing or verification key. The following are supported:
+//   - PEM-encoded keys: PKCS #8 or PKIX (Ed25519, ECDSA P-256, RSA),
+//     "EC PRIVATE KEY" (SEC 1), and "RSA PRIVATE KEY" / "RSA PUBLIC KEY"
+//     (PKCS #1).
+//   - A JSON Web Key (JWK) with kty "oct", "OKP" (Ed25519), "EC" (P-256), or
+//     "RSA".
+//   - Anything else is treated as a raw shared secret for hmac-sha256.
+//
+// Data that looks like PEM or JSON must parse as a key: treating a damaged
+// public key as a shared secret would let anyone holding the public key make
+// signatures that verify with it.
+func ParseKey(data []byte) (*Key, error) {
+	trimmed := bytes.TrimSpace(data)
+	switch {
+	case bytes.Contains(trimmed, []byte("-----BEGIN ")):
+		return parsePEMKey(trimmed)
+
+	case bytes.HasPrefix(trimmed, []byte("{")), bytes.HasPrefix(trimmed, []byte("[")):
+		var j jwk
+		if err := json.Unmarshal(trimmed, &j); err != nil {
+			return nil, fmt.Errorf("parsing JSON Web Key: %w", err)
+		}
+		if j.Kty == "" {
+			return nil, errors.New("JSON Web Key has no kty")
+		}
+		return j.key()
+	}
+
+	// Everything else is a shared secret. The raw content is used as-is, for
+	// compatibility with existing key files.
+	return &Key{Algorithm: AlgorithmHMACSHA256, Key: data}, nil
+}
+
+// parsePEMKey parses the first PEM block in data as a key.
+func parsePEMKey(data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+
+	var key any
+	var err error
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", block.Type, err)
+	}
+
+	alg, err := algorithmForKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Key{Algorithm: alg, Key: key}, nil
+}
+
+// algorithmForKey returns the algorithm name to use for a parsed key.
+func algorithmForKey(key any) (string, error) {
+	switch key := key.(type) {
+	case ed25519.PrivateKey, ed25519.PublicKey:
+		return AlgorithmEd25519, nil
+
+	case *ecdsa.PrivateKey:
+		return algorithmForKey(&key.PublicKey)
+
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P256() {
+			return "", fmt.Errorf("unsupported ECDSA curve %s, want P-256", key.Curve.Params().Name)
+		}
+		return AlgorithmECDSAP256SHA256, nil
+
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		return AlgorithmRSAPSSSHA256, nil
+
+	default:
+		return "", fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// jwkAlgorithms maps JSON Web Algorithm names onto signing algorithm names.
+var jwkAlgorithms = map[string]string{
+	"HS256": AlgorithmHMACSHA256,
+	"EdDSA": AlgorithmEd25519,
+	"ES256": AlgorithmECDSAP256SHA256,
+	"PS256": AlgorithmRSAPSSSHA256,
+}
+
+// jwk models the subset of a JSON Web Key (RFC 7517) needed for signing and
+// verification.
+type jwk struct {
+	Kty string `json:"kty"`
+	Alg string `json:"alg,omitempty"`
+	Kid string `json:"kid,omitempty"`
+	Crv string `json:"crv,omitempty"`
+
+	// Non-standard members for key rotation: the expiry time (as seconds
+	// since the Unix epoch), and whether the key has been revoked.
+	Exp     int64 `json:"exp,omitempty"`
+	Revoked bool  `json:"revoked,omitempty"`
+
+	// oct
+	K string `json:"k,omitempty"`
+
+	// OKP and EC
+	X string `json:"x,omitempty"`
+	Y string `json:"y,omitempty"`
+
+	// OKP, EC, and RSA private
+	D string `json:"d,omitempty"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	P string `json:"p,omitempty"`
+	Q string `json:"q,omitempty"`
+}
+
+// key converts the JWK into a Key.
+func (j *jwk) key() (*Key, error) {
+	var key any
+	var err error
+	switch j.Kty {
+	case "oct":
+		key, err = j.octKey()
+	case "OKP":
+		key, err = j.okpKey()
+	case "EC":
+		key, err = j.ecKey()
+	case "RSA":
+		key, err = j.rsaKey()
+	default:
+		return nil, fmt.Errorf("unsupported JWK key type %q", j.Kty)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("parsing JWK with kty %q: %w", j.Kty, err)
+	}
+
+	alg := AlgorithmHMACSHA256
+	if j.Kty != "oct" {
+		if alg, err = algorithmForKey(key); err != nil {
+			return nil, err
+		}
+	}
+
+	if j.Alg != "" {
+		jalg, ok := jwkAlgorithms[j.Alg]
+		if !ok {
+			// Permit the algorithm names used in signatures, too.
+			jalg = j.Alg
+		}
+		if jalg != alg {
+			return nil, fmt.Errorf("JWK alg %q is not supported for kty %q", j.Alg, j.Kty)
+		}
+	}
+
+	k := &Key{
+		ID:        j.Kid,
+		Algorithm: alg,
+		Key:       key,
+		Revoked:   j.Revoked,
+	}
+	if j.Exp != 0 {
+		k.Expiry = time.Unix(j.Exp, 0)
+	}
+	return k, nil
+}
+
+func (j *jwk) octKey() ([]byte, error) {
+	k, err := decodeJWKField("k", j.K)
+	if err != nil {
+		return nil, err
+	}
+	if len(k) == 0 {
+		return nil, errors.New("missing k")
+	}
+	return k, nil
+}
+
+func (j *jwk) okpKey() (any, error) {
+	if j.Crv != "Ed25519" {
+		return nil, fmt.Errorf("unsupported crv %q, want Ed25519", j.Crv)
+	}
+	x, err := decodeJWKField("x", j.X)
+	if err != nil {
+		return nil, err
+	}
+	if len(x) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid x length %d", len(x))
+	}
+	if j.D == "" {
+		return ed25519.PublicKey(x), nil
+	}
+
+	d, err := decodeJWKField("d", j.D)
+	if err != nil {
+		return nil, err
+	}
+	if len(d) != ed25519.SeedSize {
+		return nil, fmt.Errorf("invalid d length %d", len(d))
+	}
+	priv := ed25519.NewKeyFromSeed(d)
+	if !bytes.Equal(priv.Public().(ed25519.PublicKey), x) {
+		return nil, errors.New("x does not match d")
+	}
+	return priv, nil
+}
+
+func (j *jwk) ecKey() (any, error) {
+	if j.Crv != "P-256" {
+		return nil, fmt.Errorf("unsupported crv %q, want P-256", j.Crv)
+	}
+	x, err := decodeJWKBigInt("x", j.X)
+	if err != nil {
+		return nil, err
+	}
+	y, err := decodeJWKBigInt("y", j.Y)
+	if err != nil {
+		return nil, err
+	}
+	curve := elliptic.P256()
+	if !curve.IsOnCurve(x, y) {
+		return nil, errors.New("point is not on curve P-256")
+	}
+	pub := &ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	if j.D == "" {
+		return pub, nil
+	}
+
+	d, err := decodeJWKBigInt("d", j.D)
+	if err != nil {
+		return nil, err
+	}
+	priv := &ecdsa.PrivateKey{PublicKey: *pub, D: d}
+	if px, py := curve.ScalarBaseMult(d.Bytes()); px.Cmp(x) != 0 || py.Cmp(y) != 0 {
+		return nil, errors.New("x and y do not match d")
+	}
+	return priv, nil
+}
+
+func (j *jwk) rsaKey() (any, error) {
+	n, err := decodeJWKBigInt("n", j.N)
+	if err != nil {
+		return nil, err
+	}
+	e, err := decodeJWKBigInt("e", j.E)
+	if err != nil {
+		return nil, err
+	}
+	if !e.IsInt64() || e.Int64() > 1<<31-1 {
+		return nil, errors.New("e is too large")
+	}
+	pub := &rsa.PublicKey{N: n, E: int(e.Int64())}
+	if j.D == "" {
+		return pub, nil
+	}
+
+	d, err := decodeJWKBigInt("d", j.D)
+	if err != nil {
+		return nil, err
+	}
+	p, err := decodeJWKBigInt("p", j.P)
+	if err != nil {
+		return nil, err
+	}
+	q, err := decodeJWKBigInt("q", j.Q)
+	if err != nil {
+		return nil, err
+	}
+	priv := &rsa.PrivateKey{
+		PublicKey: *pub,
+		D:         d,
+		Primes:    []*big.Int{p, q},
+	}
+	if err := priv.Validate(); err != nil {
+		return nil, err
+	}
+	priv.Precompute()
+	return priv, nil
+}
+
+// decodeJWKField decodes a base64url-encoded (unpadded) JWK member.
+func decodeJWKField(name, value string) ([]byte, error) {
+	b, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", name, err)
+	}
+	return b, nil
+}
+
+// decodeJWKBigInt decodes a base64url-encoded (unpadded) big-endian integer.
+func decodeJWKBigInt(name, value string) (*big.Int, error) {
+	if value == "" {
+		return nil, fmt.Errorf("missing %s", name)
+	}
+	b, err := decodeJWKField(name, value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,248 @@
+package pipeline
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Test key from RFC 8037, appendix A.
+const (
+	rfc8037PrivateJWK = `{"kty":"OKP","crv":"Ed25519","d":"nWGxne_9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`
+	rfc8037PublicJWK  = `{"kty":"OKP","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo","alg":"EdDSA"}`
+)
+
+func TestParseKey_JWKRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	priv, err := ParseKey([]byte(rfc8037PrivateJWK))
+	if err != nil {
+		t.Fatalf("ParseKey(private JWK) error = %v", err)
+	}
+	pub, err := ParseKey([]byte(rfc8037PublicJWK))
+	if err != nil {
+		t.Fatalf("ParseKey(public JWK) error = %v", err)
+	}
+
+	assertKeysRoundTrip(t, priv, pub, AlgorithmEd25519)
+}
+
+func TestParseKey_PEMRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	_, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey(rand.Reader) error = %v", err)
+	}
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(P256, rand.Reader) error = %v", err)
+	}
+
+	cases := []struct {
+		alg  string
+		priv crypto.Signer
+	}{
+		{AlgorithmEd25519, edPriv},
+		{AlgorithmECDSAP256SHA256, ecPriv},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.alg, func(t *testing.T) {
+			t.Parallel()
+
+			privDER, err := x509.MarshalPKCS8PrivateKey(tc.priv)
+			if err != nil {
+				t.Fatalf("x509.MarshalPKCS8PrivateKey(%T) error = %v", tc.priv, err)
+			}
+			pubDER, err := x509.MarshalPKIXPublicKey(tc.priv.Public())
+			if err != nil {
+				t.Fatalf("x509.MarshalPKIXPublicKey(%T) error = %v", tc.priv.Public(), err)
+			}
+
+			priv, err := ParseKey(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}))
+			if err != nil {
+				t.Fatalf("ParseKey(private PEM) error = %v", err)
+			}
+			pub, err := ParseKey(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}))
+			if err != nil {
+				t.Fatalf("ParseKey(public PEM) error = %v", err)
+			}
+
+			assertKeysRoundTrip(t, priv, pub, tc.alg)
+		})
+	}
+}
+
+func TestParseKey_ECJWK(t *testing.T) {
+	t.Parallel()
+
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(P256, rand.Reader) error = %v", err)
+	}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	pubJWK := map[string]string{
+		"kty": "EC",
+		"crv": "P-256",
+		"alg": "ES256",
+		"x":   b64(ecPriv.X.FillBytes(make([]byte, 32))),
+		"y":   b64(ecPriv.Y.FillBytes(make([]byte, 32))),
+	}
+	pubJSON, err := json.Marshal(pubJWK)
+	if err != nil {
+		t.Fatalf("json.Marshal(pubJWK) error = %v", err)
+	}
+	pubJWK["d"] = b64(ecPriv.D.FillBytes(make([]byte, 32)))
+	privJSON, err := json.Marshal(pubJWK)
+	if err != nil {
+		t.Fatalf("json.Marshal(privJWK) error = %v", err)
+	}
+
+	priv, err := ParseKey(privJSON)
+	if err != nil {
+		t.Fatalf("ParseKey(private JWK) error = %v", err)
+	}
+	pub, err := ParseKey(pubJSON)
+	if err != nil {
+		t.Fatalf("ParseKey(public JWK) error = %v", err)
+	}
+
+	assertKeysRoundTrip(t, priv, pub, AlgorithmECDSAP256SHA256)
+}
+
+func TestParseKey_RawSecret(t *testing.T) {
+	t.Parallel()
+
+	key, err := ParseKey([]byte("alpacas"))
+	if err != nil {
+		t.Fatalf("ParseKey(alpacas) error = %v", err)
+	}
+	if got, want := key.Algorithm, AlgorithmHMACSHA256; got != want {
+		t.Errorf("key.Algorithm = %q, want %q", got, want)
+	}
+	assertKeysRoundTrip(t, key, key, AlgorithmHMACSHA256)
+}
+
+func TestParseKey_RejectsMalformedKeys(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name string
+		data string
+	}{
+		{
+			name: "JWK with trailing comma",
+			data: `{"kty":"OKP","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo",}`,
+		},
+		{
+			name: "JSON without kty",
+			data: `{"crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo"}`,
+		},
+		{
+			name: "JSON array",
+			data: `[` + rfc8037PublicJWK + `]`,
+		},
+		{
+			name: "truncated PEM",
+			data: "-----BEGIN PUBLIC KEY-----\nMCowBQYDK2VwAyEA\n",
+		},
+		{
+			name: "PEM after a comment",
+			data: "my key\n-----BEGIN PUBLIC KEY-----\nnot base64\n-----END PUBLIC KEY-----\n",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			key, err := ParseKey([]byte(test.data))
+			if err == nil {
+				t.Errorf("ParseKey(%q) = %+v, want non-nil error", test.data, key)
+			}
+		})
+	}
+}
+
+func TestParseKey_JWKAlgorithmMismatch(t *testing.T) {
+	t.Parallel()
+
+	const mismatched = `{"kty":"OKP","crv":"Ed25519","x":"11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo","alg":"ES256"}`
+	if _, err := ParseKey([]byte(mismatched)); err == nil {
+		t.Errorf("ParseKey(%s) error = %v, want non-nil error", mismatched, err)
+	}
+}
+
+func TestKeyVerifierAlgorithmMismatch(t *testing.T) {
+	t.Parallel()
+
+	key, err := ParseKey([]byte(rfc8037PublicJWK))
+	if err != nil {
+		t.Fatalf("ParseKey(public JWK) error = %v", err)
+	}
+	if _, err := key.Verifier(AlgorithmHMACSHA256); err == nil {
+		t.Errorf("key.Verifier(hmac-sha256) error = %v, want non-nil error", err)
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "key.jwk")
+	if err := os.WriteFile(path, []byte(rfc8037PublicJWK), 0o600); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", path, err)
+	}
+
+	key, err := ReadKeyFile(path)
+	if err != nil {
+		t.Fatalf("ReadKeyFile(%q) error = %v", path, err)
+	}
+	if got, want := key.Algorithm, AlgorithmEd25519; got != want {
+		t.Errorf("key.Algorithm = %q, want %q", got, want)
+	}
+}
+
+// assertKeysRoundTrip checks that priv and pub have the expected algorithm,
+// and that a signature made with priv verifies with pub.
+func assertKeysRoundTrip(t *testing.T, priv, pub *Key, alg string) {
+	t.Helper()
+
+	if got, want := priv.Algorithm, alg; got != want {
+		t.Errorf("priv.Algorithm = %q, want %q", got, want)
+	}
+	if got, want := pub.Algorithm, alg; got != want {
+		t.Errorf("pub.Algorithm = %q, want %q", got, want)
+	}
+
+	cs := &CommandStep{Command: "llamas"}
+
+	signer, err := priv.Signer()
+	if err != nil {
+		t.Fatalf("priv.Signer() error = %v", err)
+	}
+	sig, err := Sign(cs, signer)
+	if err != nil {
+		t.Fatalf("Sign(CommandStep, signer) error = %v", err)
+	}
+
+	verifier, err := pub.Verifier(sig.Algorithm)
+	if err != nil {
+		t.Fatalf("pub.Verifier(%q) error = %v", sig.Algorithm, err)
+	}
+	if err := sig.Verify(cs, verifier); err != nil {
+		t.Errorf("sig.Verify(CommandStep, verifier) = %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// KeySet is a set of keys trusted for verifying signatures. Having more than
+// one trusted key allows signing keys to be rotated without having to update
+// every verifier at the same time.
+type KeySet struct {
+	Keys []*Key
+}
+
+// ReadKeySet reads a set of verification keys from path, which may be:
+//   - a directory, where each (non-hidden) file contains either a single key
+//     or a JSON Web Key Set. Keys without a key ID are identified by their
+//     file name, without the extension.
+//   - a JSON Web Key Set (JWKS) file.
+//   - a single key file, in any format accepted by ParseKey.
+func ReadKeySet(path string) (*KeySet, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !fi.IsDir() {
+		keys, err := readKeysFromFile(path)
+		if err != nil {
+			return nil, err
+		}
+		return &KeySet{Keys: keys}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := &KeySet{}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		keys, err := readKeysFromFile(filepath.Join(path, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, k := range keys {
+			if k.ID == "" {
+				k.ID = strings.TrimSuffix(entry.Name(), filepath.Ext(entry.Name()))
+			}
+		}
+		ks.Keys = append(ks.Keys, keys...)
+	}
+	if len(ks.Keys) == 0 {
+		return nil, fmt.Errorf("no keys found in directory %q", path)
+	}
+	return ks, nil
+}
+
+// readKeysFromFile reads either a JWKS or a single key from a file.
+func readKeysFromFile(path string) ([]*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if isJWKS(data) {
+		ks, err := ParseKeySet(data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing key set file %q: %w", path, err)
+		}
+		return ks.Keys, nil
+	}
+	key, err := ParseKey(data)
+	if err != nil {
+		return nil, fmt.Errorf("parsing key file %q: %w", path, err)
+	}
+	return []*Key{key}, nil
+}
+
+// jwks models a JSON Web Key Set (RFC 7517, section 5).
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// isJWKS reports whether data looks like a JSON Web Key Set.
+func isJWKS(data []byte) bool {
+	trimmed := bytes.TrimSpace(data)
+	if !bytes.HasPrefix(trimmed, []byte("{")) {
+		return false
+	}
+	var probe map[string]json.RawMessage
+	if err := json.Unmarshal(trimmed, &probe); err != nil {
+		return false
+	}
+	_, hasKeys := probe["keys"]
+	_, hasKty := probe["kty"]
+	return hasKeys && !hasKty
+}
+
+// ParseKeySet parses a JSON Web Key Set. Every key must have a distinct key
+// ID ("kid").
+func ParseKeySet(data []byte) (*KeySet, error) {
+	var set jwks
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	if len(set.Keys) == 0 {
+		return nil, errors.New("key set contains no keys")
+	}
+
+	ks := &KeySet{Keys: make([]*Key, 0, len(set.Keys))}
+	seen := make(map[string]bool, len(set.Keys))
+	for i, j := range set.Keys {
+		if j.Kid == "" {
+			return nil, fmt.Errorf("key %d in key set has no kid", i)
+		}
+		if seen[j.Kid] {
+			return nil, fmt.Errorf("key set contains more than one key with kid %q", j.Kid)
+		}
+		seen[j.Kid] = true
+
+		k, err := j.key()
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", j.Kid, err)
+		}
+		ks.Keys = append(ks.Keys, k)
+	}
+	return ks, nil
+}
+
+// Verify verifies the signature sig on sf using a trusted key from the set,
+// and returns the key that verified it.
+//
+// If the signature names a key ID, the key with that ID is used, and it must
+// be neither revoked nor expired (as at now). If no key has that ID, each
+// trusted key without an ID (such as a key read from a single key file) with
+// the matching algorithm is tried in turn, as are all trusted keys with the
+// matching algorithm for signatures made before key IDs were recorded.
+func (ks *KeySet) Verify(sf SignedFielder, sig *Signature, now time.Time) (*Key, error) {
+	if sig.KeyID != "" {
+		if key := ks.lookup(sig.KeyID); key != nil {
+			if err := key.checkTrusted(now); err != nil {
+				return nil, err
+			}
+			if err := verifyWithKey(sf, sig, key); err != nil {
+				return nil, err
+			}
+			return key, nil
+		}
+	}
+
+	var errs []string
+	for _, key := range ks.Keys {
+		if key.Algorithm != sig.Algorithm || key.checkTrusted(now) != nil {
+			continue
+		}
+		if sig.KeyID != "" && key.ID != "" {
+			// A key with a different ID.
+			continue
+		}
+		err := verifyWithKey(sf, sig, key)
+		if err == nil {
+			return key, nil
+		}
+		errs = append(errs, err.Error())
+	}
+	if len(errs) == 0 {
+		if sig.KeyID != "" {
+			return nil, fmt.Errorf("signature was made with key %q, which is not a trusted key", sig.KeyID)
+		}
+		return nil, fmt.Errorf("no trusted key for algorithm %q", sig.Algorithm)
+	}
+	return nil, fmt.Errorf("signature did not verify with any trusted key: %s", strings.Join(errs, "; "))
+}
+
+// lookup returns the key with the given ID, or nil if there is none. A
+// signing helper key without an ID matches any ID, since the helper is
+// responsible for choosing the key.
+func (ks *KeySet) lookup(id string) *Key {
+	for _, k := range ks.Keys {
+		if k.ID == id {
+			return k
+		}
+	}
+	for _, k := range ks.Keys {
+		if _, isHelper := k.Key.(*SigningHelper); isHelper && k.ID == "" {
+			return k
+		}
+	}
+	return nil
+}
+
+func verifyWithKey(sf SignedFielder, sig *Signature, key *Key) error {
+	// Tell a signing helper which key made the signature, if it wasn't
+	// configured with a particular key.
+	if helper, ok := key.Key.(*SigningHelper); ok && helper.KeyID == "" && sig.KeyID != "" {
+		h := *helper
+		h.KeyID = sig.KeyID
+		k := *key
+		k.Key = &h
+		key = &k
+	}
+
+	verifier, err := key.Verifier(sig.Algorithm)
+	if err != nil {
+		return err
+	}
+	return sig.Verify(sf, verifier)
+}
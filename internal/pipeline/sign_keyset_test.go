@@ -0,0 +1,265 @@
+package pipeline
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestEd25519JWK returns a private Ed25519 JWK with the given kid, and the
+// corresponding public JWK (as a map, so that extra members can be added).
+func newTestEd25519JWK(t *testing.T, kid string) (priv []byte, pub map[string]any) {
+	t.Helper()
+
+	pk, sk, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey(rand.Reader) error = %v", err)
+	}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	pub = map[string]any{
+		"kty": "OKP",
+		"crv": "Ed25519",
+		"kid": kid,
+		"x":   b64(pk),
+	}
+	privJWK := map[string]any{"d": b64(sk.Seed())}
+	for k, v := range pub {
+		privJWK[k] = v
+	}
+	priv, err = json.Marshal(privJWK)
+	if err != nil {
+		t.Fatalf("json.Marshal(privJWK) error = %v", err)
+	}
+	return priv, pub
+}
+
+func signWithJWK(t *testing.T, privJWK []byte, sf SignedFielder) *Signature {
+	t.Helper()
+
+	key, err := ParseKey(privJWK)
+	if err != nil {
+		t.Fatalf("ParseKey(private JWK) error = %v", err)
+	}
+	signer, err := key.Signer()
+	if err != nil {
+		t.Fatalf("key.Signer() error = %v", err)
+	}
+	sig, err := Sign(sf, signer)
+	if err != nil {
+		t.Fatalf("Sign(sf, signer) error = %v", err)
+	}
+	return sig
+}
+
+func marshalJWKS(t *testing.T, keys ...map[string]any) []byte {
+	t.Helper()
+
+	b, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatalf("json.Marshal(jwks) error = %v", err)
+	}
+	return b
+}
+
+func TestSignRecordsKeyID(t *testing.T) {
+	t.Parallel()
+
+	priv, _ := newTestEd25519JWK(t, "llama-1")
+	sig := signWithJWK(t, priv, &CommandStep{Command: "llamas"})
+
+	if got, want := sig.KeyID, "llama-1"; got != want {
+		t.Errorf("sig.KeyID = %q, want %q", got, want)
+	}
+}
+
+func TestKeySetVerify(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2023, time.August, 1, 0, 0, 0, 0, time.UTC)
+
+	oldPriv, oldPub := newTestEd25519JWK(t, "old")
+	newPriv, newPub := newTestEd25519JWK(t, "new")
+	revokedPriv, revokedPub := newTestEd25519JWK(t, "revoked")
+	revokedPub["revoked"] = true
+	expiredPriv, expiredPub := newTestEd25519JWK(t, "expired")
+	expiredPub["exp"] = now.Add(-time.Hour).Unix()
+	untrustedPriv, _ := newTestEd25519JWK(t, "untrusted")
+
+	ks, err := ParseKeySet(marshalJWKS(t, oldPub, newPub, revokedPub, expiredPub))
+	if err != nil {
+		t.Fatalf("ParseKeySet(jwks) error = %v", err)
+	}
+
+	cs := &CommandStep{Command: "llamas"}
+
+	tests := []struct {
+		name      string
+		priv      []byte
+		wantKeyID string
+		wantErr   string
+	}{
+		{name: "old key", priv: oldPriv, wantKeyID: "old"},
+		{name: "new key", priv: newPriv, wantKeyID: "new"},
+		{name: "revoked key", priv: revokedPriv, wantErr: `key "revoked" has been revoked`},
+		{name: "expired key", priv: expiredPriv, wantErr: `key "expired" expired at`},
+		{name: "untrusted key", priv: untrustedPriv, wantErr: `key "untrusted", which is not a trusted key`},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			sig := signWithJWK(t, test.priv, cs)
+			key, err := ks.Verify(cs, sig, now)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("ks.Verify(cs, sig, now) error = %v, want error containing %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ks.Verify(cs, sig, now) error = %v", err)
+			}
+			if got, want := key.ID, test.wantKeyID; got != want {
+				t.Errorf("ks.Verify(cs, sig, now) key.ID = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestKeySetVerify_NoKeyID(t *testing.T) {
+	t.Parallel()
+
+	priv, pub := newTestEd25519JWK(t, "llama")
+	_, otherPub := newTestEd25519JWK(t, "alpaca")
+
+	ks, err := ParseKeySet(marshalJWKS(t, otherPub, pub))
+	if err != nil {
+		t.Fatalf("ParseKeySet(jwks) error = %v", err)
+	}
+
+	cs := &CommandStep{Command: "llamas"}
+	sig := signWithJWK(t, priv, cs)
+	sig.KeyID = "" // as though it was signed before key IDs were recorded
+
+	key, err := ks.Verify(cs, sig, time.Now())
+	if err != nil {
+		t.Fatalf("ks.Verify(cs, sig, now) error = %v", err)
+	}
+	if got, want := key.ID, "llama"; got != want {
+		t.Errorf("ks.Verify(cs, sig, now) key.ID = %q, want %q", got, want)
+	}
+}
+
+func TestKeySetVerify_KeyIDWithoutMatchingKey(t *testing.T) {
+	t.Parallel()
+
+	priv, _ := newTestEd25519JWK(t, "k1")
+	cs := &CommandStep{Command: "llamas"}
+	sig := signWithJWK(t, priv, cs)
+
+	// The verifier has the same key as a PEM file, which has no key ID.
+	privKey, err := ParseKey(priv)
+	if err != nil {
+		t.Fatalf("ParseKey(private JWK) error = %v", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(privKey.Key.(ed25519.PrivateKey).Public())
+	if err != nil {
+		t.Fatalf("x509.MarshalPKIXPublicKey(public key) error = %v", err)
+	}
+	path := filepath.Join(t.TempDir(), "verify.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0o600); err != nil {
+		t.Fatalf("os.WriteFile(%q) error = %v", path, err)
+	}
+	ks, err := ReadKeySet(path)
+	if err != nil {
+		t.Fatalf("ReadKeySet(%q) error = %v", path, err)
+	}
+
+	key, err := ks.Verify(cs, sig, time.Now())
+	if err != nil {
+		t.Fatalf("ks.Verify(cs, sig, now) error = %v", err)
+	}
+	if key != ks.Keys[0] {
+		t.Errorf("ks.Verify(cs, sig, now) key = %+v, want the key from %s", key, path)
+	}
+
+	// A different key without an ID doesn't verify it.
+	otherPriv, _ := newTestEd25519JWK(t, "k2")
+	otherSig := signWithJWK(t, otherPriv, cs)
+	otherSig.KeyID = "k1"
+	if _, err := ks.Verify(cs, otherSig, time.Now()); err == nil {
+		t.Errorf("ks.Verify(cs, sig from another key, now) error = %v, want non-nil error", err)
+	}
+}
+
+func TestParseKeySet_DuplicateKeyID(t *testing.T) {
+	t.Parallel()
+
+	_, pub := newTestEd25519JWK(t, "llama")
+	if _, err := ParseKeySet(marshalJWKS(t, pub, pub)); err == nil {
+		t.Errorf("ParseKeySet(jwks with duplicate kid) error = %v, want non-nil error", err)
+	}
+}
+
+func TestReadKeySet_Directory(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	priv, pub := newTestEd25519JWK(t, "")
+	delete(pub, "kid")
+	pubJSON, err := json.Marshal(pub)
+	if err != nil {
+		t.Fatalf("json.Marshal(pub) error = %v", err)
+	}
+	files := map[string][]byte{
+		"llama.jwk":  pubJSON,
+		"alpaca.key": []byte("alpacas"),
+		".DS_Store":  []byte("not a key"),
+		"rotated.json": marshalJWKS(t, func() map[string]any {
+			_, p := newTestEd25519JWK(t, "rotated")
+			return p
+		}()),
+	}
+	for name, data := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), data, 0o600); err != nil {
+			t.Fatalf("os.WriteFile(%q) error = %v", name, err)
+		}
+	}
+
+	ks, err := ReadKeySet(dir)
+	if err != nil {
+		t.Fatalf("ReadKeySet(%q) error = %v", dir, err)
+	}
+
+	var ids []string
+	for _, k := range ks.Keys {
+		ids = append(ids, k.ID)
+	}
+	if got, want := strings.Join(ids, ","), "alpaca,llama,rotated"; got != want {
+		t.Errorf("ReadKeySet(%q) key IDs = %q, want %q", dir, got, want)
+	}
+
+	// A key without a kid is identified by its file name, so a signature
+	// made with it (without a kid) still verifies.
+	cs := &CommandStep{Command: "llamas"}
+	sig := signWithJWK(t, priv, cs)
+	key, err := ks.Verify(cs, sig, time.Now())
+	if err != nil {
+		t.Fatalf("ks.Verify(cs, sig, now) error = %v", err)
+	}
+	if got, want := key.ID, "llama"; got != want {
+		t.Errorf("ks.Verify(cs, sig, now) key.ID = %q, want %q", got, want)
+	}
+}
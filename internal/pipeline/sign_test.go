@@ -2,6 +2,11 @@ package pipeline
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
 	"errors"
 	"fmt"
 	"hash"
@@ -27,8 +32,8 @@ func TestSignVerify(t *testing.T) {
 
 	want := &Signature{
 		Algorithm:    "hmac-sha256",
-		SignedFields: []string{"command"},
-		Value:        "GMetJcA3JqBNVDwljHRGfuW3t3Raixu+4+4dRYa0Cg0=",
+		SignedFields: []string{"command", "plugins"},
+		Value:        "ztYbBRPmn34CmTTa9/gwtl6LX7H1tZAQWcnK7rYE95A=",
 	}
 	if diff := cmp.Diff(sig, want); diff != "" {
 		t.Errorf("Signature diff (-got +want):\n%s", diff)
@@ -45,7 +50,7 @@ func TestSignVerify(t *testing.T) {
 
 type testFields map[string]string
 
-func (m testFields) SignedFields() map[string]string { return m }
+func (m testFields) SignedFields() (map[string]string, error) { return m, nil }
 
 func (m testFields) ValuesForFields(fields []string) (map[string]string, error) {
 	out := make(map[string]string, len(fields))
@@ -167,3 +172,80 @@ func TestSignUnknownStep(t *testing.T) {
 		t.Errorf("steps.sign(signer) = %v, want %v", err, errSigningRefusedUnknownStepType)
 	}
 }
+
+func TestSignVerifyAsymmetric(t *testing.T) {
+	t.Parallel()
+
+	_, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey(rand.Reader) error = %v", err)
+	}
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("ecdsa.GenerateKey(P256, rand.Reader) error = %v", err)
+	}
+	rsaPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("rsa.GenerateKey(rand.Reader, 2048) error = %v", err)
+	}
+
+	cases := []struct {
+		alg       string
+		signKey   any
+		verifyKey any
+	}{
+		{AlgorithmEd25519, edPriv, edPriv.Public()},
+		{AlgorithmECDSAP256SHA256, ecPriv, ecPriv.Public()},
+		{AlgorithmRSAPSSSHA256, rsaPriv, rsaPriv.Public()},
+	}
+
+	for _, tc := range cases {
+		tc := tc
+		t.Run(tc.alg, func(t *testing.T) {
+			t.Parallel()
+
+			cs := &CommandStep{
+				Command: "llamas",
+			}
+
+			signer, err := NewSigner(tc.alg, tc.signKey)
+			if err != nil {
+				t.Fatalf("NewSigner(%q, %T) error = %v", tc.alg, tc.signKey, err)
+			}
+			sig, err := Sign(cs, signer)
+			if err != nil {
+				t.Fatalf("Sign(CommandStep, signer) error = %v", err)
+			}
+			if got, want := sig.Algorithm, tc.alg; got != want {
+				t.Errorf("sig.Algorithm = %q, want %q", got, want)
+			}
+
+			verifier, err := NewVerifier(tc.alg, tc.verifyKey)
+			if err != nil {
+				t.Fatalf("NewVerifier(%q, %T) error = %v", tc.alg, tc.verifyKey, err)
+			}
+			if err := sig.Verify(cs, verifier); err != nil {
+				t.Errorf("sig.Verify(CommandStep, verifier) = %v", err)
+			}
+
+			tampered := &CommandStep{
+				Command: "alpacas",
+			}
+			if err := sig.Verify(tampered, verifier); err == nil {
+				t.Errorf("sig.Verify(tampered CommandStep, verifier) = %v, want non-nil error", err)
+			}
+		})
+	}
+}
+
+func TestNewSignerRejectsPublicKey(t *testing.T) {
+	t.Parallel()
+
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("ed25519.GenerateKey(rand.Reader) error = %v", err)
+	}
+	if _, err := NewSigner(AlgorithmEd25519, pub); err == nil {
+		t.Errorf("NewSigner(ed25519, ed25519.PublicKey) error = %v, want non-nil error", err)
+	}
+}
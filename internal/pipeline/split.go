@@ -0,0 +1,77 @@
+package pipeline
+
+import "fmt"
+
+// MaxStepsPerUpload is the number of steps the pipeline upload API accepts in
+// a single upload.
+const MaxStepsPerUpload = 500
+
+// Split splits the pipeline into consecutive pipelines of at most max steps
+// each, counting each group step as one step plus the steps within it. Group
+// steps are never split. If the pipeline is small enough, Split returns it
+// unchanged as the only element.
+//
+// Each part has the same env and other top-level fields as the original,
+// except for notify, which only the first part has (so that notifications
+// aren't sent more than once).
+//
+// Uploading the parts in order produces the same build as uploading the
+// original, since wait steps and depends_on apply across uploads.
+func (p *Pipeline) Split(max int) ([]*Pipeline, error) {
+	if max < 1 {
+		return nil, fmt.Errorf("invalid maximum steps per pipeline %d", max)
+	}
+
+	total := 0
+	for _, s := range p.Steps {
+		total += stepCount(s)
+	}
+	if total <= max {
+		return []*Pipeline{p}, nil
+	}
+
+	var parts []*Pipeline
+	var current Steps
+	count := 0
+	flush := func() {
+		part := &Pipeline{
+			Steps: current,
+			Env:   p.Env,
+		}
+		for k, v := range p.RemainingFields {
+			if k == "notify" && len(parts) > 0 {
+				continue
+			}
+			if part.RemainingFields == nil {
+				part.RemainingFields = make(map[string]any, len(p.RemainingFields))
+			}
+			part.RemainingFields[k] = v
+		}
+		parts = append(parts, part)
+		current, count = nil, 0
+	}
+
+	for i, s := range p.Steps {
+		n := stepCount(s)
+		if n > max {
+			return nil, fmt.Errorf("step %d has %d steps, which is more than the maximum of %d steps per upload", i+1, n, max)
+		}
+		if count+n > max {
+			flush()
+		}
+		current = append(current, s)
+		count += n
+	}
+	if len(current) > 0 {
+		flush()
+	}
+	return parts, nil
+}
+
+// stepCount returns the number of steps s counts as towards the upload limit.
+func stepCount(s Step) int {
+	if g, ok := s.(*GroupStep); ok {
+		return 1 + len(g.Steps)
+	}
+	return 1
+}
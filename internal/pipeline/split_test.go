@@ -0,0 +1,96 @@
+package pipeline
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/buildkite/agent/v3/internal/ordered"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestPipelineSplit(t *testing.T) {
+	t.Parallel()
+
+	env := ordered.MapFromItems(ordered.TupleSS{Key: "LLAMAS", Value: "alpacas"})
+	notify := []any{"email"}
+	group := &GroupStep{
+		Group: "g",
+		Steps: Steps{&CommandStep{Command: "c"}, &CommandStep{Command: "d"}},
+	}
+	p := &Pipeline{
+		Steps: Steps{
+			&CommandStep{Command: "a"},
+			&WaitStep{Scalar: "wait"},
+			group,
+			&CommandStep{Command: "e"},
+			&CommandStep{Command: "f"},
+		},
+		Env: env,
+		RemainingFields: map[string]any{
+			"agents": map[string]any{"queue": "q"},
+			"notify": notify,
+		},
+	}
+
+	got, err := p.Split(4)
+	if err != nil {
+		t.Fatalf("p.Split(4) error = %v", err)
+	}
+
+	// The group (3 steps) doesn't fit after the first two steps.
+	want := []*Pipeline{
+		{
+			Steps: Steps{&CommandStep{Command: "a"}, &WaitStep{Scalar: "wait"}},
+			Env:   env,
+			RemainingFields: map[string]any{
+				"agents": map[string]any{"queue": "q"},
+				"notify": notify,
+			},
+		},
+		{
+			Steps: Steps{group, &CommandStep{Command: "e"}},
+			Env:   env,
+			RemainingFields: map[string]any{
+				"agents": map[string]any{"queue": "q"},
+			},
+		},
+		{
+			Steps: Steps{&CommandStep{Command: "f"}},
+			Env:   env,
+			RemainingFields: map[string]any{
+				"agents": map[string]any{"queue": "q"},
+			},
+		},
+	}
+	if diff := cmp.Diff(got, want, cmp.Comparer(ordered.Equal[string, string])); diff != "" {
+		t.Errorf("p.Split(4) diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestPipelineSplitSmallPipeline(t *testing.T) {
+	t.Parallel()
+
+	p := &Pipeline{Steps: Steps{&CommandStep{Command: "a"}}}
+	got, err := p.Split(MaxStepsPerUpload)
+	if err != nil {
+		t.Fatalf("p.Split(%d) error = %v", MaxStepsPerUpload, err)
+	}
+	if len(got) != 1 || got[0] != p {
+		t.Errorf("p.Split(%d) = %v, want [p]", MaxStepsPerUpload, got)
+	}
+}
+
+func TestPipelineSplitGroupTooLarge(t *testing.T) {
+	t.Parallel()
+
+	p := &Pipeline{
+		Steps: Steps{
+			&CommandStep{Command: "a"},
+			&GroupStep{Group: "g", Steps: Steps{&CommandStep{Command: "b"}, &CommandStep{Command: "c"}}},
+		},
+	}
+	_, err := p.Split(2)
+	if err == nil || !strings.Contains(err.Error(), "step 2 has 3 steps") {
+		t.Errorf("p.Split(2) error = %v, want error containing %q", err, "step 2 has 3 steps")
+	}
+}
@@ -3,6 +3,7 @@ package pipeline
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strings"
 
 	"github.com/buildkite/agent/v3/internal/ordered"
@@ -11,14 +12,19 @@ import (
 
 var _ SignedFielder = (*CommandStep)(nil)
 
+// EnvNamespacePrefix is the prefix of signed field names that refer to
+// environment variables, e.g. "env::FOO" is the value of FOO.
+const EnvNamespacePrefix = "env::"
+
 // CommandStep models a command step.
 //
 // Standard caveats apply - see the package comment.
 type CommandStep struct {
-	Command   string     `yaml:"command"`
-	Plugins   Plugins    `yaml:"plugins,omitempty"`
-	Signature *Signature `yaml:"signature,omitempty"`
-	Matrix    any        `yaml:"matrix,omitempty"`
+	Command   string            `yaml:"command"`
+	Plugins   Plugins           `yaml:"plugins,omitempty"`
+	Env       map[string]string `yaml:"env,omitempty"`
+	Signature *Signature        `yaml:"signature,omitempty"`
+	Matrix    *Matrix           `yaml:"matrix,omitempty"`
 
 	// RemainingFields stores any other top-level mapping items so they at least
 	// survive an unmarshal-marshal round-trip.
@@ -66,6 +72,23 @@ func (c *CommandStep) unmarshalMap(m *ordered.MapSA) error {
 				return fmt.Errorf("unmarshaling plugins: %w", err)
 			}
 
+		case "env":
+			if v == nil {
+				c.Env = nil
+				return nil
+			}
+			msa, ok := v.(*ordered.MapSA)
+			if !ok {
+				return fmt.Errorf("unmarshaling env: got %T, want *ordered.Map[string, any]", v)
+			}
+			// As with pipeline env, anything not a string is converted to
+			// a string.
+			c.Env = make(map[string]string, msa.Len())
+			msa.Range(func(k string, v any) error {
+				c.Env[k] = fmt.Sprint(v)
+				return nil
+			})
+
 		case "signature":
 			sig := new(Signature)
 			if err := sig.unmarshalAny(v); err != nil {
@@ -74,7 +97,15 @@ func (c *CommandStep) unmarshalMap(m *ordered.MapSA) error {
 			c.Signature = sig
 
 		case "matrix":
-			c.Matrix = v
+			if v == nil {
+				c.Matrix = nil
+				return nil
+			}
+			m := new(Matrix)
+			if err := m.unmarshalAny(v); err != nil {
+				return fmt.Errorf("unmarshaling matrix: %w", err)
+			}
+			c.Matrix = m
 
 		default:
 			// Preserve any other key.
@@ -88,11 +119,31 @@ func (c *CommandStep) unmarshalMap(m *ordered.MapSA) error {
 	})
 }
 
-// SignedFields returns the default fields for signing.
-func (c *CommandStep) SignedFields() map[string]string {
-	return map[string]string{
+// SignedFields returns the default fields for signing. The plugins are always
+// signed (even if there are none, so that plugins can't be added to the step),
+// and each step env var is signed as a separate field named with
+// EnvNamespacePrefix. The matrix (if any) is signed in its entirety, so that
+// every permutation is covered by the one signature.
+func (c *CommandStep) SignedFields() (map[string]string, error) {
+	plugins, err := c.Plugins.CanonicalString()
+	if err != nil {
+		return nil, fmt.Errorf("canonicalising plugins: %w", err)
+	}
+	out := map[string]string{
 		"command": c.Command,
+		"plugins": plugins,
+	}
+	for k, v := range c.Env {
+		out[EnvNamespacePrefix+k] = v
+	}
+	if c.Matrix != nil {
+		m, err := c.Matrix.canonicalString()
+		if err != nil {
+			return nil, fmt.Errorf("canonicalising matrix: %w", err)
+		}
+		out["matrix"] = m
 	}
+	return out, nil
 }
 
 // ValuesForFields returns the contents of fields to sign.
@@ -102,18 +153,98 @@ func (c *CommandStep) ValuesForFields(fields []string) (map[string]string, error
 		switch f {
 		case "command":
 			out["command"] = c.Command
+
+		case "plugins":
+			p, err := c.Plugins.CanonicalString()
+			if err != nil {
+				return nil, fmt.Errorf("canonicalising plugins: %w", err)
+			}
+			out["plugins"] = p
+
+		case "matrix":
+			if c.Matrix == nil {
+				return nil, errors.New("signature covers matrix, but the step has no matrix")
+			}
+			m, err := c.Matrix.canonicalString()
+			if err != nil {
+				return nil, fmt.Errorf("canonicalising matrix: %w", err)
+			}
+			out["matrix"] = m
+
 		default:
-			return nil, fmt.Errorf("unknown or unsupported field for signing %q", f)
+			if !strings.HasPrefix(f, EnvNamespacePrefix) {
+				return nil, fmt.Errorf("unknown or unsupported field for signing %q", f)
+			}
+			// Signing an env var the step doesn't have is allowed (it
+			// signs the absence of a value), so that a var can't be added.
+			out[f] = c.Env[strings.TrimPrefix(f, EnvNamespacePrefix)]
 		}
 	}
 	if _, ok := out["command"]; !ok {
 		return nil, errors.New("command is required for signature verification")
 	}
+	if _, ok := out["plugins"]; len(c.Plugins) > 0 && !ok {
+		return nil, errors.New("plugins is required for signature verification of a step with plugins")
+	}
+	var unsignedEnv []string
+	for name := range c.Env {
+		if _, ok := out[EnvNamespacePrefix+name]; !ok {
+			unsignedEnv = append(unsignedEnv, name)
+		}
+	}
+	if len(unsignedEnv) > 0 {
+		sort.Strings(unsignedEnv)
+		return nil, fmt.Errorf("step env vars %v are required for signature verification", unsignedEnv)
+	}
+	if _, ok := out["matrix"]; c.Matrix != nil && !ok {
+		// Otherwise the matrix could be changed without invalidating the
+		// signature.
+		return nil, errors.New("matrix is required for signature verification of a matrix step")
+	}
 	return out, nil
 }
 
+// InterpolateMatrixPermutation validates that the permutation is one of the
+// permutations allowed by the step's matrix, and then substitutes the values
+// into the matrix tokens ({{matrix}} or {{matrix.dimension}}) in the step's
+// command, env, and plugin configuration. The env and plugins are replaced
+// rather than modified, since they may be shared with copies of the step.
+func (c *CommandStep) InterpolateMatrixPermutation(mp MatrixPermutation) error {
+	if c.Matrix == nil {
+		if len(mp) > 0 {
+			return fmt.Errorf("job has matrix permutation %v, but the step has no matrix", mp)
+		}
+		return nil
+	}
+	if len(mp) == 0 {
+		return errors.New("step has a matrix, but the job has no matrix permutation")
+	}
+	if err := c.Matrix.validatePermutation(mp); err != nil {
+		return err
+	}
+	c.Command = interpolateMatrix(mp, c.Command)
+	if c.Env != nil {
+		env := make(map[string]string, len(c.Env))
+		for k, v := range c.Env {
+			env[k] = interpolateMatrix(mp, v)
+		}
+		c.Env = env
+	}
+	if c.Plugins != nil {
+		plugins := make(Plugins, 0, len(c.Plugins))
+		for _, p := range c.Plugins {
+			plugins = append(plugins, &Plugin{
+				Name:   p.Name,
+				Config: interpolateMatrixAny(mp, p.Config),
+			})
+		}
+		c.Plugins = plugins
+	}
+	return nil
+}
+
 func (c *CommandStep) interpolate(env interpolate.Env) error {
-	cmd, err := interpolate.Interpolate(env, c.Command)
+	cmd, err := interpolateString(env, c.Command)
 	if err != nil {
 		return err
 	}
@@ -122,7 +253,11 @@ func (c *CommandStep) interpolate(env interpolate.Env) error {
 		return err
 	}
 
-	if c.Matrix, err = interpolateAny(env, c.Matrix); err != nil {
+	if err := interpolateMap(env, c.Env); err != nil {
+		return err
+	}
+
+	if err := c.Matrix.interpolate(env); err != nil {
 		return err
 	}
 
@@ -0,0 +1,493 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/buildkite/agent/v3/internal/ordered"
+	"github.com/buildkite/interpolate"
+	"golang.org/x/exp/slices"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	_ interface {
+		json.Marshaler
+		json.Unmarshaler
+		selfInterpolater
+	} = (*Matrix)(nil)
+
+	_ interface {
+		json.Marshaler
+		yaml.Marshaler
+	} = MatrixSetup(nil)
+
+	_ interface {
+		json.Marshaler
+		yaml.Marshaler
+	} = MatrixAdjustmentWith(nil)
+)
+
+// Matrix models the matrix specification for command steps.
+//
+// A matrix can be written in a short "single-dimension" form:
+//
+//	matrix:
+//	  - "value1"
+//	  - "value2"
+//
+// or a long form with a setup and optional adjustments:
+//
+//	matrix:
+//	  setup:
+//	    os: [linux, windows]
+//	    arch: [amd64, arm64]
+//	  adjustments:
+//	    - with: { os: windows, arch: arm64 }
+//	      skip: true
+//
+// Standard caveats apply - see the package comment.
+type Matrix struct {
+	Setup       MatrixSetup       `yaml:"setup"`
+	Adjustments MatrixAdjustments `yaml:"adjustments,omitempty"`
+
+	// RemainingFields stores any other top-level mapping items so they at least
+	// survive an unmarshal-marshal round-trip.
+	RemainingFields map[string]any `yaml:",inline"`
+}
+
+// MarshalJSON marshals the matrix to JSON. Special handling is needed because
+// yaml.v3 has "inline" but encoding/json has no concept of it.
+func (m *Matrix) MarshalJSON() ([]byte, error) {
+	return inlineFriendlyMarshalJSON(m)
+}
+
+// UnmarshalJSON unmarshals the matrix from JSON (such as the step on a job
+// from the Agent API). Because YAML is a superset of JSON, it is parsed with
+// the same rules as a matrix in a pipeline file.
+func (m *Matrix) UnmarshalJSON(b []byte) error {
+	n := new(yaml.Node)
+	if err := yaml.Unmarshal(b, n); err != nil {
+		return err
+	}
+	o, err := ordered.DecodeYAML(n)
+	if err != nil {
+		return err
+	}
+	return m.unmarshalAny(o)
+}
+
+// unmarshalAny unmarshals a matrix from either []any (single-dimension short
+// form) or *ordered.MapSA (long form).
+func (m *Matrix) unmarshalAny(o any) error {
+	switch o := o.(type) {
+	case []any:
+		return m.Setup.unmarshalAny(o)
+
+	case *ordered.MapSA:
+		err := o.Range(func(k string, v any) error {
+			switch k {
+			case "setup":
+				if err := m.Setup.unmarshalAny(v); err != nil {
+					return fmt.Errorf("unmarshaling setup: %w", err)
+				}
+
+			case "adjustments":
+				if err := m.Adjustments.unmarshalAny(v); err != nil {
+					return fmt.Errorf("unmarshaling adjustments: %w", err)
+				}
+
+			default:
+				// Preserve any other key.
+				if m.RemainingFields == nil {
+					m.RemainingFields = make(map[string]any)
+				}
+				m.RemainingFields[k] = v
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+	default:
+		return fmt.Errorf("unmarshaling matrix: got %T, want []any or *ordered.Map[string, any]", o)
+	}
+
+	if len(m.Setup) == 0 {
+		return errors.New("unmarshaling matrix: matrix has no setup")
+	}
+	return nil
+}
+
+func (m *Matrix) interpolate(env interpolate.Env) error {
+	if m == nil {
+		return nil
+	}
+	if err := interpolateMap(env, m.Setup); err != nil {
+		return err
+	}
+	if err := interpolateSlice(env, m.Adjustments); err != nil {
+		return err
+	}
+	return interpolateMap(env, m.RemainingFields)
+}
+
+// canonicalString returns a canonical string form of the matrix, suitable for
+// signing.
+func (m *Matrix) canonicalString() (string, error) {
+	// encoding/json sorts map keys, and everything else is either in a
+	// significant order (dimension values, adjustments) or an ordered.Map
+	// that preserves its order.
+	b, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// validatePermutation checks that a permutation is one of the permutations
+// described by the matrix: either a combination of values from the setup that
+// is not skipped by an adjustment, or an extra combination added by an
+// adjustment.
+func (m *Matrix) validatePermutation(p MatrixPermutation) error {
+	if len(p) != len(m.Setup) {
+		return fmt.Errorf("matrix permutation has %d dimensions, but the matrix has %d", len(p), len(m.Setup))
+	}
+	for dim := range p {
+		if _, ok := m.Setup[dim]; !ok {
+			return fmt.Errorf("matrix permutation has dimension %q, which is not in the matrix", dim)
+		}
+	}
+
+	for _, adj := range m.Adjustments {
+		if !adj.With.matches(p) {
+			continue
+		}
+		if adj.ShouldSkip() {
+			return fmt.Errorf("matrix permutation %v is skipped by an adjustment", p)
+		}
+		// Either an addition to the matrix, or an adjustment to an existing
+		// combination (e.g. soft_fail).
+		return nil
+	}
+
+	for dim, val := range p {
+		if !slices.Contains(m.Setup[dim], val) {
+			return fmt.Errorf("matrix permutation has value %q for dimension %q, which is not in the matrix", val, dim)
+		}
+	}
+	return nil
+}
+
+// MatrixSetup is the main setup of a matrix - one or more dimensions, each
+// with a list of values. A single-dimension matrix has one dimension named ""
+// (the empty string).
+type MatrixSetup map[string][]string
+
+// MarshalJSON returns either a list (for single-dimension matrices), or a
+// mapping of dimension names to lists of values.
+func (ms MatrixSetup) MarshalJSON() ([]byte, error) {
+	o, _ := ms.MarshalYAML()
+	return json.Marshal(o)
+}
+
+// MarshalYAML returns either a list (for single-dimension matrices), or a
+// mapping of dimension names to lists of values.
+func (ms MatrixSetup) MarshalYAML() (any, error) {
+	if vals, ok := ms[""]; ok && len(ms) == 1 {
+		return vals, nil
+	}
+	return map[string][]string(ms), nil
+}
+
+// unmarshalAny unmarshals the setup from either []any (single dimension) or
+// *ordered.MapSA (named dimensions).
+func (ms *MatrixSetup) unmarshalAny(o any) error {
+	if *ms == nil {
+		*ms = make(MatrixSetup)
+	}
+
+	switch o := o.(type) {
+	case []any:
+		vals, err := matrixValues(o)
+		if err != nil {
+			return err
+		}
+		(*ms)[""] = vals
+
+	case *ordered.MapSA:
+		return o.Range(func(dim string, v any) error {
+			sl, ok := v.([]any)
+			if !ok {
+				return fmt.Errorf("dimension %q has type %T, want []any", dim, v)
+			}
+			vals, err := matrixValues(sl)
+			if err != nil {
+				return fmt.Errorf("dimension %q: %w", dim, err)
+			}
+			(*ms)[dim] = vals
+			return nil
+		})
+
+	default:
+		return fmt.Errorf("got %T, want []any or *ordered.Map[string, any]", o)
+	}
+	return nil
+}
+
+// MatrixAdjustments is a set of adjustments.
+type MatrixAdjustments []*MatrixAdjustment
+
+// unmarshalAny unmarshals adjustments from a []any.
+func (ma *MatrixAdjustments) unmarshalAny(o any) error {
+	sl, ok := o.([]any)
+	if !ok {
+		return fmt.Errorf("got %T, want []any", o)
+	}
+	for _, a := range sl {
+		adj := new(MatrixAdjustment)
+		if err := adj.unmarshalAny(a); err != nil {
+			return err
+		}
+		*ma = append(*ma, adj)
+	}
+	return nil
+}
+
+// MatrixAdjustment models an adjustment - a combination of (possibly new)
+// matrix values, and skip/soft fail configuration.
+type MatrixAdjustment struct {
+	With MatrixAdjustmentWith `yaml:"with"`
+	Skip any                  `yaml:"skip,omitempty"`
+
+	// RemainingFields stores any other top-level mapping items so they at least
+	// survive an unmarshal-marshal round-trip.
+	RemainingFields map[string]any `yaml:",inline"`
+}
+
+// MarshalJSON marshals the adjustment to JSON. Special handling is needed
+// because yaml.v3 has "inline" but encoding/json has no concept of it.
+func (ma *MatrixAdjustment) MarshalJSON() ([]byte, error) {
+	return inlineFriendlyMarshalJSON(ma)
+}
+
+// ShouldSkip reports whether the adjustment skips the combination. Skip may
+// be a boolean or a string (a reason for skipping).
+func (ma *MatrixAdjustment) ShouldSkip() bool {
+	switch s := ma.Skip.(type) {
+	case bool:
+		return s
+	case string:
+		return s != "" && s != "false"
+	default:
+		return ma.Skip != nil
+	}
+}
+
+// unmarshalAny unmarshals an adjustment from an *ordered.MapSA.
+func (ma *MatrixAdjustment) unmarshalAny(o any) error {
+	m, ok := o.(*ordered.MapSA)
+	if !ok {
+		return fmt.Errorf("unmarshaling adjustment: got %T, want *ordered.Map[string, any]", o)
+	}
+	err := m.Range(func(k string, v any) error {
+		switch k {
+		case "with":
+			if err := ma.With.unmarshalAny(v); err != nil {
+				return fmt.Errorf("unmarshaling adjustment with: %w", err)
+			}
+
+		case "skip":
+			ma.Skip = v
+
+		default:
+			// Preserve any other key.
+			if ma.RemainingFields == nil {
+				ma.RemainingFields = make(map[string]any)
+			}
+			ma.RemainingFields[k] = v
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(ma.With) == 0 {
+		return errors.New("unmarshaling adjustment: adjustment has no with")
+	}
+	return nil
+}
+
+func (ma *MatrixAdjustment) interpolate(env interpolate.Env) error {
+	if err := interpolateMap(env, ma.With); err != nil {
+		return err
+	}
+	var err error
+	if ma.Skip, err = interpolateAny(env, ma.Skip); err != nil {
+		return err
+	}
+	return interpolateMap(env, ma.RemainingFields)
+}
+
+// MatrixAdjustmentWith is the combination of values that an adjustment
+// applies to. As with MatrixSetup, a single-dimension matrix uses the
+// dimension name "".
+type MatrixAdjustmentWith map[string]string
+
+// MarshalJSON returns either a single value (for single-dimension matrices),
+// or a mapping of dimension names to values.
+func (maw MatrixAdjustmentWith) MarshalJSON() ([]byte, error) {
+	o, _ := maw.MarshalYAML()
+	return json.Marshal(o)
+}
+
+// MarshalYAML returns either a single value (for single-dimension matrices),
+// or a mapping of dimension names to values.
+func (maw MatrixAdjustmentWith) MarshalYAML() (any, error) {
+	if val, ok := maw[""]; ok && len(maw) == 1 {
+		return val, nil
+	}
+	return map[string]string(maw), nil
+}
+
+// unmarshalAny unmarshals from either a scalar (single dimension) or an
+// *ordered.MapSA.
+func (maw *MatrixAdjustmentWith) unmarshalAny(o any) error {
+	if *maw == nil {
+		*maw = make(MatrixAdjustmentWith)
+	}
+
+	switch o := o.(type) {
+	case *ordered.MapSA:
+		return o.Range(func(dim string, v any) error {
+			val, err := matrixValue(v)
+			if err != nil {
+				return fmt.Errorf("dimension %q: %w", dim, err)
+			}
+			(*maw)[dim] = val
+			return nil
+		})
+
+	default:
+		val, err := matrixValue(o)
+		if err != nil {
+			return err
+		}
+		(*maw)[""] = val
+	}
+	return nil
+}
+
+// matches reports whether the adjustment applies to exactly the permutation.
+func (maw MatrixAdjustmentWith) matches(p MatrixPermutation) bool {
+	if len(maw) != len(p) {
+		return false
+	}
+	for dim, val := range maw {
+		if pv, ok := p[dim]; !ok || pv != val {
+			return false
+		}
+	}
+	return true
+}
+
+// MatrixPermutation is a single combination of matrix values, as assigned to
+// a job. A single-dimension matrix uses the dimension name "".
+type MatrixPermutation map[string]string
+
+// String returns a stable representation of the permutation, for messages.
+func (mp MatrixPermutation) String() string {
+	dims := make([]string, 0, len(mp))
+	for dim := range mp {
+		dims = append(dims, dim)
+	}
+	sort.Strings(dims)
+	parts := make([]string, 0, len(dims))
+	for _, dim := range dims {
+		if dim == "" {
+			parts = append(parts, fmt.Sprintf("%q", mp[dim]))
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s=%q", dim, mp[dim]))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// matrixTokenRE matches matrix interpolation tokens: {{matrix}} for
+// single-dimension matrices, or {{matrix.dimension}}.
+var matrixTokenRE = regexp.MustCompile(`\{\{\s*matrix(?:\.([^\s{}]+))?\s*\}\}`)
+
+// interpolateMatrix replaces the matrix tokens in s with values from the
+// permutation. Tokens for dimensions not in the permutation are left as-is.
+func interpolateMatrix(p MatrixPermutation, s string) string {
+	return matrixTokenRE.ReplaceAllStringFunc(s, func(token string) string {
+		dim := matrixTokenRE.FindStringSubmatch(token)[1]
+		if val, ok := p[dim]; ok {
+			return val
+		}
+		return token
+	})
+}
+
+// interpolateMatrixAny substitutes matrix values into every string within o
+// (such as plugin configuration), returning the result. Maps and slices are
+// copied rather than updated in place.
+func interpolateMatrixAny(p MatrixPermutation, o any) any {
+	switch o := o.(type) {
+	case string:
+		return interpolateMatrix(p, o)
+
+	case []any:
+		out := make([]any, len(o))
+		for i, v := range o {
+			out[i] = interpolateMatrixAny(p, v)
+		}
+		return out
+
+	case *ordered.MapSA:
+		out := ordered.NewMap[string, any](o.Len())
+		o.Range(func(k string, v any) error {
+			out.Set(k, interpolateMatrixAny(p, v))
+			return nil
+		})
+		return out
+
+	case map[string]any:
+		out := make(map[string]any, len(o))
+		for k, v := range o {
+			out[k] = interpolateMatrixAny(p, v)
+		}
+		return out
+	}
+	return o
+}
+
+// matrixValues converts a slice of scalars into strings.
+func matrixValues(sl []any) ([]string, error) {
+	vals := make([]string, 0, len(sl))
+	for _, v := range sl {
+		val, err := matrixValue(v)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, val)
+	}
+	return vals, nil
+}
+
+// matrixValue converts a scalar matrix value into a string.
+func matrixValue(v any) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("matrix value has type %T, want a scalar", v)
+	}
+}
@@ -0,0 +1,228 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+const matrixPipeline = `---
+steps:
+  - command: "GOOS={{matrix.os}} GOARCH={{ matrix.arch }} go build"
+    matrix:
+      setup:
+        os: [linux, windows]
+        arch: [amd64, arm64]
+      adjustments:
+        - with: { os: windows, arch: arm64 }
+          skip: "not supported yet"
+        - with: { os: plan9, arch: amd64 }
+          soft_fail: true
+`
+
+func parseMatrixStep(t *testing.T, src string) *CommandStep {
+	t.Helper()
+
+	p, err := Parse(strings.NewReader(src))
+	if err != nil {
+		t.Fatalf("Parse(matrix pipeline) error = %v", err)
+	}
+	cs, ok := p.Steps[0].(*CommandStep)
+	if !ok {
+		t.Fatalf("p.Steps[0] = %T, want *CommandStep", p.Steps[0])
+	}
+	if cs.Matrix == nil {
+		t.Fatalf("cs.Matrix = nil, want a matrix")
+	}
+	return cs
+}
+
+func TestMatrixParse(t *testing.T) {
+	t.Parallel()
+
+	cs := parseMatrixStep(t, matrixPipeline)
+
+	want := &Matrix{
+		Setup: MatrixSetup{
+			"os":   {"linux", "windows"},
+			"arch": {"amd64", "arm64"},
+		},
+		Adjustments: MatrixAdjustments{
+			{
+				With: MatrixAdjustmentWith{"os": "windows", "arch": "arm64"},
+				Skip: "not supported yet",
+			},
+			{
+				With:            MatrixAdjustmentWith{"os": "plan9", "arch": "amd64"},
+				RemainingFields: map[string]any{"soft_fail": true},
+			},
+		},
+	}
+	if diff := cmp.Diff(cs.Matrix, want); diff != "" {
+		t.Errorf("parsed matrix diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestMatrixSingleDimension(t *testing.T) {
+	t.Parallel()
+
+	cs := parseMatrixStep(t, `steps: [{command: "echo {{matrix}}", matrix: [llama, 42]}]`)
+
+	if diff := cmp.Diff(cs.Matrix.Setup, MatrixSetup{"": {"llama", "42"}}); diff != "" {
+		t.Errorf("parsed matrix setup diff (-got +want):\n%s", diff)
+	}
+
+	got, err := json.Marshal(cs.Matrix)
+	if err != nil {
+		t.Fatalf("json.Marshal(cs.Matrix) error = %v", err)
+	}
+	if want := `{"setup":["llama","42"]}`; string(got) != want {
+		t.Errorf("json.Marshal(cs.Matrix) = %s, want %s", got, want)
+	}
+
+	if err := cs.InterpolateMatrixPermutation(MatrixPermutation{"": "42"}); err != nil {
+		t.Fatalf("cs.InterpolateMatrixPermutation({42}) error = %v", err)
+	}
+	if got, want := cs.Command, "echo 42"; got != want {
+		t.Errorf("cs.Command = %q, want %q", got, want)
+	}
+}
+
+func TestInterpolateMatrixPermutation(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name        string
+		perm        MatrixPermutation
+		wantCommand string
+		wantErr     string
+	}{
+		{
+			name:        "from setup",
+			perm:        MatrixPermutation{"os": "linux", "arch": "arm64"},
+			wantCommand: "GOOS=linux GOARCH=arm64 go build",
+		},
+		{
+			name:        "added by adjustment",
+			perm:        MatrixPermutation{"os": "plan9", "arch": "amd64"},
+			wantCommand: "GOOS=plan9 GOARCH=amd64 go build",
+		},
+		{
+			name:    "skipped by adjustment",
+			perm:    MatrixPermutation{"os": "windows", "arch": "arm64"},
+			wantErr: "is skipped by an adjustment",
+		},
+		{
+			name:    "value not in matrix",
+			perm:    MatrixPermutation{"os": "darwin", "arch": "amd64"},
+			wantErr: `value "darwin" for dimension "os", which is not in the matrix`,
+		},
+		{
+			name:    "unknown dimension",
+			perm:    MatrixPermutation{"os": "linux", "cpu": "amd64"},
+			wantErr: `dimension "cpu", which is not in the matrix`,
+		},
+		{
+			name:    "missing dimension",
+			perm:    MatrixPermutation{"os": "linux"},
+			wantErr: "has 1 dimensions, but the matrix has 2",
+		},
+		{
+			name:    "no permutation",
+			wantErr: "the job has no matrix permutation",
+		},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			t.Parallel()
+
+			cs := parseMatrixStep(t, matrixPipeline)
+			err := cs.InterpolateMatrixPermutation(test.perm)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("cs.InterpolateMatrixPermutation(%v) error = %v, want error containing %q", test.perm, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("cs.InterpolateMatrixPermutation(%v) error = %v", test.perm, err)
+			}
+			if got, want := cs.Command, test.wantCommand; got != want {
+				t.Errorf("cs.Command = %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestSignVerifyMatrix(t *testing.T) {
+	t.Parallel()
+
+	cs := parseMatrixStep(t, matrixPipeline)
+
+	signer, err := NewSigner("hmac-sha256", "alpacas")
+	if err != nil {
+		t.Fatalf("NewSigner(hmac-sha256, alpacas) error = %v", err)
+	}
+	sig, err := Sign(cs, signer)
+	if err != nil {
+		t.Fatalf("Sign(CommandStep, signer) error = %v", err)
+	}
+	if diff := cmp.Diff(sig.SignedFields, []string{"command", "matrix", "plugins"}); diff != "" {
+		t.Errorf("sig.SignedFields diff (-got +want):\n%s", diff)
+	}
+	cs.Signature = sig
+
+	// Round-trip the step through JSON, as happens when the job is sent to an
+	// agent.
+	b, err := json.Marshal(cs)
+	if err != nil {
+		t.Fatalf("json.Marshal(cs) error = %v", err)
+	}
+	received := new(CommandStep)
+	if err := json.Unmarshal(b, received); err != nil {
+		t.Fatalf("json.Unmarshal(%s) error = %v", b, err)
+	}
+
+	verifier, err := NewVerifier("hmac-sha256", "alpacas")
+	if err != nil {
+		t.Fatalf("NewVerifier(hmac-sha256, alpacas) error = %v", err)
+	}
+	if err := received.Signature.Verify(received, verifier); err != nil {
+		t.Errorf("received.Signature.Verify(received, verifier) = %v", err)
+	}
+
+	// Changing the matrix invalidates the signature.
+	received.Matrix.Adjustments = received.Matrix.Adjustments[1:]
+	if err := received.Signature.Verify(received, verifier); err == nil {
+		t.Errorf("received.Signature.Verify(received with altered matrix, verifier) = %v, want non-nil error", err)
+	}
+}
+
+func TestVerifyMatrixRequiresMatrixField(t *testing.T) {
+	t.Parallel()
+
+	cs := parseMatrixStep(t, matrixPipeline)
+
+	// A signature over only the command must not be usable to verify a
+	// matrix step.
+	signer, err := NewSigner("hmac-sha256", "alpacas")
+	if err != nil {
+		t.Fatalf("NewSigner(hmac-sha256, alpacas) error = %v", err)
+	}
+	sig, err := Sign(testFields{"command": cs.Command}, signer)
+	if err != nil {
+		t.Fatalf("Sign(testFields, signer) error = %v", err)
+	}
+
+	verifier, err := NewVerifier("hmac-sha256", "alpacas")
+	if err != nil {
+		t.Fatalf("NewVerifier(hmac-sha256, alpacas) error = %v", err)
+	}
+	if err := sig.Verify(cs, verifier); err == nil {
+		t.Errorf("sig.Verify(matrix CommandStep, verifier) = %v, want non-nil error", err)
+	}
+}
@@ -3,12 +3,16 @@ package jobapi
 import (
 	"context"
 	"errors"
+	"net/url"
 	"os"
 
 	"github.com/buildkite/agent/v3/internal/socket"
 )
 
-const envURL = "http://job/api/current-job/v0/env"
+const (
+	baseURL = "http://job/api/current-job/v0"
+	envURL  = baseURL + "/env"
+)
 
 // Client connects to the Job API.
 type Client struct {
@@ -79,3 +83,62 @@ func (c *Client) EnvDelete(ctx context.Context, del []string) (deleted []string,
 	resp.Normalize()
 	return resp.Deleted, nil
 }
+
+// MetaDataGet gets the value of a meta-data key from the build.
+func (c *Client) MetaDataGet(ctx context.Context, key string) (string, error) {
+	var resp MetaDataGetResponse
+	if err := c.client.Do(ctx, "GET", baseURL+"/meta-data/"+url.PathEscape(key), nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Value, nil
+}
+
+// MetaDataSet sets a meta-data key on the build.
+func (c *Client) MetaDataSet(ctx context.Context, key, value string) error {
+	req := MetaDataSetRequest{Value: value}
+	return c.client.Do(ctx, "PUT", baseURL+"/meta-data/"+url.PathEscape(key), &req, nil)
+}
+
+// Annotate creates or updates the annotation on the build with the given
+// context.
+func (c *Client) Annotate(ctx context.Context, context string, req *AnnotationRequest) error {
+	return c.client.Do(ctx, "PUT", baseURL+"/annotations/"+url.PathEscape(context), req, nil)
+}
+
+// AnnotationRemove removes the annotation on the build with the given
+// context.
+func (c *Client) AnnotationRemove(ctx context.Context, context string) error {
+	return c.client.Do(ctx, "DELETE", baseURL+"/annotations/"+url.PathEscape(context), nil, nil)
+}
+
+// StepGet gets the value of an attribute of the current step.
+func (c *Client) StepGet(ctx context.Context, attribute string) (string, error) {
+	var resp StepGetResponse
+	if err := c.client.Do(ctx, "GET", baseURL+"/step/"+url.PathEscape(attribute), nil, &resp); err != nil {
+		return "", err
+	}
+	return resp.Value, nil
+}
+
+// StepUpdate updates an attribute of the current step.
+func (c *Client) StepUpdate(ctx context.Context, attribute string, req *StepUpdateRequest) error {
+	return c.client.Do(ctx, "PUT", baseURL+"/step/"+url.PathEscape(attribute), req, nil)
+}
+
+// RedactionCreate adds values to redact from the job log, returning the number
+// of values added.
+func (c *Client) RedactionCreate(ctx context.Context, values []string) (int, error) {
+	req := RedactionCreateRequest{Redact: values}
+	var resp RedactionCreateResponse
+	if err := c.client.Do(ctx, "POST", baseURL+"/redactions", &req, &resp); err != nil {
+		return 0, err
+	}
+	return resp.Redacted, nil
+}
+
+// Log writes a message to the job log, formatted according to its kind (in
+// the same way as the agent's own headers, comments, warnings, and errors).
+func (c *Client) Log(ctx context.Context, kind LogKind, message string) error {
+	req := LogRequest{Kind: kind, Message: message}
+	return c.client.Do(ctx, "POST", baseURL+"/log", &req, nil)
+}
@@ -0,0 +1,259 @@
+package jobapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/internal/redact"
+	"github.com/buildkite/agent/v3/internal/replacer"
+)
+
+// EventType is the type of an Event.
+type EventType string
+
+const (
+	EventPhaseStart  EventType = "phase_start"
+	EventPhaseFinish EventType = "phase_finish"
+	EventHookStart   EventType = "hook_start"
+	EventHookFinish  EventType = "hook_finish"
+	EventEnvChange   EventType = "env_change"
+)
+
+// eventBufferSize is how many events can be waiting to be sent to a
+// subscriber before it is considered too slow and disconnected.
+const eventBufferSize = 256
+
+// Event is an event in the lifecycle of the job, sent to subscribers of the
+// GET /events endpoint.
+type Event struct {
+	// ID increases by one with each event published by the server.
+	ID   uint64    `json:"id"`
+	Type EventType `json:"type"`
+	Time time.Time `json:"time"`
+
+	// Phase is the phase that started or finished (for phase events), or
+	// that the hook is part of (for hook events).
+	Phase string `json:"phase,omitempty"`
+
+	// Hook is the name of the hook, e.g. "global pre-command" (for hook
+	// events).
+	Hook string `json:"hook,omitempty"`
+
+	// ExitStatus is the exit status of the hook (for hook finish events).
+	ExitStatus *int `json:"exit_status,omitempty"`
+
+	// Error is the error the phase or hook failed with, if any (for finish
+	// events).
+	Error string `json:"error,omitempty"`
+
+	// Env is the change to the job environment (for env change events).
+	Env *EnvChange `json:"env,omitempty"`
+}
+
+// EnvChange is a change to the job environment. The values of variables
+// matching the redacted vars patterns, and values redacted from the job log,
+// are replaced with "[REDACTED]".
+type EnvChange struct {
+	Added   map[string]string         `json:"added,omitempty"`
+	Changed map[string]EnvValueChange `json:"changed,omitempty"`
+	Removed []string                  `json:"removed,omitempty"`
+}
+
+// EnvValueChange is the old and new value of a changed variable.
+type EnvValueChange struct {
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// PublishEvent sends an event to all subscribers of the GET /events endpoint.
+// The ID and Time are filled in.
+func (s *Server) PublishEvent(ev Event) {
+	s.events.publish(ev)
+}
+
+// PublishEnvChange sends an env change event for diff to all subscribers of
+// the GET /events endpoint, redacting the values of variables matching the
+// redacted vars patterns, and any values redacted from the job log.
+func (s *Server) PublishEnvChange(diff env.Diff) {
+	if diff.Empty() {
+		return
+	}
+
+	var needles []string
+	if s.valuesToRedact != nil {
+		needles = s.valuesToRedact()
+	}
+
+	// Variables are redacted by name under the same rules as the job log,
+	// so (for example) values that are too short to be secrets are left
+	// alone. Old and new values are checked separately, since either could
+	// be too short.
+	newValues := make(map[string]string, len(diff.Added)+len(diff.Changed))
+	oldValues := make(map[string]string, len(diff.Changed))
+	for k, v := range diff.Added {
+		newValues[k] = v
+	}
+	for k, p := range diff.Changed {
+		newValues[k] = p.New
+		oldValues[k] = p.Old
+	}
+	redactNew := redact.Vars(s.Logger, s.redactedVars, newValues)
+	var redactOld map[string]string
+	if len(oldValues) > 0 {
+		redactOld = redact.Vars(s.Logger, s.redactedVars, oldValues)
+	}
+
+	redactValue := func(byName map[string]string, name, value string) string {
+		if _, ok := byName[name]; ok {
+			return "[REDACTED]"
+		}
+		if len(needles) == 0 {
+			return value
+		}
+		// Secrets can turn up in any variable, or as part of a value, so
+		// redact them the same way as the job log.
+		var b strings.Builder
+		r := replacer.New(&b, needles, redact.Redact)
+		r.Write([]byte(value))
+		r.Flush()
+		return b.String()
+	}
+
+	change := &EnvChange{}
+	for k, v := range diff.Added {
+		if change.Added == nil {
+			change.Added = make(map[string]string)
+		}
+		change.Added[k] = redactValue(redactNew, k, v)
+	}
+	for k, p := range diff.Changed {
+		if change.Changed == nil {
+			change.Changed = make(map[string]EnvValueChange)
+		}
+		change.Changed[k] = EnvValueChange{Old: redactValue(redactOld, k, p.Old), New: redactValue(redactNew, k, p.New)}
+	}
+	for k := range diff.Removed {
+		change.Removed = append(change.Removed, k)
+	}
+	sort.Strings(change.Removed)
+
+	s.PublishEvent(Event{Type: EventEnvChange, Env: change})
+}
+
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.writeError(w, "streaming isn't supported by this connection", http.StatusInternalServerError)
+		return
+	}
+
+	events, unsubscribe := s.events.subscribe()
+	defer unsubscribe()
+
+	h := w.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case ev, ok := <-events:
+			if !ok {
+				// The server is stopping, or we fell too far behind.
+				return
+			}
+			data, err := json.Marshal(ev)
+			if err != nil {
+				s.Logger.Errorf("Job API: couldn't encode event: %v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", ev.ID, ev.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// eventBroker fans events out to subscribers.
+type eventBroker struct {
+	mu     sync.Mutex
+	nextID uint64
+	subs   map[chan Event]struct{}
+	closed bool
+}
+
+// subscribe returns a channel of published events, and a func to
+// unsubscribe. The channel is closed if the broker is closed, or if the
+// subscriber doesn't keep up.
+func (b *eventBroker) subscribe() (<-chan Event, func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan Event, eventBufferSize)
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if b.subs == nil {
+		b.subs = make(map[chan Event]struct{})
+	}
+	b.subs[ch] = struct{}{}
+
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+func (b *eventBroker) publish(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	b.nextID++
+	ev.ID = b.nextID
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+			// Disconnecting a slow subscriber is better than blocking the
+			// job, or silently missing events.
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// close closes all subscriptions, and prevents new ones.
+func (b *eventBroker) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for ch := range b.subs {
+		close(ch)
+	}
+	b.subs = nil
+}
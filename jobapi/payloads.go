@@ -48,3 +48,90 @@ type EnvDeleteResponse struct {
 func (e EnvDeleteResponse) Normalize() {
 	sort.Strings(e.Deleted)
 }
+
+// MetaDataGetResponse is the response body for the GET /meta-data/{key} endpoint
+type MetaDataGetResponse struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// MetaDataSetRequest is the request body for the PUT /meta-data/{key} endpoint
+type MetaDataSetRequest struct {
+	Value string `json:"value"`
+}
+
+// MetaDataSetResponse is the response body for the PUT /meta-data/{key} endpoint
+type MetaDataSetResponse struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// AnnotationRequest is the request body for the PUT /annotations/{context} endpoint
+type AnnotationRequest struct {
+	Body   string `json:"body"`
+	Style  string `json:"style,omitempty"`
+	Append bool   `json:"append,omitempty"`
+}
+
+// AnnotationResponse is the response body for the PUT and DELETE
+// /annotations/{context} endpoints
+type AnnotationResponse struct {
+	Context string `json:"context"`
+}
+
+// StepGetResponse is the response body for the GET /step/{attribute} endpoint
+type StepGetResponse struct {
+	Attribute string `json:"attribute"`
+	Value     string `json:"value"`
+}
+
+// StepUpdateRequest is the request body for the PUT /step/{attribute} endpoint
+type StepUpdateRequest struct {
+	Value  string `json:"value"`
+	Append bool   `json:"append,omitempty"`
+}
+
+// StepUpdateResponse is the response body for the PUT /step/{attribute} endpoint
+type StepUpdateResponse struct {
+	Attribute string `json:"attribute"`
+}
+
+// RedactionCreateRequest is the request body for the POST /redactions endpoint
+type RedactionCreateRequest struct {
+	Redact []string `json:"redact"`
+}
+
+// RedactionCreateResponse is the response body for the POST /redactions endpoint
+type RedactionCreateResponse struct {
+	Redacted int `json:"redacted"`
+}
+
+// LogKind is the kind of a message written to the job log by the POST /log
+// endpoint, which determines how it is formatted.
+type LogKind string
+
+const (
+	// LogKindHeader starts a section, like the agent's own "Running ... hook"
+	// headers.
+	LogKindHeader LogKind = "header"
+
+	// LogKindCollapsedHeader starts a section that is collapsed by default.
+	LogKindCollapsedHeader LogKind = "collapsed-header"
+
+	LogKindComment LogKind = "comment"
+
+	// LogKindWarning and LogKindError also expand the current section.
+	LogKindWarning LogKind = "warning"
+	LogKindError   LogKind = "error"
+)
+
+// LogRequest is the request body for the POST /log endpoint
+type LogRequest struct {
+	Kind    LogKind `json:"kind"`
+	Message string  `json:"message"`
+}
+
+// LogResponse is the response body for the POST /log endpoint
+type LogResponse struct {
+	Kind LogKind `json:"kind"`
+}
@@ -4,8 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/buildkite/agent/v3/agent"
+	"github.com/buildkite/agent/v3/api"
+	"github.com/buildkite/agent/v3/env"
+	"github.com/buildkite/agent/v3/internal/redact"
 	"github.com/buildkite/agent/v3/internal/socket"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
@@ -21,12 +26,28 @@ func (s *Server) router() chi.Router {
 		// All responses are in JSON.
 		socket.HeadersMiddleware(http.Header{"Content-Type": []string{"application/json"}}),
 		socket.AuthMiddleware(s.token, s.Logger.Errorf),
+		routeEscapedPath,
 	)
 
 	r.Route("/api/current-job/v0", func(r chi.Router) {
 		r.Get("/env", s.getEnv)
 		r.Patch("/env", s.patchEnv)
 		r.Delete("/env", s.deleteEnv)
+
+		r.Get("/events", s.streamEvents)
+
+		r.Post("/redactions", s.createRedactions)
+
+		r.Post("/log", s.writeLog)
+
+		r.Get("/meta-data/{key}", s.getMetaData)
+		r.Put("/meta-data/{key}", s.setMetaData)
+
+		r.Put("/annotations/{context}", s.putAnnotation)
+		r.Delete("/annotations/{context}", s.deleteAnnotation)
+
+		r.Get("/step/{attribute}", s.getStepAttribute)
+		r.Put("/step/{attribute}", s.updateStepAttribute)
 	})
 
 	return r
@@ -91,17 +112,27 @@ func (s *Server) patchEnv(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	diff := env.Diff{
+		Added:   make(map[string]string),
+		Changed: make(map[string]env.DiffPair),
+	}
 	s.mtx.Lock()
 	for k, v := range req.Env {
-		if _, ok := s.environ.Get(k); ok {
+		if old, ok := s.environ.Get(k); ok {
 			updated = append(updated, k)
+			if old != *v {
+				diff.Changed[k] = env.DiffPair{Old: old, New: *v}
+			}
 		} else {
 			added = append(added, k)
+			diff.Added[k] = *v
 		}
 		s.environ.Set(k, *v)
 	}
 	s.mtx.Unlock()
 
+	s.PublishEnvChange(diff)
+
 	resp := EnvUpdateResponse{
 		Added:   added,
 		Updated: updated,
@@ -140,16 +171,20 @@ func (s *Server) deleteEnv(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	diff := env.Diff{Removed: make(map[string]struct{})}
 	s.mtx.Lock()
 	deleted := make([]string, 0, len(req.Keys))
 	for _, k := range req.Keys {
 		if _, ok := s.environ.Get(k); ok {
 			deleted = append(deleted, k)
 			s.environ.Remove(k)
+			diff.Removed[k] = struct{}{}
 		}
 	}
 	s.mtx.Unlock()
 
+	s.PublishEnvChange(diff)
+
 	resp := EnvDeleteResponse{Deleted: deleted}
 	resp.Normalize()
 
@@ -159,6 +194,269 @@ func (s *Server) deleteEnv(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func (s *Server) getMetaData(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAPIClient(w) {
+		return
+	}
+
+	key := urlParam(r, "key")
+	md, resp, err := s.apiClient.GetMetaData(r.Context(), "job", s.envValue("BUILDKITE_JOB_ID"), key)
+	if err != nil {
+		s.writeAPIError(w, "getting meta-data", resp, err)
+		return
+	}
+
+	s.writeResponse(w, MetaDataGetResponse{Key: key, Value: md.Value})
+}
+
+func (s *Server) setMetaData(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAPIClient(w) {
+		return
+	}
+
+	var req MetaDataSetRequest
+	if !s.decodeRequest(w, r, &req) {
+		return
+	}
+
+	if strings.TrimSpace(req.Value) == "" {
+		s.writeError(w, "meta-data values can't be empty", http.StatusUnprocessableEntity)
+		return
+	}
+
+	key := urlParam(r, "key")
+	md := &api.MetaData{Key: key, Value: req.Value}
+	if resp, err := s.apiClient.SetMetaData(r.Context(), s.envValue("BUILDKITE_JOB_ID"), md); err != nil {
+		s.writeAPIError(w, "setting meta-data", resp, err)
+		return
+	}
+
+	s.writeResponse(w, MetaDataSetResponse{Key: key, Value: req.Value})
+}
+
+func (s *Server) putAnnotation(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAPIClient(w) {
+		return
+	}
+
+	var req AnnotationRequest
+	if !s.decodeRequest(w, r, &req) {
+		return
+	}
+
+	context := urlParam(r, "context")
+	annotation := &api.Annotation{
+		Body:    req.Body,
+		Context: context,
+		Style:   req.Style,
+		Append:  req.Append,
+	}
+	if resp, err := s.apiClient.Annotate(r.Context(), s.envValue("BUILDKITE_JOB_ID"), annotation); err != nil {
+		s.writeAPIError(w, "creating annotation", resp, err)
+		return
+	}
+
+	s.writeResponse(w, AnnotationResponse{Context: context})
+}
+
+func (s *Server) deleteAnnotation(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAPIClient(w) {
+		return
+	}
+
+	context := urlParam(r, "context")
+	if resp, err := s.apiClient.AnnotationRemove(r.Context(), s.envValue("BUILDKITE_JOB_ID"), context); err != nil {
+		s.writeAPIError(w, "removing annotation", resp, err)
+		return
+	}
+
+	s.writeResponse(w, AnnotationResponse{Context: context})
+}
+
+func (s *Server) getStepAttribute(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAPIClient(w) {
+		return
+	}
+
+	attribute := urlParam(r, "attribute")
+	req := &api.StepExportRequest{
+		Attribute: attribute,
+		Build:     s.envValue("BUILDKITE_BUILD_ID"),
+	}
+	out, resp, err := s.apiClient.StepExport(r.Context(), s.envValue("BUILDKITE_STEP_ID"), req)
+	if err != nil {
+		s.writeAPIError(w, "getting step attribute", resp, err)
+		return
+	}
+
+	s.writeResponse(w, StepGetResponse{Attribute: attribute, Value: out.Output})
+}
+
+func (s *Server) updateStepAttribute(w http.ResponseWriter, r *http.Request) {
+	if !s.requireAPIClient(w) {
+		return
+	}
+
+	var req StepUpdateRequest
+	if !s.decodeRequest(w, r, &req) {
+		return
+	}
+
+	attribute := urlParam(r, "attribute")
+	update := &api.StepUpdate{
+		IdempotencyUUID: api.NewUUID(),
+		Build:           s.envValue("BUILDKITE_BUILD_ID"),
+		Attribute:       attribute,
+		Value:           req.Value,
+		Append:          req.Append,
+	}
+	if resp, err := s.apiClient.StepUpdate(r.Context(), s.envValue("BUILDKITE_STEP_ID"), update); err != nil {
+		s.writeAPIError(w, "updating step", resp, err)
+		return
+	}
+
+	s.writeResponse(w, StepUpdateResponse{Attribute: attribute})
+}
+
+func (s *Server) createRedactions(w http.ResponseWriter, r *http.Request) {
+	if s.addRedactions == nil {
+		s.writeError(w, "adding redactions isn't available for this job", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req RedactionCreateRequest
+	if !s.decodeRequest(w, r, &req) {
+		return
+	}
+
+	values := make([]string, 0, len(req.Redact))
+	short := 0
+	for _, v := range req.Redact {
+		if v == "" {
+			continue
+		}
+		if len(v) < redact.LengthMin {
+			short++
+			continue
+		}
+		values = append(values, v)
+	}
+
+	// Redacting short values would mangle too much of the log.
+	if short > 0 {
+		s.writeError(w, fmt.Sprintf("%d of the values are shorter than the minimum length to redact (%d bytes)", short, redact.LengthMin), http.StatusUnprocessableEntity)
+		return
+	}
+
+	s.addRedactions(values)
+
+	s.writeResponse(w, RedactionCreateResponse{Redacted: len(values)})
+}
+
+func (s *Server) writeLog(w http.ResponseWriter, r *http.Request) {
+	var req LogRequest
+	if !s.decodeRequest(w, r, &req) {
+		return
+	}
+
+	var logf func(format string, v ...any)
+	switch req.Kind {
+	case LogKindHeader:
+		logf = s.Logger.Headerf
+	case LogKindCollapsedHeader:
+		logf = func(format string, v ...any) {
+			s.Logger.Printf("--- "+format, v...)
+		}
+	case LogKindComment:
+		logf = s.Logger.Commentf
+	case LogKindWarning:
+		logf = s.Logger.Warningf
+	case LogKindError:
+		logf = s.Logger.Errorf
+	default:
+		s.writeError(w, fmt.Sprintf("unknown log message kind %q", req.Kind), http.StatusUnprocessableEntity)
+		return
+	}
+
+	logf("%s", req.Message)
+
+	s.writeResponse(w, LogResponse{Kind: req.Kind})
+}
+
+// requireAPIClient writes an error and returns false if the server has no API
+// client.
+func (s *Server) requireAPIClient(w http.ResponseWriter) bool {
+	if s.apiClient != nil {
+		return true
+	}
+	s.writeError(w, "the Buildkite API isn't available to this job", http.StatusServiceUnavailable)
+	return false
+}
+
+// envValue returns the value of a variable in the job environment.
+func (s *Server) envValue(name string) string {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	v, _ := s.environ.Get(name)
+	return v
+}
+
+// decodeRequest decodes the request body into req. If that fails, it writes
+// an error and returns false.
+func (s *Server) decodeRequest(w http.ResponseWriter, r *http.Request, req any) bool {
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		s.writeError(w, fmt.Errorf("failed to decode request body: %w", err), http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (s *Server) writeResponse(w http.ResponseWriter, resp any) {
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(resp); err != nil {
+		s.Logger.Errorf("Job API: couldn't encode or write response: %v", err)
+	}
+}
+
+func (s *Server) writeError(w http.ResponseWriter, err any, code int) {
+	if err := socket.WriteError(w, err, code); err != nil {
+		s.Logger.Errorf("Job API: couldn't write error: %v", err)
+	}
+}
+
+// writeAPIError writes an error from the Buildkite API. Client errors (4xx)
+// are passed through, anything else is reported as 502 Bad Gateway.
+func (s *Server) writeAPIError(w http.ResponseWriter, action string, resp *api.Response, err error) {
+	code := http.StatusBadGateway
+	if resp != nil && resp.StatusCode >= 400 && resp.StatusCode < 500 {
+		code = resp.StatusCode
+	}
+	s.writeError(w, fmt.Errorf("%s: %w", action, err), code)
+}
+
+// routeEscapedPath makes chi route requests using the escaped path. Otherwise
+// chi routes using the unescaped path, unless the path contains escapes (such
+// as %2F) that can't be recovered from it, so URL parameters could be escaped
+// or not. Routing on the escaped path means they always need unescaping once.
+func routeEscapedPath(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if rctx := chi.RouteContext(r.Context()); rctx != nil {
+			rctx.RoutePath = r.URL.EscapedPath()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// urlParam returns the (unescaped) value of a URL parameter.
+func urlParam(r *http.Request, name string) string {
+	v := chi.URLParam(r, name)
+	if u, err := url.PathUnescape(v); err == nil {
+		return u
+	}
+	return v
+}
+
 func checkProtected(candidates []string) []string {
 	protected := make([]string, 0, len(candidates))
 	for _, c := range candidates {
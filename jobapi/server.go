@@ -7,6 +7,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/env"
 	"github.com/buildkite/agent/v3/internal/job/shell"
 	"github.com/buildkite/agent/v3/internal/socket"
@@ -24,12 +25,77 @@ type Server struct {
 
 	token   string
 	sockSvr *socket.Server
+
+	// apiClient is used by endpoints that proxy to the Buildkite Agent API.
+	apiClient APIClient
+
+	// redactedVars are patterns matching the names of variables whose values
+	// are redacted from events.
+	redactedVars []string
+
+	// addRedactions adds values to redact from the job log.
+	addRedactions func(values []string)
+
+	// valuesToRedact returns the values currently redacted from the job log,
+	// which are also redacted from events.
+	valuesToRedact func() []string
+
+	events eventBroker
+}
+
+// APIClient is the subset of *api.Client used by the Job API server to
+// manipulate meta-data, annotations, and steps on behalf of the job.
+type APIClient interface {
+	SetMetaData(ctx context.Context, jobID string, metaData *api.MetaData) (*api.Response, error)
+	GetMetaData(ctx context.Context, scope, id, key string) (*api.MetaData, *api.Response, error)
+	Annotate(ctx context.Context, jobID string, annotation *api.Annotation) (*api.Response, error)
+	AnnotationRemove(ctx context.Context, jobID, context string) (*api.Response, error)
+	StepExport(ctx context.Context, stepIDOrKey string, req *api.StepExportRequest) (*api.StepExportResponse, *api.Response, error)
+	StepUpdate(ctx context.Context, stepIDOrKey string, update *api.StepUpdate) (*api.Response, error)
+}
+
+// ServerOpt configures optional behaviour of a Server.
+type ServerOpt func(*Server)
+
+// WithRedactor sets the func used by the POST /redactions endpoint to add
+// values to redact from the job log. Without it, that endpoint responds with
+// 503 Service Unavailable.
+func WithRedactor(add func(values []string)) ServerOpt {
+	return func(s *Server) {
+		s.addRedactions = add
+	}
+}
+
+// WithRedactedVars sets the patterns matching the names of variables whose
+// values are redacted from env change events.
+func WithRedactedVars(patterns []string) ServerOpt {
+	return func(s *Server) {
+		s.redactedVars = patterns
+	}
+}
+
+// WithValuesToRedact sets the func returning the values currently redacted from
+// the job log (including those added through the POST /redactions endpoint),
+// so they can be redacted from env change events too.
+func WithValuesToRedact(values func() []string) ServerOpt {
+	return func(s *Server) {
+		s.valuesToRedact = values
+	}
+}
+
+// WithAPIClient sets the client used for the meta-data, annotation, and step
+// endpoints. It should be authenticated with the job's access token. Without
+// it, those endpoints respond with 503 Service Unavailable.
+func WithAPIClient(client APIClient) ServerOpt {
+	return func(s *Server) {
+		s.apiClient = client
+	}
 }
 
 // NewServer creates a new Job API server
 // socketPath is the path to the socket on which the server will listen
 // environ is the environment which the server will mutate and inspect as part of its operation
-func NewServer(logger shell.Logger, socketPath string, environ *env.Environment) (server *Server, token string, err error) {
+func NewServer(logger shell.Logger, socketPath string, environ *env.Environment, opts ...ServerOpt) (server *Server, token string, err error) {
 	token, err = socket.GenerateToken(32)
 	if err != nil {
 		return nil, "", fmt.Errorf("generating token: %w", err)
@@ -41,6 +107,9 @@ func NewServer(logger shell.Logger, socketPath string, environ *env.Environment)
 		environ:    environ,
 		token:      token,
 	}
+	for _, o := range opts {
+		o(s)
+	}
 
 	svr, err := socket.NewServer(socketPath, s.router())
 	if err != nil {
@@ -69,6 +138,9 @@ func (s *Server) Stop() error {
 	shutdownCtx, serverStopCtx := context.WithTimeout(context.Background(), 10*time.Second)
 	defer serverStopCtx()
 
+	// End any event streams, which would otherwise hold up the shutdown
+	s.events.close()
+
 	// Trigger graceful shutdown
 	err := s.sockSvr.Shutdown(shutdownCtx)
 	if err != nil {
@@ -1,6 +1,7 @@
 package jobapi_test
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
@@ -11,11 +12,15 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/buildkite/agent/v3/api"
 	"github.com/buildkite/agent/v3/env"
 	"github.com/buildkite/agent/v3/internal/job/shell"
+	"github.com/buildkite/agent/v3/internal/socket"
 	"github.com/buildkite/agent/v3/jobapi"
 	"github.com/google/go-cmp/cmp"
 )
@@ -41,6 +46,87 @@ func testServer(t *testing.T, e *env.Environment) (*jobapi.Server, string, error
 	return jobapi.NewServer(shell.TestingLogger{T: t}, sockName, e)
 }
 
+// fakeAPIClient is an in-memory jobapi.APIClient.
+type fakeAPIClient struct {
+	mu          sync.Mutex
+	metaData    map[string]string
+	annotations map[string]*api.Annotation
+	steps       map[string]map[string]string
+}
+
+func newFakeAPIClient() *fakeAPIClient {
+	return &fakeAPIClient{
+		metaData:    make(map[string]string),
+		annotations: make(map[string]*api.Annotation),
+		steps:       map[string]map[string]string{"step-id": {"label": "Test"}},
+	}
+}
+
+func notFound(msg string) (*api.Response, error) {
+	return &api.Response{Response: &http.Response{StatusCode: http.StatusNotFound}}, errors.New(msg)
+}
+
+func (f *fakeAPIClient) SetMetaData(_ context.Context, jobID string, md *api.MetaData) (*api.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.metaData[jobID+"/"+md.Key] = md.Value
+	return &api.Response{}, nil
+}
+
+func (f *fakeAPIClient) GetMetaData(_ context.Context, scope, id, key string) (*api.MetaData, *api.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.metaData[id+"/"+key]
+	if !ok {
+		resp, err := notFound("no such key")
+		return nil, resp, err
+	}
+	return &api.MetaData{Key: key, Value: v}, &api.Response{}, nil
+}
+
+func (f *fakeAPIClient) Annotate(_ context.Context, jobID string, a *api.Annotation) (*api.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.annotations[a.Context] = a
+	return &api.Response{}, nil
+}
+
+func (f *fakeAPIClient) AnnotationRemove(_ context.Context, jobID, context string) (*api.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.annotations[context]; !ok {
+		return notFound("no such annotation")
+	}
+	delete(f.annotations, context)
+	return &api.Response{}, nil
+}
+
+func (f *fakeAPIClient) StepExport(_ context.Context, step string, req *api.StepExportRequest) (*api.StepExportResponse, *api.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	attrs, ok := f.steps[step]
+	if !ok {
+		resp, err := notFound("no such step")
+		return nil, resp, err
+	}
+	return &api.StepExportResponse{Output: attrs[req.Attribute]}, &api.Response{}, nil
+}
+
+func (f *fakeAPIClient) StepUpdate(_ context.Context, step string, update *api.StepUpdate) (*api.Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	attrs, ok := f.steps[step]
+	if !ok {
+		return notFound("no such step")
+	}
+	if update.Append {
+		attrs[update.Attribute] += update.Value
+	} else {
+		attrs[update.Attribute] = update.Value
+	}
+	return &api.Response{}, nil
+}
+
 func testSocketClient(socketPath string) *http.Client {
 	return &http.Client{
 		Transport: &http.Transport{
@@ -395,3 +481,450 @@ func testAPI[Req, Resp any](t *testing.T, env *env.Environment, req *http.Reques
 		}
 	}
 }
+
+func TestAgentAPIEndpoints(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	environ := testEnviron()
+	environ.Set("BUILDKITE_JOB_ID", "job-id")
+	environ.Set("BUILDKITE_BUILD_ID", "build-id")
+	environ.Set("BUILDKITE_STEP_ID", "step-id")
+
+	sockName, err := jobapi.NewSocketPath(os.TempDir())
+	if err != nil {
+		t.Fatalf("jobapi.NewSocketPath(os.TempDir()) error = %v", err)
+	}
+	fake := newFakeAPIClient()
+	srv, token, err := jobapi.NewServer(shell.TestingLogger{T: t}, sockName, environ, jobapi.WithAPIClient(fake))
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+	defer func() {
+		if err := srv.Stop(); err != nil {
+			t.Fatalf("stopping server: %v", err)
+		}
+	}()
+
+	client, err := jobapi.NewClient(ctx, srv.SocketPath, token)
+	if err != nil {
+		t.Fatalf("jobapi.NewClient(ctx, %q, token) error = %v", srv.SocketPath, err)
+	}
+
+	// Meta-data
+	if err := client.MetaDataSet(ctx, "release/name", "llama"); err != nil {
+		t.Fatalf("client.MetaDataSet(ctx, release/name, llama) error = %v", err)
+	}
+	if got, want := fake.metaData["job-id/release/name"], "llama"; got != want {
+		t.Errorf("meta-data for job-id/release/name = %q, want %q", got, want)
+	}
+	got, err := client.MetaDataGet(ctx, "release/name")
+	if err != nil {
+		t.Fatalf("client.MetaDataGet(ctx, release/name) error = %v", err)
+	}
+	if want := "llama"; got != want {
+		t.Errorf("client.MetaDataGet(ctx, release/name) = %q, want %q", got, want)
+	}
+	// Keys are escaped in the path, and unescaped exactly once.
+	for _, key := range []string{"a%41", "100%", "a%2F/b c"} {
+		if err := client.MetaDataSet(ctx, key, "alpaca"); err != nil {
+			t.Fatalf("client.MetaDataSet(ctx, %q, alpaca) error = %v", key, err)
+		}
+		if got, want := fake.metaData["job-id/"+key], "alpaca"; got != want {
+			t.Errorf("meta-data for job-id/%s = %q, want %q", key, got, want)
+		}
+		got, err := client.MetaDataGet(ctx, key)
+		if err != nil {
+			t.Fatalf("client.MetaDataGet(ctx, %q) error = %v", key, err)
+		}
+		if want := "alpaca"; got != want {
+			t.Errorf("client.MetaDataGet(ctx, %q) = %q, want %q", key, got, want)
+		}
+	}
+	var apiErr socket.APIErr
+	if _, err := client.MetaDataGet(ctx, "missing"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("client.MetaDataGet(ctx, missing) error = %v, want API error with status 404", err)
+	}
+	if err := client.MetaDataSet(ctx, "empty", " "); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("client.MetaDataSet(ctx, empty, \" \") error = %v, want API error with status 422", err)
+	}
+
+	// Annotations
+	annotation := &jobapi.AnnotationRequest{Body: "Hello", Style: "info"}
+	if err := client.Annotate(ctx, "greeting", annotation); err != nil {
+		t.Fatalf("client.Annotate(ctx, greeting, %v) error = %v", annotation, err)
+	}
+	wantAnnotation := &api.Annotation{Body: "Hello", Context: "greeting", Style: "info"}
+	if diff := cmp.Diff(fake.annotations["greeting"], wantAnnotation); diff != "" {
+		t.Errorf("annotation diff (-got +want):\n%s", diff)
+	}
+	if err := client.AnnotationRemove(ctx, "greeting"); err != nil {
+		t.Fatalf("client.AnnotationRemove(ctx, greeting) error = %v", err)
+	}
+	if err := client.AnnotationRemove(ctx, "greeting"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Errorf("client.AnnotationRemove(ctx, greeting) error = %v, want API error with status 404", err)
+	}
+
+	// Step attributes
+	if err := client.StepUpdate(ctx, "label", &jobapi.StepUpdateRequest{Value: " :llama:", Append: true}); err != nil {
+		t.Fatalf("client.StepUpdate(ctx, label, ...) error = %v", err)
+	}
+	got, err = client.StepGet(ctx, "label")
+	if err != nil {
+		t.Fatalf("client.StepGet(ctx, label) error = %v", err)
+	}
+	if want := "Test :llama:"; got != want {
+		t.Errorf("client.StepGet(ctx, label) = %q, want %q", got, want)
+	}
+}
+
+func TestAgentAPIEndpointsWithoutAPIClient(t *testing.T) {
+	t.Parallel()
+
+	srv, token, err := testServer(t, testEnviron())
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+	defer func() {
+		if err := srv.Stop(); err != nil {
+			t.Fatalf("stopping server: %v", err)
+		}
+	}()
+
+	req, err := http.NewRequest(http.MethodPut, "http://job/api/current-job/v0/meta-data/foo", strings.NewReader(`{"value":"bar"}`))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+
+	testAPI(t, testEnviron(), req, testSocketClient(srv.SocketPath), apiTestCase[any, any]{
+		expectedStatus: http.StatusServiceUnavailable,
+		expectedError: &jobapi.ErrorResponse{
+			Error: "the Buildkite API isn't available to this job",
+		},
+	})
+}
+
+func TestEvents(t *testing.T) {
+	t.Parallel()
+
+	sockName, err := jobapi.NewSocketPath(os.TempDir())
+	if err != nil {
+		t.Fatalf("jobapi.NewSocketPath(os.TempDir()) error = %v", err)
+	}
+	environ := testEnviron()
+	srv, token, err := jobapi.NewServer(shell.TestingLogger{T: t}, sockName, environ, jobapi.WithRedactedVars([]string{"*_SECRET"}))
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+	defer srv.Stop()
+
+	client := testSocketClient(srv.SocketPath)
+
+	req, err := http.NewRequest(http.MethodGet, "http://job/api/current-job/v0/events", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("client.Do(req) error = %v", err)
+	}
+	defer resp.Body.Close()
+	if got, want := resp.Header.Get("Content-Type"), "text/event-stream"; got != want {
+		t.Errorf("Content-Type = %q, want %q", got, want)
+	}
+
+	exitStatus := 0
+	srv.PublishEvent(jobapi.Event{Type: jobapi.EventPhaseStart, Phase: "command"})
+	srv.PublishEvent(jobapi.Event{Type: jobapi.EventHookFinish, Phase: "command", Hook: "global pre-command", ExitStatus: &exitStatus})
+	srv.PublishEnvChange(env.Diff{
+		Added: map[string]string{"VAULT_SECRET": "hunter2", "COLOUR": "blue", "PIN_SECRET": "1234"},
+		Changed: map[string]env.DiffPair{
+			"MOUNTAIN":   {Old: "cotopaxi", New: "chimborazo"},
+			"API_SECRET": {Old: "none", New: "correct horse"},
+		},
+		Removed: map[string]struct{}{"CAPITAL": {}},
+	})
+
+	// Changing the env through the API also produces an event.
+	patch, err := http.NewRequest(http.MethodPatch, "http://job/api/current-job/v0/env", strings.NewReader(`{"env":{"DB_SECRET":"swordfish"}}`))
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	patch.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	patchResp, err := client.Do(patch)
+	if err != nil {
+		t.Fatalf("client.Do(patch) error = %v", err)
+	}
+	patchResp.Body.Close()
+
+	want := []jobapi.Event{
+		{ID: 1, Type: jobapi.EventPhaseStart, Phase: "command"},
+		{ID: 2, Type: jobapi.EventHookFinish, Phase: "command", Hook: "global pre-command", ExitStatus: &exitStatus},
+		{ID: 3, Type: jobapi.EventEnvChange, Env: &jobapi.EnvChange{
+			// As in the job log, values too short to be secrets aren't
+			// redacted.
+			Added: map[string]string{"VAULT_SECRET": "[REDACTED]", "COLOUR": "blue", "PIN_SECRET": "1234"},
+			Changed: map[string]jobapi.EnvValueChange{
+				"MOUNTAIN":   {Old: "cotopaxi", New: "chimborazo"},
+				"API_SECRET": {Old: "none", New: "[REDACTED]"},
+			},
+			Removed: []string{"CAPITAL"},
+		}},
+		{ID: 4, Type: jobapi.EventEnvChange, Env: &jobapi.EnvChange{
+			Added: map[string]string{"DB_SECRET": "[REDACTED]"},
+		}},
+	}
+
+	var got []jobapi.Event
+	scanner := bufio.NewScanner(resp.Body)
+	for len(got) < len(want) && scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var ev jobapi.Event
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &ev); err != nil {
+			t.Fatalf("json.Unmarshal(%q, &ev) error = %v", line, err)
+		}
+		if ev.Time.IsZero() {
+			t.Errorf("event %d has no time", ev.ID)
+		}
+		ev.Time = time.Time{}
+		got = append(got, ev)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("reading events: %v", err)
+	}
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("events diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestEventsRedactRuntimeRedactions(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	sockName, err := jobapi.NewSocketPath(os.TempDir())
+	if err != nil {
+		t.Fatalf("jobapi.NewSocketPath(os.TempDir()) error = %v", err)
+	}
+
+	// Like the executor, redact whatever has been added through the API.
+	var mu sync.Mutex
+	var redactions []string
+	redactor := func(values []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		redactions = append(redactions, values...)
+	}
+	valuesToRedact := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), redactions...)
+	}
+	srv, token, err := jobapi.NewServer(shell.TestingLogger{T: t}, sockName, testEnviron(),
+		jobapi.WithRedactor(redactor),
+		jobapi.WithValuesToRedact(valuesToRedact),
+	)
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+	defer srv.Stop()
+
+	client, err := jobapi.NewClient(ctx, srv.SocketPath, token)
+	if err != nil {
+		t.Fatalf("jobapi.NewClient(ctx, %q, token) error = %v", srv.SocketPath, err)
+	}
+	if _, err := client.RedactionCreate(ctx, []string{"swordfish"}); err != nil {
+		t.Fatalf("client.RedactionCreate(ctx, [swordfish]) error = %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, "http://job/api/current-job/v0/events", nil)
+	if err != nil {
+		t.Fatalf("creating request: %v", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	resp, err := testSocketClient(srv.SocketPath).Do(req)
+	if err != nil {
+		t.Fatalf("client.Do(req) error = %v", err)
+	}
+	defer resp.Body.Close()
+
+	srv.PublishEnvChange(env.Diff{
+		Added:   map[string]string{"DATABASE_URL": "postgres://admin:swordfish@db"},
+		Changed: map[string]env.DiffPair{"MOUNTAIN": {Old: "cotopaxi", New: "swordfish"}},
+	})
+
+	var data string
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if line := scanner.Text(); strings.HasPrefix(line, "data: ") {
+			data = strings.TrimPrefix(line, "data: ")
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("reading events: %v", err)
+	}
+	if strings.Contains(data, "swordfish") {
+		t.Errorf("env change event = %s, want swordfish redacted", data)
+	}
+
+	var ev jobapi.Event
+	if err := json.Unmarshal([]byte(data), &ev); err != nil {
+		t.Fatalf("json.Unmarshal(%q, &ev) error = %v", data, err)
+	}
+	want := &jobapi.EnvChange{
+		Added:   map[string]string{"DATABASE_URL": "postgres://admin:[REDACTED]@db"},
+		Changed: map[string]jobapi.EnvValueChange{"MOUNTAIN": {Old: "cotopaxi", New: "[REDACTED]"}},
+	}
+	if diff := cmp.Diff(ev.Env, want); diff != "" {
+		t.Errorf("env change diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestCreateRedactions(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	sockName, err := jobapi.NewSocketPath(os.TempDir())
+	if err != nil {
+		t.Fatalf("jobapi.NewSocketPath(os.TempDir()) error = %v", err)
+	}
+	var mu sync.Mutex
+	var added []string
+	redactor := func(values []string) {
+		mu.Lock()
+		defer mu.Unlock()
+		added = append(added, values...)
+	}
+	srv, token, err := jobapi.NewServer(shell.TestingLogger{T: t}, sockName, testEnviron(), jobapi.WithRedactor(redactor))
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+	defer srv.Stop()
+
+	client, err := jobapi.NewClient(ctx, srv.SocketPath, token)
+	if err != nil {
+		t.Fatalf("jobapi.NewClient(ctx, %q, token) error = %v", srv.SocketPath, err)
+	}
+
+	n, err := client.RedactionCreate(ctx, []string{"swordfish", "", "hunter22"})
+	if err != nil {
+		t.Fatalf("client.RedactionCreate(ctx, ...) error = %v", err)
+	}
+	if n != 2 {
+		t.Errorf("client.RedactionCreate(ctx, ...) = %d, want 2", n)
+	}
+
+	var apiErr socket.APIErr
+	if _, err := client.RedactionCreate(ctx, []string{"abc"}); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("client.RedactionCreate(ctx, [abc]) error = %v, want API error with status 422", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if diff := cmp.Diff(added, []string{"swordfish", "hunter22"}); diff != "" {
+		t.Errorf("added redactions diff (-got +want):\n%s", diff)
+	}
+}
+
+// syncBuffer is a bytes.Buffer that is safe to write from the server.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWriteLog(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+
+	sockName, err := jobapi.NewSocketPath(os.TempDir())
+	if err != nil {
+		t.Fatalf("jobapi.NewSocketPath(os.TempDir()) error = %v", err)
+	}
+	out := &syncBuffer{}
+	srv, token, err := jobapi.NewServer(&shell.WriterLogger{Writer: out}, sockName, testEnviron())
+	if err != nil {
+		t.Fatalf("creating server: %v", err)
+	}
+	if err := srv.Start(); err != nil {
+		t.Fatalf("starting server: %v", err)
+	}
+	defer srv.Stop()
+
+	client, err := jobapi.NewClient(ctx, srv.SocketPath, token)
+	if err != nil {
+		t.Fatalf("jobapi.NewClient(ctx, %q, token) error = %v", srv.SocketPath, err)
+	}
+
+	messages := []struct {
+		kind    jobapi.LogKind
+		message string
+	}{
+		{jobapi.LogKindHeader, "Deploying"},
+		{jobapi.LogKindCollapsedHeader, "Details"},
+		{jobapi.LogKindComment, "100% done"},
+		{jobapi.LogKindWarning, "Slow"},
+		{jobapi.LogKindError, "Broken"},
+	}
+	for _, m := range messages {
+		if err := client.Log(ctx, m.kind, m.message); err != nil {
+			t.Fatalf("client.Log(ctx, %q, %q) error = %v", m.kind, m.message, err)
+		}
+	}
+
+	want := "~~~ Deploying\n" +
+		"--- Details\n" +
+		"# 100% done\n" +
+		"⚠️ Warning: Slow\n^^^ +++\n" +
+		"🚨 Error: Broken\n^^^ +++\n"
+	// Ignore the server's own logging.
+	var got strings.Builder
+	for _, line := range strings.SplitAfter(out.String(), "\n") {
+		if !strings.HasPrefix(line, "# Job API") {
+			got.WriteString(line)
+		}
+	}
+	if diff := cmp.Diff(got.String(), want); diff != "" {
+		t.Errorf("log output diff (-got +want):\n%s", diff)
+	}
+
+	var apiErr socket.APIErr
+	if err := client.Log(ctx, "shout", "HELLO"); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnprocessableEntity {
+		t.Errorf("client.Log(ctx, shout, HELLO) error = %v, want API error with status 422", err)
+	}
+}
@@ -20,6 +20,12 @@ import (
 // "the blink of an eye" (for a human).
 const localSocketSleepDuration = 100 * time.Millisecond
 
+// Info describes a lock key that is in use, as returned by List.
+type Info = agentapi.LockInfo
+
+// Holder describes a holder of a lock, as returned by List.
+type Holder = agentapi.LockHolder
+
 // Client implements a client library for the Agent API locking service.
 type Client struct {
 	client *agentapi.Client
@@ -51,10 +57,40 @@ func (c *Client) Locker(key string) sync.Locker {
 	}
 }
 
+// LockOption configures a lock acquired with Lock.
+type LockOption func(*agentapi.LockAcquireRequest)
+
+// WithSlots makes the lock a counting semaphore, which up to n holders can
+// hold at once. Everything using the same key must agree on n.
+func WithSlots(n int) LockOption {
+	return func(r *agentapi.LockAcquireRequest) { r.Slots = n }
+}
+
+// WithTTL causes the lock to be released automatically unless it is renewed
+// (with Renew) within ttl.
+func WithTTL(ttl time.Duration) LockOption {
+	return func(r *agentapi.LockAcquireRequest) { r.TTL = ttl }
+}
+
+// WithHolderPID causes the lock to be released automatically when the process
+// with the given ID exits.
+func WithHolderPID(pid int) LockOption {
+	return func(r *agentapi.LockAcquireRequest) { r.PID = pid }
+}
+
+// WithHolderInfo records the job and agent acquiring the lock, which is shown
+// when listing locks.
+func WithHolderInfo(jobID, agentName string) LockOption {
+	return func(r *agentapi.LockAcquireRequest) {
+		r.JobID = jobID
+		r.AgentName = agentName
+	}
+}
+
 // Lock blocks until the lock for the given key is acquired. It returns a
 // token or an error. The token must be passed to Unlock in order to unlock the
 // lock later on.
-func (c *Client) Lock(ctx context.Context, key string) (string, error) {
+func (c *Client) Lock(ctx context.Context, key string, opts ...LockOption) (string, error) {
 	// The token generation only has to avoid making the same token twice to
 	// prevent separate processes unlocking each other.
 	// Using crypto/rand to generate 16 bytes is possibly overkill - it's not a
@@ -65,31 +101,48 @@ func (c *Client) Lock(ctx context.Context, key string) (string, error) {
 	}
 	token := fmt.Sprintf("acquired(pid=%d,otp=%x)", os.Getpid(), otp)
 
-	for {
-		_, done, err := c.client.LockCompareAndSwap(ctx, key, "", token)
-		if err != nil {
-			return "", fmt.Errorf("cas: %w", err)
-		}
+	req := &agentapi.LockAcquireRequest{Token: token}
+	for _, o := range opts {
+		o(req)
+	}
 
-		if done {
-			return token, nil
+	// The server waits until the lock can be acquired.
+	if _, err := c.client.LockAcquire(ctx, key, req); err != nil {
+		if ctx.Err() != nil {
+			// The lock might have been acquired just as the context ended, so
+			// make a best-effort attempt to release it.
+			rctx, canc := context.WithTimeout(context.Background(), localSocketSleepDuration)
+			defer canc()
+			c.client.LockRelease(rctx, key, token)
+			return "", ctx.Err()
 		}
+		return "", fmt.Errorf("acquire: %w", err)
+	}
+	return token, nil
+}
 
-		// Not done.
-		if err := sleep(ctx, localSocketSleepDuration); err != nil {
-			return "", err
-		}
+// Renew renews the lease on a lock acquired using WithTTL, returning when it
+// now expires.
+func (c *Client) Renew(ctx context.Context, key, token string) (time.Time, error) {
+	expires, err := c.client.LockRenew(ctx, key, token, 0)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("renew: %w", err)
 	}
+	return expires, nil
 }
 
 // Unlock unlocks the lock for the given key. To prevent different processes
 // accidentally unlocking the same lock, token must match the current lock value.
 func (c *Client) Unlock(ctx context.Context, key, token string) error {
-	val, done, err := c.client.LockCompareAndSwap(ctx, key, token, "")
+	released, err := c.client.LockRelease(ctx, key, token)
 	if err != nil {
-		return fmt.Errorf("cas: %w", err)
+		return fmt.Errorf("release: %w", err)
 	}
-	if !done {
+	if !released {
+		val, err := c.client.LockGet(ctx, key)
+		if err != nil {
+			return err
+		}
 		if val == "" {
 			return errors.New("already unlocked")
 		}
@@ -98,6 +151,24 @@ func (c *Client) Unlock(ctx context.Context, key, token string) error {
 	return nil
 }
 
+// ForceUnlock unlocks the lock for the given key, whoever holds it. It is
+// intended for cleaning up after processes that failed to unlock.
+func (c *Client) ForceUnlock(ctx context.Context, key string) error {
+	deleted, err := c.client.LockDelete(ctx, key)
+	if err != nil {
+		return fmt.Errorf("delete: %w", err)
+	}
+	if !deleted {
+		return errors.New("already unlocked")
+	}
+	return nil
+}
+
+// List lists every lock currently in use, sorted by key.
+func (c *Client) List(ctx context.Context) ([]Info, error) {
+	return c.client.LockList(ctx)
+}
+
 // DoOnce is similar to sync.Once. In the absence of an error, it does one of
 // two things:
 //   - Calls f, and returns when done.
@@ -93,6 +93,13 @@ func main() {
 				clicommand.EnvUnsetCommand,
 			},
 		},
+		{
+			Name:  "git-mirrors",
+			Usage: "Manage git mirrors",
+			Subcommands: []cli.Command{
+				clicommand.GitMirrorsGCCommand,
+			},
+		},
 		{
 			Name:  "lock",
 			Usage: "Process lock subcommands",
@@ -101,7 +108,18 @@ func main() {
 				clicommand.LockDoCommand,
 				clicommand.LockDoneCommand,
 				clicommand.LockGetCommand,
+				clicommand.LockListCommand,
 				clicommand.LockReleaseCommand,
+				clicommand.LockRenewCommand,
+			},
+		},
+		{
+			Name:  "local-kv",
+			Usage: "Get/set values shared by jobs on this host",
+			Subcommands: []cli.Command{
+				clicommand.LocalKVGetCommand,
+				clicommand.LocalKVSetCommand,
+				clicommand.LocalKVDeleteCommand,
 			},
 		},
 		{
@@ -126,6 +144,16 @@ func main() {
 			Usage: "Make changes to the pipeline of the currently running build",
 			Subcommands: []cli.Command{
 				clicommand.PipelineUploadCommand,
+				clicommand.PipelineSignCommand,
+				clicommand.PipelineVerifyCommand,
+				clicommand.PipelineLintCommand,
+			},
+		},
+		{
+			Name:  "redactor",
+			Usage: "Redact sensitive information from the job log",
+			Subcommands: []cli.Command{
+				clicommand.RedactorAddCommand,
 			},
 		},
 		{